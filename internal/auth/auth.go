@@ -2,6 +2,7 @@ package auth
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"time"
@@ -207,14 +208,34 @@ func (s *Service) HasPermission(r *http.Request, permission string) bool {
 	if err != nil {
 		return false
 	}
+	return s.UserHasPermission(user, permission)
+}
 
+// UserHasPermission reports whether the user's role grants permission. The
+// permissions are those of the tenant's role of the same name, or the
+// built-in defaults if the tenant has not configured the role.
+func (s *Service) UserHasPermission(user *models.User, permission string) bool {
 	// Admin has all permissions
 	if user.Role == "admin" {
 		return true
 	}
 
-	// TODO: Implement role-based permissions from database
-	// For now, simple role-based checks
+	var permissions string
+	err := s.db.QueryRow(`SELECT COALESCE(permissions, '[]') FROM roles WHERE tenant_id = ? AND name = ?`,
+		user.TenantID, user.Role).Scan(&permissions)
+	if err == nil {
+		var granted []string
+		if err := json.Unmarshal([]byte(permissions), &granted); err == nil {
+			for _, p := range granted {
+				if p == permission {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	// Built-in role checks for tenants without configured roles
 	switch permission {
 	case "manage_classes":
 		return user.Role == "admin" || user.Role == "instructor"
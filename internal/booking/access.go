@@ -0,0 +1,269 @@
+package booking
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/memberships"
+	"samskipnad/internal/models"
+)
+
+// Ways a member can pay for a class, in the order they are offered
+const (
+	PayFree       = "free"
+	PayMembership = "membership"
+	PayKlipp      = "klipp"
+	PayTicket     = "ticket"
+	PayCard       = "card" // The class's drop-in price
+)
+
+// PaymentOption is a way a member can pay for a class
+type PaymentOption struct {
+	Method string
+	Price  int // Drop-in price in cents, for PayCard
+	Left   int // Klipp or ticket classes the member has left, for PayKlipp and PayTicket
+}
+
+// PaymentOptions returns the ways the member can pay for a class, cheapest
+// first. Free classes need nothing. Otherwise a membership whose tier
+// includes the class's category covers it, unless the class requires a
+// ticket; then come a klipp from the class's category, a ticket, and the
+// drop-in price. Classes that require a membership are only offered to
+// members with an active one. It returns ErrMembershipRequired or
+// ErrTicketRequired when the member has no way to book the class.
+func (s *Service) PaymentOptions(userID, classID int) ([]PaymentOption, error) {
+	class, err := s.getClass(s.db, classID)
+	if err != nil {
+		return nil, err
+	}
+	if !class.Active {
+		return nil, ErrClassNotFound
+	}
+	if err := s.checkMembership(s.db, userID, class); err != nil {
+		return nil, err
+	}
+	if class.Price == 0 && !class.RequiresTicket {
+		return []PaymentOption{{Method: PayFree}}, nil
+	}
+
+	now := s.now()
+	var options []PaymentOption
+	_, err = s.includingMembership(s.db, userID, class)
+	switch err {
+	case nil:
+		options = append(options, PaymentOption{Method: PayMembership})
+	case ErrMembershipRequired, ErrNotIncluded:
+	default:
+		return nil, err
+	}
+
+	if class.CategoryID != "" {
+		left, err := klippekort.Available(s.db, userID, class.TenantID, class.CategoryID, now)
+		if err != nil {
+			return nil, err
+		}
+		if left > 0 {
+			options = append(options, PaymentOption{Method: PayKlipp, Left: left})
+		}
+	}
+
+	left, err := ticketsLeft(s.db, userID, class.TenantID, now)
+	if err != nil {
+		return nil, err
+	}
+	if left > 0 {
+		options = append(options, PaymentOption{Method: PayTicket, Left: left})
+	}
+
+	if class.Price > 0 {
+		options = append(options, PaymentOption{Method: PayCard, Price: class.Price})
+	}
+
+	if len(options) == 0 {
+		return nil, ErrTicketRequired
+	}
+	return options, nil
+}
+
+// BookWithMembership books a member onto a class included in their
+// membership, at no charge. It returns ErrMembershipRequired if the member
+// has no active membership, and ErrNotIncluded if none of theirs includes
+// the class or the class requires a ticket.
+func (s *Service) BookWithMembership(userID, classID int) (*models.Booking, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if !class.Active {
+		return nil, ErrClassNotFound
+	}
+
+	membership, err := s.includingMembership(tx, userID, class)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSeat(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	bookingID, err := s.confirmSeat(tx, userID, classID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.publish(EventBookingConfirmed, class.TenantID, userID, map[string]interface{}{
+		"booking_id":    bookingID,
+		"class_id":      classID,
+		"membership_id": membership.ID,
+	})
+
+	return s.GetBooking(bookingID)
+}
+
+// BookWithTicket books a member onto a class with one class from their
+// ticket that expires first. The seat and the ticket are taken in one
+// transaction. It returns ErrNoTicket if the member has no ticket left.
+func (s *Service) BookWithTicket(userID, classID int) (*models.Booking, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if !class.Active {
+		return nil, ErrClassNotFound
+	}
+	if err := s.checkMembership(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSeat(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	bookingID, err := s.confirmSeat(tx, userID, classID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ticketID, err := useTicket(tx, userID, class.TenantID, s.now())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE bookings SET ticket_id = ? WHERE id = ?`, ticketID, bookingID); err != nil {
+		return nil, fmt.Errorf("failed to record ticket on booking: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.publish(EventBookingConfirmed, class.TenantID, userID, map[string]interface{}{
+		"booking_id": bookingID,
+		"class_id":   classID,
+		"ticket_id":  ticketID,
+	})
+
+	return s.GetBooking(bookingID)
+}
+
+// checkMembership returns ErrMembershipRequired if the class is for
+// members only and the member has no active membership. Any membership
+// lets them book it; one whose tier does not include the class still
+// leaves them paying for it.
+func (s *Service) checkMembership(q queryer, userID int, class *models.Class) error {
+	if !class.RequiresMembership {
+		return nil
+	}
+	active, err := memberships.Active(q, userID, s.now())
+	if err != nil {
+		return err
+	}
+	if len(active) == 0 {
+		return ErrMembershipRequired
+	}
+	return nil
+}
+
+// includingMembership returns the member's active membership whose tier
+// includes the class
+func (s *Service) includingMembership(q queryer, userID int, class *models.Class) (*models.Membership, error) {
+	active, err := memberships.Active(q, userID, s.now())
+	if err != nil {
+		return nil, err
+	}
+	if len(active) == 0 {
+		return nil, ErrMembershipRequired
+	}
+	if class.RequiresTicket {
+		return nil, ErrNotIncluded
+	}
+
+	community := s.community()
+	for _, m := range active {
+		if community.MembershipIncludes(m.Tier, class.CategoryID) {
+			return m, nil
+		}
+	}
+	return nil, ErrNotIncluded
+}
+
+// ticketsLeft returns the classes left at now on the member's tickets
+func ticketsLeft(q queryer, userID, tenantID int, now time.Time) (int, error) {
+	var left int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(classes_left), 0) FROM tickets
+		WHERE user_id = ? AND tenant_id = ? AND classes_left > 0 AND expiry_date > ?`,
+		userID, tenantID, now.UTC()).Scan(&left)
+	return left, err
+}
+
+// useTicket takes one class from the member's ticket that expires first
+// and returns the ticket's ID. The ticket is picked and decremented in a
+// single statement, so concurrent bookings never take the same class twice.
+func useTicket(q queryer, userID, tenantID int, now time.Time) (int, error) {
+	var ticketID int
+	err := q.QueryRow(`
+		UPDATE tickets SET classes_left = classes_left - 1, updated_at = ?
+		WHERE id = (
+			SELECT id FROM tickets
+			WHERE user_id = ? AND tenant_id = ? AND classes_left > 0 AND expiry_date > ?
+			ORDER BY expiry_date ASC, id ASC
+			LIMIT 1)
+		RETURNING id`, now, userID, tenantID, now.UTC()).Scan(&ticketID)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoTicket
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to use ticket: %w", err)
+	}
+	return ticketID, nil
+}
+
+// returnTicket puts a class back on a ticket, as when a booking made with
+// it is cancelled in time
+func returnTicket(q queryer, ticketID int, now time.Time) error {
+	_, err := q.Exec(`UPDATE tickets SET classes_left = classes_left + 1, updated_at = ? WHERE id = ?`, now, ticketID)
+	if err != nil {
+		return fmt.Errorf("failed to return ticket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/klippekort"
+)
+
+// giveMembership gives the member an active membership of the tier
+func (env *testEnv) giveMembership(t *testing.T, userID int, tier string) int {
+	result, err := env.db.Exec(`
+		INSERT INTO memberships (user_id, tenant_id, type, tier, start_date, end_date, active, status)
+		VALUES (?, 1, 'monthly', ?, ?, ?, true, 'active')`,
+		userID, tier, env.now.AddDate(0, 0, -1).UTC(), env.now.AddDate(0, 1, 0).UTC())
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+// giveTicket gives the member a ticket for classes classes
+func (env *testEnv) giveTicket(t *testing.T, userID, classes int) int {
+	result, err := env.db.Exec(`
+		INSERT INTO tickets (user_id, tenant_id, type, classes_left, expiry_date)
+		VALUES (?, 1, 'pack_5', ?, ?)`, userID, classes, env.now.AddDate(0, 3, 0).UTC())
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func (env *testEnv) setClass(t *testing.T, classID int, set string) {
+	_, err := env.db.Exec(`UPDATE classes SET `+set+` WHERE id = ?`, classID)
+	require.NoError(t, err)
+}
+
+func methods(options []PaymentOption) []string {
+	var m []string
+	for _, o := range options {
+		m = append(m, o.Method)
+	}
+	return m
+}
+
+func newAccessTestEnv(t *testing.T) *testEnv {
+	env := newTestEnv(t)
+	env.community.Pricing.MembershipTiers = []config.MembershipTier{
+		{ID: "yoga_only", Name: "Yoga", Monthly: 399, Categories: []string{"yoga"}},
+	}
+	return env
+}
+
+func TestPaymentOptions(t *testing.T) {
+	env := newAccessTestEnv(t)
+	member := env.createUser(t, 1)
+
+	free := env.createClass(t, 5, 0)
+	options, err := env.service.PaymentOptions(member, free)
+	require.NoError(t, err)
+	assert.Equal(t, []string{PayFree}, methods(options))
+
+	paid := env.createClass(t, 5, 15000)
+	env.setClass(t, paid, `category_id = 'yoga'`)
+	options, err = env.service.PaymentOptions(member, paid)
+	require.NoError(t, err)
+	require.Equal(t, []string{PayCard}, methods(options))
+	assert.Equal(t, 15000, options[0].Price)
+
+	env.buyKlipp(t, member)
+	env.giveTicket(t, member, 5)
+	env.giveMembership(t, member, "")
+	options, err = env.service.PaymentOptions(member, paid)
+	require.NoError(t, err)
+	require.Equal(t, []string{PayMembership, PayKlipp, PayTicket, PayCard}, methods(options), "cheapest first")
+	assert.Equal(t, 9, options[1].Left)
+	assert.Equal(t, 5, options[2].Left)
+
+	t.Run("TicketRequired", func(t *testing.T) {
+		workshop := env.createClass(t, 5, 0)
+		env.setClass(t, workshop, `requires_ticket = true`)
+		options, err := env.service.PaymentOptions(member, workshop)
+		require.NoError(t, err)
+		assert.Equal(t, []string{PayTicket}, methods(options), "memberships do not include it")
+
+		_, err = env.service.PaymentOptions(env.createUser(t, 2), workshop)
+		assert.ErrorIs(t, err, ErrTicketRequired)
+	})
+
+	t.Run("MembersOnly", func(t *testing.T) {
+		membersOnly := env.createClass(t, 5, 15000)
+		env.setClass(t, membersOnly, `requires_membership = true`)
+		_, err := env.service.PaymentOptions(env.createUser(t, 3), membersOnly)
+		assert.ErrorIs(t, err, ErrMembershipRequired)
+	})
+
+	t.Run("Tier", func(t *testing.T) {
+		other := env.createClass(t, 5, 15000)
+		env.setClass(t, other, `category_id = 'pilates'`)
+		tiered := env.createUser(t, 4)
+		env.giveMembership(t, tiered, "yoga_only")
+
+		options, err := env.service.PaymentOptions(tiered, paid)
+		require.NoError(t, err)
+		assert.Equal(t, []string{PayMembership, PayCard}, methods(options))
+		options, err = env.service.PaymentOptions(tiered, other)
+		require.NoError(t, err)
+		assert.Equal(t, []string{PayCard}, methods(options), "the tier does not include pilates")
+	})
+}
+
+func TestBookWithMembership(t *testing.T) {
+	env := newAccessTestEnv(t)
+	classID := env.createClass(t, 1, 15000)
+	env.setClass(t, classID, `category_id = 'pilates'`)
+	member := env.createUser(t, 1)
+
+	_, err := env.service.BookWithMembership(member, classID)
+	assert.ErrorIs(t, err, ErrMembershipRequired)
+
+	tierID := env.giveMembership(t, member, "yoga_only")
+	_, err = env.service.BookWithMembership(member, classID)
+	assert.ErrorIs(t, err, ErrNotIncluded)
+
+	membershipID := env.giveMembership(t, member, "")
+	booking, err := env.service.BookWithMembership(member, classID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusConfirmed, booking.Status)
+	assert.Empty(t, booking.PaymentID)
+	events := env.events.published(EventBookingConfirmed, member)
+	require.Len(t, events, 1)
+	assert.Equal(t, membershipID, events[0].Data["membership_id"])
+	assert.NotEqual(t, tierID, events[0].Data["membership_id"])
+
+	_, err = env.service.BookWithMembership(env.createUser(t, 2), classID)
+	assert.ErrorIs(t, err, ErrMembershipRequired, "access is checked before seats")
+
+	t.Run("Paused", func(t *testing.T) {
+		paused := env.createUser(t, 3)
+		id := env.giveMembership(t, paused, "")
+		_, err := env.db.Exec(`UPDATE memberships SET status = 'paused', active = false WHERE id = ?`, id)
+		require.NoError(t, err)
+		_, err = env.service.BookWithMembership(paused, env.createClass(t, 5, 15000))
+		assert.ErrorIs(t, err, ErrMembershipRequired)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		lapsed := env.createUser(t, 4)
+		env.giveMembership(t, lapsed, "")
+		later := env.createClass(t, 5, 15000)
+		env.now = env.now.AddDate(0, 2, 0)
+		defer func() { env.now = env.now.AddDate(0, -2, 0) }()
+		_, err := env.service.BookWithMembership(lapsed, later)
+		assert.ErrorIs(t, err, ErrMembershipRequired, "the period is over even before the expiry job runs")
+	})
+}
+
+func TestMembersOnlyClass(t *testing.T) {
+	env := newAccessTestEnv(t)
+	free := env.createClass(t, 5, 0)
+	env.setClass(t, free, `requires_membership = true`)
+	paid := env.createClass(t, 5, 15000)
+	env.setClass(t, paid, `requires_membership = true, category_id = 'yoga'`)
+	guest := env.createUser(t, 1)
+	env.buyKlipp(t, guest)
+
+	_, err := env.service.Book(guest, free)
+	assert.ErrorIs(t, err, ErrMembershipRequired)
+	_, err = env.service.BookWithKlipp(guest, paid)
+	assert.ErrorIs(t, err, ErrMembershipRequired)
+	_, err = env.service.HoldSeat(guest, paid)
+	assert.ErrorIs(t, err, ErrMembershipRequired)
+
+	env.giveMembership(t, guest, "")
+	_, err = env.service.Book(guest, free)
+	assert.NoError(t, err)
+	_, err = env.service.BookWithKlipp(guest, paid)
+	assert.NoError(t, err)
+}
+
+func TestBookWithTicket(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 5, 0)
+	env.setClass(t, classID, `requires_ticket = true`)
+	member := env.createUser(t, 1)
+
+	_, err := env.service.Book(member, classID)
+	assert.ErrorIs(t, err, ErrTicketRequired)
+	_, err = env.service.BookWithTicket(member, classID)
+	assert.ErrorIs(t, err, ErrNoTicket)
+
+	later := env.giveTicket(t, member, 5)
+	_, err = env.db.Exec(`UPDATE tickets SET expiry_date = ? WHERE id = ?`, env.now.AddDate(1, 0, 0).UTC(), later)
+	require.NoError(t, err)
+	sooner := env.giveTicket(t, member, 1)
+
+	booking, err := env.service.BookWithTicket(member, classID)
+	require.NoError(t, err)
+	require.NotNil(t, booking.TicketID)
+	assert.Equal(t, sooner, *booking.TicketID, "the ticket expiring first is used")
+	assert.Equal(t, 0, env.classesLeft(t, sooner))
+
+	terms, err := env.service.Cancel(booking.ID)
+	require.NoError(t, err)
+	assert.True(t, terms.ReturnsKlipp)
+	assert.Equal(t, 1, env.classesLeft(t, sooner), "the ticket is returned")
+
+	t.Run("LateCancelForfeits", func(t *testing.T) {
+		booking, err := env.service.BookWithTicket(member, classID)
+		require.NoError(t, err)
+		env.now = env.now.Add(40 * time.Hour)
+		defer func() { env.now = env.now.Add(-40 * time.Hour) }()
+
+		terms, err := env.service.Cancel(booking.ID)
+		require.NoError(t, err)
+		assert.False(t, terms.ReturnsKlipp)
+		assert.Equal(t, 0, env.classesLeft(t, sooner))
+		var forfeited bool
+		require.NoError(t, env.db.QueryRow(`SELECT klipp_forfeited FROM booking_penalties WHERE booking_id = ?`, booking.ID).Scan(&forfeited))
+		assert.True(t, forfeited)
+	})
+}
+
+func TestWaitlistOfferForTicketClass(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 1, 0)
+	env.setClass(t, classID, `requires_ticket = true, category_id = 'yoga'`)
+	first := env.createUser(t, 1)
+	second := env.createUser(t, 2)
+	env.buyKlipp(t, first)
+
+	booking, err := env.service.BookWithKlipp(first, classID)
+	require.NoError(t, err)
+	_, err = env.service.JoinWaitlist(second, classID)
+	require.NoError(t, err)
+
+	_, err = env.service.Cancel(booking.ID)
+	require.NoError(t, err)
+	entry, err := env.service.WaitlistEntry(second, classID)
+	require.NoError(t, err)
+	assert.True(t, entry.HasOffer(env.now), "the seat is held until they use a ticket")
+	assert.Equal(t, StatusWaitlist, env.status(t, second, classID))
+
+	_, err = env.service.BookWithKlipp(second, classID)
+	assert.ErrorIs(t, err, klippekort.ErrNoKlipp)
+}
+
+func (env *testEnv) classesLeft(t *testing.T, ticketID int) int {
+	var left int
+	require.NoError(t, env.db.QueryRow(`SELECT classes_left FROM tickets WHERE id = ?`, ticketID).Scan(&left))
+	return left
+}
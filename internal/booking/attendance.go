@@ -0,0 +1,232 @@
+package booking
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/resources"
+)
+
+// CheckInOpensBefore is how long before a class starts its attendees can
+// be checked in
+const CheckInOpensBefore = time.Hour
+
+// AttendanceStats summarises how many confirmed bookings were checked in
+type AttendanceStats struct {
+	Booked    int
+	CheckedIn int
+	NoShows   int
+}
+
+// Rate returns the percentage of booked seats that were checked in
+func (a AttendanceStats) Rate() int {
+	if a.Booked == 0 {
+		return 0
+	}
+	return a.CheckedIn * 100 / a.Booked
+}
+
+// AttendanceRecord is the outcome of checking in a booking
+type AttendanceRecord struct {
+	BookingID      int
+	UserID         int
+	ClassID        int
+	CheckedInAt    time.Time
+	AlreadyChecked bool // The booking had been checked in before
+}
+
+// CheckInToken returns the signed token encoded in a booking's QR code.
+// It identifies the booking and cannot be forged without the check-in key.
+func (s *Service) CheckInToken(bookingID int) string {
+	id := strconv.Itoa(bookingID)
+	return id + "." + s.signCheckIn(id)
+}
+
+// ParseCheckInToken verifies a check-in token and returns the booking it
+// was issued for
+func (s *Service) ParseCheckInToken(token string) (int, error) {
+	id, signature, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.signCheckIn(id))) {
+		return 0, ErrInvalidCheckIn
+	}
+	bookingID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, ErrInvalidCheckIn
+	}
+	return bookingID, nil
+}
+
+// CheckInWithToken checks in the booking a scanned QR code was issued for.
+// The booking must be for classID so a code for another class is not
+// accepted at the door.
+func (s *Service) CheckInWithToken(classID int, token string) (*AttendanceRecord, error) {
+	bookingID, err := s.ParseCheckInToken(token)
+	if err != nil {
+		return nil, err
+	}
+	booking, err := s.GetBooking(bookingID)
+	if err != nil {
+		return nil, err
+	}
+	if booking.ClassID != classID {
+		return nil, ErrWrongClass
+	}
+	return s.CheckIn(bookingID)
+}
+
+// CheckIn records that the member of a confirmed booking has arrived, and
+// inducts them on the equipment the class trains them on. Check-in opens
+// CheckInOpensBefore the class starts. Checking in twice keeps the original
+// arrival time.
+func (s *Service) CheckIn(bookingID int) (*AttendanceRecord, error) {
+	booking, err := s.GetBooking(bookingID)
+	if err != nil {
+		return nil, err
+	}
+	if booking.Status != StatusConfirmed {
+		return nil, ErrBookingNotConfirmed
+	}
+	if booking.NoShow {
+		return nil, ErrMarkedNoShow
+	}
+
+	record := &AttendanceRecord{
+		BookingID: booking.ID,
+		UserID:    booking.UserID,
+		ClassID:   booking.ClassID,
+	}
+	if booking.CheckedInAt != nil {
+		record.CheckedInAt = *booking.CheckedInAt
+		record.AlreadyChecked = true
+		return record, nil
+	}
+
+	class, err := s.getClass(s.db, booking.ClassID)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	if class.StartTime.Sub(now) > CheckInOpensBefore {
+		return nil, ErrCheckInNotOpen
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE bookings SET checked_in_at = ?, updated_at = ?
+		WHERE id = ? AND checked_in_at IS NULL`, now.UTC(), now, bookingID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check in booking: %w", err)
+	}
+	if err := resources.RecordInduction(tx, booking.ClassID, booking.UserID, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	record.CheckedInAt = now
+
+	s.publish(EventBookingCheckedIn, class.TenantID, booking.UserID, map[string]interface{}{
+		"booking_id": booking.ID,
+		"class_id":   booking.ClassID,
+	})
+	return record, nil
+}
+
+// UndoCheckIn clears a check-in recorded by mistake, together with any
+// induction the check-in recorded
+func (s *Service) UndoCheckIn(bookingID int) error {
+	booking, err := s.GetBooking(bookingID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE bookings SET checked_in_at = NULL, updated_at = ?
+		WHERE id = ?`, s.now(), bookingID)
+	if err != nil {
+		return fmt.Errorf("failed to undo check-in: %w", err)
+	}
+	if err := resources.UndoInduction(tx, booking.ClassID, booking.UserID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClassAttendance returns how many of a class's confirmed bookings have
+// been checked in or marked as no-shows
+func (s *Service) ClassAttendance(classID int) (*AttendanceStats, error) {
+	var stats AttendanceStats
+	err := s.db.QueryRow(`
+		SELECT COUNT(*),
+			COUNT(checked_in_at),
+			COALESCE(SUM(CASE WHEN no_show THEN 1 ELSE 0 END), 0)
+		FROM bookings WHERE class_id = ? AND status = 'confirmed'`, classID).Scan(
+		&stats.Booked, &stats.CheckedIn, &stats.NoShows)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// MemberAttendance returns a member's attendance across the confirmed
+// bookings for classes that have already started
+func (s *Service) MemberAttendance(userID int) (*AttendanceStats, error) {
+	var stats AttendanceStats
+	err := s.db.QueryRow(`
+		SELECT COUNT(*),
+			COUNT(b.checked_in_at),
+			COALESCE(SUM(CASE WHEN b.no_show THEN 1 ELSE 0 END), 0)
+		FROM bookings b JOIN classes c ON c.id = b.class_id
+		WHERE b.user_id = ? AND b.status = 'confirmed' AND c.start_time <= ?`, userID, s.now().UTC()).Scan(
+		&stats.Booked, &stats.CheckedIn, &stats.NoShows)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (s *Service) signCheckIn(id string) string {
+	mac := hmac.New(sha256.New, s.checkInKey)
+	mac.Write([]byte("checkin:" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// checkInKeyFromEnv returns the key check-in tokens are signed with, from
+// CHECKIN_SECRET. The key must be the same on every server and across
+// restarts, or printed QR codes stop working, so it is required outside
+// development, where a random key is used instead.
+func checkInKeyFromEnv() ([]byte, error) {
+	if secret := os.Getenv("CHECKIN_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	if !config.Development() {
+		return nil, errors.New("CHECKIN_SECRET must be set to sign check-in QR codes")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate check-in key: %w", err)
+	}
+	log.Printf("CHECKIN_SECRET is not set; check-in QR codes will change when the server restarts")
+	return key, nil
+}
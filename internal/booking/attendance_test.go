@@ -0,0 +1,151 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/resources"
+)
+
+func TestCheckInToken(t *testing.T) {
+	env := newTestEnv(t)
+
+	token := env.service.CheckInToken(42)
+	bookingID, err := env.service.ParseCheckInToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, 42, bookingID)
+
+	for _, forged := range []string{"", "42", "43" + token[2:], token + "x", "abc.def"} {
+		_, err := env.service.ParseCheckInToken(forged)
+		assert.ErrorIs(t, err, ErrInvalidCheckIn, forged)
+	}
+
+	other, err := NewService(env.db, nil, nil)
+	require.NoError(t, err)
+	other.checkInKey = []byte("another key")
+	_, err = other.ParseCheckInToken(token)
+	assert.ErrorIs(t, err, ErrInvalidCheckIn, "tokens are bound to the signing key")
+}
+
+func TestCheckInKeyFromEnv(t *testing.T) {
+	t.Setenv("CHECKIN_SECRET", "")
+	t.Setenv("APP_ENV", "")
+	_, err := checkInKeyFromEnv()
+	assert.Error(t, err, "production needs a check-in secret")
+	_, err = NewService(nil, nil, nil)
+	assert.Error(t, err, "the service is not created without one")
+
+	t.Setenv("APP_ENV", "development")
+	key, err := checkInKeyFromEnv()
+	require.NoError(t, err)
+	assert.Len(t, key, 32)
+
+	t.Setenv("CHECKIN_SECRET", "shared secret")
+	key, err = checkInKeyFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("shared secret"), key)
+}
+
+func TestCheckIn(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 10, 0)
+	otherClassID := env.createClass(t, 10, 0)
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+	token := env.service.CheckInToken(bookingID)
+
+	_, err := env.service.CheckInWithToken(classID, token)
+	assert.ErrorIs(t, err, ErrCheckInNotOpen)
+
+	env.now = env.now.Add(47*time.Hour + 30*time.Minute)
+	_, err = env.service.CheckInWithToken(otherClassID, token)
+	assert.ErrorIs(t, err, ErrWrongClass)
+
+	record, err := env.service.CheckInWithToken(classID, token)
+	require.NoError(t, err)
+	assert.False(t, record.AlreadyChecked)
+	assert.Equal(t, userID, record.UserID)
+	assert.Len(t, env.events.published(EventBookingCheckedIn, userID), 1)
+
+	arrived := env.now
+	env.now = env.now.Add(10 * time.Minute)
+	record, err = env.service.CheckIn(bookingID)
+	require.NoError(t, err)
+	assert.True(t, record.AlreadyChecked)
+	assert.True(t, arrived.Equal(record.CheckedInAt), "the first arrival time is kept")
+
+	env.now = env.now.Add(2 * time.Hour)
+	assert.ErrorIs(t, env.service.MarkNoShow(bookingID), ErrCheckedIn)
+
+	require.NoError(t, env.service.UndoCheckIn(bookingID))
+	booking, err := env.service.GetBooking(bookingID)
+	require.NoError(t, err)
+	assert.Nil(t, booking.CheckedInAt)
+
+	t.Run("NoShow", func(t *testing.T) {
+		require.NoError(t, env.service.MarkNoShow(bookingID))
+		_, err := env.service.CheckIn(bookingID)
+		assert.ErrorIs(t, err, ErrMarkedNoShow)
+	})
+}
+
+func TestAttendanceStats(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 10, 0)
+	laterClassID := env.createClass(t, 10, 0)
+	_, err := env.db.Exec(`UPDATE classes SET start_time = ? WHERE id = ?`, env.now.Add(96*time.Hour).UTC(), laterClassID)
+	require.NoError(t, err)
+
+	member := env.createUser(t, 1)
+	attended := env.confirm(t, member, classID)
+	env.confirm(t, member, laterClassID)
+	missed := env.confirm(t, env.createUser(t, 2), classID)
+	env.confirm(t, env.createUser(t, 3), classID)
+
+	env.now = env.now.Add(48 * time.Hour)
+	_, err = env.service.CheckIn(attended)
+	require.NoError(t, err)
+	env.now = env.now.Add(time.Hour)
+	require.NoError(t, env.service.MarkNoShow(missed))
+
+	class, err := env.service.ClassAttendance(classID)
+	require.NoError(t, err)
+	assert.Equal(t, AttendanceStats{Booked: 3, CheckedIn: 1, NoShows: 1}, *class)
+	assert.Equal(t, 33, class.Rate())
+
+	stats, err := env.service.MemberAttendance(member)
+	require.NoError(t, err)
+	assert.Equal(t, AttendanceStats{Booked: 1, CheckedIn: 1}, *stats, "classes that have not started are left out")
+	assert.Equal(t, 100, stats.Rate())
+}
+
+func TestCheckInRecordsInduction(t *testing.T) {
+	env := newTestEnv(t)
+	result, err := env.db.Exec(`INSERT INTO resources (tenant_id, name, kind, requires_induction) VALUES (1, 'Lathe', 'equipment', true)`)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	lathe := int(id)
+
+	classID := env.createClass(t, 10, 0)
+	_, err = env.db.Exec(`UPDATE classes SET induction_resource_id = ? WHERE id = ?`, lathe, classID)
+	require.NoError(t, err)
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+
+	lathes := resources.NewService(env.db, nil)
+	env.now = env.now.Add(48 * time.Hour)
+	_, err = env.service.CheckIn(bookingID)
+	require.NoError(t, err)
+	ok, err := lathes.HasInduction(lathe, userID)
+	require.NoError(t, err)
+	assert.True(t, ok, "attending the induction class inducts the member")
+
+	require.NoError(t, env.service.UndoCheckIn(bookingID))
+	ok, err = lathes.HasInduction(lathe, userID)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
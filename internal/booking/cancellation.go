@@ -0,0 +1,343 @@
+package booking
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/models"
+	"samskipnad/internal/services"
+)
+
+// Penalty reasons recorded in booking_penalties
+const (
+	PenaltyLateCancel = "late_cancel"
+	PenaltyNoShow     = "no_show"
+)
+
+// CancellationTerms describes what a member gets back when a booking is
+// cancelled under the community's cancellation policy
+type CancellationTerms struct {
+	Late         bool // Cancelled inside the free cancellation window
+	Refund       int  // Part of the card payment returned, in cents
+	Fee          int  // Part of the card payment kept, in cents
+	ReturnsKlipp bool // The klipp or ticket used for the booking goes back on the card or ticket
+}
+
+// cancellationTerms applies a cancellation policy to a booking for a class
+// starting at start, of which paid cents are refundable
+func cancellationTerms(policy config.CancellationPolicy, start time.Time, paid int, now time.Time) CancellationTerms {
+	terms := CancellationTerms{Refund: paid, ReturnsKlipp: true}
+	if start.Sub(now) >= time.Duration(policy.FreeUntilHours)*time.Hour {
+		return terms
+	}
+
+	percent := policy.LateFeePercent
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+
+	terms.Late = true
+	terms.Fee = paid * percent / 100
+	terms.Refund = paid - terms.Fee
+	terms.ReturnsKlipp = !policy.LateForfeitsKlipp
+	return terms
+}
+
+// Cancel cancels a booking on behalf of the member. Confirmed bookings are
+// refunded according to the community's cancellation policy: the card
+// payment is refunded and the klipp returned in full before the free
+// cancellation window closes, minus the late fee and klipp after it.
+// Waitlist entries are simply removed. Any freed seat is offered to the
+// waitlist. Cancelling a booking that is being or has been cancelled does
+// nothing, so a booking is only refunded once.
+func (s *Service) Cancel(bookingID int) (*CancellationTerms, error) {
+	booking, err := s.GetBooking(bookingID)
+	if err != nil {
+		return nil, err
+	}
+	if booking.Status == StatusCancelled {
+		return &CancellationTerms{}, nil
+	}
+
+	class, err := s.getClass(s.db, booking.ClassID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	terms := &CancellationTerms{}
+	if booking.Status == StatusConfirmed {
+		if !class.StartTime.After(now) {
+			return nil, ErrCancellationClosed
+		}
+
+		paid, err := s.refundableAmount(booking.PaymentID)
+		if err != nil {
+			return nil, err
+		}
+		*terms = cancellationTerms(s.community().Booking.Cancellation, class.StartTime, paid, now)
+	}
+
+	// The booking is cancelled before the refund goes out, and only if it
+	// is still as it was read, so of two cancels at once only one refunds
+	result, err := s.db.Exec(`
+		UPDATE bookings SET status = ?, offer_expires_at = NULL, cancelled_at = ?, late_cancellation = ?, updated_at = ?
+		WHERE id = ? AND status = ?`, StatusCancelled, now.UTC(), terms.Late, now, bookingID, booking.Status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel booking: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return &CancellationTerms{}, nil
+	}
+
+	// A failed refund puts the booking back
+	if terms.Refund > 0 {
+		err := fmt.Errorf("failed to refund payment %s: no refund provider", booking.PaymentID)
+		if s.refunds != nil {
+			err = s.refunds.RefundPayment(booking.PaymentID, terms.Refund)
+		}
+		if err != nil {
+			if restoreErr := s.restoreCancelled(booking); restoreErr != nil {
+				log.Printf("Failed to restore booking %d after failed refund: %v", booking.ID, restoreErr)
+			}
+			return nil, fmt.Errorf("failed to refund payment: %w", err)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	usedKlipp := booking.Status == StatusConfirmed && booking.KlippekortID != nil
+	if usedKlipp && terms.ReturnsKlipp {
+		entry := klippekort.Entry{UserID: booking.UserID, BookingID: booking.ID, Note: "Booking cancelled"}
+		if err := klippekort.Return(tx, *booking.KlippekortID, entry, now); err != nil {
+			return nil, err
+		}
+	}
+
+	usedTicket := booking.Status == StatusConfirmed && booking.TicketID != nil
+	if usedTicket && terms.ReturnsKlipp {
+		if err := returnTicket(tx, *booking.TicketID, now); err != nil {
+			return nil, err
+		}
+	}
+
+	forfeitsKlipp := (usedKlipp || usedTicket) && !terms.ReturnsKlipp
+	if terms.Fee > 0 || forfeitsKlipp {
+		// The late fee is settled by withholding it from the refund
+		err = s.recordPenalty(tx, booking.ID, booking.UserID, class.TenantID, PenaltyLateCancel, terms.Fee, forfeitsKlipp, now, &now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.publish(EventBookingCancelled, class.TenantID, booking.UserID, map[string]interface{}{
+		"booking_id":      booking.ID,
+		"class_id":        booking.ClassID,
+		"late":            terms.Late,
+		"refund":          terms.Refund,
+		"fee":             terms.Fee,
+		"klipp_returned":  usedKlipp && terms.ReturnsKlipp,
+		"ticket_returned": usedTicket && terms.ReturnsKlipp,
+	})
+
+	return terms, s.PromoteNext(booking.ClassID)
+}
+
+// CancelRefunded cancels the booking paid with a payment that an admin
+// refunded in full. The money has already been returned, so nothing more
+// is refunded, and the freed seat is offered to the waitlist. Bookings for
+// classes that have started are kept as a record of attendance.
+func (s *Service) CancelRefunded(paymentID string) error {
+	var bookingID int
+	err := s.db.QueryRow(`SELECT id FROM bookings WHERE payment_id = ? AND status = ?`, paymentID, StatusConfirmed).Scan(&bookingID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	booking, err := s.GetBooking(bookingID)
+	if err != nil {
+		return err
+	}
+	class, err := s.getClass(s.db, booking.ClassID)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	if !class.StartTime.After(now) {
+		return nil
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE bookings SET status = ?, offer_expires_at = NULL, cancelled_at = ?, updated_at = ?
+		WHERE id = ? AND status = ?`, StatusCancelled, now.UTC(), now, bookingID, StatusConfirmed)
+	if err != nil {
+		return fmt.Errorf("failed to cancel booking: %w", err)
+	}
+
+	data := map[string]interface{}{
+		"booking_id": booking.ID,
+		"class_id":   booking.ClassID,
+		"refunded":   true,
+	}
+	s.publish(EventBookingCancelled, class.TenantID, booking.UserID, data)
+	s.notify(booking.UserID, &services.Notification{
+		Type:     EventBookingCancelled,
+		Title:    "Booking cancelled: " + class.Name,
+		Message:  fmt.Sprintf("Your payment for %s on %s has been refunded, and your booking is cancelled.", class.Name, s.community().LocalTime(class.StartTime).Format("Mon Jan 2 15:04")),
+		Data:     data,
+		Priority: 1,
+	})
+
+	return s.PromoteNext(booking.ClassID)
+}
+
+// MarkNoShow records that a member did not turn up for a confirmed booking
+// and charges the community's no-show fee. The fee stays outstanding until
+// it is collected. Bookings that were checked in cannot be marked.
+func (s *Service) MarkNoShow(bookingID int) error {
+	booking, err := s.GetBooking(bookingID)
+	if err != nil {
+		return err
+	}
+	if booking.Status != StatusConfirmed {
+		return ErrBookingNotConfirmed
+	}
+	if booking.NoShow {
+		return nil
+	}
+	if booking.CheckedInAt != nil {
+		return ErrCheckedIn
+	}
+
+	class, err := s.getClass(s.db, booking.ClassID)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	if class.StartTime.After(now) {
+		return ErrClassNotStarted
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE bookings SET no_show = true, updated_at = ? WHERE id = ?`, now, bookingID)
+	if err != nil {
+		return fmt.Errorf("failed to mark no-show: %w", err)
+	}
+
+	community := s.community()
+	fee := int(community.Price(community.Booking.Cancellation.NoShowFee).Amount)
+	if fee > 0 {
+		err = s.recordPenalty(tx, booking.ID, booking.UserID, class.TenantID, PenaltyNoShow, fee, false, class.StartTime, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"booking_id": booking.ID,
+		"class_id":   booking.ClassID,
+		"fee":        fee,
+	}
+	s.publish(EventBookingNoShow, class.TenantID, booking.UserID, data)
+	if fee > 0 {
+		s.notify(booking.UserID, &services.Notification{
+			Type:     EventBookingNoShow,
+			Title:    "Missed class: " + class.Name,
+			Message:  fmt.Sprintf("You were booked for %s on %s but did not check in. A no-show fee of %s has been added to your account.", class.Name, s.community().LocalTime(class.StartTime).Format("Mon Jan 2 15:04"), s.community().FormatAmount(fee)),
+			Data:     data,
+			Priority: 1,
+		})
+	}
+
+	return nil
+}
+
+// restoreCancelled puts a booking that Cancel cancelled back as it was
+// read, unless it has changed since
+func (s *Service) restoreCancelled(booking *models.Booking) error {
+	var cancelledAt interface{}
+	if booking.CancelledAt != nil {
+		cancelledAt = booking.CancelledAt.UTC()
+	}
+	_, err := s.db.Exec(`
+		UPDATE bookings SET status = ?, cancelled_at = ?, late_cancellation = ?, updated_at = ?
+		WHERE id = ? AND status = ?`,
+		booking.Status, cancelledAt, booking.LateCancellation, s.now(), booking.ID, StatusCancelled)
+	return err
+}
+
+// refundableAmount returns how much of a booking's card payment can still
+// be refunded
+func (s *Service) refundableAmount(paymentID string) (int, error) {
+	if paymentID == "" {
+		return 0, nil
+	}
+
+	var amount, refunded int
+	var status string
+	err := s.db.QueryRow(`
+		SELECT amount, refunded_amount, status FROM payments WHERE id = ?`, paymentID).Scan(
+		&amount, &refunded, &status)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if status != "succeeded" && status != "partially_refunded" {
+		return 0, nil
+	}
+	return amount - refunded, nil
+}
+
+// recordPenalty records a penalty incurred at incurredAt: when the booking
+// was cancelled, or when the class the member missed started. Booking rows
+// are reused when a member books the same class again, so a booking can
+// have more than one late cancellation; recording the same one twice does
+// nothing.
+func (s *Service) recordPenalty(q queryer, bookingID, userID, tenantID int, reason string, amount int, klippForfeited bool, incurredAt time.Time, settledAt *time.Time) error {
+	var settled interface{}
+	if settledAt != nil {
+		settled = settledAt.UTC()
+	}
+
+	_, err := q.Exec(`
+		INSERT INTO booking_penalties (booking_id, user_id, tenant_id, reason, amount, klipp_forfeited, incurred_at, settled_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(booking_id, reason, incurred_at) DO NOTHING`,
+		bookingID, userID, tenantID, reason, amount, klippForfeited, incurredAt.UTC(), settled, s.now())
+	if err != nil {
+		return fmt.Errorf("failed to record %s penalty: %w", reason, err)
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package booking
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+)
+
+func TestCancellationTerms(t *testing.T) {
+	start := time.Date(2025, 3, 3, 18, 0, 0, 0, time.UTC)
+	policy := config.CancellationPolicy{
+		FreeUntilHours:    12,
+		LateFeePercent:    50,
+		LateForfeitsKlipp: true,
+	}
+
+	tests := []struct {
+		name   string
+		policy config.CancellationPolicy
+		before time.Duration
+		paid   int
+		want   CancellationTerms
+	}{
+		{"Early", policy, 24 * time.Hour, 20000, CancellationTerms{Refund: 20000, ReturnsKlipp: true}},
+		{"AtDeadline", policy, 12 * time.Hour, 20000, CancellationTerms{Refund: 20000, ReturnsKlipp: true}},
+		{"Late", policy, 2 * time.Hour, 20000, CancellationTerms{Late: true, Refund: 10000, Fee: 10000}},
+		{"LateUnpaid", policy, 2 * time.Hour, 0, CancellationTerms{Late: true}},
+		{"NoPolicy", config.CancellationPolicy{}, time.Minute, 20000, CancellationTerms{Refund: 20000, ReturnsKlipp: true}},
+		{"FeeCapped", config.CancellationPolicy{FreeUntilHours: 1, LateFeePercent: 150}, time.Minute, 20000, CancellationTerms{Late: true, Fee: 20000, ReturnsKlipp: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cancellationTerms(tt.policy, start, tt.paid, start.Add(-tt.before))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func (env *testEnv) pay(t *testing.T, bookingID, userID, amount int) string {
+	paymentID := fmt.Sprintf("pi_test_%d", bookingID)
+	_, err := env.db.Exec(`
+		INSERT INTO payments (id, user_id, tenant_id, amount, status, payment_type, reference_id)
+		VALUES (?, ?, 1, ?, 'succeeded', 'class', 0)`, paymentID, userID, amount)
+	require.NoError(t, err)
+	_, err = env.db.Exec(`UPDATE bookings SET payment_id = ? WHERE id = ?`, paymentID, bookingID)
+	require.NoError(t, err)
+	return paymentID
+}
+
+func (env *testEnv) buyKlipp(t *testing.T, userID int) int {
+	result, err := env.db.Exec(`
+		INSERT INTO klippekort (user_id, tenant_id, category_id, klipp_left, original_klipp)
+		VALUES (?, 1, 'yoga', 9, 10)`, userID)
+	require.NoError(t, err)
+	cardID, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(cardID)
+}
+
+func (env *testEnv) payWithKlipp(t *testing.T, bookingID, userID int) int {
+	cardID := env.buyKlipp(t, userID)
+	_, err := env.db.Exec(`UPDATE bookings SET klippekort_id = ? WHERE id = ?`, cardID, bookingID)
+	require.NoError(t, err)
+	return cardID
+}
+
+func (env *testEnv) klippLeft(t *testing.T, cardID int) int {
+	var left int
+	require.NoError(t, env.db.QueryRow(`SELECT klipp_left FROM klippekort WHERE id = ?`, cardID).Scan(&left))
+	return left
+}
+
+func (env *testEnv) ledgerEntries(t *testing.T, bookingID int, kind string) int {
+	var n int
+	err := env.db.QueryRow(`SELECT COUNT(*) FROM klipp_transactions WHERE booking_id = ? AND kind = ?`, bookingID, kind).Scan(&n)
+	require.NoError(t, err)
+	return n
+}
+
+func newPolicyTestEnv(t *testing.T) *testEnv {
+	env := newTestEnv(t)
+	env.community.Booking.Cancellation = config.CancellationPolicy{
+		FreeUntilHours:    12,
+		LateFeePercent:    50,
+		LateForfeitsKlipp: true,
+		NoShowFee:         150,
+	}
+	return env
+}
+
+func TestCancelEarlyRefundsInFull(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 20000)
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+	paymentID := env.pay(t, bookingID, userID, 20000)
+
+	terms, err := env.service.Cancel(bookingID)
+	require.NoError(t, err)
+
+	assert.False(t, terms.Late)
+	assert.Equal(t, 20000, env.refunds.refunds[paymentID])
+	assert.Equal(t, StatusCancelled, env.status(t, userID, classID))
+
+	booking, err := env.service.GetBooking(bookingID)
+	require.NoError(t, err)
+	assert.NotNil(t, booking.CancelledAt)
+	assert.False(t, booking.LateCancellation)
+
+	var penalties int
+	require.NoError(t, env.db.QueryRow(`SELECT COUNT(*) FROM booking_penalties`).Scan(&penalties))
+	assert.Zero(t, penalties)
+
+	t.Run("KlippReturned", func(t *testing.T) {
+		userID := env.createUser(t, 2)
+		bookingID := env.confirm(t, userID, classID)
+		cardID := env.payWithKlipp(t, bookingID, userID)
+
+		terms, err := env.service.Cancel(bookingID)
+		require.NoError(t, err)
+		assert.True(t, terms.ReturnsKlipp)
+		assert.Equal(t, 10, env.klippLeft(t, cardID))
+	})
+}
+
+func TestCancelLateKeepsFee(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 20000)
+	env.now = env.now.Add(46 * time.Hour) // Two hours before start
+
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+	paymentID := env.pay(t, bookingID, userID, 20000)
+
+	terms, err := env.service.Cancel(bookingID)
+	require.NoError(t, err)
+
+	assert.True(t, terms.Late)
+	assert.Equal(t, 10000, terms.Fee)
+	assert.Equal(t, 10000, env.refunds.refunds[paymentID])
+
+	var amount int
+	var settledAt *time.Time
+	err = env.db.QueryRow(`
+		SELECT amount, settled_at FROM booking_penalties
+		WHERE booking_id = ? AND reason = ?`, bookingID, PenaltyLateCancel).Scan(&amount, &settledAt)
+	require.NoError(t, err)
+	assert.Equal(t, 10000, amount)
+	assert.NotNil(t, settledAt, "the fee is withheld from the refund")
+
+	events := env.events.published(EventBookingCancelled, userID)
+	require.Len(t, events, 1)
+	assert.Equal(t, true, events[0].Data["late"])
+
+	t.Run("KlippForfeited", func(t *testing.T) {
+		userID := env.createUser(t, 2)
+		bookingID := env.confirm(t, userID, classID)
+		cardID := env.payWithKlipp(t, bookingID, userID)
+
+		terms, err := env.service.Cancel(bookingID)
+		require.NoError(t, err)
+		assert.False(t, terms.ReturnsKlipp)
+		assert.Equal(t, 9, env.klippLeft(t, cardID))
+
+		var forfeited bool
+		err = env.db.QueryRow(`SELECT klipp_forfeited FROM booking_penalties WHERE booking_id = ?`, bookingID).Scan(&forfeited)
+		require.NoError(t, err)
+		assert.True(t, forfeited)
+	})
+}
+
+func TestCancelFailedRefundKeepsBooking(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 20000)
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+	env.pay(t, bookingID, userID, 20000)
+
+	env.refunds.err = errors.New("card declined")
+	_, err := env.service.Cancel(bookingID)
+
+	assert.Error(t, err)
+	assert.Equal(t, StatusConfirmed, env.status(t, userID, classID))
+}
+
+func TestCancelTwiceRefundsOnce(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 20000)
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+	paymentID := env.pay(t, bookingID, userID, 20000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := env.service.Cancel(bookingID)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 20000, env.refunds.refunds[paymentID])
+	assert.Len(t, env.events.published(EventBookingCancelled, userID), 1)
+}
+
+func TestCancelLateAgainAfterRebooking(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 0)
+	env.now = env.now.Add(46 * time.Hour) // Two hours before start
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+	env.payWithKlipp(t, bookingID, userID)
+
+	_, err := env.service.Cancel(bookingID)
+	require.NoError(t, err)
+
+	// Booking the class again reuses the booking
+	env.now = env.now.Add(10 * time.Minute)
+	_, err = env.db.Exec(`UPDATE bookings SET status = 'confirmed' WHERE id = ?`, bookingID)
+	require.NoError(t, err)
+	env.payWithKlipp(t, bookingID, userID)
+
+	env.now = env.now.Add(10 * time.Minute)
+	_, err = env.service.Cancel(bookingID)
+	require.NoError(t, err)
+
+	var penalties int
+	err = env.db.QueryRow(`SELECT COUNT(*) FROM booking_penalties WHERE booking_id = ? AND reason = ?`,
+		bookingID, PenaltyLateCancel).Scan(&penalties)
+	require.NoError(t, err)
+	assert.Equal(t, 2, penalties)
+}
+
+func TestCancelAfterStart(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 0)
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+	env.now = env.now.Add(48 * time.Hour)
+
+	_, err := env.service.Cancel(bookingID)
+
+	assert.ErrorIs(t, err, ErrCancellationClosed)
+	assert.Equal(t, StatusConfirmed, env.status(t, userID, classID))
+}
+
+func TestCancelRefunded(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 20000)
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+	paymentID := env.pay(t, bookingID, userID, 20000)
+
+	require.NoError(t, env.service.CancelRefunded(paymentID))
+	assert.Equal(t, StatusCancelled, env.status(t, userID, classID))
+	assert.Empty(t, env.refunds.refunds, "the admin already refunded the payment")
+	assert.Len(t, env.events.notifications[userID], 1)
+
+	require.NoError(t, env.service.CancelRefunded(paymentID), "cancelling again is a no-op")
+	assert.Len(t, env.events.notifications[userID], 1)
+
+	t.Run("ClassStarted", func(t *testing.T) {
+		userID := env.createUser(t, 2)
+		bookingID := env.confirm(t, userID, classID)
+		paymentID := env.pay(t, bookingID, userID, 20000)
+		env.now = env.now.Add(48 * time.Hour)
+
+		require.NoError(t, env.service.CancelRefunded(paymentID))
+		assert.Equal(t, StatusConfirmed, env.status(t, userID, classID), "attended classes stay booked")
+	})
+}
+
+func TestMarkNoShow(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 0)
+	userID := env.createUser(t, 1)
+	bookingID := env.confirm(t, userID, classID)
+
+	err := env.service.MarkNoShow(bookingID)
+	assert.ErrorIs(t, err, ErrClassNotStarted)
+
+	env.now = env.now.Add(50 * time.Hour)
+	require.NoError(t, env.service.MarkNoShow(bookingID))
+	require.NoError(t, env.service.MarkNoShow(bookingID), "marking twice is a no-op")
+
+	booking, err := env.service.GetBooking(bookingID)
+	require.NoError(t, err)
+	assert.True(t, booking.NoShow)
+
+	var amount int
+	var settledAt *time.Time
+	err = env.db.QueryRow(`
+		SELECT amount, settled_at FROM booking_penalties
+		WHERE booking_id = ? AND reason = ?`, bookingID, PenaltyNoShow).Scan(&amount, &settledAt)
+	require.NoError(t, err)
+	assert.Equal(t, 15000, amount)
+	assert.Nil(t, settledAt, "the no-show fee is outstanding")
+
+	assert.Len(t, env.events.published(EventBookingNoShow, userID), 1)
+	assert.Len(t, env.events.notifications[userID], 1)
+}
@@ -0,0 +1,364 @@
+package booking
+
+import (
+	"database/sql"
+	"fmt"
+
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/models"
+	"samskipnad/internal/resources"
+	"samskipnad/internal/services"
+)
+
+// CreateClass schedules a one-off class and sets its ID. A class using a
+// resource cannot overlap another class or reservation of the resource.
+func (s *Service) CreateClass(class *models.Class) error {
+	if !class.EndTime.After(class.StartTime) {
+		return ErrInvalidClassTime
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if class.ResourceID != nil {
+		err := resources.CheckAvailable(tx, *class.ResourceID, class.StartTime, class.EndTime, resources.Exclude{})
+		if err != nil {
+			return err
+		}
+	}
+
+	var category, icalUID, icalSource interface{}
+	if class.CategoryID != "" {
+		category = class.CategoryID
+	}
+	if class.ICalUID != "" {
+		icalUID, icalSource = class.ICalUID, class.ICalSource
+	}
+
+	now := s.now()
+	result, err := tx.Exec(`
+		INSERT INTO classes (tenant_id, name, description, instructor_id, start_time, end_time, max_capacity, price,
+			requires_ticket, requires_membership, category_id, resource_id, induction_resource_id, ical_uid, ical_source,
+			created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		class.TenantID, class.Name, class.Description, class.InstructorID, class.StartTime.UTC(), class.EndTime.UTC(),
+		class.MaxCapacity, class.Price, class.RequiresTicket, class.RequiresMembership, category, class.ResourceID,
+		class.InductionFor, icalUID, icalSource, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to create class: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	class.ID = int(id)
+	class.Active = true
+	class.CreatedAt = now
+	class.UpdatedAt = now
+	return nil
+}
+
+// UpdateClass saves an admin's changes to a class. The capacity cannot drop
+// below the number of confirmed bookings, and the class cannot overlap
+// another use of its resource. A new instructor is assigned with the
+// changes, through the InstructorAssigner if one is set. Booked members
+// are notified when the class moves, and new seats are offered to the
+// waitlist.
+func (s *Service) UpdateClass(update *models.Class) error {
+	if !update.EndTime.After(update.StartTime) {
+		return ErrInvalidClassTime
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, update.ID)
+	if err != nil {
+		return err
+	}
+
+	var confirmed int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM bookings WHERE class_id = ? AND status = 'confirmed'`, update.ID).Scan(&confirmed)
+	if err != nil {
+		return err
+	}
+	if update.MaxCapacity < confirmed {
+		return ErrCapacityBelowBookings
+	}
+
+	if update.ResourceID != nil {
+		exclude := resources.Exclude{ClassID: update.ID}
+		if err := resources.CheckAvailable(tx, *update.ResourceID, update.StartTime, update.EndTime, exclude); err != nil {
+			return err
+		}
+	}
+
+	announce := func() {}
+	if update.InstructorID != class.InstructorID && s.instructors != nil {
+		if announce, err = s.instructors.AssignTx(tx, update.ID, update.InstructorID); err != nil {
+			return err
+		}
+	}
+
+	var category interface{}
+	if update.CategoryID != "" {
+		category = update.CategoryID
+	}
+
+	_, err = tx.Exec(`
+		UPDATE classes SET name = ?, description = ?, instructor_id = ?, start_time = ?, end_time = ?,
+			max_capacity = ?, price = ?, category_id = ?, resource_id = ?, induction_resource_id = ?, updated_at = ?
+		WHERE id = ?`,
+		update.Name, update.Description, update.InstructorID, update.StartTime.UTC(), update.EndTime.UTC(),
+		update.MaxCapacity, update.Price, category, update.ResourceID, update.InductionFor, s.now(), update.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update class: %w", err)
+	}
+
+	attendees, err := s.attendees(tx, update.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	announce()
+
+	moved := !class.StartTime.Equal(update.StartTime) || !class.EndTime.Equal(update.EndTime)
+	data := map[string]interface{}{
+		"class_id": update.ID,
+		"moved":    moved,
+	}
+	s.publish(EventClassUpdated, class.TenantID, 0, data)
+	if moved {
+		for _, userID := range attendees {
+			s.notify(userID, &services.Notification{
+				Type:     EventClassUpdated,
+				Title:    "Class moved: " + update.Name,
+				Message:  fmt.Sprintf("%s on %s has moved to %s. Your booking is unchanged; cancel it if the new time does not suit you.", class.Name, s.community().LocalTime(class.StartTime).Format("Mon Jan 2 15:04"), s.community().LocalTime(update.StartTime).Format("Mon Jan 2 15:04")),
+				Data:     data,
+				Priority: 2,
+			})
+		}
+	}
+
+	if update.MaxCapacity > class.MaxCapacity {
+		return s.PromoteNext(update.ID)
+	}
+	return nil
+}
+
+// CancelClass cancels a class on behalf of the studio. Every booked member
+// gets their card payment refunded and their klipp or ticket returned in
+// full, regardless of the cancellation policy, and is notified. Waitlisted
+// members are removed. The class is kept, inactive, so bookings and klipp
+// history still refer to it. It returns the number of bookings cancelled.
+func (s *Service) CancelClass(classID int) (int, error) {
+	class, err := s.getClass(s.db, classID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Deactivating first stops new bookings while the existing ones are
+	// cancelled. Payments still in flight are refunded by ConfirmPaid.
+	now := s.now()
+	_, err = s.db.Exec(`UPDATE classes SET active = false, updated_at = ? WHERE id = ?`, now, classID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel class: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM seat_holds WHERE class_id = ?`, classID); err != nil {
+		return 0, fmt.Errorf("failed to release holds: %w", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id FROM bookings
+		WHERE class_id = ? AND status IN ('confirmed', 'waitlist')
+		ORDER BY id`, classID)
+	if err != nil {
+		return 0, err
+	}
+	var bookingIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		bookingIDs = append(bookingIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	cancelled := 0
+	for _, id := range bookingIDs {
+		booking, err := s.GetBooking(id)
+		if err != nil {
+			return cancelled, err
+		}
+		if err := s.cancelForClass(booking, class); err != nil {
+			return cancelled, err
+		}
+		if booking.Status == StatusConfirmed {
+			cancelled++
+		}
+	}
+
+	s.publish(EventClassCancelled, class.TenantID, 0, map[string]interface{}{
+		"class_id": classID,
+		"bookings": cancelled,
+	})
+
+	return cancelled, nil
+}
+
+// DeleteClass removes a class. Classes that were never booked or held, and
+// are not part of a series, are deleted outright; all others are cancelled
+// with CancelClass and kept inactive so the series does not recreate them,
+// refunding payments and returning klipp and tickets. It returns the
+// number of bookings cancelled.
+func (s *Service) DeleteClass(classID int) (int, error) {
+	var bookings int
+	var seriesID sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM bookings WHERE class_id = c.id)
+			+ (SELECT COUNT(*) FROM seat_holds WHERE class_id = c.id), c.series_id
+		FROM classes c WHERE c.id = ?`, classID).Scan(&bookings, &seriesID)
+	if err == sql.ErrNoRows {
+		return 0, ErrClassNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if bookings > 0 || seriesID.Valid {
+		return s.CancelClass(classID)
+	}
+
+	if _, err := s.db.Exec(`DELETE FROM substitute_requests WHERE class_id = ?`, classID); err != nil {
+		return 0, fmt.Errorf("failed to delete substitute requests: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM classes WHERE id = ?`, classID); err != nil {
+		return 0, fmt.Errorf("failed to delete class: %w", err)
+	}
+	return 0, nil
+}
+
+// cancelForClass cancels one booking of a class the studio cancelled,
+// refunding the payment and returning the klipp or ticket used for it in
+// full
+func (s *Service) cancelForClass(booking *models.Booking, class *models.Class) error {
+	confirmed := booking.Status == StatusConfirmed
+
+	refund := 0
+	if confirmed {
+		var err error
+		refund, err = s.refundableAmount(booking.PaymentID)
+		if err != nil {
+			return err
+		}
+	}
+	if refund > 0 {
+		if s.refunds == nil {
+			return fmt.Errorf("failed to refund payment %s: no refund provider", booking.PaymentID)
+		}
+		if err := s.refunds.RefundPayment(booking.PaymentID, refund); err != nil {
+			return fmt.Errorf("failed to refund payment: %w", err)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+	_, err = tx.Exec(`
+		UPDATE bookings SET status = ?, offer_expires_at = NULL, cancelled_at = ?, updated_at = ?
+		WHERE id = ?`, StatusCancelled, now.UTC(), now, booking.ID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel booking: %w", err)
+	}
+
+	klippReturned := confirmed && booking.KlippekortID != nil
+	if klippReturned {
+		entry := klippekort.Entry{UserID: booking.UserID, BookingID: booking.ID, Note: "Class cancelled"}
+		if err := klippekort.Return(tx, *booking.KlippekortID, entry, now); err != nil {
+			return err
+		}
+	}
+
+	ticketReturned := confirmed && booking.TicketID != nil
+	if ticketReturned {
+		if err := returnTicket(tx, *booking.TicketID, now); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"booking_id":      booking.ID,
+		"class_id":        class.ID,
+		"refund":          refund,
+		"klipp_returned":  klippReturned,
+		"ticket_returned": ticketReturned,
+	}
+	s.publish(EventBookingCancelled, class.TenantID, booking.UserID, data)
+
+	message := fmt.Sprintf("%s on %s has been cancelled by the studio.", class.Name, s.community().LocalTime(class.StartTime).Format("Mon Jan 2 15:04"))
+	switch {
+	case refund > 0:
+		message += fmt.Sprintf(" Your payment of %s has been refunded.", s.community().FormatAmount(refund))
+	case klippReturned:
+		message += " Your klipp has been returned to your klippekort."
+	case ticketReturned:
+		message += " The class has been returned to your ticket."
+	case !confirmed:
+		message += " You have been removed from the waitlist."
+	}
+	s.notify(booking.UserID, &services.Notification{
+		Type:     EventClassCancelled,
+		Title:    "Class cancelled: " + class.Name,
+		Message:  message,
+		Data:     data,
+		Priority: 2,
+	})
+
+	return nil
+}
+
+// attendees returns the members with a confirmed booking for a class
+func (s *Service) attendees(q queryer, classID int) ([]int, error) {
+	rows, err := q.Query(`SELECT user_id FROM bookings WHERE class_id = ? AND status = 'confirmed' ORDER BY id`, classID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	return userIDs, rows.Err()
+}
@@ -0,0 +1,246 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/models"
+	"samskipnad/internal/resources"
+)
+
+func (env *testEnv) classUpdate(t *testing.T, classID int) *models.Class {
+	class, err := env.service.getClass(env.db, classID)
+	require.NoError(t, err)
+	class.InstructorID = 1
+	return class
+}
+
+func TestUpdateClass(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 3, 0)
+	first := env.createUser(t, 1)
+	second := env.createUser(t, 2)
+	waiting := env.createUser(t, 3)
+	env.confirm(t, first, classID)
+	env.confirm(t, second, classID)
+	_, err := env.db.Exec(`UPDATE classes SET max_capacity = 2 WHERE id = ?`, classID)
+	require.NoError(t, err)
+	_, err = env.service.JoinWaitlist(waiting, classID)
+	require.NoError(t, err)
+
+	t.Run("CapacityBelowBookings", func(t *testing.T) {
+		update := env.classUpdate(t, classID)
+		update.MaxCapacity = 1
+		assert.ErrorIs(t, env.service.UpdateClass(update), ErrCapacityBelowBookings)
+	})
+
+	t.Run("InvalidTime", func(t *testing.T) {
+		update := env.classUpdate(t, classID)
+		update.EndTime = update.StartTime
+		assert.ErrorIs(t, env.service.UpdateClass(update), ErrInvalidClassTime)
+	})
+
+	update := env.classUpdate(t, classID)
+	update.Name = "Yin"
+	update.StartTime = update.StartTime.Add(time.Hour)
+	update.EndTime = update.EndTime.Add(time.Hour)
+	update.MaxCapacity = 3
+	update.Price = 15000
+	update.CategoryID = "yoga"
+	require.NoError(t, env.service.UpdateClass(update))
+
+	class, err := env.service.getClass(env.db, classID)
+	require.NoError(t, err)
+	assert.Equal(t, "Yin", class.Name)
+	assert.True(t, update.StartTime.Equal(class.StartTime))
+	assert.Equal(t, 3, class.MaxCapacity)
+	assert.Equal(t, 15000, class.Price)
+	assert.Equal(t, "yoga", class.CategoryID)
+
+	for _, userID := range []int{first, second} {
+		require.Len(t, env.events.notifications[userID], 1)
+		assert.Equal(t, EventClassUpdated, env.events.notifications[userID][0].Type)
+	}
+	assert.Len(t, env.events.published(EventWaitlistOffered, waiting), 1, "the new seat is offered to the waitlist")
+}
+
+// fakeAssigner assigns instructors in the transaction given, failing with
+// err if set
+type fakeAssigner struct {
+	err       error
+	announced []int
+}
+
+func (a *fakeAssigner) AssignTx(tx *sql.Tx, classID, instructorID int) (func(), error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	if _, err := tx.Exec(`UPDATE classes SET instructor_id = ? WHERE id = ?`, instructorID, classID); err != nil {
+		return nil, err
+	}
+	return func() { a.announced = append(a.announced, instructorID) }, nil
+}
+
+func TestUpdateClassAssignsInstructor(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 3, 0)
+	assigner := &fakeAssigner{err: errors.New("not an instructor")}
+	env.service.SetInstructorAssigner(assigner)
+
+	update := env.classUpdate(t, classID)
+	update.Name = "Yin"
+	update.InstructorID = 7
+	assert.Error(t, env.service.UpdateClass(update))
+
+	class, err := env.service.getClass(env.db, classID)
+	require.NoError(t, err)
+	assert.NotEqual(t, "Yin", class.Name, "nothing is saved when the instructor cannot be assigned")
+	assert.Equal(t, 1, class.InstructorID)
+
+	assigner.err = nil
+	require.NoError(t, env.service.UpdateClass(update))
+	class, err = env.service.getClass(env.db, classID)
+	require.NoError(t, err)
+	assert.Equal(t, "Yin", class.Name)
+	assert.Equal(t, 7, class.InstructorID)
+	assert.Equal(t, []int{7}, assigner.announced)
+
+	update.Name = "Yin Yoga"
+	require.NoError(t, env.service.UpdateClass(update))
+	assert.Equal(t, []int{7}, assigner.announced, "the instructor is assigned only when they change")
+}
+
+func TestClassResourceConflicts(t *testing.T) {
+	env := newTestEnv(t)
+	result, err := env.db.Exec(`INSERT INTO resources (tenant_id, name, kind) VALUES (1, 'Studio A', 'room')`)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	room := int(id)
+
+	start := env.now.Add(24 * time.Hour)
+	morning := &models.Class{TenantID: 1, Name: "Hatha", InstructorID: 1, StartTime: start, EndTime: start.Add(time.Hour),
+		MaxCapacity: 10, ResourceID: &room}
+	require.NoError(t, env.service.CreateClass(morning))
+	assert.NotZero(t, morning.ID)
+
+	clash := &models.Class{TenantID: 1, Name: "Yin", InstructorID: 1, StartTime: start.Add(30 * time.Minute),
+		EndTime: start.Add(90 * time.Minute), MaxCapacity: 10, ResourceID: &room}
+	assert.ErrorIs(t, env.service.CreateClass(clash), resources.ErrConflict)
+
+	clash.StartTime, clash.EndTime = start.Add(time.Hour), start.Add(2*time.Hour)
+	require.NoError(t, env.service.CreateClass(clash), "back-to-back classes share the room")
+
+	update := env.classUpdate(t, clash.ID)
+	update.ResourceID = &room
+	update.StartTime = start.Add(45 * time.Minute)
+	assert.ErrorIs(t, env.service.UpdateClass(update), resources.ErrConflict)
+
+	update = env.classUpdate(t, morning.ID)
+	update.ResourceID = &room
+	update.EndTime = start.Add(50 * time.Minute)
+	assert.NoError(t, env.service.UpdateClass(update), "a class does not conflict with itself")
+}
+
+func TestCancelClass(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 20000)
+	// Cancelling inside the late window still refunds everything
+	env.now = env.now.Add(47 * time.Hour)
+
+	paid := env.createUser(t, 1)
+	paidBooking := env.confirm(t, paid, classID)
+	paymentID := env.pay(t, paidBooking, paid, 20000)
+
+	klipp := env.createUser(t, 2)
+	klippBooking := env.confirm(t, klipp, classID)
+	cardID := env.payWithKlipp(t, klippBooking, klipp)
+
+	waiting := env.createUser(t, 3)
+	_, err := env.db.Exec(`INSERT INTO bookings (user_id, class_id, status) VALUES (?, ?, 'waitlist')`, waiting, classID)
+	require.NoError(t, err)
+
+	cancelled, err := env.service.CancelClass(classID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, cancelled)
+
+	assert.Equal(t, 20000, env.refunds.refunds[paymentID])
+	assert.Equal(t, 10, env.klippLeft(t, cardID))
+	assert.Equal(t, 1, env.ledgerEntries(t, klippBooking, klippekort.KindRefund))
+	for _, userID := range []int{paid, klipp, waiting} {
+		assert.Equal(t, StatusCancelled, env.status(t, userID, classID))
+		require.Len(t, env.events.notifications[userID], 1)
+		assert.Equal(t, EventClassCancelled, env.events.notifications[userID][0].Type)
+	}
+
+	var penalties int
+	require.NoError(t, env.db.QueryRow(`SELECT COUNT(*) FROM booking_penalties`).Scan(&penalties))
+	assert.Zero(t, penalties, "members are not charged when the studio cancels")
+
+	_, err = env.service.Book(env.createUser(t, 4), classID)
+	assert.ErrorIs(t, err, ErrClassNotFound)
+
+	t.Run("PaymentInFlight", func(t *testing.T) {
+		userID := env.createUser(t, 5)
+		_, err := env.db.Exec(`
+			INSERT INTO payments (id, user_id, tenant_id, amount, status, payment_type, reference_id)
+			VALUES ('pi_late', ?, 1, 20000, 'succeeded', 'class', ?)`, userID, classID)
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, env.service.ConfirmPaid(userID, classID, "pi_late"), ErrClassNotFound)
+		assert.Equal(t, 20000, env.refunds.refunds["pi_late"])
+	})
+}
+
+func TestCancelClassReturnsTicket(t *testing.T) {
+	env := newPolicyTestEnv(t)
+	classID := env.createClass(t, 10, 0)
+	env.setClass(t, classID, `requires_ticket = true`)
+	member := env.createUser(t, 1)
+	ticketID := env.giveTicket(t, member, 1)
+
+	booking, err := env.service.BookWithTicket(member, classID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, env.classesLeft(t, ticketID))
+
+	cancelled, err := env.service.CancelClass(classID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cancelled)
+	assert.Equal(t, StatusCancelled, env.status(t, member, classID))
+	assert.Equal(t, 1, env.classesLeft(t, ticketID), "the ticket is returned")
+
+	require.Len(t, env.events.notifications[member], 1)
+	notification := env.events.notifications[member][0]
+	assert.Contains(t, notification.Message, "returned to your ticket")
+	assert.Equal(t, true, notification.Data["ticket_returned"])
+	assert.Equal(t, booking.ID, notification.Data["booking_id"])
+}
+
+func TestDeleteClass(t *testing.T) {
+	env := newTestEnv(t)
+
+	unbooked := env.createClass(t, 10, 0)
+	cancelled, err := env.service.DeleteClass(unbooked)
+	require.NoError(t, err)
+	assert.Zero(t, cancelled)
+	_, err = env.service.getClass(env.db, unbooked)
+	assert.ErrorIs(t, err, ErrClassNotFound)
+
+	booked := env.createClass(t, 10, 0)
+	userID := env.createUser(t, 1)
+	env.confirm(t, userID, booked)
+	cancelled, err = env.service.DeleteClass(booked)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cancelled)
+
+	class, err := env.service.getClass(env.db, booked)
+	require.NoError(t, err, "booked classes are kept for their history")
+	assert.False(t, class.Active)
+	assert.Equal(t, StatusCancelled, env.status(t, userID, booked))
+}
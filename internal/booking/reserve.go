@@ -0,0 +1,403 @@
+package booking
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/models"
+)
+
+// DefaultPaymentHold is how long a seat in a paid class is held while the
+// member pays for it
+const DefaultPaymentHold = 15 * time.Minute
+
+// SeatHold reserves a seat in a paid class while the member pays for it
+type SeatHold struct {
+	ID        int
+	ClassID   int
+	UserID    int
+	PaymentID string
+	ExpiresAt time.Time
+}
+
+// Book books a member onto a free class. The capacity check and the insert
+// run in one transaction, so concurrent bookings cannot overbook the class.
+// Members holding a waitlist offer take the seat held for them. Free
+// classes that require a ticket are booked with a klipp or a ticket.
+func (s *Service) Book(userID, classID int) (*models.Booking, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if !class.Active {
+		return nil, ErrClassNotFound
+	}
+	if class.Price > 0 {
+		return nil, ErrPaymentRequired
+	}
+	if class.RequiresTicket {
+		return nil, ErrTicketRequired
+	}
+	if err := s.checkMembership(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSeat(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	bookingID, err := s.confirmSeat(tx, userID, classID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.publish(EventBookingConfirmed, class.TenantID, userID, map[string]interface{}{
+		"booking_id": bookingID,
+		"class_id":   classID,
+	})
+
+	return s.GetBooking(bookingID)
+}
+
+// BookWithKlipp books a member onto a class in exchange for one klipp from
+// their oldest non-expired card in the class's klippekort category. The
+// seat and the klipp are taken in one transaction, so the member is never
+// charged a klipp for a seat they did not get. It returns
+// klippekort.ErrNoKlipp if the member has no klipp left in the category.
+func (s *Service) BookWithKlipp(userID, classID int) (*models.Booking, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if !class.Active {
+		return nil, ErrClassNotFound
+	}
+	if class.CategoryID == "" {
+		return nil, ErrNotKlippClass
+	}
+	if err := s.checkMembership(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSeat(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	bookingID, err := s.confirmSeat(tx, userID, classID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	entry := klippekort.Entry{BookingID: bookingID}
+	cardID, err := klippekort.Deduct(tx, userID, class.TenantID, class.CategoryID, entry, s.now())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE bookings SET klippekort_id = ? WHERE id = ?`, cardID, bookingID); err != nil {
+		return nil, fmt.Errorf("failed to record klipp on booking: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.publish(EventBookingConfirmed, class.TenantID, userID, map[string]interface{}{
+		"booking_id":    bookingID,
+		"class_id":      classID,
+		"klippekort_id": cardID,
+	})
+
+	return s.GetBooking(bookingID)
+}
+
+// HoldSeat reserves a seat in a paid class for the member while they pay.
+// The hold counts against the class capacity until it expires or the
+// payment is confirmed.
+func (s *Service) HoldSeat(userID, classID int) (*SeatHold, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if !class.Active {
+		return nil, ErrClassNotFound
+	}
+	if err := s.checkMembership(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkSeat(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	hold := &SeatHold{
+		ClassID:   classID,
+		UserID:    userID,
+		ExpiresAt: now.Add(s.paymentHold).UTC(),
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO seat_holds (class_id, user_id, expires_at, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(class_id, user_id) DO UPDATE SET expires_at = excluded.expires_at, payment_id = NULL`,
+		classID, userID, hold.ExpiresAt, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hold seat: %w", err)
+	}
+
+	err = tx.QueryRow(`SELECT id FROM seat_holds WHERE class_id = ? AND user_id = ?`, classID, userID).Scan(&hold.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// AttachPayment records the payment that will confirm a held seat
+func (s *Service) AttachPayment(holdID int, paymentID string) error {
+	_, err := s.db.Exec(`UPDATE seat_holds SET payment_id = ? WHERE id = ?`, paymentID, holdID)
+	if err != nil {
+		return fmt.Errorf("failed to attach payment to hold: %w", err)
+	}
+	return nil
+}
+
+// ReleaseHold gives up a held seat, for example when the payment could not
+// be started, and offers it to the waitlist
+func (s *Service) ReleaseHold(holdID int) error {
+	var classID int
+	err := s.db.QueryRow(`SELECT class_id FROM seat_holds WHERE id = ?`, holdID).Scan(&classID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(`DELETE FROM seat_holds WHERE id = ?`, holdID); err != nil {
+		return fmt.Errorf("failed to release hold: %w", err)
+	}
+
+	return s.PromoteNext(classID)
+}
+
+// ConfirmPaid confirms a member's booking once its payment has succeeded.
+// A held seat is always honoured. If the hold expired and the class filled
+// up in the meantime, the payment is refunded in full and
+// ErrClassFullRefunded is returned; if the class was cancelled or deleted, it is refunded and
+// ErrClassNotFound returned. Confirming the same payment twice is a no-op.
+func (s *Service) ConfirmPaid(userID, classID int, paymentID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, classID)
+	if err == ErrClassNotFound {
+		return s.refundUnused(tx, paymentID, err)
+	}
+	if err != nil {
+		return err
+	}
+	if !class.Active {
+		return s.refundUnused(tx, paymentID, ErrClassNotFound)
+	}
+
+	var status string
+	var existingPayment sql.NullString
+	err = tx.QueryRow(`SELECT status, payment_id FROM bookings WHERE user_id = ? AND class_id = ?`, userID, classID).Scan(
+		&status, &existingPayment)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if status == StatusConfirmed {
+		if existingPayment.String == paymentID {
+			return nil
+		}
+		return s.refundUnused(tx, paymentID, ErrAlreadyBooked)
+	}
+
+	var held int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM seat_holds
+		WHERE class_id = ? AND user_id = ? AND expires_at > ?`, classID, userID, s.now().UTC()).Scan(&held)
+	if err != nil {
+		return err
+	}
+
+	if held == 0 {
+		taken, err := s.seatsTakenByOthers(tx, classID, userID)
+		if err != nil {
+			return err
+		}
+		if taken >= class.MaxCapacity {
+			return s.refundUnused(tx, paymentID, ErrClassFull)
+		}
+	}
+
+	bookingID, err := s.confirmSeat(tx, userID, classID, paymentID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.publish(EventBookingConfirmed, class.TenantID, userID, map[string]interface{}{
+		"booking_id": bookingID,
+		"class_id":   classID,
+		"payment_id": paymentID,
+	})
+
+	return nil
+}
+
+// refundUnused ends tx and refunds a payment that could not be turned into
+// a booking, returning reason
+func (s *Service) refundUnused(tx *sql.Tx, paymentID string, reason error) error {
+	tx.Rollback()
+
+	amount, err := s.refundableAmount(paymentID)
+	if err == nil && amount > 0 {
+		if s.refunds == nil {
+			err = fmt.Errorf("no refund provider")
+		} else {
+			err = s.refunds.RefundPayment(paymentID, amount)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%v and refund failed: %w", reason, err)
+	}
+	if reason == ErrClassFull {
+		return ErrClassFullRefunded
+	}
+	return reason
+}
+
+// ExpireHolds removes holds whose payment window has passed and offers the
+// freed seats to the waitlist. It returns the number of holds removed.
+func (s *Service) ExpireHolds() (int, error) {
+	now := s.now().UTC()
+
+	rows, err := s.db.Query(`SELECT DISTINCT class_id FROM seat_holds WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	var classIDs []int
+	for rows.Next() {
+		var classID int
+		if err := rows.Scan(&classID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		classIDs = append(classIDs, classID)
+	}
+	rows.Close()
+
+	result, err := s.db.Exec(`DELETE FROM seat_holds WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire holds: %w", err)
+	}
+	expired, _ := result.RowsAffected()
+
+	for _, classID := range classIDs {
+		if err := s.PromoteNext(classID); err != nil {
+			return int(expired), err
+		}
+	}
+
+	return int(expired), nil
+}
+
+// checkSeat returns nil if the member may take a seat in class. Members who
+// are already booked or waiting without an offer are refused, as is
+// everyone once the seats not held for the member are taken.
+func (s *Service) checkSeat(q queryer, userID int, class *models.Class) error {
+	var status string
+	var offerExpiresAt sql.NullTime
+	err := q.QueryRow(`
+		SELECT status, offer_expires_at FROM bookings
+		WHERE user_id = ? AND class_id = ?`, userID, class.ID).Scan(&status, &offerExpiresAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	switch status {
+	case StatusConfirmed:
+		return ErrAlreadyBooked
+	case StatusWaitlist:
+		if !offerExpiresAt.Valid || !offerExpiresAt.Time.After(s.now()) {
+			return ErrAlreadyWaitlist
+		}
+	}
+
+	taken, err := s.seatsTakenByOthers(q, class.ID, userID)
+	if err != nil {
+		return err
+	}
+	if taken >= class.MaxCapacity {
+		return ErrClassFull
+	}
+	return nil
+}
+
+// confirmSeat turns the member's seat into a confirmed booking, reusing a
+// cancelled or waitlist booking row, and clears their hold
+func (s *Service) confirmSeat(q queryer, userID, classID int, paymentID string) (int, error) {
+	var payment interface{}
+	if paymentID != "" {
+		payment = paymentID
+	}
+
+	now := s.now()
+	_, err := q.Exec(`
+		INSERT INTO bookings (user_id, class_id, status, payment_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, class_id) DO UPDATE SET
+			status = excluded.status, payment_id = excluded.payment_id, klippekort_id = NULL, ticket_id = NULL,
+			offer_expires_at = NULL, cancelled_at = NULL, late_cancellation = false, updated_at = excluded.updated_at`,
+		userID, classID, StatusConfirmed, payment, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to confirm booking: %w", err)
+	}
+
+	if _, err := q.Exec(`DELETE FROM seat_holds WHERE class_id = ? AND user_id = ?`, classID, userID); err != nil {
+		return 0, fmt.Errorf("failed to clear hold: %w", err)
+	}
+
+	var bookingID int
+	err = q.QueryRow(`SELECT id FROM bookings WHERE user_id = ? AND class_id = ?`, userID, classID).Scan(&bookingID)
+	return bookingID, err
+}
@@ -0,0 +1,225 @@
+package booking
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/database"
+	"samskipnad/internal/klippekort"
+)
+
+func TestBook(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 1, 0)
+	first := env.createUser(t, 1)
+
+	booking, err := env.service.Book(first, classID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusConfirmed, booking.Status)
+
+	_, err = env.service.Book(first, classID)
+	assert.ErrorIs(t, err, ErrAlreadyBooked)
+
+	_, err = env.service.Book(env.createUser(t, 2), classID)
+	assert.ErrorIs(t, err, ErrClassFull)
+
+	t.Run("PaidClassNeedsHold", func(t *testing.T) {
+		paid := env.createClass(t, 5, 15000)
+		_, err := env.service.Book(first, paid)
+		assert.ErrorIs(t, err, ErrPaymentRequired)
+	})
+
+	t.Run("RebookAfterCancel", func(t *testing.T) {
+		_, err := env.service.Cancel(booking.ID)
+		require.NoError(t, err)
+
+		rebooked, err := env.service.Book(first, classID)
+		require.NoError(t, err)
+		assert.Equal(t, booking.ID, rebooked.ID, "the booking row is reused")
+		assert.Nil(t, rebooked.CancelledAt)
+	})
+}
+
+func TestBookWithKlipp(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 1, 15000)
+	_, err := env.db.Exec(`UPDATE classes SET category_id = 'yoga' WHERE id = ?`, classID)
+	require.NoError(t, err)
+
+	first := env.createUser(t, 1)
+	second := env.createUser(t, 2)
+
+	_, err = env.service.BookWithKlipp(first, classID)
+	assert.ErrorIs(t, err, klippekort.ErrNoKlipp)
+
+	firstCard := env.buyKlipp(t, first)
+	secondCard := env.buyKlipp(t, second)
+
+	booking, err := env.service.BookWithKlipp(first, classID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusConfirmed, booking.Status)
+	require.NotNil(t, booking.KlippekortID)
+	assert.Equal(t, firstCard, *booking.KlippekortID)
+	assert.Equal(t, 8, env.klippLeft(t, firstCard))
+	assert.Equal(t, 1, env.ledgerEntries(t, booking.ID, klippekort.KindUse))
+
+	_, err = env.service.BookWithKlipp(second, classID)
+	assert.ErrorIs(t, err, ErrClassFull)
+	assert.Equal(t, 9, env.klippLeft(t, secondCard), "no klipp is taken for a seat the member did not get")
+
+	t.Run("CancelReturnsKlipp", func(t *testing.T) {
+		terms, err := env.service.Cancel(booking.ID)
+		require.NoError(t, err)
+		assert.True(t, terms.ReturnsKlipp)
+		assert.Equal(t, 9, env.klippLeft(t, firstCard))
+		assert.Equal(t, 1, env.ledgerEntries(t, booking.ID, klippekort.KindRefund))
+	})
+
+	t.Run("ClassWithoutCategory", func(t *testing.T) {
+		_, err := env.service.BookWithKlipp(first, env.createClass(t, 5, 15000))
+		assert.ErrorIs(t, err, ErrNotKlippClass)
+	})
+}
+
+func TestHoldSeat(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 1, 15000)
+	first := env.createUser(t, 1)
+	second := env.createUser(t, 2)
+
+	hold, err := env.service.HoldSeat(first, classID)
+	require.NoError(t, err)
+	require.NoError(t, env.service.AttachPayment(hold.ID, "pi_first"))
+	assert.Equal(t, env.now.Add(DefaultPaymentHold), hold.ExpiresAt)
+
+	taken, err := env.service.SeatsTaken(classID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, taken)
+
+	_, err = env.service.HoldSeat(second, classID)
+	assert.ErrorIs(t, err, ErrClassFull)
+
+	t.Run("HeldSeatIsHonoured", func(t *testing.T) {
+		require.NoError(t, env.service.ConfirmPaid(first, classID, "pi_first"))
+		require.NoError(t, env.service.ConfirmPaid(first, classID, "pi_first"), "confirming twice is a no-op")
+
+		assert.Equal(t, StatusConfirmed, env.status(t, first, classID))
+
+		taken, err := env.service.SeatsTaken(classID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, taken, "the hold is replaced by the booking")
+	})
+}
+
+func TestConfirmPaidAfterHoldExpired(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 1, 15000)
+	first := env.createUser(t, 1)
+	second := env.createUser(t, 2)
+
+	_, err := env.service.HoldSeat(first, classID)
+	require.NoError(t, err)
+
+	env.now = env.now.Add(DefaultPaymentHold + time.Minute)
+	expired, err := env.service.ExpireHolds()
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+
+	_, err = env.service.HoldSeat(second, classID)
+	require.NoError(t, err)
+
+	_, err = env.db.Exec(`
+		INSERT INTO payments (id, user_id, tenant_id, amount, status, payment_type, reference_id)
+		VALUES ('pi_late', ?, 1, 15000, 'succeeded', 'class', ?)`, first, classID)
+	require.NoError(t, err)
+
+	err = env.service.ConfirmPaid(first, classID, "pi_late")
+
+	assert.ErrorIs(t, err, ErrClassFullRefunded)
+	assert.ErrorIs(t, err, ErrClassFull)
+	assert.Equal(t, 15000, env.refunds.refunds["pi_late"], "the payment for a lost seat is refunded")
+
+	env.refunds.err = errors.New("card expired")
+	_, err = env.db.Exec(`
+		INSERT INTO payments (id, user_id, tenant_id, amount, status, payment_type, reference_id)
+		VALUES ('pi_later', ?, 1, 15000, 'succeeded', 'class', ?)`, first, classID)
+	require.NoError(t, err)
+
+	err = env.service.ConfirmPaid(first, classID, "pi_later")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrClassFullRefunded, "the refund failed")
+}
+
+func TestConcurrentBooking(t *testing.T) {
+	const (
+		capacity = 5
+		members  = 200
+	)
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "booking.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(t, database.Migrate(db))
+
+	service, err := NewService(db, nil, nil)
+	require.NoError(t, err)
+	service.community = func() *config.Community { return &config.Community{} }
+
+	start := time.Now().Add(24 * time.Hour).UTC()
+	result, err := db.Exec(`
+		INSERT INTO classes (tenant_id, name, instructor_id, start_time, end_time, max_capacity, price)
+		VALUES (1, 'Open Mat', 1, ?, ?, ?, 0)`, start, start.Add(time.Hour), capacity)
+	require.NoError(t, err)
+	classID64, err := result.LastInsertId()
+	require.NoError(t, err)
+	classID := int(classID64)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	userIDs := make([]int, members)
+	for i := range userIDs {
+		result, err := tx.Exec(`
+			INSERT INTO users (email, password_hash, first_name, last_name, tenant_id)
+			VALUES (?, 'x', 'Member', ?, 1)`, fmt.Sprintf("member%d@example.com", i), fmt.Sprint(i))
+		require.NoError(t, err)
+		id, err := result.LastInsertId()
+		require.NoError(t, err)
+		userIDs[i] = int(id)
+	}
+	require.NoError(t, tx.Commit())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, members)
+	for _, userID := range userIDs {
+		wg.Add(1)
+		go func(userID int) {
+			defer wg.Done()
+			_, err := service.Book(userID, classID)
+			errs <- err
+		}(userID)
+	}
+	wg.Wait()
+	close(errs)
+
+	booked := 0
+	for err := range errs {
+		if err == nil {
+			booked++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrClassFull)
+	}
+	assert.Equal(t, capacity, booked)
+
+	var confirmed int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM bookings WHERE class_id = ? AND status = 'confirmed'`, classID).Scan(&confirmed))
+	assert.Equal(t, capacity, confirmed)
+}
@@ -0,0 +1,224 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/models"
+	"samskipnad/internal/services"
+)
+
+// Booking statuses
+const (
+	StatusConfirmed = "confirmed"
+	StatusCancelled = "cancelled"
+	StatusWaitlist  = "waitlist"
+)
+
+// Event types published by the booking service
+const (
+	EventBookingConfirmed = "booking.confirmed"
+	EventBookingCancelled = "booking.cancelled"
+	EventBookingNoShow    = "booking.no_show"
+	EventBookingCheckedIn = "booking.checked_in"
+	EventWaitlistJoined   = "booking.waitlist_joined"
+	EventWaitlistOffered  = "booking.waitlist_offered"
+	EventWaitlistPromoted = "booking.waitlist_promoted"
+	EventWaitlistExpired  = "booking.waitlist_offer_expired"
+	EventClassUpdated     = "class.updated"
+	EventClassCancelled   = "class.cancelled"
+)
+
+var (
+	ErrClassNotFound    = errors.New("class not found")
+	ErrBookingNotFound  = errors.New("booking not found")
+	ErrAlreadyBooked    = errors.New("already booked")
+	ErrClassFull        = errors.New("class is full")
+	ErrPaymentRequired  = errors.New("class requires payment")
+	ErrAlreadyWaitlist  = errors.New("already on the waitlist")
+	ErrClassNotFull     = errors.New("class still has free seats")
+	ErrWaitlistDisabled = errors.New("waitlist is not enabled")
+	ErrNotOnWaitlist    = errors.New("not on the waitlist")
+	ErrNotKlippClass    = errors.New("class cannot be booked with klipp")
+
+	// ErrClassFullRefunded is ErrClassFull once the payment for the lost
+	// seat has been refunded
+	ErrClassFullRefunded = fmt.Errorf("%w and the payment was refunded", ErrClassFull)
+
+	ErrMembershipRequired = errors.New("class is for members only")
+	ErrNotIncluded        = errors.New("class is not included in the membership")
+	ErrTicketRequired     = errors.New("class requires a ticket")
+	ErrNoTicket           = errors.New("no tickets left")
+
+	ErrInvalidClassTime      = errors.New("end time must be after start time")
+	ErrCapacityBelowBookings = errors.New("capacity cannot be lower than the number of confirmed bookings")
+
+	ErrCancellationClosed  = errors.New("class has already started")
+	ErrClassNotStarted     = errors.New("class has not started yet")
+	ErrBookingNotConfirmed = errors.New("booking is not confirmed")
+
+	ErrInvalidCheckIn = errors.New("check-in code is not valid")
+	ErrWrongClass     = errors.New("booking is for another class")
+	ErrCheckInNotOpen = errors.New("check-in has not opened yet")
+	ErrCheckedIn      = errors.New("member has checked in")
+	ErrMarkedNoShow   = errors.New("booking is marked as a no-show")
+)
+
+// Refunder returns money paid for a booking. payments.Service implements it.
+type Refunder interface {
+	RefundPayment(paymentID string, amount int) error
+}
+
+// InstructorAssigner assigns classes' instructors. instructors.Service
+// implements it.
+type InstructorAssigner interface {
+	// AssignTx assigns the instructor within tx and returns a function
+	// notifying the instructors, to call once tx is committed
+	AssignTx(tx *sql.Tx, classID, instructorID int) (func(), error)
+}
+
+// Service handles class bookings and waitlists
+type Service struct {
+	db          *sql.DB
+	events      services.EventBusService
+	refunds     Refunder
+	instructors InstructorAssigner
+	community   func() *config.Community
+	now         func() time.Time
+
+	paymentHold time.Duration
+	checkInKey  []byte // Signs the check-in QR codes of bookings
+}
+
+// NewService returns the booking service. It fails without a check-in
+// key, as the server cannot run without one; see checkInKeyFromEnv.
+func NewService(db *sql.DB, events services.EventBusService, refunds Refunder) (*Service, error) {
+	checkInKey, err := checkInKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Service{
+		db:        db,
+		events:    events,
+		refunds:   refunds,
+		community: config.GetCurrent,
+		now:       time.Now,
+
+		paymentHold: DefaultPaymentHold,
+		checkInKey:  checkInKey,
+	}, nil
+}
+
+// SetInstructorAssigner sets how UpdateClass assigns a new instructor, so
+// substitute requests are filled and the instructors notified. Without
+// one, the instructor is only saved with the class.
+func (s *Service) SetInstructorAssigner(instructors InstructorAssigner) {
+	s.instructors = instructors
+}
+
+// GetBooking returns a booking by ID
+func (s *Service) GetBooking(bookingID int) (*models.Booking, error) {
+	var b models.Booking
+	var paymentID sql.NullString
+	var klippekortID, ticketID sql.NullInt64
+	var cancelledAt, checkedInAt sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT id, user_id, class_id, status, payment_id, klippekort_id, ticket_id, cancelled_at, checked_in_at,
+			COALESCE(late_cancellation, false), COALESCE(no_show, false), created_at, updated_at
+		FROM bookings WHERE id = ?`, bookingID).Scan(
+		&b.ID, &b.UserID, &b.ClassID, &b.Status, &paymentID, &klippekortID, &ticketID, &cancelledAt, &checkedInAt,
+		&b.LateCancellation, &b.NoShow, &b.CreatedAt, &b.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrBookingNotFound
+		}
+		return nil, err
+	}
+	b.PaymentID = paymentID.String
+	if klippekortID.Valid {
+		id := int(klippekortID.Int64)
+		b.KlippekortID = &id
+	}
+	if ticketID.Valid {
+		id := int(ticketID.Int64)
+		b.TicketID = &id
+	}
+	if cancelledAt.Valid {
+		b.CancelledAt = &cancelledAt.Time
+	}
+	if checkedInAt.Valid {
+		b.CheckedInAt = &checkedInAt.Time
+	}
+	return &b, nil
+}
+
+// SeatsTaken returns the number of seats occupied by confirmed bookings,
+// unexpired waitlist offers and unexpired payment holds
+func (s *Service) SeatsTaken(classID int) (int, error) {
+	return s.seatsTaken(s.db, classID)
+}
+
+// Helper methods
+
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *Service) seatsTaken(q queryer, classID int) (int, error) {
+	return s.seatsTakenByOthers(q, classID, 0)
+}
+
+// seatsTakenByOthers counts the seats occupied by members other than
+// userID. A member holding both a waitlist offer and a payment hold
+// occupies a single seat.
+func (s *Service) seatsTakenByOthers(q queryer, classID, userID int) (int, error) {
+	now := s.now().UTC()
+	var taken int
+	err := q.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM bookings
+			 WHERE class_id = ? AND user_id != ?
+				AND (status = 'confirmed' OR (status = 'waitlist' AND offer_expires_at > ?)))
+			+
+			(SELECT COUNT(*) FROM seat_holds h
+			 WHERE h.class_id = ? AND h.user_id != ? AND h.expires_at > ?
+				AND NOT EXISTS (
+					SELECT 1 FROM bookings b
+					WHERE b.class_id = h.class_id AND b.user_id = h.user_id
+						AND (b.status = 'confirmed' OR (b.status = 'waitlist' AND b.offer_expires_at > ?))))`,
+		classID, userID, now, classID, userID, now, now).Scan(&taken)
+	return taken, err
+}
+
+func (s *Service) getClass(q queryer, classID int) (*models.Class, error) {
+	var class models.Class
+	err := q.QueryRow(`
+		SELECT id, tenant_id, name, instructor_id, start_time, end_time, max_capacity, price, active,
+			COALESCE(category_id, ''), COALESCE(requires_ticket, false), COALESCE(requires_membership, false)
+		FROM classes WHERE id = ?`, classID).Scan(
+		&class.ID, &class.TenantID, &class.Name, &class.InstructorID, &class.StartTime, &class.EndTime,
+		&class.MaxCapacity, &class.Price, &class.Active, &class.CategoryID,
+		&class.RequiresTicket, &class.RequiresMembership)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrClassNotFound
+		}
+		return nil, err
+	}
+	return &class, nil
+}
+
+// publish dispatches an event from the booking service; see services.Publish
+func (s *Service) publish(eventType string, tenantID, userID int, data map[string]interface{}) {
+	services.Publish(s.events, "booking", eventType, tenantID, userID, data)
+}
+
+func (s *Service) notify(userID int, notification *services.Notification) {
+	services.Notify(s.events, userID, notification)
+}
@@ -0,0 +1,321 @@
+package booking
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"samskipnad/internal/services"
+)
+
+// WaitlistEntry describes a member's place on a class waitlist
+type WaitlistEntry struct {
+	BookingID      int
+	ClassID        int
+	UserID         int
+	Position       int        // 1-based; 0 while holding an offer
+	OfferExpiresAt *time.Time // Set when a seat is held for the member
+}
+
+// HasOffer reports whether a seat is currently held for the member
+func (e *WaitlistEntry) HasOffer(now time.Time) bool {
+	return e.OfferExpiresAt != nil && e.OfferExpiresAt.After(now)
+}
+
+// JoinWaitlist adds a member to the waitlist of a full class and returns
+// their position
+func (s *Service) JoinWaitlist(userID, classID int) (*WaitlistEntry, error) {
+	if !s.community().Booking.Waitlist.Enabled {
+		return nil, ErrWaitlistDisabled
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if !class.Active {
+		return nil, ErrClassNotFound
+	}
+	if err := s.checkMembership(tx, userID, class); err != nil {
+		return nil, err
+	}
+
+	var existingID int
+	var status string
+	err = tx.QueryRow(`SELECT id, status FROM bookings WHERE user_id = ? AND class_id = ?`, userID, classID).Scan(&existingID, &status)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	switch status {
+	case StatusConfirmed:
+		return nil, ErrAlreadyBooked
+	case StatusWaitlist:
+		return nil, ErrAlreadyWaitlist
+	}
+
+	taken, err := s.seatsTaken(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if taken < class.MaxCapacity {
+		return nil, ErrClassNotFull
+	}
+
+	now := s.now()
+	if existingID != 0 {
+		// Rejoining after a cancellation reuses the booking row
+		_, err = tx.Exec(`
+			UPDATE bookings SET status = ?, waitlisted_at = ?, offer_expires_at = NULL, updated_at = ?
+			WHERE id = ?`, StatusWaitlist, now.UTC(), now, existingID)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO bookings (user_id, class_id, status, waitlisted_at, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)`, userID, classID, StatusWaitlist, now.UTC(), now, now)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to join waitlist: %w", err)
+	}
+
+	entry, err := s.waitlistEntry(tx, userID, classID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.publish(EventWaitlistJoined, class.TenantID, userID, map[string]interface{}{
+		"class_id": classID,
+		"position": entry.Position,
+	})
+
+	return entry, nil
+}
+
+// WaitlistEntry returns the member's current waitlist entry for a class
+func (s *Service) WaitlistEntry(userID, classID int) (*WaitlistEntry, error) {
+	return s.waitlistEntry(s.db, userID, classID)
+}
+
+// LeaveWaitlist removes a member from a class waitlist. A held seat is
+// released to the next member in line.
+func (s *Service) LeaveWaitlist(userID, classID int) error {
+	entry, err := s.WaitlistEntry(userID, classID)
+	if err != nil {
+		return err
+	}
+	_, err = s.Cancel(entry.BookingID)
+	return err
+}
+
+// PromoteNext fills free seats of a class from its waitlist in order. Free
+// classes are confirmed immediately; for paid classes, and free classes
+// that require a ticket, the seat is held for the community's claim window
+// so the member can pay for it.
+func (s *Service) PromoteNext(classID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	class, err := s.getClass(tx, classID)
+	if err != nil {
+		return err
+	}
+	if !class.Active || !class.StartTime.After(s.now()) {
+		return nil
+	}
+
+	taken, err := s.seatsTaken(tx, classID)
+	if err != nil {
+		return err
+	}
+	free := class.MaxCapacity - taken
+	if free <= 0 {
+		return nil
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, user_id FROM bookings
+		WHERE class_id = ? AND status = 'waitlist' AND offer_expires_at IS NULL
+		ORDER BY waitlisted_at ASC, id ASC
+		LIMIT ?`, classID, free)
+	if err != nil {
+		return err
+	}
+
+	type candidate struct {
+		bookingID int
+		userID    int
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.bookingID, &c.userID); err != nil {
+			rows.Close()
+			return err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+
+	now := s.now()
+	expires := now.Add(s.community().WaitlistClaimWindow())
+	confirm := class.Price == 0 && !class.RequiresTicket
+
+	for _, c := range candidates {
+		if confirm {
+			_, err = tx.Exec(`
+				UPDATE bookings SET status = ?, offer_expires_at = NULL, updated_at = ?
+				WHERE id = ?`, StatusConfirmed, now, c.bookingID)
+		} else {
+			_, err = tx.Exec(`
+				UPDATE bookings SET offer_expires_at = ?, updated_at = ?
+				WHERE id = ?`, expires.UTC(), now, c.bookingID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to promote booking %d: %w", c.bookingID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		data := map[string]interface{}{
+			"booking_id": c.bookingID,
+			"class_id":   classID,
+		}
+
+		if confirm {
+			s.publish(EventWaitlistPromoted, class.TenantID, c.userID, data)
+			s.notify(c.userID, &services.Notification{
+				Type:     EventWaitlistPromoted,
+				Title:    "You're in: " + class.Name,
+				Message:  fmt.Sprintf("A spot opened up and you are now booked for %s on %s.", class.Name, s.community().LocalTime(class.StartTime).Format("Mon Jan 2 15:04")),
+				Data:     data,
+				Priority: 1,
+			})
+			continue
+		}
+
+		data["offer_expires_at"] = expires
+		s.publish(EventWaitlistOffered, class.TenantID, c.userID, data)
+		s.notify(c.userID, &services.Notification{
+			Type:     EventWaitlistOffered,
+			Title:    "A spot opened up: " + class.Name,
+			Message:  fmt.Sprintf("A spot in %s on %s is held for you until %s. Complete your booking to claim it.", class.Name, s.community().LocalTime(class.StartTime).Format("Mon Jan 2 15:04"), s.community().LocalTime(expires).Format("15:04")),
+			Data:     data,
+			Priority: 2,
+		})
+	}
+
+	return nil
+}
+
+// ExpireOffers releases held seats whose claim window has passed and offers
+// them to the next members on the waitlist. It returns the number of offers
+// that expired.
+func (s *Service) ExpireOffers() (int, error) {
+	now := s.now()
+
+	rows, err := s.db.Query(`
+		SELECT b.id, b.user_id, b.class_id, c.tenant_id, c.name
+		FROM bookings b JOIN classes c ON c.id = b.class_id
+		WHERE b.status = 'waitlist' AND b.offer_expires_at <= ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	type expired struct {
+		bookingID int
+		userID    int
+		classID   int
+		tenantID  int
+		className string
+	}
+	var offers []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.bookingID, &e.userID, &e.classID, &e.tenantID, &e.className); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		offers = append(offers, e)
+	}
+	rows.Close()
+
+	classes := make(map[int]bool)
+	for _, e := range offers {
+		_, err := s.db.Exec(`
+			UPDATE bookings SET status = ?, offer_expires_at = NULL, updated_at = ?
+			WHERE id = ? AND status = 'waitlist'`, StatusCancelled, now, e.bookingID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to expire offer %d: %w", e.bookingID, err)
+		}
+		classes[e.classID] = true
+
+		data := map[string]interface{}{
+			"booking_id": e.bookingID,
+			"class_id":   e.classID,
+		}
+		s.publish(EventWaitlistExpired, e.tenantID, e.userID, data)
+		s.notify(e.userID, &services.Notification{
+			Type:    EventWaitlistExpired,
+			Title:   "Waitlist spot released: " + e.className,
+			Message: fmt.Sprintf("The spot held for you in %s was not claimed in time and has been offered to the next member.", e.className),
+			Data:    data,
+		})
+	}
+
+	for classID := range classes {
+		if err := s.PromoteNext(classID); err != nil {
+			return len(offers), err
+		}
+	}
+
+	return len(offers), nil
+}
+
+func (s *Service) waitlistEntry(q queryer, userID, classID int) (*WaitlistEntry, error) {
+	entry := &WaitlistEntry{UserID: userID, ClassID: classID}
+	var waitlistedAt time.Time
+	var offerExpiresAt sql.NullTime
+	err := q.QueryRow(`
+		SELECT id, waitlisted_at, offer_expires_at FROM bookings
+		WHERE user_id = ? AND class_id = ? AND status = 'waitlist'`, userID, classID).Scan(
+		&entry.BookingID, &waitlistedAt, &offerExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotOnWaitlist
+		}
+		return nil, err
+	}
+
+	if offerExpiresAt.Valid {
+		entry.OfferExpiresAt = &offerExpiresAt.Time
+		return entry, nil
+	}
+
+	var ahead int
+	err = q.QueryRow(`
+		SELECT COUNT(*) FROM bookings
+		WHERE class_id = ? AND status = 'waitlist' AND offer_expires_at IS NULL
+			AND (waitlisted_at < ? OR (waitlisted_at = ? AND id < ?))`,
+		classID, waitlistedAt, waitlistedAt, entry.BookingID).Scan(&ahead)
+	if err != nil {
+		return nil, err
+	}
+	entry.Position = ahead + 1
+
+	return entry, nil
+}
@@ -0,0 +1,245 @@
+package booking
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/database"
+	"samskipnad/internal/services"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("CHECKIN_SECRET", "test secret")
+	os.Exit(m.Run())
+}
+
+// setupTestDB creates a migrated in-memory SQLite database for testing
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// recordingBus captures published events and notifications
+type recordingBus struct {
+	services.EventBusService
+	events        []*services.Event
+	notifications map[int][]*services.Notification
+}
+
+func (b *recordingBus) Publish(ctx context.Context, event *services.Event) error {
+	b.events = append(b.events, event)
+	return nil
+}
+
+func (b *recordingBus) SendNotification(ctx context.Context, userID int, notification *services.Notification) error {
+	b.notifications[userID] = append(b.notifications[userID], notification)
+	return nil
+}
+
+func (b *recordingBus) published(eventType string, userID int) []*services.Event {
+	var events []*services.Event
+	for _, e := range b.events {
+		if e.Type == eventType && e.UserID == userID {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// fakeRefunder records refunds instead of calling Stripe
+type fakeRefunder struct {
+	mu      sync.Mutex
+	refunds map[string]int
+	err     error
+}
+
+func (f *fakeRefunder) RefundPayment(paymentID string, amount int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.refunds[paymentID] += amount
+	return nil
+}
+
+type testEnv struct {
+	db        *sql.DB
+	service   *Service
+	events    *recordingBus
+	refunds   *fakeRefunder
+	community *config.Community
+	now       time.Time
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := setupTestDB(t)
+	env := &testEnv{
+		db:        db,
+		events:    &recordingBus{notifications: make(map[int][]*services.Notification)},
+		refunds:   &fakeRefunder{refunds: make(map[string]int)},
+		community: &config.Community{},
+		now:       time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC),
+	}
+	env.community.Booking.Waitlist.Enabled = true
+	env.community.Booking.Waitlist.ClaimWindowMinutes = 60
+
+	service, err := NewService(db, env.events, env.refunds)
+	require.NoError(t, err)
+	env.service = service
+	env.service.community = func() *config.Community { return env.community }
+	env.service.now = func() time.Time { return env.now }
+	return env
+}
+
+func (env *testEnv) createUser(t *testing.T, n int) int {
+	result, err := env.db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, tenant_id)
+		VALUES (?, 'x', 'Member', ?, 1)`, fmt.Sprintf("member%d@example.com", n), fmt.Sprint(n))
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func (env *testEnv) createClass(t *testing.T, capacity, price int) int {
+	start := env.now.Add(48 * time.Hour)
+	result, err := env.db.Exec(`
+		INSERT INTO classes (tenant_id, name, instructor_id, start_time, end_time, max_capacity, price)
+		VALUES (1, 'Vinyasa', 1, ?, ?, ?, ?)`, start.UTC(), start.Add(time.Hour).UTC(), capacity, price)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func (env *testEnv) confirm(t *testing.T, userID, classID int) int {
+	result, err := env.db.Exec(`INSERT INTO bookings (user_id, class_id, status) VALUES (?, ?, 'confirmed')`, userID, classID)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func (env *testEnv) status(t *testing.T, userID, classID int) string {
+	var status string
+	err := env.db.QueryRow(`SELECT status FROM bookings WHERE user_id = ? AND class_id = ?`, userID, classID).Scan(&status)
+	require.NoError(t, err)
+	return status
+}
+
+func TestJoinWaitlist(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 1, 0)
+	env.confirm(t, env.createUser(t, 1), classID)
+
+	second := env.createUser(t, 2)
+	third := env.createUser(t, 3)
+
+	entry, err := env.service.JoinWaitlist(second, classID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, entry.Position)
+
+	entry, err = env.service.JoinWaitlist(third, classID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, entry.Position)
+
+	_, err = env.service.JoinWaitlist(third, classID)
+	assert.ErrorIs(t, err, ErrAlreadyWaitlist)
+
+	t.Run("RejectedWhenSeatsAvailable", func(t *testing.T) {
+		open := env.createClass(t, 5, 0)
+		_, err := env.service.JoinWaitlist(second, open)
+		assert.ErrorIs(t, err, ErrClassNotFull)
+	})
+
+	t.Run("RejectedWhenDisabled", func(t *testing.T) {
+		env.community.Booking.Waitlist.Enabled = false
+		defer func() { env.community.Booking.Waitlist.Enabled = true }()
+
+		_, err := env.service.JoinWaitlist(env.createUser(t, 4), classID)
+		assert.ErrorIs(t, err, ErrWaitlistDisabled)
+	})
+}
+
+func TestPromotionOnCancelFreeClass(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 1, 0)
+	first := env.createUser(t, 1)
+	bookingID := env.confirm(t, first, classID)
+
+	second := env.createUser(t, 2)
+	third := env.createUser(t, 3)
+	_, err := env.service.JoinWaitlist(second, classID)
+	require.NoError(t, err)
+	_, err = env.service.JoinWaitlist(third, classID)
+	require.NoError(t, err)
+
+	_, err = env.service.Cancel(bookingID)
+	require.NoError(t, err)
+
+	assert.Equal(t, StatusCancelled, env.status(t, first, classID))
+	assert.Equal(t, StatusConfirmed, env.status(t, second, classID))
+
+	entry, err := env.service.WaitlistEntry(third, classID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, entry.Position)
+
+	assert.Len(t, env.events.published(EventWaitlistPromoted, second), 1)
+	assert.Len(t, env.events.notifications[second], 1)
+}
+
+func TestPromotionOfferForPaidClass(t *testing.T) {
+	env := newTestEnv(t)
+	classID := env.createClass(t, 1, 15000)
+	bookingID := env.confirm(t, env.createUser(t, 1), classID)
+
+	second := env.createUser(t, 2)
+	third := env.createUser(t, 3)
+	_, err := env.service.JoinWaitlist(second, classID)
+	require.NoError(t, err)
+	_, err = env.service.JoinWaitlist(third, classID)
+	require.NoError(t, err)
+
+	_, err = env.service.Cancel(bookingID)
+	require.NoError(t, err)
+
+	// The seat is held, not confirmed, until the member pays
+	entry, err := env.service.WaitlistEntry(second, classID)
+	require.NoError(t, err)
+	require.NotNil(t, entry.OfferExpiresAt)
+	assert.True(t, entry.HasOffer(env.now))
+	assert.Equal(t, env.now.Add(time.Hour), entry.OfferExpiresAt.UTC())
+
+	taken, err := env.service.SeatsTaken(classID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, taken, "a held offer occupies the seat")
+
+	t.Run("ExpiredOfferPassesToNext", func(t *testing.T) {
+		env.now = env.now.Add(61 * time.Minute)
+
+		expired, err := env.service.ExpireOffers()
+		require.NoError(t, err)
+		assert.Equal(t, 1, expired)
+
+		assert.Equal(t, StatusCancelled, env.status(t, second, classID))
+
+		entry, err := env.service.WaitlistEntry(third, classID)
+		require.NoError(t, err)
+		assert.True(t, entry.HasOffer(env.now))
+	})
+}
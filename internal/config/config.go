@@ -2,8 +2,13 @@ package config
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"samskipnad/internal/money"
+	"strings"
+	"time"
+	_ "time/tzdata" // Community timezones must load on hosts without a zoneinfo database
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,11 +17,12 @@ import (
 type CardPackage struct {
 	Name          string `yaml:"name"`
 	Klipp         int    `yaml:"klipp"`           // Number of klipp/credits
-	Price         int    `yaml:"price"`           // Total price in cents
-	PricePerKlipp int    `yaml:"price_per_klipp"` // Price per klipp for display
+	Price         int    `yaml:"price"`           // Total price in whole units of the currency
+	PricePerKlipp int    `yaml:"price_per_klipp"` // Price per klipp for display, in whole units
 	SavePercent   int    `yaml:"save_percent"`    // Percentage savings
 	Badge         string `yaml:"badge"`           // Optional badge text (e.g., "Best Deal")
 	Description   string `yaml:"description"`     // Optional description
+	ValidDays     int    `yaml:"valid_days"`      // Days the klipp can be used after purchase, 0 for no expiry
 }
 
 // KlippekortCategory represents a category of classes with klippekort pricing
@@ -27,7 +33,47 @@ type KlippekortCategory struct {
 	Icon        string        `yaml:"icon"`
 	Color       string        `yaml:"color"`
 	Packages    []CardPackage `yaml:"packages"`
-	InfoText    string        `yaml:"info_text"` // Trust & action microcopy
+	InfoText    string        `yaml:"info_text"`   // Trust & action microcopy
+	MaxHolders  int           `yaml:"max_holders"` // Members besides the owner who may share a card, 0 disables sharing
+}
+
+// MembershipTier is a membership that includes only the classes in some
+// categories, priced on its own. The community's standard membership,
+// priced by pricing.monthly and pricing.yearly, includes every class.
+type MembershipTier struct {
+	ID          string   `yaml:"id"`
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Monthly     int      `yaml:"monthly"`    // Price of a month in whole units of the currency, 0 if not sold monthly
+	Yearly      int      `yaml:"yearly"`     // Price of a year in whole units of the currency, 0 if not sold yearly
+	Categories  []string `yaml:"categories"` // Klippekort categories whose classes the tier includes
+}
+
+// Includes reports whether the tier includes classes in the category
+func (t *MembershipTier) Includes(categoryID string) bool {
+	for _, id := range t.Categories {
+		if id == categoryID {
+			return true
+		}
+	}
+	return false
+}
+
+// CancellationPolicy describes what members get back when they cancel a
+// booking or do not turn up
+type CancellationPolicy struct {
+	FreeUntilHours    int  `yaml:"free_until_hours"`    // Full refund when cancelling at least this many hours before start
+	LateFeePercent    int  `yaml:"late_fee_percent"`    // Share of the paid price kept on a late cancellation
+	LateForfeitsKlipp bool `yaml:"late_forfeits_klipp"` // Late cancellations do not return the klipp
+	NoShowFee         int  `yaml:"no_show_fee"`         // Fee in whole units of the currency charged when a member does not turn up
+}
+
+// SubscriptionPolicy describes how membership subscriptions are renewed
+// when the saved card is declined
+type SubscriptionPolicy struct {
+	RetryDays    []int `yaml:"retry_days"`     // Days after the renewal date to try a declined renewal again
+	GraceDays    int   `yaml:"grace_days"`     // Members keep access this many days after a declined renewal
+	MaxPauseDays int   `yaml:"max_pause_days"` // Longest a member can pause their membership, 0 to not allow pausing
 }
 
 // Community represents the configuration for a community
@@ -61,6 +107,7 @@ type Community struct {
 		Community   bool `yaml:"community"`
 		Payments    bool `yaml:"payments"`
 		Calendar    bool `yaml:"calendar"`
+		Resources   bool `yaml:"resources"` // Rooms and equipment members can reserve
 	} `yaml:"features"`
 
 	Content struct {
@@ -84,10 +131,48 @@ type Community struct {
 
 		// Klippekort pricing by category
 		Klippekort struct {
-			Categories []KlippekortCategory `yaml:"categories"`
+			Categories         []KlippekortCategory `yaml:"categories"`
+			ExpiryReminderDays int                  `yaml:"expiry_reminder_days"` // Remind members this many days before a card expires, 0 to disable
 		} `yaml:"klippekort"`
+
+		Subscriptions SubscriptionPolicy `yaml:"subscriptions"`
+
+		// Memberships that include only some class categories, sold
+		// besides the standard membership
+		MembershipTiers []MembershipTier `yaml:"membership_tiers"`
 	} `yaml:"pricing"`
 
+	// Payments selects how members pay. API secrets are read from the
+	// environment, not the config.
+	Payments struct {
+		Provider string `yaml:"provider"` // stripe (default) or vipps
+		Vipps    struct {
+			BaseURL              string `yaml:"base_url"` // https://apitest.vipps.no for the test environment, production if empty
+			MerchantSerialNumber string `yaml:"merchant_serial_number"`
+			ReturnURL            string `yaml:"return_url"` // The community's /payment/success page
+		} `yaml:"vipps"`
+	} `yaml:"payments"`
+
+	// Invoicing holds the business details printed on receipts. Norwegian
+	// businesses must show their organisation number, and those registered
+	// for VAT (MVA) the VAT included in each payment.
+	Invoicing struct {
+		CompanyName        string         `yaml:"company_name"` // Legal name; the community's name if empty
+		OrganisationNumber string         `yaml:"organisation_number"`
+		VATRegistered      bool           `yaml:"vat_registered"`
+		Address            string         `yaml:"address"`
+		Email              string         `yaml:"email"`
+		VATRates           map[string]int `yaml:"vat_rates"` // Percent by product type (class, membership, klippekort), or "default"
+	} `yaml:"invoicing"`
+
+	Booking struct {
+		Waitlist struct {
+			Enabled            bool `yaml:"enabled"`
+			ClaimWindowMinutes int  `yaml:"claim_window_minutes"` // How long a promoted member has to claim a paid seat
+		} `yaml:"waitlist"`
+		Cancellation CancellationPolicy `yaml:"cancellation"`
+	} `yaml:"booking"`
+
 	Locale struct {
 		Language string `yaml:"language"`
 		Country  string `yaml:"country"`
@@ -109,6 +194,12 @@ type Community struct {
 
 var currentCommunity *Community
 
+// DefaultWaitlistClaimWindow is used when booking.waitlist.claim_window_minutes is not set
+const DefaultWaitlistClaimWindow = 2 * time.Hour
+
+// DefaultRenewalRetryDays are used when pricing.subscriptions.retry_days is not set
+var DefaultRenewalRetryDays = []int{1, 3, 5}
+
 // Load loads the community configuration from a YAML file
 func Load(communityName string) (*Community, error) {
 	if communityName == "" {
@@ -131,6 +222,13 @@ func Load(communityName string) (*Community, error) {
 	return &community, nil
 }
 
+// Development reports whether the server runs for local development, as
+// set with APP_ENV=development. Only then are missing secrets replaced
+// with throwaway ones.
+func Development() bool {
+	return strings.EqualFold(os.Getenv("APP_ENV"), "development")
+}
+
 // GetCurrent returns the currently loaded community configuration
 func GetCurrent() *Community {
 	if currentCommunity == nil {
@@ -144,9 +242,43 @@ func GetCurrent() *Community {
 	return currentCommunity
 }
 
-// FormatPrice formats a price with the community's currency
+// Currency returns the ISO 4217 code of the community's currency, USD
+// when none is configured
+func (c *Community) Currency() string {
+	if c.Pricing.Currency == "" {
+		return "USD"
+	}
+	return strings.ToUpper(c.Pricing.Currency)
+}
+
+// Price returns a price from the pricing section, which is written in
+// whole units of the currency, such as kroner
+func (c *Community) Price(amount int) money.Money {
+	return money.FromMajor(int64(amount), c.Currency())
+}
+
+// Amount returns an amount in the currency's minor unit, such as øre, as
+// class prices, fees and payments are stored
+func (c *Community) Amount(amount int) money.Money {
+	return money.New(int64(amount), c.Currency())
+}
+
+// FormatPrice formats a price from the pricing section for the
+// community's locale
 func (c *Community) FormatPrice(amount int) string {
-	return fmt.Sprintf("%d %s", amount, c.Pricing.Currency)
+	return c.Format(c.Price(amount))
+}
+
+// FormatAmount formats an amount in the currency's minor unit for the
+// community's locale
+func (c *Community) FormatAmount(amount int) string {
+	return c.Format(c.Amount(amount))
+}
+
+// Format formats an amount in any currency, such as that of an older
+// payment, for the community's locale
+func (c *Community) Format(m money.Money) string {
+	return m.Format(c.Locale.Language, c.Locale.Country)
 }
 
 // CalculateSavings calculates the savings for a card package
@@ -185,3 +317,120 @@ func (c *Community) GetBestValuePackage(category KlippekortCategory) int {
 
 	return bestIndex
 }
+
+// WaitlistClaimWindow returns how long a member promoted from the waitlist has
+// to claim a seat that requires payment
+func (c *Community) WaitlistClaimWindow() time.Duration {
+	if c.Booking.Waitlist.ClaimWindowMinutes <= 0 {
+		return DefaultWaitlistClaimWindow
+	}
+	return time.Duration(c.Booking.Waitlist.ClaimWindowMinutes) * time.Minute
+}
+
+// RenewalRetryDays returns the days after a membership's renewal date on
+// which a declined renewal is tried again
+func (c *Community) RenewalRetryDays() []int {
+	if c.Pricing.Subscriptions.RetryDays == nil {
+		return DefaultRenewalRetryDays
+	}
+	return c.Pricing.Subscriptions.RetryDays
+}
+
+// CategoryName returns the name of the klippekort category with the given
+// ID, or the ID if the category is no longer in the config
+func (c *Community) CategoryName(id string) string {
+	if category, ok := c.KlippekortCategoryByID(id); ok {
+		return category.Name
+	}
+	return id
+}
+
+// MembershipTierByID returns the membership tier with the given ID
+func (c *Community) MembershipTierByID(id string) (*MembershipTier, bool) {
+	for i := range c.Pricing.MembershipTiers {
+		if c.Pricing.MembershipTiers[i].ID == id {
+			return &c.Pricing.MembershipTiers[i], true
+		}
+	}
+	return nil, false
+}
+
+// MembershipIncludes reports whether a membership of the tier includes
+// classes in the category. The standard membership, tier "", includes
+// every class; a tier no longer in the config includes none.
+func (c *Community) MembershipIncludes(tier, categoryID string) bool {
+	if tier == "" {
+		return true
+	}
+	t, ok := c.MembershipTierByID(tier)
+	return ok && t.Includes(categoryID)
+}
+
+// SellerName returns the legal name receipts are issued in
+func (c *Community) SellerName() string {
+	if c.Invoicing.CompanyName != "" {
+		return c.Invoicing.CompanyName
+	}
+	return c.Name
+}
+
+// VATRate returns the VAT percentage included in the price of a product
+// type: class, membership or klippekort. Types without a rate of their own
+// use the default rate. Businesses not registered for VAT charge none.
+func (c *Community) VATRate(productType string) int {
+	if !c.Invoicing.VATRegistered {
+		return 0
+	}
+	if rate, ok := c.Invoicing.VATRates[productType]; ok {
+		return rate
+	}
+	return c.Invoicing.VATRates["default"]
+}
+
+// Location returns the community's timezone. Class times are stored in UTC
+// and converted to and from this location when members enter or see them.
+// An empty or unknown timezone falls back to UTC.
+func (c *Community) Location() *time.Location {
+	if c.Locale.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(c.Locale.Timezone)
+	if err != nil {
+		log.Printf("Unknown timezone %q, using UTC: %v", c.Locale.Timezone, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// ParseLocalTime parses a wall-clock time entered in the community's
+// timezone, such as the value of a datetime-local input, and returns it in UTC
+func (c *Community) ParseLocalTime(layout, value string) (time.Time, error) {
+	t, err := time.ParseInLocation(layout, value, c.Location())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// LocalTime returns t in the community's timezone, for display
+func (c *Community) LocalTime(t time.Time) time.Time {
+	return t.In(c.Location())
+}
+
+// StartOfDay returns local midnight on the community's calendar day
+// containing t. Add days with AddDate rather than 24 hours so day ranges stay
+// correct across daylight saving changes.
+func (c *Community) StartOfDay(t time.Time) time.Time {
+	t = c.LocalTime(t)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// KlippekortCategoryByID returns the klippekort category with the given ID
+func (c *Community) KlippekortCategoryByID(id string) (*KlippekortCategory, bool) {
+	for i := range c.Pricing.Klippekort.Categories {
+		if c.Pricing.Klippekort.Categories[i].ID == id {
+			return &c.Pricing.Klippekort.Categories[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func osloCommunity() *Community {
+	var c Community
+	c.Locale.Timezone = "Europe/Oslo"
+	return &c
+}
+
+func TestLocation(t *testing.T) {
+	if got := osloCommunity().Location().String(); got != "Europe/Oslo" {
+		t.Errorf("Expected Europe/Oslo, got %s", got)
+	}
+
+	var unset Community
+	if got := unset.Location(); got != time.UTC {
+		t.Errorf("Expected UTC without a timezone, got %s", got)
+	}
+
+	var unknown Community
+	unknown.Locale.Timezone = "Europe/Atlantis"
+	if got := unknown.Location(); got != time.UTC {
+		t.Errorf("Expected UTC for an unknown timezone, got %s", got)
+	}
+}
+
+func TestParseLocalTime(t *testing.T) {
+	community := osloCommunity()
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Time
+	}{
+		{"Winter", "2025-01-15T18:00", time.Date(2025, 1, 15, 17, 0, 0, 0, time.UTC)},
+		{"Summer", "2025-07-15T18:00", time.Date(2025, 7, 15, 16, 0, 0, 0, time.UTC)},
+		{"BeforeSpringForward", "2025-03-30T01:30", time.Date(2025, 3, 30, 0, 30, 0, 0, time.UTC)},
+		{"AfterSpringForward", "2025-03-30T03:30", time.Date(2025, 3, 30, 1, 30, 0, 0, time.UTC)},
+		{"BeforeFallBack", "2025-10-26T01:30", time.Date(2025, 10, 25, 23, 30, 0, 0, time.UTC)},
+		{"AfterFallBack", "2025-10-26T03:30", time.Date(2025, 10, 26, 2, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := community.ParseLocalTime("2006-01-02T15:04", tt.value)
+			if err != nil {
+				t.Fatalf("Failed to parse %s: %v", tt.value, err)
+			}
+			if !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+			if local := community.LocalTime(got).Format("2006-01-02T15:04"); local != tt.value {
+				t.Errorf("Expected %s to render as %s, got %s", got, tt.value, local)
+			}
+		})
+	}
+
+	if _, err := community.ParseLocalTime("2006-01-02T15:04", "tomorrow"); err == nil {
+		t.Error("Expected an error for an invalid time")
+	}
+}
+
+func TestStartOfDay(t *testing.T) {
+	community := osloCommunity()
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		day    string
+		length time.Duration
+	}{
+		{"Ordinary", time.Date(2025, 1, 15, 12, 0, 0, 0, time.UTC), "2025-01-15", 24 * time.Hour},
+		{"LateEveningUTC", time.Date(2025, 1, 15, 23, 30, 0, 0, time.UTC), "2025-01-16", 24 * time.Hour},
+		{"SpringForward", time.Date(2025, 3, 30, 12, 0, 0, 0, time.UTC), "2025-03-30", 23 * time.Hour},
+		{"FallBack", time.Date(2025, 10, 26, 12, 0, 0, 0, time.UTC), "2025-10-26", 25 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := community.StartOfDay(tt.at)
+			if got := start.Format("2006-01-02 15:04"); got != tt.day+" 00:00" {
+				t.Errorf("Expected local midnight on %s, got %s", tt.day, got)
+			}
+			if got := start.AddDate(0, 0, 1).Sub(start); got != tt.length {
+				t.Errorf("Expected the day to last %s, got %s", tt.length, got)
+			}
+			if tt.at.Before(start) || !tt.at.Before(start.AddDate(0, 0, 1)) {
+				t.Errorf("Expected %s to fall within its local day", tt.at)
+			}
+		})
+	}
+}
+
+func TestFormatPrice(t *testing.T) {
+	c := osloCommunity()
+	c.Pricing.Currency = "nok"
+	c.Locale.Language = "nb"
+	c.Locale.Country = "NO"
+
+	if got := c.Currency(); got != "NOK" {
+		t.Errorf("Expected NOK, got %s", got)
+	}
+	if got := c.FormatPrice(1349); got != "kr 1 349,00" {
+		t.Errorf("Expected prices in kroner, got %q", got)
+	}
+	if got := c.FormatAmount(134950); got != "kr 1 349,50" {
+		t.Errorf("Expected amounts in øre, got %q", got)
+	}
+	if got := c.Price(599).Amount; got != 59900 {
+		t.Errorf("Expected 599 kroner to be 59900 øre, got %d", got)
+	}
+
+	var unset Community
+	if got := unset.FormatPrice(25); got != "$25.00" {
+		t.Errorf("Expected USD without a currency, got %q", got)
+	}
+}
+
+func TestMembershipIncludes(t *testing.T) {
+	var c Community
+	c.Pricing.MembershipTiers = []MembershipTier{
+		{ID: "weekday", Name: "Weekday", Monthly: 399, Categories: []string{"all_levels", "restorative"}},
+	}
+
+	tests := []struct {
+		tier, category string
+		want           bool
+	}{
+		{"", "hot_yoga", true},
+		{"", "", true},
+		{"weekday", "restorative", true},
+		{"weekday", "hot_yoga", false},
+		{"weekday", "", false},
+		{"retired", "all_levels", false},
+	}
+	for _, tt := range tests {
+		if got := c.MembershipIncludes(tt.tier, tt.category); got != tt.want {
+			t.Errorf("MembershipIncludes(%q, %q) = %v, want %v", tt.tier, tt.category, got, tt.want)
+		}
+	}
+}
+
+func TestVATRate(t *testing.T) {
+	var c Community
+	c.Invoicing.VATRates = map[string]int{"default": 25, "class": 12}
+
+	if got := c.VATRate("class"); got != 0 {
+		t.Errorf("VATRate(class) = %d without VAT registration, want 0", got)
+	}
+
+	c.Invoicing.VATRegistered = true
+	tests := []struct {
+		productType string
+		want        int
+	}{
+		{"class", 12},
+		{"membership", 25},
+		{"klippekort", 25},
+	}
+	for _, tt := range tests {
+		if got := c.VATRate(tt.productType); got != tt.want {
+			t.Errorf("VATRate(%q) = %d, want %d", tt.productType, got, tt.want)
+		}
+	}
+}
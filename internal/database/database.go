@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -16,7 +17,30 @@ func Init() (*sql.DB, error) {
 		dbPath = "./samskipnad.db"
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Migrate(db); err != nil {
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	return db, nil
+}
+
+// Open opens the SQLite database at path. Transactions take the write lock
+// when they begin, so check-then-write sequences such as reserving a seat
+// are serialised, and connections wait for the lock instead of failing
+// with SQLITE_BUSY.
+func Open(path string) (*sql.DB, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	dsn := path + separator + "_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL"
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -25,15 +49,12 @@ func Init() (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	if err := runMigrations(db); err != nil {
-		return nil, fmt.Errorf("failed to run migrations: %w", err)
-	}
-
 	return db, nil
 }
 
-// runMigrations runs database migrations
-func runMigrations(db *sql.DB) error {
+// Migrate runs all database migrations against db. It is safe to call on an
+// already migrated database.
+func Migrate(db *sql.DB) error {
 	migrations := []string{
 		createTenantsTable,
 		createUsersTable,
@@ -44,7 +65,21 @@ func runMigrations(db *sql.DB) error {
 		createKlippekortTable,
 		createPaymentsTable,
 		createRolesTable,
-		insertDefaultData,
+		createClassSeriesTable,
+		createEventsTable,
+		createNotificationsTable,
+		createBookingPenaltiesTable,
+		createSeatHoldsTable,
+		createKlippTransactionsTable,
+		createKlippekortHoldersTable,
+		createSubstituteRequestsTable,
+		createResourcesTable,
+		createResourceReservationsTable,
+		createResourceInductionsTable,
+		createWebhookEventsTable,
+		createPaymentRefundsTable,
+		createInvoicesTable,
+		createDiscountCodesTable,
 	}
 
 	for _, migration := range migrations {
@@ -54,6 +89,190 @@ func runMigrations(db *sql.DB) error {
 		}
 	}
 
+	for _, rebuild := range tableRebuilds {
+		if err := rebuildTable(db, rebuild); err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
+
+	for _, column := range columnMigrations {
+		if err := addColumnIfMissing(db, column); err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
+
+	indexes := []string{
+		createClassOccurrenceIndex,
+		createKlippTransactionsCardIndex,
+		createClassResourceIndex,
+		createResourceReservationsIndex,
+		createUserCalendarTokenIndex,
+		createClassICalUIDIndex,
+		createPaymentRefundsIndex,
+		createPaymentRefundsEventIndex,
+		createMembershipsUserIndex,
+		createMembershipsPaymentIndex,
+		createInvoicesUserIndex,
+		createPaymentsDiscountIndex,
+		preventKlippTransactionUpdates,
+		preventKlippTransactionDeletes,
+		backfillKlippTransactions,
+	}
+
+	for _, index := range indexes {
+		if _, err := db.Exec(index); err != nil {
+			log.Printf("Migration failed: %s", index)
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
+
+	if _, err := db.Exec(insertDefaultData); err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+
+	return nil
+}
+
+// tableRebuild describes a table whose constraints changed after its
+// initial CREATE TABLE statement shipped. SQLite cannot alter constraints,
+// so a table whose schema lacks marker is renamed to <table>_old,
+// recreated, and its rows copied back.
+type tableRebuild struct {
+	table  string
+	create string
+	marker string
+	copy   string // INSERT ... SELECT from <table>_old
+}
+
+// tableRebuilds are applied in order
+var tableRebuilds = []tableRebuild{
+	// Penalties were unique per booking and reason, so a member who booked
+	// a class again and late-cancelled twice was only charged once
+	{"booking_penalties", createBookingPenaltiesTable, "incurred_at", `
+		INSERT INTO booking_penalties (id, booking_id, user_id, tenant_id, reason, amount, klipp_forfeited, incurred_at, settled_at, created_at)
+		SELECT id, booking_id, user_id, tenant_id, reason, amount, klipp_forfeited, COALESCE(created_at, CURRENT_TIMESTAMP), settled_at, created_at
+		FROM booking_penalties_old`},
+}
+
+func rebuildTable(db *sql.DB, m tableRebuild) error {
+	var schema string
+	err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, m.table).Scan(&schema)
+	if err != nil {
+		return fmt.Errorf("failed to read %s schema: %w", m.table, err)
+	}
+	if strings.Contains(schema, m.marker) {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s_old", m.table, m.table),
+		m.create,
+		m.copy,
+		fmt.Sprintf("DROP TABLE %s_old", m.table),
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to rebuild %s: %w", m.table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// columnMigration describes a column added to a table after its initial
+// CREATE TABLE statement shipped
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+}
+
+// columnMigrations are applied in order; SQLite has no ADD COLUMN IF NOT
+// EXISTS, so each one is checked against PRAGMA table_info first
+var columnMigrations = []columnMigration{
+	{"classes", "series_id", "INTEGER REFERENCES class_series(id)"},
+	{"classes", "occurrence_start", "DATETIME"},
+	{"bookings", "waitlisted_at", "DATETIME"},
+	{"bookings", "offer_expires_at", "DATETIME"},
+	{"bookings", "klippekort_id", "INTEGER REFERENCES klippekort(id)"},
+	{"bookings", "cancelled_at", "DATETIME"},
+	{"bookings", "late_cancellation", "BOOLEAN DEFAULT false"},
+	{"bookings", "no_show", "BOOLEAN DEFAULT false"},
+	{"payments", "refunded_amount", "INTEGER NOT NULL DEFAULT 0"},
+	{"classes", "category_id", "TEXT"},
+	{"class_series", "category_id", "TEXT"},
+	{"klippekort", "expiry_reminded_at", "DATETIME"},
+	{"bookings", "checked_in_at", "DATETIME"},
+	{"classes", "resource_id", "INTEGER REFERENCES resources(id)"},
+	{"class_series", "resource_id", "INTEGER REFERENCES resources(id)"},
+	{"resources", "requires_induction", "BOOLEAN DEFAULT false"},
+	{"resources", "max_slot_minutes", "INTEGER NOT NULL DEFAULT 0"},
+	{"resources", "category_id", "TEXT"},
+	{"resource_reservations", "klippekort_id", "INTEGER REFERENCES klippekort(id)"},
+	{"classes", "induction_resource_id", "INTEGER REFERENCES resources(id)"},
+	{"class_series", "induction_resource_id", "INTEGER REFERENCES resources(id)"},
+	{"users", "calendar_token", "TEXT"},
+	{"classes", "ical_uid", "TEXT"},
+	{"classes", "ical_source", "TEXT"},
+	{"payments", "provider", "TEXT NOT NULL DEFAULT 'stripe'"},
+	{"payments", "metadata", "TEXT"},
+	{"memberships", "status", "TEXT NOT NULL DEFAULT 'active'"},
+	{"memberships", "auto_renew", "BOOLEAN DEFAULT false"},
+	{"memberships", "amount", "INTEGER NOT NULL DEFAULT 0"},
+	{"memberships", "customer_id", "TEXT"},
+	{"memberships", "payment_method", "TEXT"},
+	{"memberships", "failed_attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"memberships", "next_attempt", "DATETIME"},
+	{"memberships", "grace_until", "DATETIME"},
+	{"memberships", "paused_at", "DATETIME"},
+	{"memberships", "paused_until", "DATETIME"},
+	{"memberships", "cancelled_at", "DATETIME"},
+	{"memberships", "tier", "TEXT NOT NULL DEFAULT ''"},
+	{"payments", "discount_code_id", "INTEGER REFERENCES discount_codes(id)"},
+	{"payments", "discount_amount", "INTEGER NOT NULL DEFAULT 0"},
+	{"bookings", "ticket_id", "INTEGER REFERENCES tickets(id)"},
+	{"payment_refunds", "provider_event_id", "TEXT"},
+	{"memberships", "renewing_at", "DATETIME"},
+	{"payment_refunds", "idempotency_key", "TEXT"},
+	{"payment_refunds", "pending", "BOOLEAN NOT NULL DEFAULT false"},
+}
+
+func addColumnIfMissing(db *sql.DB, m columnMigration) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", m.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == m.column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition))
+	if err != nil {
+		return fmt.Errorf("failed to add %s.%s: %w", m.table, m.column, err)
+	}
 	return nil
 }
 
@@ -196,6 +415,348 @@ CREATE TABLE IF NOT EXISTS roles (
 	UNIQUE(tenant_id, name)
 );`
 
+const createClassSeriesTable = `
+CREATE TABLE IF NOT EXISTS class_series (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tenant_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	description TEXT,
+	instructor_id INTEGER NOT NULL,
+	dtstart DATETIME NOT NULL,
+	timezone TEXT NOT NULL DEFAULT 'UTC',
+	duration_minutes INTEGER NOT NULL,
+	rrule TEXT NOT NULL,
+	max_capacity INTEGER DEFAULT 20,
+	price INTEGER DEFAULT 0,
+	requires_ticket BOOLEAN DEFAULT false,
+	requires_membership BOOLEAN DEFAULT false,
+	materialised_until DATETIME,
+	active BOOLEAN DEFAULT true,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+	FOREIGN KEY (instructor_id) REFERENCES users(id)
+);`
+
+const createEventsTable = `
+CREATE TABLE IF NOT EXISTS events (
+	id TEXT PRIMARY KEY,
+	type TEXT NOT NULL,
+	source TEXT,
+	tenant_id INTEGER,
+	user_id INTEGER,
+	data TEXT, -- JSON object
+	timestamp DATETIME NOT NULL
+);`
+
+const createNotificationsTable = `
+CREATE TABLE IF NOT EXISTS notifications (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	title TEXT NOT NULL,
+	message TEXT,
+	data TEXT, -- JSON object
+	priority INTEGER DEFAULT 0,
+	read_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);`
+
+// Penalties record what a member was charged under the cancellation policy.
+// A late-cancellation fee is settled by withholding it from the refund; a
+// no-show fee stays outstanding until it is collected. A penalty is
+// incurred when the booking is cancelled or the missed class starts;
+// bookings are reused when a member books a class again, so one booking
+// can incur more than one.
+const createBookingPenaltiesTable = `
+CREATE TABLE IF NOT EXISTS booking_penalties (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	booking_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	tenant_id INTEGER NOT NULL,
+	reason TEXT NOT NULL CHECK (reason IN ('late_cancel', 'no_show')),
+	amount INTEGER NOT NULL DEFAULT 0,
+	klipp_forfeited BOOLEAN DEFAULT false,
+	incurred_at DATETIME NOT NULL,
+	settled_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (booking_id) REFERENCES bookings(id),
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+	UNIQUE(booking_id, reason, incurred_at)
+);`
+
+// A seat hold reserves a seat while the member pays for it. Expired holds
+// no longer count against the class capacity.
+const createSeatHoldsTable = `
+CREATE TABLE IF NOT EXISTS seat_holds (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	class_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	payment_id TEXT,
+	expires_at DATETIME NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (class_id) REFERENCES classes(id),
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	UNIQUE(class_id, user_id)
+);`
+
+// The klipp ledger records every change to a klippekort balance. It is
+// append-only: corrections are made with further adjustment transactions.
+const createKlippTransactionsTable = `
+CREATE TABLE IF NOT EXISTS klipp_transactions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	klippekort_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	tenant_id INTEGER NOT NULL,
+	kind TEXT NOT NULL CHECK (kind IN ('purchase', 'use', 'refund', 'expiry', 'adjustment')),
+	delta INTEGER NOT NULL,
+	balance_after INTEGER NOT NULL,
+	booking_id INTEGER,
+	payment_id TEXT,
+	note TEXT,
+	created_by INTEGER,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (klippekort_id) REFERENCES klippekort(id),
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+	FOREIGN KEY (booking_id) REFERENCES bookings(id),
+	FOREIGN KEY (payment_id) REFERENCES payments(id),
+	FOREIGN KEY (created_by) REFERENCES users(id)
+);`
+
+const createKlippekortHoldersTable = `
+CREATE TABLE IF NOT EXISTS klippekort_holders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	klippekort_id INTEGER NOT NULL,
+	email TEXT NOT NULL,
+	user_id INTEGER,
+	token TEXT UNIQUE NOT NULL,
+	invited_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	accepted_at DATETIME,
+	revoked_at DATETIME,
+	FOREIGN KEY (klippekort_id) REFERENCES klippekort(id),
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	UNIQUE(klippekort_id, email)
+);`
+
+const createSubstituteRequestsTable = `
+CREATE TABLE IF NOT EXISTS substitute_requests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	class_id INTEGER NOT NULL,
+	instructor_id INTEGER NOT NULL,
+	reason TEXT,
+	status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'filled', 'withdrawn')),
+	substitute_id INTEGER,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	resolved_at DATETIME,
+	FOREIGN KEY (class_id) REFERENCES classes(id),
+	FOREIGN KEY (instructor_id) REFERENCES users(id),
+	FOREIGN KEY (substitute_id) REFERENCES users(id)
+);`
+
+// Resources are the rooms and equipment classes and member reservations
+// are scheduled into. A resource is used by one class or reservation at a
+// time.
+const createResourcesTable = `
+CREATE TABLE IF NOT EXISTS resources (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tenant_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	kind TEXT NOT NULL DEFAULT 'room' CHECK (kind IN ('room', 'equipment')),
+	description TEXT,
+	reservable BOOLEAN DEFAULT false,
+	active BOOLEAN DEFAULT true,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+	UNIQUE(tenant_id, name)
+);`
+
+const createResourceReservationsTable = `
+CREATE TABLE IF NOT EXISTS resource_reservations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	resource_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	tenant_id INTEGER NOT NULL,
+	start_time DATETIME NOT NULL,
+	end_time DATETIME NOT NULL,
+	note TEXT,
+	cancelled_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (resource_id) REFERENCES resources(id),
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (tenant_id) REFERENCES tenants(id)
+);`
+
+const createResourceInductionsTable = `
+CREATE TABLE IF NOT EXISTS resource_inductions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	resource_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	class_id INTEGER,
+	granted_by INTEGER,
+	completed_at DATETIME NOT NULL,
+	FOREIGN KEY (resource_id) REFERENCES resources(id),
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (class_id) REFERENCES classes(id),
+	FOREIGN KEY (granted_by) REFERENCES users(id),
+	UNIQUE(resource_id, user_id)
+);`
+
+// Webhook events record the payment provider webhooks already processed,
+// since providers deliver the same event more than once
+const createWebhookEventsTable = `
+CREATE TABLE IF NOT EXISTS webhook_events (
+	provider TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	processed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (provider, event_id)
+);`
+
+// Payment refunds are the audit trail of refunds: who refunded how much of
+// a payment and why, and what was reversed with it
+const createPaymentRefundsTable = `
+CREATE TABLE IF NOT EXISTS payment_refunds (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	payment_id TEXT NOT NULL,
+	amount INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	refunded_by INTEGER,
+	reversed TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (payment_id) REFERENCES payments(id),
+	FOREIGN KEY (refunded_by) REFERENCES users(id)
+);`
+
+// Discount code uses are counted from the payments made with them
+const createDiscountCodesTable = `
+CREATE TABLE IF NOT EXISTS discount_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tenant_id INTEGER NOT NULL,
+	code TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	percent_off INTEGER NOT NULL DEFAULT 0,
+	amount_off INTEGER NOT NULL DEFAULT 0,
+	valid_from DATETIME,
+	valid_until DATETIME,
+	max_uses INTEGER NOT NULL DEFAULT 0,
+	max_uses_per_user INTEGER NOT NULL DEFAULT 0,
+	products TEXT NOT NULL DEFAULT '[]',
+	categories TEXT NOT NULL DEFAULT '[]',
+	tiers TEXT NOT NULL DEFAULT '[]',
+	active BOOLEAN NOT NULL DEFAULT true,
+	created_by INTEGER,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (tenant_id, code),
+	FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+	FOREIGN KEY (created_by) REFERENCES users(id)
+);`
+
+// Invoices are numbered in sequence within a tenant, without gaps, as
+// Norwegian bookkeeping rules require
+const createInvoicesTable = `
+CREATE TABLE IF NOT EXISTS invoices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tenant_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	payment_id TEXT NOT NULL UNIQUE,
+	number INTEGER NOT NULL,
+	issued_at DATETIME NOT NULL,
+	currency TEXT NOT NULL,
+	total INTEGER NOT NULL,
+	vat INTEGER NOT NULL DEFAULT 0,
+	lines TEXT NOT NULL,
+	seller_name TEXT NOT NULL DEFAULT '',
+	organisation_number TEXT NOT NULL DEFAULT '',
+	vat_registered BOOLEAN NOT NULL DEFAULT false,
+	seller_address TEXT NOT NULL DEFAULT '',
+	buyer_name TEXT NOT NULL DEFAULT '',
+	buyer_email TEXT NOT NULL DEFAULT '',
+	emailed_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (tenant_id, number),
+	FOREIGN KEY (tenant_id) REFERENCES tenants(id),
+	FOREIGN KEY (user_id) REFERENCES users(id),
+	FOREIGN KEY (payment_id) REFERENCES payments(id)
+);`
+
+const createPaymentRefundsIndex = `
+CREATE INDEX IF NOT EXISTS idx_payment_refunds_payment
+ON payment_refunds(payment_id);`
+
+// Refunds made with the provider are recorded once per webhook event
+const createPaymentRefundsEventIndex = `
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payment_refunds_event
+ON payment_refunds(provider_event_id) WHERE provider_event_id IS NOT NULL;`
+
+const createMembershipsUserIndex = `
+CREATE INDEX IF NOT EXISTS idx_memberships_user
+ON memberships(user_id, status);`
+
+const createMembershipsPaymentIndex = `
+CREATE INDEX IF NOT EXISTS idx_memberships_payment
+ON memberships(payment_id);`
+
+const createPaymentsDiscountIndex = `
+CREATE INDEX IF NOT EXISTS idx_payments_discount_code
+ON payments(discount_code_id, user_id);`
+
+const createInvoicesUserIndex = `
+CREATE INDEX IF NOT EXISTS idx_invoices_user
+ON invoices(user_id, issued_at);`
+
+const createUserCalendarTokenIndex = `
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_calendar_token
+ON users(calendar_token);`
+
+const createClassICalUIDIndex = `
+CREATE UNIQUE INDEX IF NOT EXISTS idx_classes_ical_uid
+ON classes(tenant_id, ical_uid);`
+
+const createClassResourceIndex = `
+CREATE INDEX IF NOT EXISTS idx_classes_resource
+ON classes(resource_id, start_time);`
+
+const createResourceReservationsIndex = `
+CREATE INDEX IF NOT EXISTS idx_resource_reservations_resource
+ON resource_reservations(resource_id, start_time);`
+
+const createKlippTransactionsCardIndex = `
+CREATE INDEX IF NOT EXISTS idx_klipp_transactions_card
+ON klipp_transactions(klippekort_id);`
+
+const preventKlippTransactionUpdates = `
+CREATE TRIGGER IF NOT EXISTS klipp_transactions_no_update
+BEFORE UPDATE ON klipp_transactions
+BEGIN
+	SELECT RAISE(ABORT, 'klipp_transactions is append-only');
+END;`
+
+const preventKlippTransactionDeletes = `
+CREATE TRIGGER IF NOT EXISTS klipp_transactions_no_delete
+BEFORE DELETE ON klipp_transactions
+BEGIN
+	SELECT RAISE(ABORT, 'klipp_transactions is append-only');
+END;`
+
+// Cards bought before the ledger existed get an opening balance so their
+// ledger sums to klipp_left
+const backfillKlippTransactions = `
+INSERT INTO klipp_transactions (klippekort_id, user_id, tenant_id, kind, delta, balance_after, payment_id, note, created_at)
+SELECT k.id, k.user_id, k.tenant_id, 'adjustment', k.klipp_left, k.klipp_left, k.payment_id, 'Opening balance', k.created_at
+FROM klippekort k
+WHERE NOT EXISTS (SELECT 1 FROM klipp_transactions t WHERE t.klippekort_id = k.id);`
+
+// Each occurrence of a series is materialised at most once; skipped and
+// rescheduled occurrences keep their original occurrence_start so they are
+// not recreated by later materialisation runs.
+const createClassOccurrenceIndex = `
+CREATE UNIQUE INDEX IF NOT EXISTS idx_classes_series_occurrence
+ON classes(series_id, occurrence_start);`
+
 const insertDefaultData = `
 INSERT OR IGNORE INTO tenants (id, name, slug, description) VALUES 
 (1, 'Kjernekraft Oslo', 'kjernekraft', 'High-end yoga gym in Oslo');
@@ -0,0 +1,348 @@
+// Package discounts keeps the discount codes a community offers, such as
+// introductory prices, and works out what they take off a purchase at
+// checkout. The discount is recorded on the payment, and a code's uses are
+// counted from the payments that succeeded with it. Checkouts in progress
+// hold a use for a while, and payments confirmed once a code is used up
+// are refunded by the payments package.
+package discounts
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"samskipnad/internal/models"
+	"samskipnad/internal/payments"
+)
+
+// Products discount codes can be restricted to
+const (
+	ProductClass      = "class"
+	ProductKlippekort = "klippekort"
+	ProductMembership = "membership"
+)
+
+// StandardTier stands for the standard membership among a code's tiers
+const StandardTier = "standard"
+
+var (
+	ErrInvalidCode   = errors.New("invalid discount code")
+	ErrDuplicateCode = errors.New("a discount code with this code already exists")
+	ErrCodeNotFound  = errors.New("discount code not found")
+	ErrCodeNotValid  = errors.New("discount code is not valid at this time")
+	ErrCodeUsedUp    = errors.New("discount code has been used up")
+	ErrAlreadyUsed   = errors.New("discount code already used")
+	ErrNotApplicable = errors.New("discount code does not apply to this purchase")
+	ErrCoversPrice   = errors.New("discount code would make the purchase free")
+)
+
+var validCode = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// checkoutHold is how long a payment started with a code and not gone
+// through yet holds one of the code's uses
+const checkoutHold = time.Hour
+
+// Purchase is what a member is about to pay for
+type Purchase struct {
+	Product  string // class, klippekort or membership
+	Category string // Klippekort category of the class or card
+	Tier     string // Membership tier; empty for the standard membership
+	Amount   int    // Full price in cents
+}
+
+// Service manages discount codes
+type Service struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func NewService(db *sql.DB) *Service {
+	return &Service{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+// Create adds a discount code. Codes are stored in upper case and must be
+// unique within the tenant.
+func (s *Service) Create(code *models.DiscountCode) error {
+	code.Code = strings.ToUpper(strings.TrimSpace(code.Code))
+	code.Description = strings.TrimSpace(code.Description)
+	if err := validate(code); err != nil {
+		return err
+	}
+
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM discount_codes WHERE tenant_id = ? AND code = ?)`,
+		code.TenantID, code.Code).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check discount code: %w", err)
+	}
+	if exists {
+		return ErrDuplicateCode
+	}
+
+	products, categories, tiers, err := encodeLists(code)
+	if err != nil {
+		return err
+	}
+	code.Active = true
+	code.CreatedAt = s.now().UTC()
+	result, err := s.db.Exec(`
+		INSERT INTO discount_codes (tenant_id, code, description, percent_off, amount_off, valid_from, valid_until,
+			max_uses, max_uses_per_user, products, categories, tiers, active, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		code.TenantID, code.Code, code.Description, code.PercentOff, code.AmountOff, utc(code.ValidFrom), utc(code.ValidUntil),
+		code.MaxUses, code.MaxUsesPerUser, products, categories, tiers, code.Active, code.CreatedBy, code.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create discount code: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	code.ID = int(id)
+	return nil
+}
+
+// List returns the tenant's discount codes, newest first, with how often
+// each has been used
+func (s *Service) List(tenantID int) ([]*models.DiscountCode, error) {
+	rows, err := s.db.Query(selectCode+` WHERE d.tenant_id = ? ORDER BY d.created_at DESC, d.id DESC`, paidStatuses(tenantID)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list discount codes: %w", err)
+	}
+	defer rows.Close()
+
+	var codes []*models.DiscountCode
+	for rows.Next() {
+		code, err := scanCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// Deactivate stops a discount code from being used. Payments already made
+// with it keep their discount.
+func (s *Service) Deactivate(tenantID, id int) error {
+	result, err := s.db.Exec(`UPDATE discount_codes SET active = false WHERE id = ? AND tenant_id = ?`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate discount code: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrCodeNotFound
+	}
+	return nil
+}
+
+// Apply works out the discount a code gives the member on a purchase, to
+// be taken off the payment for it. Codes are entered in any case. A code
+// restricted to categories or membership tiers applies only to classes
+// and klippekort in those categories and memberships of those tiers; a
+// code restricted to products applies only to them. A code's uses are
+// counted once their payments succeed, and while their checkouts are in
+// progress, for up to checkoutHold.
+func (s *Service) Apply(tenantID, userID int, code string, purchase Purchase) (*payments.Discount, error) {
+	d, err := scanCode(s.db.QueryRow(selectCode+` WHERE d.tenant_id = ? AND d.code = ?`,
+		append(paidStatuses(tenantID), strings.ToUpper(strings.TrimSpace(code)))...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCodeNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get discount code: %w", err)
+	}
+	if !d.Active {
+		return nil, ErrCodeNotFound
+	}
+
+	now := s.now()
+	if (d.ValidFrom != nil && now.Before(*d.ValidFrom)) || (d.ValidUntil != nil && !now.Before(*d.ValidUntil)) {
+		return nil, ErrCodeNotValid
+	}
+	if !Applies(d, purchase) {
+		return nil, ErrNotApplicable
+	}
+	if d.MaxUses > 0 {
+		uses, err := s.uses(d.ID, 0, now)
+		if err != nil {
+			return nil, err
+		}
+		if uses >= d.MaxUses {
+			return nil, ErrCodeUsedUp
+		}
+	}
+	if d.MaxUsesPerUser > 0 {
+		uses, err := s.uses(d.ID, userID, now)
+		if err != nil {
+			return nil, err
+		}
+		if uses >= d.MaxUsesPerUser {
+			return nil, ErrAlreadyUsed
+		}
+	}
+
+	amount := d.AmountOff
+	if d.PercentOff > 0 {
+		amount = (purchase.Amount*d.PercentOff + 50) / 100
+	}
+	if amount >= purchase.Amount {
+		return nil, ErrCoversPrice
+	}
+	if amount <= 0 {
+		return nil, ErrNotApplicable
+	}
+	return &payments.Discount{CodeID: d.ID, Code: d.Code, Amount: amount}, nil
+}
+
+// uses counts the uses of a code, by the member if userID is not 0: the
+// payments that succeeded with it, and those started in the last
+// checkoutHold that have not gone through yet
+func (s *Service) uses(codeID, userID int, now time.Time) (int, error) {
+	query := `
+		SELECT COUNT(*) FROM payments
+		WHERE discount_code_id = ? AND (status IN (?, ?, ?)
+			OR (status IN (?, ?, ?, ?) AND created_at > ?))`
+	args := append([]interface{}{codeID}, paidStatuses()...)
+	args = append(args, payments.StatusRequiresPaymentMethod, payments.StatusRequiresAction, payments.StatusRequiresCapture,
+		payments.StatusProcessing, now.Add(-checkoutHold).UTC().Format("2006-01-02 15:04:05"))
+	if userID != 0 {
+		query += ` AND user_id = ?`
+		args = append(args, userID)
+	}
+
+	var uses int
+	if err := s.db.QueryRow(query, args...).Scan(&uses); err != nil {
+		return 0, fmt.Errorf("failed to count discount code uses: %w", err)
+	}
+	return uses, nil
+}
+
+// Applies reports whether a discount code applies to a purchase, leaving
+// aside when and how often it may be used
+func Applies(code *models.DiscountCode, purchase Purchase) bool {
+	if len(code.Products) > 0 && !contains(code.Products, purchase.Product) {
+		return false
+	}
+	if len(code.Categories) == 0 && len(code.Tiers) == 0 {
+		return true
+	}
+	switch purchase.Product {
+	case ProductClass, ProductKlippekort:
+		return purchase.Category != "" && contains(code.Categories, purchase.Category)
+	case ProductMembership:
+		tier := purchase.Tier
+		if tier == "" {
+			tier = StandardTier
+		}
+		return contains(code.Tiers, tier)
+	}
+	return false
+}
+
+func validate(code *models.DiscountCode) error {
+	switch {
+	case !validCode.MatchString(code.Code):
+		return fmt.Errorf("%w: codes are 3 to 32 letters, digits, dashes or underscores", ErrInvalidCode)
+	case (code.PercentOff > 0) == (code.AmountOff > 0):
+		return fmt.Errorf("%w: give either a percentage or an amount off", ErrInvalidCode)
+	case code.PercentOff < 0 || code.PercentOff > 99 || code.AmountOff < 0:
+		return fmt.Errorf("%w: the percentage must be from 1 to 99 and the amount more than zero", ErrInvalidCode)
+	case code.MaxUses < 0 || code.MaxUsesPerUser < 0:
+		return fmt.Errorf("%w: use limits cannot be negative", ErrInvalidCode)
+	case code.ValidFrom != nil && code.ValidUntil != nil && !code.ValidUntil.After(*code.ValidFrom):
+		return fmt.Errorf("%w: the code must be valid until after it becomes valid", ErrInvalidCode)
+	}
+	for _, product := range code.Products {
+		switch product {
+		case ProductClass, ProductKlippekort, ProductMembership:
+		default:
+			return fmt.Errorf("%w: unknown product %q", ErrInvalidCode, product)
+		}
+	}
+	return nil
+}
+
+// selectCode selects discount codes with their uses. Its arguments start
+// with paidStatuses.
+const selectCode = `
+	SELECT d.id, d.tenant_id, d.code, d.description, d.percent_off, d.amount_off, d.valid_from, d.valid_until,
+		d.max_uses, d.max_uses_per_user, d.products, d.categories, d.tiers, d.active, d.created_by, d.created_at,
+		(SELECT COUNT(*) FROM payments p WHERE p.discount_code_id = d.id AND p.status IN (?, ?, ?))
+	FROM discount_codes d`
+
+func paidStatuses(args ...interface{}) []interface{} {
+	return append([]interface{}{payments.StatusSucceeded, payments.StatusPartiallyRefunded, payments.StatusRefunded}, args...)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCode(row scanner) (*models.DiscountCode, error) {
+	var d models.DiscountCode
+	var validFrom, validUntil sql.NullTime
+	var createdBy sql.NullInt64
+	var products, categories, tiers string
+	err := row.Scan(&d.ID, &d.TenantID, &d.Code, &d.Description, &d.PercentOff, &d.AmountOff, &validFrom, &validUntil,
+		&d.MaxUses, &d.MaxUsesPerUser, &products, &categories, &tiers, &d.Active, &createdBy, &d.CreatedAt, &d.Uses)
+	if err != nil {
+		return nil, err
+	}
+	if validFrom.Valid {
+		d.ValidFrom = &validFrom.Time
+	}
+	if validUntil.Valid {
+		d.ValidUntil = &validUntil.Time
+	}
+	if createdBy.Valid {
+		id := int(createdBy.Int64)
+		d.CreatedBy = &id
+	}
+	for _, list := range []struct {
+		data string
+		into *[]string
+	}{{products, &d.Products}, {categories, &d.Categories}, {tiers, &d.Tiers}} {
+		if err := json.Unmarshal([]byte(list.data), list.into); err != nil {
+			return nil, fmt.Errorf("invalid discount code restrictions: %w", err)
+		}
+	}
+	return &d, nil
+}
+
+func encodeLists(code *models.DiscountCode) (products, categories, tiers string, err error) {
+	encoded := make([]string, 3)
+	for i, list := range [][]string{code.Products, code.Categories, code.Tiers} {
+		if list == nil {
+			list = []string{}
+		}
+		data, err := json.Marshal(list)
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to encode discount code restrictions: %w", err)
+		}
+		encoded[i] = string(data)
+	}
+	return encoded[0], encoded[1], encoded[2], nil
+}
+
+func utc(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+package discounts
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/database"
+	"samskipnad/internal/models"
+)
+
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+type testEnv struct {
+	db      *sql.DB
+	service *Service
+	now     time.Time
+	userID  int
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := setupTestDB(t)
+	env := &testEnv{
+		db:  db,
+		now: time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC),
+	}
+	env.service = NewService(db)
+	env.service.now = func() time.Time { return env.now }
+	env.userID = env.addUser(t, "kari@example.com")
+	return env
+}
+
+func (env *testEnv) addUser(t *testing.T, email string) int {
+	result, err := env.db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, tenant_id)
+		VALUES (?, 'x', 'Kari', 'Nordmann', 1)`, email)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+// pay records a payment with the discount code, started now
+func (env *testEnv) pay(t *testing.T, id string, userID, codeID int, status string) {
+	_, err := env.db.Exec(`
+		INSERT INTO payments (id, user_id, tenant_id, amount, status, payment_type, reference_id, discount_code_id, discount_amount, created_at)
+		VALUES (?, ?, 1, 8000, ?, 'class', 0, ?, 2000, ?)`, id, userID, status, codeID, env.now.UTC().Format("2006-01-02 15:04:05"))
+	require.NoError(t, err)
+}
+
+func TestCreate(t *testing.T) {
+	env := newTestEnv(t)
+
+	code := &models.DiscountCode{TenantID: 1, Code: " intro20 ", PercentOff: 20}
+	require.NoError(t, env.service.Create(code))
+	assert.NotZero(t, code.ID)
+	assert.Equal(t, "INTRO20", code.Code)
+	assert.True(t, code.Active)
+
+	err := env.service.Create(&models.DiscountCode{TenantID: 1, Code: "Intro20", PercentOff: 10})
+	assert.ErrorIs(t, err, ErrDuplicateCode)
+	require.NoError(t, env.service.Create(&models.DiscountCode{TenantID: 2, Code: "INTRO20", PercentOff: 10}),
+		"codes are unique per tenant")
+
+	until := env.now
+	for name, invalid := range map[string]*models.DiscountCode{
+		"short code":      {Code: "AB", PercentOff: 10},
+		"spaces":          {Code: "INTRO 20", PercentOff: 10},
+		"no discount":     {Code: "NONE"},
+		"both discounts":  {Code: "BOTH", PercentOff: 10, AmountOff: 5000},
+		"whole price":     {Code: "FREE", PercentOff: 100},
+		"negative limit":  {Code: "LIMIT", PercentOff: 10, MaxUses: -1},
+		"empty window":    {Code: "WINDOW", PercentOff: 10, ValidFrom: &until, ValidUntil: &until},
+		"unknown product": {Code: "PRODUCT", PercentOff: 10, Products: []string{"merch"}},
+	} {
+		invalid.TenantID = 1
+		assert.ErrorIs(t, env.service.Create(invalid), ErrInvalidCode, name)
+	}
+}
+
+func TestApply(t *testing.T) {
+	env := newTestEnv(t)
+	require.NoError(t, env.service.Create(&models.DiscountCode{TenantID: 1, Code: "INTRO20", PercentOff: 20}))
+	require.NoError(t, env.service.Create(&models.DiscountCode{TenantID: 1, Code: "HUNDRED", AmountOff: 10000}))
+
+	discount, err := env.service.Apply(1, env.userID, "intro20", Purchase{Product: ProductKlippekort, Category: "yoga", Amount: 120000})
+	require.NoError(t, err)
+	assert.Equal(t, "INTRO20", discount.Code)
+	assert.Equal(t, 24000, discount.Amount)
+
+	discount, err = env.service.Apply(1, env.userID, "INTRO20", Purchase{Product: ProductClass, Amount: 12345})
+	require.NoError(t, err)
+	assert.Equal(t, 2469, discount.Amount, "percentages are rounded to the nearest cent")
+
+	discount, err = env.service.Apply(1, env.userID, "HUNDRED", Purchase{Product: ProductMembership, Amount: 59900})
+	require.NoError(t, err)
+	assert.Equal(t, 10000, discount.Amount)
+
+	_, err = env.service.Apply(1, env.userID, "HUNDRED", Purchase{Product: ProductClass, Amount: 10000})
+	assert.ErrorIs(t, err, ErrCoversPrice)
+	_, err = env.service.Apply(1, env.userID, "MISSING", Purchase{Product: ProductClass, Amount: 10000})
+	assert.ErrorIs(t, err, ErrCodeNotFound)
+	_, err = env.service.Apply(2, env.userID, "INTRO20", Purchase{Product: ProductClass, Amount: 10000})
+	assert.ErrorIs(t, err, ErrCodeNotFound, "codes belong to their tenant")
+}
+
+func TestApplyValidity(t *testing.T) {
+	env := newTestEnv(t)
+	from := env.now.Add(24 * time.Hour)
+	until := env.now.Add(7 * 24 * time.Hour)
+	code := &models.DiscountCode{TenantID: 1, Code: "SPRING", PercentOff: 15, ValidFrom: &from, ValidUntil: &until}
+	require.NoError(t, env.service.Create(code))
+	purchase := Purchase{Product: ProductClass, Amount: 20000}
+
+	_, err := env.service.Apply(1, env.userID, "SPRING", purchase)
+	assert.ErrorIs(t, err, ErrCodeNotValid, "not valid yet")
+
+	env.now = from
+	_, err = env.service.Apply(1, env.userID, "SPRING", purchase)
+	assert.NoError(t, err)
+
+	env.now = until
+	_, err = env.service.Apply(1, env.userID, "SPRING", purchase)
+	assert.ErrorIs(t, err, ErrCodeNotValid, "expired")
+
+	env.now = from
+	require.NoError(t, env.service.Deactivate(1, code.ID))
+	_, err = env.service.Apply(1, env.userID, "SPRING", purchase)
+	assert.ErrorIs(t, err, ErrCodeNotFound)
+	assert.ErrorIs(t, env.service.Deactivate(2, code.ID), ErrCodeNotFound)
+}
+
+func TestApplyLimits(t *testing.T) {
+	env := newTestEnv(t)
+	other := env.addUser(t, "ola@example.com")
+	code := &models.DiscountCode{TenantID: 1, Code: "FIRST", PercentOff: 20, MaxUses: 3, MaxUsesPerUser: 1}
+	require.NoError(t, env.service.Create(code))
+	purchase := Purchase{Product: ProductClass, Amount: 10000}
+
+	env.pay(t, "pi_pending", env.userID, code.ID, "requires_payment_method")
+	_, err := env.service.Apply(1, env.userID, "FIRST", purchase)
+	assert.ErrorIs(t, err, ErrAlreadyUsed, "a checkout in progress holds a use")
+
+	env.now = env.now.Add(checkoutHold)
+	env.pay(t, "pi_canceled", env.userID, code.ID, "canceled")
+	_, err = env.service.Apply(1, env.userID, "FIRST", purchase)
+	require.NoError(t, err, "payments that did not go through are not uses")
+
+	env.pay(t, "pi_1", env.userID, code.ID, "succeeded")
+	_, err = env.service.Apply(1, env.userID, "FIRST", purchase)
+	assert.ErrorIs(t, err, ErrAlreadyUsed)
+	_, err = env.service.Apply(1, other, "FIRST", purchase)
+	require.NoError(t, err)
+
+	env.pay(t, "pi_2", other, code.ID, "refunded")
+	env.pay(t, "pi_3", env.addUser(t, "per@example.com"), code.ID, "partially_refunded")
+	_, err = env.service.Apply(1, env.addUser(t, "nils@example.com"), "FIRST", purchase)
+	assert.ErrorIs(t, err, ErrCodeUsedUp)
+
+	codes, err := env.service.List(1)
+	require.NoError(t, err)
+	require.Len(t, codes, 1)
+	assert.Equal(t, 3, codes[0].Uses)
+}
+
+func TestApplyLimitsHeld(t *testing.T) {
+	env := newTestEnv(t)
+	code := &models.DiscountCode{TenantID: 1, Code: "LAST", AmountOff: 2000, MaxUses: 1}
+	require.NoError(t, env.service.Create(code))
+	purchase := Purchase{Product: ProductClass, Amount: 10000}
+
+	env.pay(t, "pi_processing", env.addUser(t, "ola@example.com"), code.ID, "processing")
+	_, err := env.service.Apply(1, env.userID, "LAST", purchase)
+	assert.ErrorIs(t, err, ErrCodeUsedUp, "another member is paying with the last use")
+
+	env.now = env.now.Add(checkoutHold + time.Minute)
+	_, err = env.service.Apply(1, env.userID, "LAST", purchase)
+	assert.NoError(t, err, "the hold of an abandoned checkout ends")
+}
+
+func TestApplies(t *testing.T) {
+	yoga := &models.DiscountCode{Categories: []string{"yoga"}}
+	standard := &models.DiscountCode{Tiers: []string{StandardTier}}
+	cards := &models.DiscountCode{Products: []string{ProductKlippekort}}
+	yogaCards := &models.DiscountCode{Products: []string{ProductKlippekort}, Categories: []string{"yoga"}}
+
+	tests := []struct {
+		name     string
+		code     *models.DiscountCode
+		purchase Purchase
+		want     bool
+	}{
+		{"unrestricted", &models.DiscountCode{}, Purchase{Product: ProductMembership, Tier: "weekday"}, true},
+		{"category class", yoga, Purchase{Product: ProductClass, Category: "yoga"}, true},
+		{"category card", yoga, Purchase{Product: ProductKlippekort, Category: "yoga"}, true},
+		{"other category", yoga, Purchase{Product: ProductClass, Category: "strength"}, false},
+		{"class without category", yoga, Purchase{Product: ProductClass}, false},
+		{"category membership", yoga, Purchase{Product: ProductMembership}, false},
+		{"standard tier", standard, Purchase{Product: ProductMembership}, true},
+		{"other tier", standard, Purchase{Product: ProductMembership, Tier: "weekday"}, false},
+		{"tier class", standard, Purchase{Product: ProductClass, Category: "yoga"}, false},
+		{"product", cards, Purchase{Product: ProductKlippekort, Category: "strength"}, true},
+		{"other product", cards, Purchase{Product: ProductClass, Category: "yoga"}, false},
+		{"product and category", yogaCards, Purchase{Product: ProductKlippekort, Category: "yoga"}, true},
+		{"product and other category", yogaCards, Purchase{Product: ProductKlippekort, Category: "strength"}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Applies(tt.code, tt.purchase), tt.name)
+	}
+}
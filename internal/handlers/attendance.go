@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"samskipnad/internal/booking"
+	"samskipnad/internal/config"
+	"samskipnad/internal/instructors"
+	"samskipnad/internal/middleware"
+	"samskipnad/internal/models"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Attendance check-in handlers
+
+// BookingQRCode serves the check-in QR code of one of the current member's
+// confirmed bookings as a PNG image
+func (h *Handlers) BookingQRCode(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	bookingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	b, err := h.bookingService.GetBooking(bookingID)
+	if err != nil || b.UserID != user.ID || b.Status != booking.StatusConfirmed {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	png, err := qrcode.Encode(h.bookingService.CheckInToken(b.ID), qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(png)
+}
+
+// CheckInPage shows the check-in view for a class: a field that accepts
+// scanned QR codes and a searchable roster, loaded by CheckInRoster
+func (h *Handlers) CheckInPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	class, ok := h.staffClass(w, r, user)
+	if !ok {
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":     "Check-in: " + class.Name,
+		"User":      user,
+		"Community": config.GetCurrent(),
+		"Class":     class,
+	}
+
+	h.renderTemplate(w, "instructor-checkin.html", data)
+}
+
+// CheckInRoster renders the attendance and roster of a class, filtered by
+// the attendee search
+func (h *Handlers) CheckInRoster(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	class, ok := h.staffClass(w, r, user)
+	if !ok {
+		return
+	}
+
+	data, err := h.checkInData(class, r.FormValue("q"))
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderTemplate(w, "checkin-roster", data)
+}
+
+// CheckInAttendee checks in a member, either from a scanned QR code in the
+// token field or by picking their booking_id from the roster
+func (h *Handlers) CheckInAttendee(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	class, ok := h.staffClass(w, r, user)
+	if !ok {
+		return
+	}
+
+	var record *booking.AttendanceRecord
+	var err error
+	if token := r.FormValue("token"); token != "" {
+		record, err = h.bookingService.CheckInWithToken(class.ID, token)
+	} else {
+		var bookingID int
+		bookingID, err = strconv.Atoi(r.FormValue("booking_id"))
+		if err != nil {
+			http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+			return
+		}
+		record, err = h.checkInBooking(class.ID, bookingID)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	switch err {
+	case nil:
+		w.Header().Set("HX-Trigger", "attendance-updated")
+		name := h.attendeeName(record.UserID)
+		if record.AlreadyChecked {
+			fmt.Fprintf(w, `<div class="booking-success">%s was already checked in at %s</div>`,
+				html.EscapeString(name), config.GetCurrent().LocalTime(record.CheckedInAt).Format("15:04"))
+			return
+		}
+		fmt.Fprintf(w, `<div class="booking-success">%s checked in</div>`, html.EscapeString(name))
+	case booking.ErrInvalidCheckIn, booking.ErrWrongClass, booking.ErrBookingNotFound, booking.ErrBookingNotConfirmed,
+		booking.ErrCheckInNotOpen, booking.ErrMarkedNoShow:
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to check in", http.StatusInternalServerError)
+	}
+}
+
+// UndoCheckIn clears a check-in recorded by mistake
+func (h *Handlers) UndoCheckIn(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	class, ok := h.staffClass(w, r, user)
+	if !ok {
+		return
+	}
+
+	bookingID, err := strconv.Atoi(mux.Vars(r)["booking"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+	b, err := h.bookingService.GetBooking(bookingID)
+	if err != nil || b.ClassID != class.ID {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.bookingService.UndoCheckIn(bookingID); err != nil {
+		http.Error(w, "Failed to undo check-in", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("HX-Trigger", "attendance-updated")
+	w.Write([]byte(`<div class="booking-success">Check-in undone</div>`))
+}
+
+// checkInBooking checks in a booking picked from the roster of a class
+func (h *Handlers) checkInBooking(classID, bookingID int) (*booking.AttendanceRecord, error) {
+	b, err := h.bookingService.GetBooking(bookingID)
+	if err != nil {
+		return nil, err
+	}
+	if b.ClassID != classID {
+		return nil, booking.ErrWrongClass
+	}
+	return h.bookingService.CheckIn(bookingID)
+}
+
+// checkInData loads the attendance of a class and the attendees matching
+// query by name or email
+func (h *Handlers) checkInData(class *models.Class, query string) (map[string]interface{}, error) {
+	roster, err := h.instructorService.Roster(class.ID)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := h.bookingService.ClassAttendance(class.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	query = strings.TrimSpace(query)
+	if query != "" {
+		needle := strings.ToLower(query)
+		var matches []instructors.Attendee
+		for _, a := range roster {
+			haystack := strings.ToLower(a.FirstName + " " + a.LastName + " " + a.Email)
+			if strings.Contains(haystack, needle) {
+				matches = append(matches, a)
+			}
+		}
+		roster = matches
+	}
+
+	return map[string]interface{}{
+		"Class":      class,
+		"Roster":     roster,
+		"Attendance": stats,
+		"Query":      query,
+	}, nil
+}
+
+func (h *Handlers) attendeeName(userID int) string {
+	var first, last string
+	if err := h.db.QueryRow(`SELECT first_name, last_name FROM users WHERE id = ?`, userID).Scan(&first, &last); err != nil {
+		return "Member"
+	}
+	return first + " " + last
+}
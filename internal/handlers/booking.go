@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+
+	"samskipnad/internal/booking"
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/models"
+	"samskipnad/internal/payments"
+)
+
+// Booking helpers shared by the class booking and payment handlers
+
+// holdSeatForPayment reserves a seat in a paid class and starts the payment
+// for it, less any discount. The hold is released again if the payment
+// cannot be started.
+func (h *Handlers) holdSeatForPayment(userID int, class *models.Class, discount *payments.Discount) (*payments.Intent, error) {
+	hold, err := h.bookingService.HoldSeat(userID, class.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentIntent, err := h.paymentService.CreatePaymentIntent(userID, class.ID, int64(class.Price), discount)
+	if err != nil {
+		if releaseErr := h.bookingService.ReleaseHold(hold.ID); releaseErr != nil {
+			log.Printf("Failed to release seat hold %d: %v", hold.ID, releaseErr)
+		}
+		return nil, err
+	}
+
+	if err := h.bookingService.AttachPayment(hold.ID, paymentIntent.ID); err != nil {
+		log.Printf("Failed to attach payment %s to seat hold %d: %v", paymentIntent.ID, hold.ID, err)
+	}
+
+	return paymentIntent, nil
+}
+
+// writeBookingError renders the fragment for a booking that could not be made
+func (h *Handlers) writeBookingError(w http.ResponseWriter, userID int, class *models.Class, err error) {
+	switch err {
+	case booking.ErrClassNotFound:
+		http.Error(w, "Class not found", http.StatusNotFound)
+	case booking.ErrAlreadyBooked:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">Already booked</div>`))
+	case booking.ErrAlreadyWaitlist:
+		entry, err := h.bookingService.WaitlistEntry(userID, class.ID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		h.writeWaitlistPosition(w, entry)
+	case booking.ErrClassFull:
+		h.writeClassFull(w, class)
+	case booking.ErrNotKlippClass:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">This class cannot be booked with klipp</div>`))
+	case booking.ErrMembershipRequired:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">This class is for members only. <a href="/memberships">Become a member</a></div>`))
+	case booking.ErrNotIncluded:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">This class is not included in your membership</div>`))
+	case booking.ErrTicketRequired:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">This class requires a ticket or klipp. <a href="/memberships">Get one</a></div>`))
+	case booking.ErrNoTicket:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">You have no tickets left</div>`))
+	case klippekort.ErrNoKlipp:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">You have no klipp left for this class</div>`))
+	default:
+		http.Error(w, "Failed to book class", http.StatusInternalServerError)
+	}
+}
+
+// writeKlippBookingSuccess renders the fragment for a class booked with a
+// klipp, including the klipp the member has left in the category
+func (h *Handlers) writeKlippBookingSuccess(w http.ResponseWriter, user *models.User, class *models.Class) {
+	message := fmt.Sprintf("Successfully booked %s with 1 klipp!", class.Name)
+	if left, err := h.klippekortService.Balance(user.ID, user.TenantID, class.CategoryID); err == nil {
+		message = fmt.Sprintf("Successfully booked %s with 1 klipp! %d klipp left.", class.Name, left)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("HX-Trigger", "booking-updated")
+	w.Write([]byte(`<div class="booking-success">` + html.EscapeString(message) + `</div>`))
+}
+
+// choosePaymentOption picks how the member pays for a class: the way they
+// chose, or the only way, or a way that costs them nothing. It returns
+// false when the member has to choose.
+func choosePaymentOption(options []booking.PaymentOption, method string) (booking.PaymentOption, bool) {
+	if method != "" {
+		for _, option := range options {
+			if option.Method == method {
+				return option, true
+			}
+		}
+		return booking.PaymentOption{}, false
+	}
+
+	if len(options) == 1 {
+		return options[0], true
+	}
+	if len(options) > 1 && (options[0].Method == booking.PayFree || options[0].Method == booking.PayMembership) {
+		return options[0], true
+	}
+	return booking.PaymentOption{}, false
+}
+
+const paymentOptionsTemplate = `
+	<div class="payment-options p-3">
+		<h6 class="text-white">How would you like to pay for {{.Class.Name}}?</h6>
+		{{range .Options}}
+		<button class="btn {{if eq .Method "card"}}btn-outline-primary{{else}}btn-primary{{end}} w-100 mb-2"
+				hx-post="/classes/{{$.Class.ID}}/book"
+				hx-vals='{"pay_with": "{{.Method}}"}'
+				hx-target="#booking-result-{{$.Class.ID}}"
+				hx-swap="innerHTML">
+			{{if eq .Method "membership"}}Included in your membership
+			{{else if eq .Method "klipp"}}Use 1 klipp ({{.Left}} left)
+			{{else if eq .Method "ticket"}}Use your ticket ({{.Left}} {{if eq .Left 1}}class{{else}}classes{{end}} left)
+			{{else if eq .Method "card"}}Pay drop-in {{money .Price}}
+			{{else}}Book for free{{end}}
+		</button>
+		{{end}}
+	</div>`
+
+// writePaymentOptions renders the ways the member can pay for a class, for
+// them to choose one
+func (h *Handlers) writePaymentOptions(w http.ResponseWriter, class *models.Class, options []booking.PaymentOption) {
+	data := struct {
+		Class   *models.Class
+		Options []booking.PaymentOption
+	}{class, options}
+
+	t, err := template.New("payment-options").Funcs(getFuncMap()).Parse(paymentOptionsTemplate)
+	if err != nil {
+		http.Error(w, "Template error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, "Template execution error", http.StatusInternalServerError)
+	}
+}
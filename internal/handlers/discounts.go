@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/discounts"
+	"samskipnad/internal/middleware"
+	"samskipnad/internal/models"
+	"samskipnad/internal/money"
+	"samskipnad/internal/payments"
+
+	"github.com/gorilla/mux"
+)
+
+// Discount code handlers
+
+// discountErrors are the reasons a discount code cannot be used, as
+// members are told them. The key names the reason in redirects.
+var discountErrors = []struct {
+	key     string
+	err     error
+	message string
+}{
+	{"not_found", discounts.ErrCodeNotFound, "We don't recognise that discount code"},
+	{"not_valid", discounts.ErrCodeNotValid, "That discount code has expired or is not valid yet"},
+	{"used_up", discounts.ErrCodeUsedUp, "That discount code has been used up"},
+	{"already_used", discounts.ErrAlreadyUsed, "You have already used that discount code"},
+	{"not_applicable", discounts.ErrNotApplicable, "That discount code does not apply to this purchase"},
+	{"covers_price", discounts.ErrCoversPrice, "That discount code cannot be used on this purchase"},
+}
+
+// applyDiscount works out the discount the code entered at checkout gives
+// the member. It returns no discount when no code was entered.
+func (h *Handlers) applyDiscount(user *models.User, code string, purchase discounts.Purchase) (*payments.Discount, error) {
+	if strings.TrimSpace(code) == "" {
+		return nil, nil
+	}
+	return h.discountService.Apply(user.TenantID, user.ID, code, purchase)
+}
+
+// discountErrorKey returns the key of a discount code the member cannot
+// use, or false for other errors
+func discountErrorKey(err error) (string, bool) {
+	for _, reason := range discountErrors {
+		if errors.Is(err, reason.err) {
+			return reason.key, true
+		}
+	}
+	return "", false
+}
+
+// discountErrorMessage returns what the member is told about the discount
+// code error with key
+func discountErrorMessage(key string) string {
+	for _, reason := range discountErrors {
+		if reason.key == key {
+			return reason.message
+		}
+	}
+	return ""
+}
+
+// writeDiscountError renders the fragment for a discount code the member
+// cannot use
+func writeDiscountError(w http.ResponseWriter, err error) {
+	key, ok := discountErrorKey(err)
+	if !ok {
+		http.Error(w, "Failed to apply discount code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(`<div class="booking-error">` + html.EscapeString(discountErrorMessage(key)) + `</div>`))
+}
+
+// AdminDiscounts lists the tenant's discount codes on GET and adds a new
+// one otherwise
+func (h *Handlers) AdminDiscounts(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "GET" {
+		codes, err := h.discountService.List(user.TenantID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		data := map[string]interface{}{
+			"Title":     "Discount Codes",
+			"User":      user,
+			"Community": config.GetCurrent(),
+			"Codes":     codes,
+		}
+
+		h.renderTemplate(w, "admin-discounts.html", data)
+		return
+	}
+
+	code := &models.DiscountCode{TenantID: user.TenantID, CreatedBy: &user.ID}
+	if err := discountFromAdminForm(r, code); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.discountService.Create(code); err != nil {
+		if errors.Is(err, discounts.ErrInvalidCode) || errors.Is(err, discounts.ErrDuplicateCode) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to create discount code", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/discounts", http.StatusSeeOther)
+}
+
+// DeactivateDiscount stops a discount code from being used. Payments
+// already made with it keep their discount.
+func (h *Handlers) DeactivateDiscount(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid discount code ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.discountService.Deactivate(user.TenantID, id)
+	if errors.Is(err, discounts.ErrCodeNotFound) {
+		http.Error(w, "Discount code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to deactivate discount code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(`<span class="badge bg-secondary">Inactive</span>`))
+}
+
+// discountFromAdminForm copies the fields of the admin discount code form
+// onto code. The amount off is entered in whole units of the community's
+// currency, and the code is valid through the last day entered.
+func discountFromAdminForm(r *http.Request, code *models.DiscountCode) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	community := config.GetCurrent()
+
+	value := r.FormValue("value")
+	switch r.FormValue("kind") {
+	case "percent":
+		percent, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid percentage: %s", value)
+		}
+		code.PercentOff = percent
+	case "amount":
+		amount, err := money.Parse(value, community.Pricing.Currency)
+		if err != nil {
+			return fmt.Errorf("invalid amount: %s", value)
+		}
+		code.AmountOff = int(amount.Amount)
+	default:
+		return fmt.Errorf("choose a percentage or an amount off")
+	}
+
+	for field, limit := range map[string]*int{"max_uses": &code.MaxUses, "max_uses_per_user": &code.MaxUsesPerUser} {
+		if value := r.FormValue(field); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid use limit: %s", value)
+			}
+			*limit = n
+		}
+	}
+
+	if value := r.FormValue("valid_from"); value != "" {
+		from, err := community.ParseLocalTime("2006-01-02", value)
+		if err != nil {
+			return fmt.Errorf("invalid start date: %s", value)
+		}
+		code.ValidFrom = &from
+	}
+	if value := r.FormValue("valid_until"); value != "" {
+		until, err := community.ParseLocalTime("2006-01-02", value)
+		if err != nil {
+			return fmt.Errorf("invalid end date: %s", value)
+		}
+		until = community.StartOfDay(community.LocalTime(until).AddDate(0, 0, 1)).UTC()
+		code.ValidUntil = &until
+	}
+
+	code.Code = r.FormValue("code")
+	code.Description = r.FormValue("description")
+	code.Products = r.Form["products"]
+	code.Categories = r.Form["categories"]
+	code.Tiers = r.Form["tiers"]
+	return nil
+}
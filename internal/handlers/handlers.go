@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"html"
 	"html/template"
 	"net/http"
 	"strconv"
@@ -10,30 +12,91 @@ import (
 	"time"
 
 	"samskipnad/internal/auth"
+	"samskipnad/internal/booking"
 	"samskipnad/internal/config"
+	"samskipnad/internal/discounts"
+	"samskipnad/internal/ical"
+	"samskipnad/internal/instructors"
+	"samskipnad/internal/invoices"
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/memberships"
 	"samskipnad/internal/middleware"
 	"samskipnad/internal/models"
+	"samskipnad/internal/money"
 	"samskipnad/internal/payments"
+	"samskipnad/internal/resources"
+	"samskipnad/internal/scheduling"
+	"samskipnad/internal/services"
+	"samskipnad/internal/services/impl"
 
 	"github.com/gorilla/mux"
 )
 
 type Handlers struct {
-	db             *sql.DB
-	authService    *auth.Service
-	paymentService *payments.Service
-	templates      *template.Template
-}
-
-func New(db *sql.DB, authService *auth.Service, paymentService *payments.Service) *Handlers {
+	db                *sql.DB
+	authService       *auth.Service
+	paymentService    *payments.Service
+	schedulingService *scheduling.Service
+	bookingService    *booking.Service
+	klippekortService *klippekort.Service
+	membershipService *memberships.Service
+	invoiceService    *invoices.Service
+	discountService   *discounts.Service
+	instructorService *instructors.Service
+	resourceService   *resources.Service
+	icalService       *ical.Service
+	eventBus          services.EventBusService
+	templates         *template.Template
+}
+
+// New creates the handlers and the services behind them. It fails if a
+// service is misconfigured, as when CHECKIN_SECRET is missing.
+func New(db *sql.DB, authService *auth.Service, paymentService *payments.Service) (*Handlers, error) {
 	// Parse all templates
 	templates := template.Must(template.New("").Funcs(getFuncMap()).ParseGlob("web/templates/*.html"))
 
+	eventBus := impl.NewEventBusService(db)
+	bookingService, err := booking.NewService(db, eventBus, paymentService)
+	if err != nil {
+		return nil, err
+	}
+	paymentService.SetClassBooker(bookingService)
+	membershipService := memberships.NewService(db, eventBus, paymentService)
+	paymentService.SetMembershipIssuer(membershipService)
+	invoiceService := invoices.NewService(db, eventBus)
+	paymentService.SetReceiptIssuer(invoiceService)
+	instructorService := instructors.NewService(db, eventBus)
+	bookingService.SetInstructorAssigner(instructorService)
+
 	return &Handlers{
-		db:             db,
-		authService:    authService,
-		paymentService: paymentService,
-		templates:      templates,
+		db:                db,
+		authService:       authService,
+		paymentService:    paymentService,
+		schedulingService: scheduling.NewService(db),
+		bookingService:    bookingService,
+		klippekortService: klippekort.NewService(db, eventBus),
+		membershipService: membershipService,
+		invoiceService:    invoiceService,
+		discountService:   discounts.NewService(db),
+		instructorService: instructorService,
+		resourceService:   resources.NewService(db, eventBus),
+		icalService:       ical.NewService(db, bookingService),
+		eventBus:          eventBus,
+		templates:         templates,
+	}, nil
+}
+
+// StartJobs starts the background jobs behind the handlers, such as
+// klippekort expiry, membership renewals and topping up class series, and
+// returns a function that stops them
+func (h *Handlers) StartJobs() (stop func()) {
+	stopExpiry := h.klippekortService.StartExpiryJob(klippekort.DefaultExpiryInterval)
+	stopRenewals := h.membershipService.StartRenewalJob(memberships.DefaultRenewalInterval)
+	stopSeries := h.schedulingService.StartMaterialiseJob(scheduling.DefaultMaterialiseInterval)
+	return func() {
+		stopExpiry()
+		stopRenewals()
+		stopSeries()
 	}
 }
 
@@ -99,9 +162,33 @@ func getFuncMap() template.FuncMap {
 		"upper": func(s string) string {
 			return strings.ToUpper(s)
 		},
+		"deref": func(p *int) int {
+			if p == nil {
+				return 0
+			}
+			return *p
+		},
+		// local shows a stored UTC time in the community's timezone
+		"local": func(t time.Time) time.Time {
+			return config.GetCurrent().LocalTime(t)
+		},
+		// money shows an amount in øre or cents, such as a class price,
+		// in the community's currency and locale
+		"money": formatAmount,
+		// moneyIn shows an amount in another currency, such as that of a
+		// payment taken before the community changed currency
+		"moneyIn": func(amount int, currency string) string {
+			return config.GetCurrent().Format(money.New(int64(amount), currency))
+		},
 	}
 }
 
+// parseLocalTime parses a datetime-local form value, which members enter in
+// the community's timezone, into the UTC time that is stored
+func parseLocalTime(value string) (time.Time, error) {
+	return config.GetCurrent().ParseLocalTime("2006-01-02T15:04", value)
+}
+
 func (h *Handlers) Home(w http.ResponseWriter, r *http.Request) {
 	if h.authService.IsAuthenticated(r) {
 		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
@@ -199,6 +286,15 @@ func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// paymentMessages are shown on the dashboard after checkout, keyed by the
+// payment outcome in the redirect
+var paymentMessages = map[string]string{
+	"success":          "Thank you, your payment went through.",
+	"failed":           "Your payment did not go through, and you have not been charged.",
+	"class_full":       "The class filled up while you paid, so you have not been booked. Your payment has been refunded in full.",
+	"discount_used_up": "Your discount code was used up while you paid, so your purchase did not go through. Your payment has been refunded in full.",
+}
+
 func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUserFromContext(r.Context())
 	if user == nil {
@@ -218,6 +314,16 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request) {
 		userBookings = []models.Booking{} // Empty slice on error
 	}
 
+	attendance, err := h.bookingService.MemberAttendance(user.ID)
+	if err != nil {
+		attendance = nil // Stats are left out on error
+	}
+
+	membership, err := h.membershipService.Current(user.ID)
+	if err != nil {
+		membership = nil // No membership, or left out on error
+	}
+
 	community := config.GetCurrent()
 	data := map[string]interface{}{
 		"Title":           "Dashboard",
@@ -225,7 +331,9 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request) {
 		"Community":       community,
 		"UpcomingClasses": upcomingClasses,
 		"UserBookings":    userBookings,
-		"UserMembership":  nil, // TODO: Implement membership checking
+		"Attendance":      attendance,
+		"UserMembership":  membership,
+		"PaymentMessage":  paymentMessages[r.URL.Query().Get("payment")],
 	}
 
 	h.renderTemplate(w, "dashboard.html", data)
@@ -276,52 +384,71 @@ func (h *Handlers) BookClass(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check capacity
-	var currentBookings int
-	err = h.db.QueryRow("SELECT COUNT(*) FROM bookings WHERE class_id = ? AND status = 'confirmed'", classID).Scan(&currentBookings)
+	options, err := h.bookingService.PaymentOptions(user.ID, classID)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		h.writeBookingError(w, user.ID, class, err)
 		return
 	}
 
-	if currentBookings >= class.MaxCapacity {
-		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(`<div class="booking-error">Class is full</div>`))
+	// Members choose how to pay when there is more than one way; classes
+	// that are free to them are booked straight away
+	option, ok := choosePaymentOption(options, r.FormValue("pay_with"))
+	if !ok {
+		h.writePaymentOptions(w, class, options)
 		return
 	}
 
-	// Check if user already booked
-	var existingBooking int
-	err = h.db.QueryRow("SELECT COUNT(*) FROM bookings WHERE user_id = ? AND class_id = ?", user.ID, classID).Scan(&existingBooking)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
+	switch option.Method {
+	case booking.PayFree, booking.PayMembership:
+		book := h.bookingService.Book
+		if option.Method == booking.PayMembership {
+			book = h.bookingService.BookWithMembership
+		}
+		if _, err := book(user.ID, classID); err != nil {
+			h.writeBookingError(w, user.ID, class, err)
+			return
+		}
 
-	if existingBooking > 0 {
 		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(`<div class="booking-error">Already booked</div>`))
+		w.Header().Set("HX-Trigger", "booking-updated")
+		w.Write([]byte(`<div class="booking-success">Successfully booked ` + html.EscapeString(class.Name) + `!</div>`))
 		return
-	}
-
-	// If class is free, book directly
-	if class.Price == 0 {
-		err = h.bookClassDirectly(user.ID, classID)
-		if err != nil {
-			http.Error(w, "Failed to book class", http.StatusInternalServerError)
+	case booking.PayKlipp:
+		if _, err := h.bookingService.BookWithKlipp(user.ID, classID); err != nil {
+			h.writeBookingError(w, user.ID, class, err)
+			return
+		}
+		h.writeKlippBookingSuccess(w, user, class)
+		return
+	case booking.PayTicket:
+		if _, err := h.bookingService.BookWithTicket(user.ID, classID); err != nil {
+			h.writeBookingError(w, user.ID, class, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "text/html")
 		w.Header().Set("HX-Trigger", "booking-updated")
-		w.Write([]byte(`<div class="booking-success">Successfully booked ` + class.Name + `!</div>`))
+		w.Write([]byte(`<div class="booking-success">Successfully booked ` + html.EscapeString(class.Name) + ` with your ticket!</div>`))
 		return
 	}
 
-	// For paid classes, create payment intent
-	paymentIntent, err := h.paymentService.CreatePaymentIntent(user.ID, classID, int64(class.Price))
+	// Paying the drop-in price: apply any discount code, hold the seat and
+	// create payment intent
+	discount, err := h.applyDiscount(user, r.FormValue("discount_code"), discounts.Purchase{
+		Product:  discounts.ProductClass,
+		Category: class.CategoryID,
+		Amount:   class.Price,
+	})
 	if err != nil {
-		http.Error(w, "Failed to create payment", http.StatusInternalServerError)
+		writeDiscountError(w, err)
+		return
+	}
+	paymentIntent, err := h.holdSeatForPayment(user.ID, class, discount)
+	if err != nil {
+		h.writeBookingError(w, user.ID, class, err)
+		return
+	}
+	if redirectToProvider(w, r, paymentIntent) {
 		return
 	}
 
@@ -331,8 +458,10 @@ func (h *Handlers) BookClass(w http.ResponseWriter, r *http.Request) {
 			ID           string
 			ClientSecret string
 		}
-		Class *models.Class
-		User  *models.User
+		Class    *models.Class
+		User     *models.User
+		Discount *payments.Discount
+		Total    int
 	}{
 		PaymentIntent: &struct {
 			ID           string
@@ -341,8 +470,10 @@ func (h *Handlers) BookClass(w http.ResponseWriter, r *http.Request) {
 			ID:           paymentIntent.ID,
 			ClientSecret: paymentIntent.ClientSecret,
 		},
-		Class: class,
-		User:  user,
+		Class:    class,
+		User:     user,
+		Discount: discount,
+		Total:    paymentIntent.Amount,
 	}
 
 	// Render payment form as HTML fragment
@@ -354,11 +485,36 @@ func (h *Handlers) BookClass(w http.ResponseWriter, r *http.Request) {
 				<span>Class:</span>
 				<span class="text-white">{{.Class.Name}}</span>
 			</div>
+			{{if .Discount}}
+			<div class="d-flex justify-content-between">
+				<span>Price:</span>
+				<span class="text-white">{{money .Class.Price}}</span>
+			</div>
+			<div class="d-flex justify-content-between">
+				<span>Discount {{.Discount.Code}}:</span>
+				<span class="text-success">&minus;{{money .Discount.Amount}}</span>
+			</div>
+			<div class="d-flex justify-content-between">
+				<span>Total:</span>
+				<span class="payment-total">{{money .Total}}</span>
+			</div>
+			{{else}}
 			<div class="d-flex justify-content-between">
 				<span>Price:</span>
-				<span class="payment-total">${{printf "%.2f" (divf (float64 .Class.Price) 100.0)}}</span>
+				<span class="payment-total">{{money .Class.Price}}</span>
 			</div>
+			{{end}}
 		</div>
+		{{if not .Discount}}
+		<form class="d-flex mb-3"
+			  hx-post="/classes/{{.Class.ID}}/book"
+			  hx-vals='{"pay_with": "card"}'
+			  hx-target="#booking-result-{{.Class.ID}}"
+			  hx-swap="innerHTML">
+			<input type="text" name="discount_code" class="form-control form-control-sm me-2" placeholder="Discount code" required>
+			<button type="submit" class="btn btn-sm btn-outline-secondary text-nowrap">Apply</button>
+		</form>
+		{{end}}
 		<div id="payment-element-{{.Class.ID}}" class="mb-3"></div>
 		<button id="submit-payment-{{.Class.ID}}" class="btn btn-primary w-100">Pay Now</button>
 		<div id="payment-messages-{{.Class.ID}}" class="mt-2"></div>
@@ -406,17 +562,7 @@ func (h *Handlers) BookClass(w http.ResponseWriter, r *http.Request) {
 		})();
 	</script>`
 
-	t, err := template.New("payment-form").Funcs(template.FuncMap{
-		"divf": func(a, b float64) float64 {
-			if b != 0 {
-				return a / b
-			}
-			return 0
-		},
-		"float64": func(i int) float64 {
-			return float64(i)
-		},
-	}).Parse(tmpl)
+	t, err := template.New("payment-form").Funcs(getFuncMap()).Parse(tmpl)
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 		return
@@ -437,11 +583,24 @@ func (h *Handlers) Memberships(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	membership, err := h.membershipService.Current(user.ID)
+	if err != nil && !errors.Is(err, memberships.ErrMembershipNotFound) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	community := config.GetCurrent()
 	data := map[string]interface{}{
-		"Title":     "Memberships",
-		"User":      user,
-		"Community": community,
+		"Title":         "Memberships",
+		"User":          user,
+		"Community":     community,
+		"Membership":    membership,
+		"DiscountError": discountErrorMessage(r.URL.Query().Get("discount_error")),
+	}
+	if membership != nil && membership.Tier != "" {
+		if tier, ok := community.MembershipTierByID(membership.Tier); ok {
+			data["MembershipTier"] = tier
+		}
 	}
 
 	h.renderTemplate(w, "memberships.html", data)
@@ -504,17 +663,32 @@ func (h *Handlers) KlippekortPurchase(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create payment intent for klippekort purchase
+	// Create payment intent for klippekort purchase, less any discount code
+	price := community.Price(selectedPackage.Price).Amount
+	discount, err := h.applyDiscount(user, r.FormValue("discount_code"), discounts.Purchase{
+		Product:  discounts.ProductKlippekort,
+		Category: categoryID,
+		Amount:   int(price),
+	})
+	if err != nil {
+		writeDiscountError(w, err)
+		return
+	}
 	paymentIntent, err := h.paymentService.CreateKlippekortPaymentIntent(
 		user.ID,
 		categoryID,
 		selectedPackage.Klipp,
-		int64(selectedPackage.Price),
+		selectedPackage.ValidDays,
+		price,
+		discount,
 	)
 	if err != nil {
 		http.Error(w, "Failed to create payment", http.StatusInternalServerError)
 		return
 	}
+	if redirectToProvider(w, r, paymentIntent) {
+		return
+	}
 
 	// Return payment form
 	data := map[string]interface{}{
@@ -522,6 +696,7 @@ func (h *Handlers) KlippekortPurchase(w http.ResponseWriter, r *http.Request) {
 		"Package":       selectedPackage,
 		"Category":      selectedCategory,
 		"Community":     community,
+		"Discount":      discount,
 	}
 
 	h.renderTemplate(w, "klippekort-payment.html", data)
@@ -593,12 +768,33 @@ func (h *Handlers) AdminClasses(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		staff, err := h.instructorService.Instructors(user.TenantID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		substituteRequests, err := h.instructorService.OpenRequests(user.TenantID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rooms, err := h.resourceService.Resources(user.TenantID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		community := config.GetCurrent()
 		data := map[string]interface{}{
-			"Title":     "Manage Classes",
-			"User":      user,
-			"Community": community,
-			"Classes":   classes,
+			"Title":              "Manage Classes",
+			"User":               user,
+			"Community":          community,
+			"Classes":            classes,
+			"Instructors":        staff,
+			"SubstituteRequests": substituteRequests,
+			"Resources":          rooms,
 		}
 
 		h.renderTemplate(w, "admin-classes.html", data)
@@ -613,23 +809,107 @@ func (h *Handlers) AdminClasses(w http.ResponseWriter, r *http.Request) {
 	maxCapacity, _ := strconv.Atoi(r.FormValue("max_capacity"))
 	price, _ := strconv.Atoi(r.FormValue("price"))
 
-	startTimeParsed, err := time.Parse("2006-01-02T15:04", startTime)
+	startTimeParsed, err := parseLocalTime(startTime)
 	if err != nil {
 		http.Error(w, "Invalid start time", http.StatusBadRequest)
 		return
 	}
 
-	endTimeParsed, err := time.Parse("2006-01-02T15:04", endTime)
+	endTimeParsed, err := parseLocalTime(endTime)
 	if err != nil {
 		http.Error(w, "Invalid end time", http.StatusBadRequest)
 		return
 	}
 
-	_, err = h.db.Exec(`
-		INSERT INTO classes (tenant_id, name, description, instructor_id, start_time, end_time, max_capacity, price, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		user.TenantID, name, description, user.ID, startTimeParsed, endTimeParsed, maxCapacity, price, time.Now(), time.Now())
+	categoryID, err := klippCategoryFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resourceID, err := h.resourceFromForm(r, "resource_id", user.TenantID, nil)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inductionFor, err := h.resourceFromForm(r, "induction_for", user.TenantID, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	instructorID := user.ID
+	if id, err := strconv.Atoi(r.FormValue("instructor_id")); err == nil {
+		ok, err := h.instructorService.IsInstructor(id, user.TenantID)
+		if err != nil || !ok {
+			http.Error(w, "Invalid instructor", http.StatusBadRequest)
+			return
+		}
+		instructorID = id
+	}
+
+	if r.FormValue("repeat") == "on" {
+		// Occurrences repeat at the same local time, across daylight saving
+		// changes, so the series starts in the community's timezone
+		localStart := config.GetCurrent().LocalTime(startTimeParsed)
+		rrule, err := recurrenceFromForm(r, localStart)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		series := &models.ClassSeries{
+			TenantID:           user.TenantID,
+			Name:               name,
+			Description:        description,
+			InstructorID:       instructorID,
+			DTStart:            localStart,
+			DurationMinutes:    int(endTimeParsed.Sub(startTimeParsed).Minutes()),
+			RRule:              rrule,
+			MaxCapacity:        maxCapacity,
+			Price:              price,
+			RequiresTicket:     r.FormValue("requires_ticket") == "on",
+			RequiresMembership: r.FormValue("requires_membership") == "on",
+			CategoryID:         categoryID,
+			ResourceID:         resourceID,
+			InductionFor:       inductionFor,
+		}
+		if err := h.schedulingService.CreateSeries(series); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, resources.ErrConflict) {
+				status = http.StatusConflict
+			}
+			http.Error(w, "Failed to create class series: "+err.Error(), status)
+			return
+		}
+
+		http.Redirect(w, r, "/admin/classes", http.StatusSeeOther)
+		return
+	}
+
+	class := &models.Class{
+		TenantID:     user.TenantID,
+		Name:         name,
+		Description:  description,
+		InstructorID: instructorID,
+		StartTime:    startTimeParsed,
+		EndTime:      endTimeParsed,
+		MaxCapacity:  maxCapacity,
+		Price:        price,
+		CategoryID:   categoryID,
+		ResourceID:   resourceID,
+		InductionFor: inductionFor,
+	}
+	err = h.bookingService.CreateClass(class)
+	switch {
+	case err == nil:
+	case errors.Is(err, resources.ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, booking.ErrInvalidClassTime), errors.Is(err, resources.ErrResourceNotFound):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
 		http.Error(w, "Failed to create class", http.StatusInternalServerError)
 		return
 	}
@@ -637,14 +917,154 @@ func (h *Handlers) AdminClasses(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin/classes", http.StatusSeeOther)
 }
 
+// EditClass renders the edit form for a class on GET and saves the changes
+// otherwise. Booked members are notified if the class moves.
 func (h *Handlers) EditClass(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement edit class functionality
-	http.Error(w, "Not implemented", http.StatusNotImplemented)
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	class, err := h.getClassByID(classID)
+	if err != nil || class.TenantID != user.TenantID {
+		http.Error(w, "Class not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		staff, err := h.instructorService.Instructors(user.TenantID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rooms, err := h.resourceService.Resources(user.TenantID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		data := map[string]interface{}{
+			"Class":       class,
+			"Instructors": staff,
+			"Resources":   rooms,
+			"Community":   config.GetCurrent(),
+		}
+		h.renderTemplate(w, "class-edit-form", data)
+		return
+	}
+
+	startTime, err := parseLocalTime(r.FormValue("start_time"))
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return
+	}
+	endTime, err := parseLocalTime(r.FormValue("end_time"))
+	if err != nil {
+		http.Error(w, "Invalid end time", http.StatusBadRequest)
+		return
+	}
+	maxCapacity, err := strconv.Atoi(r.FormValue("max_capacity"))
+	if err != nil || maxCapacity < 1 {
+		http.Error(w, "Invalid capacity", http.StatusBadRequest)
+		return
+	}
+	price, err := strconv.Atoi(r.FormValue("price"))
+	if err != nil || price < 0 {
+		http.Error(w, "Invalid price", http.StatusBadRequest)
+		return
+	}
+	instructorID, err := strconv.Atoi(r.FormValue("instructor_id"))
+	if err != nil {
+		instructorID = class.InstructorID
+	}
+	categoryID, err := klippCategoryFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resourceID, err := h.resourceFromForm(r, "resource_id", user.TenantID, class.ResourceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inductionFor, err := h.resourceFromForm(r, "induction_for", user.TenantID, class.InductionFor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	update := &models.Class{
+		ID:           class.ID,
+		Name:         r.FormValue("name"),
+		Description:  r.FormValue("description"),
+		InstructorID: instructorID,
+		StartTime:    startTime,
+		EndTime:      endTime,
+		MaxCapacity:  maxCapacity,
+		Price:        price,
+		CategoryID:   categoryID,
+		ResourceID:   resourceID,
+		InductionFor: inductionFor,
+	}
+
+	err = h.bookingService.UpdateClass(update)
+	w.Header().Set("Content-Type", "text/html")
+	if errors.Is(err, resources.ErrConflict) {
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+		return
+	}
+	switch err {
+	case nil:
+		w.Header().Set("HX-Trigger", "classes-updated")
+		w.Write([]byte(`<div class="booking-success">Class updated</div>`))
+	case booking.ErrInvalidClassTime, booking.ErrCapacityBelowBookings, instructors.ErrNotInstructor:
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to update class", http.StatusInternalServerError)
+	}
 }
 
+// DeleteClass deletes a class, cancelling its bookings. Booked members are
+// notified and get their payment refunded or klipp returned.
 func (h *Handlers) DeleteClass(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement delete class functionality
-	http.Error(w, "Not implemented", http.StatusNotImplemented)
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	class, err := h.getClassByID(classID)
+	if err != nil || class.TenantID != user.TenantID {
+		http.Error(w, "Class not found", http.StatusNotFound)
+		return
+	}
+
+	cancelled, err := h.bookingService.DeleteClass(classID)
+	if err != nil {
+		http.Error(w, "Failed to delete class", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Class deleted"
+	if cancelled > 0 {
+		message = fmt.Sprintf("Class cancelled; %d booked members were notified and refunded", cancelled)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(`<tr><td colspan="8"><div class="booking-success">` + message + `</div></td></tr>`))
 }
 
 func (h *Handlers) AdminUsers(w http.ResponseWriter, r *http.Request) {
@@ -657,11 +1077,6 @@ func (h *Handlers) AdminRoles(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Not implemented", http.StatusNotImplemented)
 }
 
-func (h *Handlers) AdminPayments(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement payment management
-	http.Error(w, "Not implemented", http.StatusNotImplemented)
-}
-
 func (h *Handlers) Calendar(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value("user").(*models.User)
 	if !ok {
@@ -670,7 +1085,8 @@ func (h *Handlers) Calendar(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get month and year from query params, default to current month
-	now := time.Now()
+	community := config.GetCurrent()
+	now := community.LocalTime(time.Now())
 	yearStr := r.URL.Query().Get("year")
 	monthStr := r.URL.Query().Get("month")
 
@@ -689,9 +1105,9 @@ func (h *Handlers) Calendar(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Get classes for the month
-	startOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
-	endOfMonth := startOfMonth.AddDate(0, 1, -1)
+	// Get classes for the month, in the community's timezone
+	startOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, community.Location())
+	endOfMonth := startOfMonth.AddDate(0, 1, 0)
 
 	classes, err := h.getClassesForDateRange(user.TenantID, startOfMonth, endOfMonth)
 	if err != nil {
@@ -700,7 +1116,7 @@ func (h *Handlers) Calendar(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Build calendar data
-	calendarData := h.buildCalendarData(year, month, classes)
+	calendarData := h.buildCalendarData(startOfMonth, classes)
 
 	data := struct {
 		Title        string
@@ -713,9 +1129,9 @@ func (h *Handlers) Calendar(w http.ResponseWriter, r *http.Request) {
 		Title:        "Calendar",
 		User:         user,
 		CalendarData: calendarData,
-		CurrentMonth: time.Date(year, month, 1, 0, 0, 0, 0, time.UTC),
-		PrevMonth:    time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0),
-		NextMonth:    time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0),
+		CurrentMonth: startOfMonth,
+		PrevMonth:    startOfMonth.AddDate(0, -1, 0),
+		NextMonth:    startOfMonth.AddDate(0, 1, 0),
 	}
 
 	h.renderTemplate(w, "calendar.html", data)
@@ -736,10 +1152,12 @@ type CalendarDay struct {
 	Classes      []models.Class
 }
 
-func (h *Handlers) buildCalendarData(year int, month time.Month, classes []models.Class) CalendarData {
-	firstDay := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+// buildCalendarData lays out the month starting at firstDay, local midnight
+// in the community's timezone, placing classes on their local day
+func (h *Handlers) buildCalendarData(firstDay time.Time, classes []models.Class) CalendarData {
+	year, month := firstDay.Year(), firstDay.Month()
 	lastDay := firstDay.AddDate(0, 1, -1)
-	today := time.Now()
+	today := time.Now().In(firstDay.Location())
 
 	// Start from Monday of the week containing the first day
 	startDate := firstDay
@@ -757,7 +1175,8 @@ func (h *Handlers) buildCalendarData(year int, month time.Month, classes []model
 	for d := startDate; !d.After(endDate); d = d.AddDate(0, 0, 1) {
 		var dayClasses []models.Class
 		for _, class := range classes {
-			if class.StartTime.Day() == d.Day() && class.StartTime.Month() == d.Month() {
+			start := class.StartTime.In(d.Location())
+			if start.Day() == d.Day() && start.Month() == d.Month() {
 				dayClasses = append(dayClasses, class)
 			}
 		}
@@ -783,8 +1202,8 @@ func (h *Handlers) getClassesForDateRange(tenantID int, start, end time.Time) ([
 	rows, err := h.db.Query(`
 		SELECT id, name, description, instructor_id, start_time, end_time, max_capacity, price
 		FROM classes
-		WHERE tenant_id = ? AND start_time >= ? AND start_time <= ? AND active = true
-		ORDER BY start_time ASC`, tenantID, start, end)
+		WHERE tenant_id = ? AND start_time >= ? AND start_time < ? AND active = true
+		ORDER BY start_time ASC`, tenantID, start.UTC(), end.UTC())
 	if err != nil {
 		return nil, err
 	}
@@ -815,15 +1234,17 @@ func (h *Handlers) CalendarDayDetails(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	dateStr := vars["date"]
 
-	date, err := time.Parse("2006-01-02", dateStr)
+	// The day runs from local midnight to local midnight, which is 23 or 25
+	// hours on the days the clocks change
+	date, err := time.ParseInLocation("2006-01-02", dateStr, config.GetCurrent().Location())
 	if err != nil {
 		http.Error(w, "Invalid date format", http.StatusBadRequest)
 		return
 	}
 
 	// Get classes for the specific day
-	startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
-	endOfDay := startOfDay.Add(24 * time.Hour)
+	startOfDay := date
+	endOfDay := startOfDay.AddDate(0, 0, 1)
 
 	classes, err := h.getClassesForDateRange(user.TenantID, startOfDay, endOfDay)
 	if err != nil {
@@ -865,7 +1286,7 @@ func (h *Handlers) CalendarDayDetails(w http.ResponseWriter, r *http.Request) {
 				<div class="class-details">
 					<div class="detail-item">
 						<span class="detail-label">Time:</span>
-						<span class="detail-value">{{.StartTime.Format "15:04"}} - {{.EndTime.Format "15:04"}}</span>
+						<span class="detail-value">{{(local .StartTime).Format "15:04"}} - {{(local .EndTime).Format "15:04"}}</span>
 					</div>
 					<div class="detail-item">
 						<span class="detail-label">Duration:</span>
@@ -875,7 +1296,7 @@ func (h *Handlers) CalendarDayDetails(w http.ResponseWriter, r *http.Request) {
 						<span class="detail-label">Price:</span>
 						<span class="detail-value">
 							{{if gt .Price 0}}
-								${{printf "%.2f" (divf (float64 .Price) 100.0)}}
+								{{money .Price}}
 							{{else}}
 								Free
 							{{end}}
@@ -906,17 +1327,7 @@ func (h *Handlers) CalendarDayDetails(w http.ResponseWriter, r *http.Request) {
 		<p class="text-muted">No classes scheduled for this day.</p>
 	{{end}}`
 
-	t, err := template.New("day-details").Funcs(template.FuncMap{
-		"divf": func(a, b float64) float64 {
-			if b != 0 {
-				return a / b
-			}
-			return 0
-		},
-		"float64": func(i int) float64 {
-			return float64(i)
-		},
-	}).Parse(tmpl)
+	t, err := template.New("day-details").Funcs(getFuncMap()).Parse(tmpl)
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 		return
@@ -955,9 +1366,8 @@ func (h *Handlers) CreateClassPayment(w http.ResponseWriter, r *http.Request) {
 
 	if class.Price == 0 {
 		// Free class, book directly
-		err = h.bookClassDirectly(user.ID, classID)
-		if err != nil {
-			http.Error(w, "Failed to book class", http.StatusInternalServerError)
+		if _, err := h.bookingService.Book(user.ID, classID); err != nil {
+			h.writeBookingError(w, user.ID, class, err)
 			return
 		}
 
@@ -966,10 +1376,13 @@ func (h *Handlers) CreateClassPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create payment intent for paid class
-	paymentIntent, err := h.paymentService.CreatePaymentIntent(user.ID, classID, int64(class.Price))
+	// Hold the seat and create payment intent for paid class
+	paymentIntent, err := h.holdSeatForPayment(user.ID, class, nil)
 	if err != nil {
-		http.Error(w, "Failed to create payment", http.StatusInternalServerError)
+		h.writeBookingError(w, user.ID, class, err)
+		return
+	}
+	if redirectToProvider(w, r, paymentIntent) {
 		return
 	}
 
@@ -998,7 +1411,7 @@ func (h *Handlers) CreateClassPayment(w http.ResponseWriter, r *http.Request) {
 	<div class="payment-form">
 		<h6>Payment Required</h6>
 		<p>Class: {{.Class.Name}}</p>
-		<p>Price: ${{printf "%.2f" (divf (float64 .Class.Price) 100.0)}}</p>
+		<p>Price: {{money .Class.Price}}</p>
 		<div id="payment-element"></div>
 		<button id="submit-payment" class="btn btn-primary mt-3">Pay Now</button>
 		<div id="payment-messages" class="mt-2"></div>
@@ -1028,17 +1441,7 @@ func (h *Handlers) CreateClassPayment(w http.ResponseWriter, r *http.Request) {
 		});
 	</script>`
 
-	t, err := template.New("payment-form").Funcs(template.FuncMap{
-		"divf": func(a, b float64) float64 {
-			if b != 0 {
-				return a / b
-			}
-			return 0
-		},
-		"float64": func(i int) float64 {
-			return float64(i)
-		},
-	}).Parse(tmpl)
+	t, err := template.New("payment-form").Funcs(getFuncMap()).Parse(tmpl)
 	if err != nil {
 		http.Error(w, "Template error", http.StatusInternalServerError)
 		return
@@ -1067,6 +1470,20 @@ func (h *Handlers) PaymentSuccess(w http.ResponseWriter, r *http.Request) {
 
 	// Confirm the payment
 	err := h.paymentService.ConfirmPayment(paymentIntentID)
+	if errors.Is(err, payments.ErrPaymentNotSucceeded) {
+		// The member cancelled or was declined, for example in Vipps
+		http.Redirect(w, r, "/dashboard?payment=failed", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, booking.ErrClassFullRefunded) {
+		// The seat was lost while the member paid
+		http.Redirect(w, r, "/dashboard?payment=class_full", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, payments.ErrDiscountUsedUp) {
+		http.Redirect(w, r, "/dashboard?payment=discount_used_up", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Payment confirmation failed", http.StatusInternalServerError)
 		return
@@ -1086,11 +1503,13 @@ func (h *Handlers) MembershipPayment(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		// Show membership options
 		data := struct {
-			Title string
-			User  *models.User
+			Title     string
+			User      *models.User
+			Community *config.Community
 		}{
-			Title: "Purchase Membership",
-			User:  user,
+			Title:     "Purchase Membership",
+			User:      user,
+			Community: config.GetCurrent(),
 		}
 
 		h.renderTemplate(w, "membership-payment.html", data)
@@ -1104,24 +1523,45 @@ func (h *Handlers) MembershipPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set prices based on type from community config
-	community := config.GetCurrent()
-	var amount int64
-	switch membershipType {
-	case "monthly":
-		amount = int64(community.Pricing.Monthly * 100) // Convert to cents
-	case "yearly":
-		amount = int64(community.Pricing.Yearly * 100) // Convert to cents
-	default:
+	// Memberships renew with the saved card, unless the payment provider
+	// cannot charge renewals; then they are bought one period at a time.
+	// Without a tier the member buys the standard membership. A discount
+	// code is taken off the first payment only.
+	tier := r.FormValue("tier")
+	amount, err := h.membershipService.Price(tier, membershipType)
+	var discount *payments.Discount
+	if err == nil {
+		discount, err = h.applyDiscount(user, r.FormValue("discount_code"), discounts.Purchase{
+			Product: discounts.ProductMembership,
+			Tier:    tier,
+			Amount:  amount,
+		})
+		if key, ok := discountErrorKey(err); ok {
+			http.Redirect(w, r, "/memberships?discount_error="+key, http.StatusSeeOther)
+			return
+		}
+	}
+	var paymentIntent *payments.Intent
+	if err == nil {
+		paymentIntent, err = h.membershipService.CreateSubscription(user.ID, tier, membershipType, discount)
+	}
+	if errors.Is(err, payments.ErrRecurringNotSupported) {
+		paymentIntent, err = h.paymentService.CreateMembershipPaymentIntent(user.ID, tier, membershipType, int64(amount), discount)
+	}
+	switch {
+	case errors.Is(err, memberships.ErrUnknownPlan):
 		http.Error(w, "Invalid membership type", http.StatusBadRequest)
 		return
-	}
-
-	paymentIntent, err := h.paymentService.CreateMembershipPaymentIntent(user.ID, membershipType, amount)
-	if err != nil {
+	case errors.Is(err, memberships.ErrAlreadySubscribed):
+		http.Redirect(w, r, "/memberships", http.StatusSeeOther)
+		return
+	case err != nil:
 		http.Error(w, "Failed to create payment", http.StatusInternalServerError)
 		return
 	}
+	if redirectToProvider(w, r, paymentIntent) {
+		return
+	}
 
 	// Redirect to payment page
 	http.Redirect(w, r, fmt.Sprintf("/payment/membership?payment_intent=%s", paymentIntent.ID), http.StatusSeeOther)
@@ -1130,43 +1570,150 @@ func (h *Handlers) MembershipPayment(w http.ResponseWriter, r *http.Request) {
 // Helper methods for payments
 
 func (h *Handlers) getClassByID(classID int) (*models.Class, error) {
-	query := `SELECT id, name, description, instructor_id, start_time, end_time, max_capacity, price, tenant_id
+	query := `SELECT id, name, description, instructor_id, start_time, end_time, max_capacity, price, tenant_id,
+			  COALESCE(category_id, ''), resource_id, induction_resource_id
 			  FROM classes WHERE id = ? AND active = true`
 
 	var class models.Class
+	var resourceID, inductionFor sql.NullInt64
 	err := h.db.QueryRow(query, classID).Scan(
 		&class.ID, &class.Name, &class.Description, &class.InstructorID,
-		&class.StartTime, &class.EndTime, &class.MaxCapacity, &class.Price, &class.TenantID,
+		&class.StartTime, &class.EndTime, &class.MaxCapacity, &class.Price, &class.TenantID, &class.CategoryID,
+		&resourceID, &inductionFor,
 	)
 
 	if err != nil {
 		return nil, err
 	}
+	if resourceID.Valid {
+		id := int(resourceID.Int64)
+		class.ResourceID = &id
+	}
+	if inductionFor.Valid {
+		id := int(inductionFor.Int64)
+		class.InductionFor = &id
+	}
 
 	return &class, nil
 }
 
-func (h *Handlers) bookClassDirectly(userID, classID int) error {
-	query := `INSERT INTO bookings (user_id, class_id, status, created_at, updated_at)
-			  VALUES (?, ?, 'confirmed', datetime('now'), datetime('now'))`
-
-	_, err := h.db.Exec(query, userID, classID)
-	return err
-}
-
 // API handlers for HTMX
 func (h *Handlers) SearchClasses(w http.ResponseWriter, r *http.Request) {
 	// TODO: Implement class search
 	http.Error(w, "Not implemented", http.StatusNotImplemented)
 }
 
+// CancelBooking cancels one of the current user's bookings under the
+// community's cancellation policy
 func (h *Handlers) CancelBooking(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement booking cancellation
-	http.Error(w, "Not implemented", http.StatusNotImplemented)
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	bookingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.bookingService.GetBooking(bookingID)
+	if err != nil || existing.UserID != user.ID {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	terms, err := h.bookingService.Cancel(bookingID)
+	if err == booking.ErrCancellationClosed {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">The class has started and can no longer be cancelled</div>`))
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to cancel booking", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Booking cancelled"
+	switch {
+	case terms.Refund > 0 && terms.Fee > 0:
+		message = fmt.Sprintf("Booking cancelled. %s will be refunded; a late cancellation fee of %s applies.",
+			formatAmount(terms.Refund), formatAmount(terms.Fee))
+	case terms.Refund > 0:
+		message = fmt.Sprintf("Booking cancelled. %s will be refunded.", formatAmount(terms.Refund))
+	case terms.Fee > 0:
+		message = "Booking cancelled. Late cancellations are not refunded."
+	case existing.KlippekortID != nil && terms.ReturnsKlipp:
+		message = "Booking cancelled. Your klipp has been returned."
+	case existing.KlippekortID != nil:
+		message = "Booking cancelled. Late cancellations do not return the klipp."
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("HX-Trigger", "booking-updated")
+	fmt.Fprintf(w, `<div class="booking-success">%s</div>`, template.HTMLEscapeString(message))
+}
+
+// MarkNoShow records that a member did not turn up for a class and applies
+// the community's no-show fee. Only the instructor who teaches the class or
+// an admin of its tenant can mark a no-show.
+func (h *Handlers) MarkNoShow(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	bookingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.bookingService.GetBooking(bookingID)
+	if err != nil {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+	class, err := h.getClassByID(existing.ClassID)
+	if err != nil || class.TenantID != user.TenantID {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+	if class.InstructorID != user.ID && user.Role != "admin" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	err = h.bookingService.MarkNoShow(bookingID)
+	w.Header().Set("Content-Type", "text/html")
+	switch err {
+	case nil:
+		w.Write([]byte(`<div class="booking-success">Marked as no-show</div>`))
+	case booking.ErrBookingNotFound:
+		http.Error(w, "Booking not found", http.StatusNotFound)
+	case booking.ErrBookingNotConfirmed:
+		w.Write([]byte(`<div class="booking-error">Only confirmed bookings can be marked as no-show</div>`))
+	case booking.ErrClassNotStarted:
+		w.Write([]byte(`<div class="booking-error">The class has not started yet</div>`))
+	case booking.ErrCheckedIn:
+		w.Write([]byte(`<div class="booking-error">The member checked in for this class</div>`))
+	default:
+		http.Error(w, "Failed to mark no-show", http.StatusInternalServerError)
+	}
 }
 
 // Helper methods
 func (h *Handlers) renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
+	// HTMX fragments are defined by name in the shared template set
+	if !strings.HasSuffix(tmpl, ".html") {
+		if err := h.templates.ExecuteTemplate(w, tmpl, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
 	// For templates that extend base, we need to execute the base template
 	if tmpl != "home-standalone.html" && tmpl != "login-standalone.html" && tmpl != "register-standalone.html" && tmpl != "admin-dashboard-standalone.html" && tmpl != "dashboard-standalone.html" {
 		// Parse the specific template along with base
@@ -1189,7 +1736,7 @@ func (h *Handlers) getFuncMap() template.FuncMap {
 
 func (h *Handlers) getUpcomingClasses(tenantID int) ([]models.Class, error) {
 	rows, err := h.db.Query(`
-		SELECT id, name, description, instructor_id, start_time, end_time, max_capacity, price
+		SELECT id, name, description, instructor_id, start_time, end_time, max_capacity, price, COALESCE(category_id, '')
 		FROM classes
 		WHERE tenant_id = ? AND start_time > ? AND active = true
 		ORDER BY start_time ASC
@@ -1203,7 +1750,7 @@ func (h *Handlers) getUpcomingClasses(tenantID int) ([]models.Class, error) {
 	for rows.Next() {
 		var class models.Class
 		err := rows.Scan(&class.ID, &class.Name, &class.Description, &class.InstructorID,
-			&class.StartTime, &class.EndTime, &class.MaxCapacity, &class.Price)
+			&class.StartTime, &class.EndTime, &class.MaxCapacity, &class.Price, &class.CategoryID)
 		if err != nil {
 			return nil, err
 		}
@@ -1215,7 +1762,8 @@ func (h *Handlers) getUpcomingClasses(tenantID int) ([]models.Class, error) {
 
 func (h *Handlers) getAllClasses(tenantID int) ([]models.Class, error) {
 	rows, err := h.db.Query(`
-		SELECT id, name, description, instructor_id, start_time, end_time, max_capacity, price
+		SELECT id, name, description, instructor_id, start_time, end_time, max_capacity, price, active, series_id,
+			COALESCE(category_id, ''), resource_id, induction_resource_id
 		FROM classes
 		WHERE tenant_id = ? AND active = true
 		ORDER BY start_time ASC`, tenantID)
@@ -1227,11 +1775,25 @@ func (h *Handlers) getAllClasses(tenantID int) ([]models.Class, error) {
 	var classes []models.Class
 	for rows.Next() {
 		var class models.Class
+		var seriesID, resourceID, inductionFor sql.NullInt64
 		err := rows.Scan(&class.ID, &class.Name, &class.Description, &class.InstructorID,
-			&class.StartTime, &class.EndTime, &class.MaxCapacity, &class.Price)
+			&class.StartTime, &class.EndTime, &class.MaxCapacity, &class.Price, &class.Active, &seriesID,
+			&class.CategoryID, &resourceID, &inductionFor)
 		if err != nil {
 			return nil, err
 		}
+		if seriesID.Valid {
+			id := int(seriesID.Int64)
+			class.SeriesID = &id
+		}
+		if resourceID.Valid {
+			id := int(resourceID.Int64)
+			class.ResourceID = &id
+		}
+		if inductionFor.Valid {
+			id := int(inductionFor.Int64)
+			class.InductionFor = &id
+		}
 		classes = append(classes, class)
 	}
 
@@ -1240,10 +1802,11 @@ func (h *Handlers) getAllClasses(tenantID int) ([]models.Class, error) {
 
 func (h *Handlers) getUserBookings(userID int) ([]models.Booking, error) {
 	rows, err := h.db.Query(`
-		SELECT id, user_id, class_id, status, created_at
-		FROM bookings
-		WHERE user_id = ? AND status = 'confirmed'
-		ORDER BY created_at DESC`, userID)
+		SELECT b.id, b.user_id, b.class_id, b.status, b.klippekort_id, b.created_at,
+			c.name, c.start_time, c.end_time, c.price
+		FROM bookings b JOIN classes c ON c.id = b.class_id
+		WHERE b.user_id = ? AND b.status = 'confirmed' AND c.start_time > ?
+		ORDER BY c.start_time ASC`, userID, time.Now().UTC())
 	if err != nil {
 		return nil, err
 	}
@@ -1252,16 +1815,31 @@ func (h *Handlers) getUserBookings(userID int) ([]models.Booking, error) {
 	var bookings []models.Booking
 	for rows.Next() {
 		var booking models.Booking
-		err := rows.Scan(&booking.ID, &booking.UserID, &booking.ClassID, &booking.Status, &booking.CreatedAt)
+		var klippekortID sql.NullInt64
+		class := &models.Class{}
+		err := rows.Scan(&booking.ID, &booking.UserID, &booking.ClassID, &booking.Status, &klippekortID, &booking.CreatedAt,
+			&class.Name, &class.StartTime, &class.EndTime, &class.Price)
 		if err != nil {
 			return nil, err
 		}
+		if klippekortID.Valid {
+			id := int(klippekortID.Int64)
+			booking.KlippekortID = &id
+		}
+		class.ID = booking.ClassID
+		booking.Class = class
 		bookings = append(bookings, booking)
 	}
 
 	return bookings, nil
 }
 
+// formatAmount formats an amount in the currency's minor unit, such as
+// øre, for the community's locale
+func formatAmount(amount int) string {
+	return config.GetCurrent().FormatAmount(amount)
+}
+
 // DynamicCSS generates CSS based on community configuration
 func (h *Handlers) DynamicCSS(w http.ResponseWriter, r *http.Request) {
 	community := config.GetCurrent()
@@ -1626,16 +2204,23 @@ func (h *Handlers) KlippekortBalance(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user's klipp balances by category
-	balances, err := h.getUserKlippBalances(user.ID)
+	balances, err := h.klippekortService.Balances(user.ID, user.TenantID)
 	if err != nil {
 		http.Error(w, "Failed to get balances", http.StatusInternalServerError)
 		return
 	}
 
+	statements, err := h.klippekortService.Statements(user.ID, user.TenantID)
+	if err != nil {
+		http.Error(w, "Failed to get klipp history", http.StatusInternalServerError)
+		return
+	}
+
 	community := config.GetCurrent()
 	data := map[string]interface{}{
-		"Balances":  balances,
-		"Community": community,
+		"Balances":   balances,
+		"Statements": statements,
+		"Community":  community,
 	}
 
 	h.renderTemplate(w, "klippekort-balance", data)
@@ -1671,7 +2256,7 @@ func (h *Handlers) KlippekortCategory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get user's balance for this category
-	balance, err := h.getUserKlippBalance(user.ID, categoryID)
+	balance, err := h.klippekortService.Balance(user.ID, user.TenantID, categoryID)
 	if err != nil {
 		balance = 0 // Default to 0 if error
 	}
@@ -1725,17 +2310,32 @@ func (h *Handlers) KlippekortPurchaseInstant(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Create payment intent
+	// Create payment intent, less any discount code
+	price := community.Price(selectedPackage.Price).Amount
+	discount, err := h.applyDiscount(user, r.FormValue("discount_code"), discounts.Purchase{
+		Product:  discounts.ProductKlippekort,
+		Category: categoryID,
+		Amount:   int(price),
+	})
+	if err != nil {
+		writeDiscountError(w, err)
+		return
+	}
 	paymentIntent, err := h.paymentService.CreateKlippekortPaymentIntent(
 		user.ID,
 		categoryID,
 		selectedPackage.Klipp,
-		int64(selectedPackage.Price),
+		selectedPackage.ValidDays,
+		price,
+		discount,
 	)
 	if err != nil {
 		http.Error(w, "Failed to create payment", http.StatusInternalServerError)
 		return
 	}
+	if redirectToProvider(w, r, paymentIntent) {
+		return
+	}
 
 	// Return inline payment form
 	data := map[string]interface{}{
@@ -1743,55 +2343,8 @@ func (h *Handlers) KlippekortPurchaseInstant(w http.ResponseWriter, r *http.Requ
 		"Package":       selectedPackage,
 		"Category":      selectedCategory,
 		"Community":     community,
+		"Discount":      discount,
 	}
 
 	h.renderTemplate(w, "klippekort-purchase-form", data)
 }
-
-// Helper functions
-
-func (h *Handlers) getUserKlippBalances(userID int) (map[string]int, error) {
-	query := `
-		SELECT category_id, SUM(klipp_left) as total_klipp 
-		FROM klippekort 
-		WHERE user_id = ? AND klipp_left > 0 
-		GROUP BY category_id
-	`
-
-	rows, err := h.db.Query(query, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	balances := make(map[string]int)
-	for rows.Next() {
-		var categoryID string
-		var totalKlipp int
-		if err := rows.Scan(&categoryID, &totalKlipp); err != nil {
-			return nil, err
-		}
-		balances[categoryID] = totalKlipp
-	}
-
-	return balances, nil
-}
-
-func (h *Handlers) getUserKlippBalance(userID int, categoryID string) (int, error) {
-	query := `
-		SELECT SUM(klipp_left) as total_klipp 
-		FROM klippekort 
-		WHERE user_id = ? AND category_id = ? AND klipp_left > 0
-	`
-
-	var totalKlipp sql.NullInt64
-	err := h.db.QueryRow(query, userID, categoryID).Scan(&totalKlipp)
-	if err != nil {
-		return 0, err
-	}
-
-	if totalKlipp.Valid {
-		return int(totalKlipp.Int64), nil
-	}
-	return 0, nil
-}
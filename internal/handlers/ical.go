@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/ical"
+	"samskipnad/internal/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCalendarImport limits the size of an imported calendar file
+const maxCalendarImport = 5 << 20
+
+// calendarClient fetches calendars imported from a URL. It only connects
+// to public addresses, checked on every connection, so the import cannot
+// be pointed at the server's own network, including through redirects or
+// host names that resolve to private addresses.
+var calendarClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return checkCalendarURL(req.URL)
+	},
+}
+
+var errPrivateAddress = errors.New("the calendar URL must point to a public address")
+
+// publicIP reports whether ip is reachable on the public internet, rather
+// than on the loopback, private or link-local networks, such as the cloud
+// metadata service at 169.254.169.254
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	// Carrier-grade NAT addresses are shared within a provider's network
+	_, sharedNet, _ := net.ParseCIDR("100.64.0.0/10")
+	return !sharedNet.Contains(ip)
+}
+
+// checkCalendarURL accepts only https calendar URLs, and plain http in
+// development
+func checkCalendarURL(u *url.URL) error {
+	if u.Scheme == "https" || (u.Scheme == "http" && config.Development()) {
+		return nil
+	}
+	return errors.New("the calendar URL must start with https:// or webcal://")
+}
+
+// Calendar feed handlers
+
+// TenantCalendarFeed serves a tenant's public class timetable as an
+// iCalendar feed, for websites and calendar apps
+func (h *Handlers) TenantCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	calendar, err := h.icalService.TenantFeed(mux.Vars(r)["tenant"])
+	if errors.Is(err, ical.ErrTenantNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeCalendar(w, calendar)
+}
+
+// MemberCalendarFeed serves a member's bookings as an iCalendar feed. The
+// feed is found by the secret token in its URL, since calendar apps cannot
+// log in.
+func (h *Handlers) MemberCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	calendar, err := h.icalService.MemberFeed(mux.Vars(r)["token"])
+	if errors.Is(err, ical.ErrFeedNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeCalendar(w, calendar)
+}
+
+// CalendarFeeds shows the current member the URLs of the timetable feed
+// and their private bookings feed. A POST replaces the bookings feed URL,
+// for when it has been shared by mistake.
+func (h *Handlers) CalendarFeeds(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := h.icalService.FeedToken(user.ID)
+	if r.Method == http.MethodPost {
+		token, err = h.icalService.ResetFeedToken(user.ID)
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slug, err := h.icalService.TenantSlug(user.TenantID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	timetable := r.Host + "/calendar/" + slug + ".ics"
+	bookings := r.Host + "/calendar/feed/" + token + ".ics"
+	scheme := "http://"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https://"
+	}
+
+	// webcal:// links open the subscribe dialog of the member's calendar app
+	data := map[string]interface{}{
+		"TimetableURL":       scheme + timetable,
+		"BookingsURL":        scheme + bookings,
+		"TimetableSubscribe": template.URL("webcal://" + timetable),
+		"BookingsSubscribe":  template.URL("webcal://" + bookings),
+		"Reset":              r.Method == http.MethodPost,
+	}
+	h.renderTemplate(w, "calendar-feeds", data)
+}
+
+func writeCalendar(w http.ResponseWriter, calendar *ical.Calendar) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := calendar.Encode(w, time.Now()); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// AdminCalendarImport shows the form for importing classes from an
+// iCalendar file or URL
+func (h *Handlers) AdminCalendarImport(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	staff, err := h.instructorService.Instructors(user.TenantID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":       "Import Classes",
+		"User":        user,
+		"Community":   config.GetCurrent(),
+		"Instructors": staff,
+		"RuleRows":    []int{1, 2, 3},
+	}
+	h.renderTemplate(w, "admin-calendar-import.html", data)
+}
+
+// ImportCalendar previews the classes an uploaded or linked calendar would
+// create, update and cancel, or applies them when the form's action is
+// "apply". The calendar is read again for the apply, so what is applied
+// always matches the calendar at that moment.
+func (h *Handlers) ImportCalendar(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+
+	if err := r.ParseMultipartForm(maxCalendarImport); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		writeImportError(w, "The upload could not be read")
+		return
+	}
+
+	mapping, err := h.importMappingFromForm(r, user.TenantID)
+	if err != nil {
+		writeImportError(w, err.Error())
+		return
+	}
+
+	source, calendar, err := calendarFromForm(r)
+	if err != nil {
+		writeImportError(w, err.Error())
+		return
+	}
+	defer calendar.Close()
+
+	events, err := ical.Parse(io.LimitReader(calendar, maxCalendarImport), config.GetCurrent().Location())
+	if err != nil {
+		writeImportError(w, err.Error())
+		return
+	}
+
+	plan, err := h.icalService.PlanImport(user.TenantID, source, events, mapping)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	applied := r.FormValue("action") == "apply"
+	if applied {
+		h.icalService.ApplyImport(plan)
+	}
+
+	data := map[string]interface{}{
+		"Plan":    plan,
+		"Applied": applied,
+	}
+	h.renderTemplate(w, "calendar-import-plan", data)
+}
+
+// importMappingFromForm reads the instructor, default price and capacity,
+// and the summary rules of the import form
+func (h *Handlers) importMappingFromForm(r *http.Request, tenantID int) (ical.Mapping, error) {
+	var mapping ical.Mapping
+
+	instructorID, err := strconv.Atoi(r.FormValue("instructor_id"))
+	if err != nil {
+		return mapping, errors.New("choose who teaches the imported classes")
+	}
+	if ok, err := h.instructorService.IsInstructor(instructorID, tenantID); err != nil || !ok {
+		return mapping, errors.New("invalid instructor")
+	}
+	mapping.InstructorID = instructorID
+
+	if mapping.Price, err = strconv.Atoi(r.FormValue("price")); err != nil || mapping.Price < 0 {
+		return mapping, errors.New("invalid price")
+	}
+	if mapping.Capacity, err = strconv.Atoi(r.FormValue("max_capacity")); err != nil || mapping.Capacity < 1 {
+		return mapping, errors.New("invalid capacity")
+	}
+
+	matches := r.Form["rule_match"]
+	prices := r.Form["rule_price"]
+	capacities := r.Form["rule_capacity"]
+	for i, match := range matches {
+		rule := ical.Rule{Match: strings.TrimSpace(match)}
+		if rule.Match == "" {
+			continue
+		}
+		if i < len(prices) && prices[i] != "" {
+			price, err := strconv.Atoi(prices[i])
+			if err != nil || price < 0 {
+				return mapping, fmt.Errorf("invalid price for %q", rule.Match)
+			}
+			rule.Price = &price
+		}
+		if i < len(capacities) && capacities[i] != "" {
+			capacity, err := strconv.Atoi(capacities[i])
+			if err != nil || capacity < 1 {
+				return mapping, fmt.Errorf("invalid capacity for %q", rule.Match)
+			}
+			rule.Capacity = &capacity
+		}
+		mapping.Rules = append(mapping.Rules, rule)
+	}
+	return mapping, nil
+}
+
+// calendarFromForm opens the uploaded calendar file, or fetches the
+// calendar at the form's URL. The source identifies the calendar between
+// imports: classes whose events disappear from it are cancelled.
+func calendarFromForm(r *http.Request) (string, io.ReadCloser, error) {
+	if file, header, err := r.FormFile("calendar_file"); err == nil {
+		return "upload:" + header.Filename, file, nil
+	}
+
+	source := strings.TrimSpace(r.FormValue("calendar_url"))
+	if source == "" {
+		return "", nil, errors.New("choose a calendar file or enter its URL")
+	}
+	if rest, ok := strings.CutPrefix(source, "webcal://"); ok {
+		source = "https://" + rest
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return "", nil, errors.New("invalid calendar URL")
+	}
+	if err := checkCalendarURL(u); err != nil {
+		return "", nil, err
+	}
+
+	resp, err := calendarClient.Get(u.String())
+	if errors.Is(err, errPrivateAddress) {
+		return "", nil, errPrivateAddress
+	}
+	if err != nil {
+		return "", nil, errors.New("the calendar could not be fetched")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return "", nil, fmt.Errorf("the calendar could not be fetched: %s", resp.Status)
+	}
+	return source, resp.Body, nil
+}
+
+func writeImportError(w http.ResponseWriter, message string) {
+	fmt.Fprintf(w, `<div class="booking-error">%s</div>`, html.EscapeString(message))
+}
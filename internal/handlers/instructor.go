@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"html"
+	"net/http"
+	"strconv"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/instructors"
+	"samskipnad/internal/middleware"
+	"samskipnad/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Instructor portal handlers
+
+// InstructorPortal lists the classes the current instructor teaches
+func (h *Handlers) InstructorPortal(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	classes, err := h.instructorService.UpcomingClasses(user.ID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":     "My Classes",
+		"User":      user,
+		"Community": config.GetCurrent(),
+		"Classes":   classes,
+	}
+
+	h.renderTemplate(w, "instructor.html", data)
+}
+
+// InstructorRoster shows the members booked for a class the current user
+// teaches. Contact details are only included with the view_students
+// permission.
+func (h *Handlers) InstructorRoster(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	class, ok := h.staffClass(w, r, user)
+	if !ok {
+		return
+	}
+
+	roster, err := h.instructorService.Roster(class.ID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	showContact := h.authService.UserHasPermission(user, "view_students")
+	if !showContact {
+		for i := range roster {
+			roster[i].Email = ""
+			roster[i].Phone = ""
+		}
+	}
+
+	data := map[string]interface{}{
+		"Class":       class,
+		"Roster":      roster,
+		"ShowContact": showContact,
+	}
+
+	h.renderTemplate(w, "instructor-roster", data)
+}
+
+// RequestSubstitute asks the admins to find someone to cover one of the
+// current instructor's classes
+func (h *Handlers) RequestSubstitute(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	_, err = h.instructorService.RequestSubstitute(classID, user.ID, r.FormValue("reason"))
+	w.Header().Set("Content-Type", "text/html")
+	switch err {
+	case nil:
+		w.Write([]byte(`<div class="booking-success">Substitute requested. The admins have been notified.</div>`))
+	case instructors.ErrClassNotFound, instructors.ErrNotClassTeacher:
+		http.Error(w, "Class not found", http.StatusNotFound)
+	case instructors.ErrClassStarted, instructors.ErrRequestOpen:
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to request substitute", http.StatusInternalServerError)
+	}
+}
+
+// WithdrawSubstitute cancels the current instructor's substitute request
+// for a class
+func (h *Handlers) WithdrawSubstitute(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.instructorService.WithdrawSubstitute(classID, user.ID)
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-success">Substitute request withdrawn</div>`))
+	case instructors.ErrRequestNotFound:
+		http.Error(w, "Substitute request not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to withdraw substitute request", http.StatusInternalServerError)
+	}
+}
+
+// AssignClassInstructor lets an admin assign an instructor or substitute
+// to a class
+func (h *Handlers) AssignClassInstructor(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+	instructorID, err := strconv.Atoi(r.FormValue("instructor_id"))
+	if err != nil {
+		http.Error(w, "Invalid instructor", http.StatusBadRequest)
+		return
+	}
+
+	class, err := h.getClassByID(classID)
+	if err != nil || class.TenantID != user.TenantID {
+		http.Error(w, "Class not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.instructorService.Assign(classID, instructorID)
+	w.Header().Set("Content-Type", "text/html")
+	switch err {
+	case nil:
+		w.Header().Set("HX-Trigger", "classes-updated")
+		w.Write([]byte(`<div class="booking-success">Instructor assigned</div>`))
+	case instructors.ErrNotInstructor:
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to assign instructor", http.StatusInternalServerError)
+	}
+}
+
+// staffClass loads the class in the request path for the instructor who
+// teaches it or an admin of its tenant. Otherwise it writes an error
+// response and returns false.
+func (h *Handlers) staffClass(w http.ResponseWriter, r *http.Request, user *models.User) (*models.Class, bool) {
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	class, err := h.getClassByID(classID)
+	if err != nil || class.TenantID != user.TenantID {
+		http.Error(w, "Class not found", http.StatusNotFound)
+		return nil, false
+	}
+	if class.InstructorID != user.ID && user.Role != "admin" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return class, true
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// Klippekort ledger handlers
+
+// AdminKlippekort shows a member's klippekort and their ledgers, looked up
+// by email, and lists any card whose balance does not match its ledger
+func (h *Handlers) AdminKlippekort(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	discrepancies, err := h.klippekortService.Reconcile(user.TenantID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":         "Klippekort",
+		"User":          user,
+		"Community":     config.GetCurrent(),
+		"Discrepancies": discrepancies,
+	}
+
+	if email := r.URL.Query().Get("email"); email != "" {
+		data["Email"] = email
+
+		member, err := h.authService.GetUserByEmail(email)
+		if err == nil && member.TenantID == user.TenantID {
+			statements, err := h.klippekortService.Statements(member.ID, member.TenantID)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			data["Member"] = member
+			data["Statements"] = statements
+		}
+	}
+
+	h.renderTemplate(w, "admin-klippekort.html", data)
+}
+
+// AdjustKlippekort corrects a card's balance. The correction is recorded as
+// an adjustment in the card's ledger together with the admin's note.
+func (h *Handlers) AdjustKlippekort(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid klippekort ID", http.StatusBadRequest)
+		return
+	}
+
+	delta, err := strconv.Atoi(r.FormValue("delta"))
+	if err != nil {
+		http.Error(w, "Invalid adjustment", http.StatusBadRequest)
+		return
+	}
+
+	card, err := h.klippekortService.Card(cardID)
+	if err != nil || card.TenantID != user.TenantID {
+		http.Error(w, "Klippekort not found", http.StatusNotFound)
+		return
+	}
+
+	transaction, err := h.klippekortService.Adjust(cardID, delta, r.FormValue("note"), user.ID)
+	w.Header().Set("Content-Type", "text/html")
+	switch err {
+	case nil:
+		w.Write([]byte(fmt.Sprintf(`<div class="booking-success">Adjusted by %+d klipp, %d left</div>`,
+			transaction.Delta, transaction.BalanceAfter)))
+	case klippekort.ErrNegativeBalance, klippekort.ErrInvalidAdjustment, klippekort.ErrAdjustmentNoteEmpty:
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to adjust klippekort", http.StatusInternalServerError)
+	}
+}
+
+// Klippekort sharing handlers
+
+// InviteKlippekortHolder lets the owner of a card share it with another
+// member by email
+func (h *Handlers) InviteKlippekortHolder(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid klippekort ID", http.StatusBadRequest)
+		return
+	}
+
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	acceptURL := scheme + "://" + r.Host + "/klippekort/shared/accept"
+
+	holder, err := h.klippekortService.Invite(cardID, user.ID, r.FormValue("email"), acceptURL)
+	w.Header().Set("Content-Type", "text/html")
+	switch err {
+	case nil:
+		w.Write([]byte(`<div class="booking-success">Invitation sent to ` + html.EscapeString(holder.Email) + `</div>`))
+	case klippekort.ErrCardNotFound, klippekort.ErrNotOwner:
+		http.Error(w, "Klippekort not found", http.StatusNotFound)
+	case klippekort.ErrSharingDisabled, klippekort.ErrTooManyHolders, klippekort.ErrAlreadyHolder, klippekort.ErrHolderEmailEmpty:
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to share klippekort", http.StatusInternalServerError)
+	}
+}
+
+// AcceptKlippekortInvite gives the logged in member access to the card
+// they were invited to share
+func (h *Handlers) AcceptKlippekortInvite(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	_, err := h.klippekortService.Accept(r.URL.Query().Get("token"), user.ID, user.TenantID, user.Email)
+	switch err {
+	case nil:
+		http.Redirect(w, r, "/klippekort", http.StatusSeeOther)
+	case klippekort.ErrInviteNotFound, klippekort.ErrInviteEmailMismatch, klippekort.ErrAlreadyHolder:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+	}
+}
+
+// RevokeKlippekortHolder stops sharing the owner's card with a holder
+func (h *Handlers) RevokeKlippekortHolder(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	cardID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid klippekort ID", http.StatusBadRequest)
+		return
+	}
+	holderID, err := strconv.Atoi(vars["holderID"])
+	if err != nil {
+		http.Error(w, "Invalid holder ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.klippekortService.Revoke(cardID, user.ID, holderID)
+	w.Header().Set("Content-Type", "text/html")
+	switch err {
+	case nil:
+		w.Write([]byte(`<div class="booking-success">This klippekort is no longer shared with them</div>`))
+	case klippekort.ErrCardNotFound, klippekort.ErrNotOwner, klippekort.ErrHolderNotFound:
+		http.Error(w, "Klippekort holder not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to revoke access", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/memberships"
+	"samskipnad/internal/middleware"
+)
+
+// Membership subscription handlers. Members manage their own current
+// membership, so none of them take a membership ID.
+
+// CancelMembership stops the current member's subscription from renewing
+func (h *Handlers) CancelMembership(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	membership, err := h.membershipService.Current(user.ID)
+	if err != nil {
+		http.Error(w, "Membership not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.membershipService.Cancel(membership.ID)
+	w.Header().Set("Content-Type", "text/html")
+	switch {
+	case err == nil:
+		w.Header().Set("HX-Refresh", "true")
+		w.Write([]byte(`<div class="booking-success">Your membership will not renew</div>`))
+	case errors.Is(err, memberships.ErrNotRenewing):
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to cancel membership", http.StatusInternalServerError)
+	}
+}
+
+// PauseMembership freezes the current member's membership until the date
+// they give, as for an injury or a holiday
+func (h *Handlers) PauseMembership(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	until, err := config.GetCurrent().ParseLocalTime("2006-01-02", r.FormValue("until"))
+	if err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	membership, err := h.membershipService.Current(user.ID)
+	if err != nil {
+		http.Error(w, "Membership not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.membershipService.Pause(membership.ID, until)
+	w.Header().Set("Content-Type", "text/html")
+	switch {
+	case err == nil:
+		w.Header().Set("HX-Refresh", "true")
+		w.Write([]byte(fmt.Sprintf(`<div class="booking-success">Your membership is paused until %s</div>`,
+			until.Format("Mon Jan 2"))))
+	case errors.Is(err, memberships.ErrPauseNotAllowed), errors.Is(err, memberships.ErrPauseTooLong),
+		errors.Is(err, memberships.ErrInvalidPause), errors.Is(err, memberships.ErrCannotPause):
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to pause membership", http.StatusInternalServerError)
+	}
+}
+
+// ResumeMembership ends the current member's pause early
+func (h *Handlers) ResumeMembership(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	membership, err := h.membershipService.Current(user.ID)
+	if err != nil {
+		http.Error(w, "Membership not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.membershipService.Resume(membership.ID)
+	w.Header().Set("Content-Type", "text/html")
+	switch {
+	case err == nil:
+		w.Header().Set("HX-Refresh", "true")
+		w.Write([]byte(`<div class="booking-success">Welcome back! Your membership is active again</div>`))
+	case errors.Is(err, memberships.ErrNotPaused):
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to resume membership", http.StatusInternalServerError)
+	}
+}
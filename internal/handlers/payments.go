@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/middleware"
+	"samskipnad/internal/money"
+	"samskipnad/internal/payments"
+
+	"github.com/gorilla/mux"
+)
+
+// maxWebhookBody limits the size of payment provider webhooks
+const maxWebhookBody = 64 << 10
+
+// adminPaymentsLimit is how many payments the admin payments page lists
+const adminPaymentsLimit = 100
+
+// Payment provider handlers
+
+// redirectToProvider sends the member to the provider's own payment page,
+// for providers like Vipps that have one. It reports whether it did; card
+// payments are completed in a form on our pages instead.
+func redirectToProvider(w http.ResponseWriter, r *http.Request, intent *payments.Intent) bool {
+	if intent.RedirectURL == "" {
+		return false
+	}
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", intent.RedirectURL)
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	http.Redirect(w, r, intent.RedirectURL, http.StatusSeeOther)
+	return true
+}
+
+// VippsWebhook receives Vipps' notifications about payments, so payments
+// are confirmed even when the member never returns from the Vipps app, and
+// refunds made in the Vipps portal are recorded
+func (h *Handlers) VippsWebhook(w http.ResponseWriter, r *http.Request) {
+	vipps, ok := h.paymentService.Provider().(*payments.VippsProvider)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	event, err := vipps.ParseWebhookRequest(r, body)
+	if errors.Is(err, payments.ErrInvalidWebhook) {
+		log.Printf("Rejected Vipps webhook: %v", err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if err == nil {
+		err = h.paymentService.HandleWebhookEvent(vipps.Name(), event)
+	}
+	if err != nil {
+		log.Printf("Failed to process Vipps webhook: %v", err)
+		// Vipps retries webhooks that are not acknowledged
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// StripeWebhook receives Stripe's notifications about payments, so
+// payments are confirmed even when the member closes the tab before
+// returning, and refunds made in the Stripe dashboard are recorded
+func (h *Handlers) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err = h.paymentService.HandleWebhook("stripe", body, r.Header.Get("Stripe-Signature"))
+	switch {
+	case errors.Is(err, payments.ErrWebhookNotSupported):
+		http.NotFound(w, r)
+	case errors.Is(err, payments.ErrInvalidWebhook):
+		log.Printf("Rejected Stripe webhook: %v", err)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+	case err != nil:
+		log.Printf("Failed to process Stripe webhook: %v", err)
+		// Stripe retries webhooks that are not acknowledged
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Admin payment handlers
+
+// AdminPayments lists the community's most recent payments, optionally
+// only those with the status given in the query
+func (h *Handlers) AdminPayments(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	list, err := h.paymentService.ListPayments(user.TenantID, status, adminPaymentsLimit)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":     "Payments",
+		"User":      user,
+		"Community": config.GetCurrent(),
+		"Payments":  list,
+		"Status":    status,
+	}
+	h.renderTemplate(w, "admin-payments.html", data)
+}
+
+// AdminPaymentDetail shows a payment, what it bought and the audit trail
+// of its refunds, with a form for refunding it
+func (h *Handlers) AdminPaymentDetail(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	payment, err := h.paymentService.GetPayment(mux.Vars(r)["id"])
+	if err != nil || payment.TenantID != user.TenantID {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+
+	refunds, err := h.paymentService.Refunds(payment.ID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":      "Payment",
+		"User":       user,
+		"Community":  config.GetCurrent(),
+		"Payment":    payment,
+		"Refunds":    refunds,
+		"Refundable": money.New(int64(payment.Amount-payment.RefundedAmount), payment.Currency),
+		"CanRefund": (payment.Status == payments.StatusSucceeded || payment.Status == payments.StatusPartiallyRefunded) &&
+			payment.Provider == h.paymentService.Provider().Name(),
+	}
+	if member, err := h.authService.GetUserByID(payment.UserID); err == nil {
+		data["Member"] = member
+	}
+	if invoice, err := h.invoiceService.ForPayment(payment.ID); err == nil {
+		data["Invoice"] = invoice
+	}
+	h.renderTemplate(w, "admin-payment.html", data)
+}
+
+// AdminRefundPayment refunds all or part of a payment on the admin's
+// behalf. The amount is entered in whole units of the payment's currency
+// and the reason is recorded in the payment's audit trail.
+func (h *Handlers) AdminRefundPayment(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	payment, err := h.paymentService.GetPayment(mux.Vars(r)["id"])
+	if err != nil || payment.TenantID != user.TenantID {
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	amount, err := money.Parse(r.FormValue("amount"), payment.Currency)
+	if err != nil {
+		w.Write([]byte(`<div class="booking-error">Enter the amount to refund, such as 150 or 149,50</div>`))
+		return
+	}
+
+	refund, err := h.paymentService.IssueRefund(payment.ID, int(amount.Amount), r.FormValue("reason"), user.ID)
+	switch {
+	case err == nil:
+		message := "Refunded " + config.GetCurrent().Format(amount)
+		if refund.Reversed != "" {
+			message += fmt.Sprintf("; the %s was reversed", refund.Reversed)
+		}
+		w.Header().Set("HX-Refresh", "true")
+		w.Write([]byte(`<div class="booking-success">` + html.EscapeString(message) + `</div>`))
+	case refund != nil:
+		// The money was returned but the purchase could not be reversed
+		log.Printf("Failed to reverse refunded payment %s: %v", payment.ID, err)
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	case errors.Is(err, payments.ErrRefundReasonRequired), errors.Is(err, payments.ErrInvalidRefundAmount),
+		errors.Is(err, payments.ErrNotRefundable):
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	case errors.Is(err, payments.ErrRefundPending):
+		// The refund stays reserved; refunding again retries it first
+		log.Printf("Refund of payment %s is pending: %v", payment.ID, err)
+		w.Write([]byte(`<div class="booking-error">The payment provider did not answer. ` +
+			`The refund is pending; refund again later to retry it.</div>`))
+	default:
+		log.Printf("Failed to refund payment %s: %v", payment.ID, err)
+		http.Error(w, "Failed to refund payment", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/invoices"
+	"samskipnad/internal/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// Receipt handlers. Members see and download the receipts for their own
+// payments; admins can download any receipt in their community.
+
+// Receipts lists the current member's receipts
+func (h *Handlers) Receipts(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	receipts, err := h.invoiceService.List(user.ID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":     "Receipts",
+		"User":      user,
+		"Community": config.GetCurrent(),
+		"Receipts":  receipts,
+	}
+	h.renderTemplate(w, "receipts.html", data)
+}
+
+// ReceiptPDF downloads a receipt as a PDF
+func (h *Handlers) ReceiptPDF(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	invoice, err := h.invoiceService.Get(id)
+	if err != nil || invoice.TenantID != user.TenantID || (invoice.UserID != user.ID && user.Role != "admin") {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", invoices.Filename(invoice)))
+	w.Write(h.invoiceService.PDF(invoice))
+}
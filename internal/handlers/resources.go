@@ -0,0 +1,456 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/middleware"
+	"samskipnad/internal/models"
+	"samskipnad/internal/resources"
+
+	"github.com/gorilla/mux"
+)
+
+// Room and equipment handlers
+
+// AdminResources lists the tenant's rooms and equipment on GET and adds a
+// new one otherwise
+func (h *Handlers) AdminResources(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "GET" {
+		list, err := h.resourceService.Resources(user.TenantID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		data := map[string]interface{}{
+			"Title":     "Rooms & Equipment",
+			"User":      user,
+			"Community": config.GetCurrent(),
+			"Resources": list,
+		}
+
+		h.renderTemplate(w, "admin-resources.html", data)
+		return
+	}
+
+	resource := &models.Resource{TenantID: user.TenantID}
+	if err := resourceFromAdminForm(r, resource); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.resourceService.CreateResource(resource); err != nil {
+		if errors.Is(err, resources.ErrInvalidResource) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to create resource", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/resources", http.StatusSeeOther)
+}
+
+// UpdateResource saves an admin's changes to a room or piece of equipment
+func (h *Handlers) UpdateResource(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resource, ok := h.tenantResource(w, r, user)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := resourceFromAdminForm(r, resource); err != nil {
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+		return
+	}
+
+	err := h.resourceService.UpdateResource(resource)
+	switch err {
+	case nil:
+		w.Write([]byte(`<div class="booking-success">Saved</div>`))
+	case resources.ErrInvalidResource:
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	default:
+		http.Error(w, "Failed to update resource", http.StatusInternalServerError)
+	}
+}
+
+// DeactivateResource retires a room or piece of equipment. Classes already
+// scheduled into it keep it.
+func (h *Handlers) DeactivateResource(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resource, ok := h.tenantResource(w, r, user)
+	if !ok {
+		return
+	}
+
+	if err := h.resourceService.DeactivateResource(resource.ID); err != nil {
+		http.Error(w, "Failed to remove resource", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(`<tr><td colspan="8"><div class="booking-success">` + html.EscapeString(resource.Name) + ` removed</div></td></tr>`))
+}
+
+// reservableResource is a resource on the member reservation page, with
+// whether the member may reserve it yet
+type reservableResource struct {
+	models.Resource
+	Inducted         bool
+	InductionClasses []models.Class // Upcoming classes that induct members on it
+	CategoryName     string
+}
+
+// Resources lists the rooms and equipment members can reserve, together
+// with the current member's upcoming reservations. Equipment that needs an
+// induction lists the classes that give it until the member has one.
+func (h *Handlers) Resources(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	list, err := h.resourceService.Resources(user.TenantID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	inducted, err := h.resourceService.Inducted(user.ID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	community := config.GetCurrent()
+	var reservable []reservableResource
+	for _, res := range list {
+		if !res.Reservable {
+			continue
+		}
+		item := reservableResource{Resource: res, Inducted: !res.RequiresInduction || inducted[res.ID]}
+		if !item.Inducted {
+			item.InductionClasses, err = h.resourceService.InductionClasses(res.ID)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if category, ok := community.KlippekortCategoryByID(res.CategoryID); ok {
+			item.CategoryName = category.Name
+		}
+		reservable = append(reservable, item)
+	}
+
+	reservations, err := h.resourceService.UpcomingReservations(user.ID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Title":        "Reserve",
+		"User":         user,
+		"Community":    community,
+		"Resources":    reservable,
+		"Reservations": reservations,
+	}
+
+	h.renderTemplate(w, "resources.html", data)
+}
+
+// ResourceCalendar shows a week of the classes and reservations using a
+// resource. The week starts on the Monday of the week query parameter
+// (YYYY-MM-DD), defaulting to the current week.
+func (h *Handlers) ResourceCalendar(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	resource, ok := h.tenantResource(w, r, user)
+	if !ok {
+		return
+	}
+
+	community := config.GetCurrent()
+	day := community.LocalTime(time.Now())
+	if week := r.URL.Query().Get("week"); week != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", week, community.Location())
+		if err != nil {
+			http.Error(w, "Invalid week", http.StatusBadRequest)
+			return
+		}
+		day = parsed
+	}
+	weekday := (int(day.Weekday()) + 6) % 7
+	monday := community.StartOfDay(day).AddDate(0, 0, -weekday)
+	sunday := monday.AddDate(0, 0, 7)
+
+	slots, err := h.resourceService.Schedule(resource.ID, monday, sunday)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	type calendarDay struct {
+		Date  time.Time
+		Slots []resources.Slot
+	}
+	days := make([]calendarDay, 7)
+	for i := range days {
+		days[i].Date = monday.AddDate(0, 0, i)
+	}
+	for _, slot := range slots {
+		for i := range days {
+			dayEnd := days[i].Date.AddDate(0, 0, 1)
+			if slot.StartTime.Before(dayEnd) && slot.EndTime.After(days[i].Date) {
+				days[i].Slots = append(days[i].Slots, slot)
+			}
+		}
+	}
+
+	data := map[string]interface{}{
+		"Title":     resource.Name,
+		"User":      user,
+		"Community": community,
+		"Resource":  resource,
+		"Days":      days,
+		"PrevWeek":  monday.AddDate(0, 0, -7).Format("2006-01-02"),
+		"NextWeek":  monday.AddDate(0, 0, 7).Format("2006-01-02"),
+	}
+
+	h.renderTemplate(w, "resource-calendar.html", data)
+}
+
+// ReserveResource books a reservable resource for the current member
+func (h *Handlers) ReserveResource(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resource, ok := h.tenantResource(w, r, user)
+	if !ok {
+		return
+	}
+
+	start, err := parseLocalTime(r.FormValue("start_time"))
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return
+	}
+	end, err := parseLocalTime(r.FormValue("end_time"))
+	if err != nil {
+		http.Error(w, "Invalid end time", http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := h.resourceService.Reserve(resource.ID, user.ID, start, end, r.FormValue("note"))
+	w.Header().Set("Content-Type", "text/html")
+	switch {
+	case err == nil:
+		w.Header().Set("HX-Trigger", "reservations-updated")
+		fmt.Fprintf(w, `<div class="booking-success">%s reserved %s–%s</div>`, html.EscapeString(resource.Name),
+			config.GetCurrent().LocalTime(reservation.StartTime).Format("Mon Jan 2 15:04"),
+			config.GetCurrent().LocalTime(reservation.EndTime).Format("15:04"))
+	case errors.Is(err, resources.ErrConflict), errors.Is(err, resources.ErrInvalidTime),
+		errors.Is(err, resources.ErrReservationInPast), errors.Is(err, resources.ErrNotReservable),
+		errors.Is(err, resources.ErrInductionRequired), errors.Is(err, resources.ErrSlotTooLong):
+		w.Write([]byte(`<div class="booking-error">` + html.EscapeString(err.Error()) + `</div>`))
+	case errors.Is(err, klippekort.ErrNoKlipp):
+		w.Write([]byte(`<div class="booking-error">You have no klipp left in this category. <a href="/klippekort">Buy a klippekort</a></div>`))
+	default:
+		http.Error(w, "Failed to reserve", http.StatusInternalServerError)
+	}
+}
+
+// CancelReservation cancels one of the current member's reservations.
+// Admins can cancel any reservation in their tenant.
+func (h *Handlers) CancelReservation(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	reservationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid reservation ID", http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := h.resourceService.GetReservation(reservationID)
+	if err != nil || reservation.TenantID != user.TenantID || (reservation.UserID != user.ID && user.Role != "admin") {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.resourceService.CancelReservation(reservationID); err != nil {
+		http.Error(w, "Failed to cancel reservation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("HX-Trigger", "reservations-updated")
+	w.Write([]byte(`<div class="booking-success">Reservation cancelled</div>`))
+}
+
+// ResourceInductions lists the members inducted on a resource on GET and
+// inducts the member with the posted email otherwise
+func (h *Handlers) ResourceInductions(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resource, ok := h.tenantResource(w, r, user)
+	if !ok {
+		return
+	}
+
+	data := map[string]interface{}{"Resource": resource}
+
+	if r.Method != "GET" {
+		email := r.FormValue("email")
+		member, err := h.authService.GetUserByEmail(email)
+		if err != nil || member.TenantID != user.TenantID {
+			data["Error"] = "No member with email " + email
+		} else if err := h.resourceService.GrantInduction(resource.ID, member.ID, user.ID); err != nil {
+			http.Error(w, "Failed to record induction", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	inductions, err := h.resourceService.Inductions(resource.ID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	data["Inductions"] = inductions
+
+	h.renderTemplate(w, "resource-inductions", data)
+}
+
+// RevokeInduction removes a member's induction on a resource
+func (h *Handlers) RevokeInduction(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resource, ok := h.tenantResource(w, r, user)
+	if !ok {
+		return
+	}
+
+	memberID, err := strconv.Atoi(mux.Vars(r)["user"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.resourceService.RevokeInduction(resource.ID, memberID); err != nil {
+		http.Error(w, "Failed to revoke induction", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(`<tr><td colspan="3"><div class="booking-success">Induction revoked</div></td></tr>`))
+}
+
+// tenantResource loads the resource named by the id route variable,
+// writing a 404 if it does not belong to the user's tenant
+func (h *Handlers) tenantResource(w http.ResponseWriter, r *http.Request, user *models.User) (*models.Resource, bool) {
+	resourceID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid resource ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	resource, err := h.resourceService.GetResource(resourceID)
+	if err != nil || resource.TenantID != user.TenantID || !resource.Active {
+		http.Error(w, "Resource not found", http.StatusNotFound)
+		return nil, false
+	}
+	return resource, true
+}
+
+// resourceFromForm returns the room or equipment selected in the field of
+// the admin class form. An empty selection clears it; a form without the
+// field keeps current.
+func (h *Handlers) resourceFromForm(r *http.Request, field string, tenantID int, current *int) (*int, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	if _, ok := r.Form[field]; !ok {
+		return current, nil
+	}
+
+	value := r.FormValue(field)
+	if value == "" {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource: %s", value)
+	}
+	resource, err := h.resourceService.GetResource(id)
+	if err != nil || resource.TenantID != tenantID {
+		return nil, fmt.Errorf("unknown resource: %s", value)
+	}
+	return &id, nil
+}
+
+// resourceFromAdminForm copies the fields of the admin resource form onto
+// resource
+func resourceFromAdminForm(r *http.Request, resource *models.Resource) error {
+	categoryID, err := klippCategoryFromForm(r)
+	if err != nil {
+		return err
+	}
+
+	maxSlot := 0
+	if value := r.FormValue("max_slot_minutes"); value != "" {
+		if maxSlot, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("invalid maximum slot length: %s", value)
+		}
+	}
+
+	resource.Name = r.FormValue("name")
+	resource.Kind = r.FormValue("kind")
+	resource.Description = r.FormValue("description")
+	resource.Reservable = r.FormValue("reservable") == "on"
+	resource.RequiresInduction = r.FormValue("requires_induction") == "on"
+	resource.MaxSlotMinutes = maxSlot
+	resource.CategoryID = categoryID
+	return nil
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/middleware"
+	"samskipnad/internal/models"
+	"samskipnad/internal/resources"
+	"samskipnad/internal/scheduling"
+
+	"github.com/gorilla/mux"
+)
+
+// Recurring class series handlers
+
+// SkipClassOccurrence cancels a single occurrence of a recurring class
+func (h *Handlers) SkipClassOccurrence(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.getClassByID(classID); err != nil {
+		http.Error(w, "Class not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.schedulingService.SkipOccurrence(classID)
+	if err != nil {
+		h.writeSeriesError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("HX-Trigger", "classes-updated")
+	w.Write([]byte(`<div class="booking-success">Occurrence skipped</div>`))
+}
+
+// RescheduleClassOccurrence moves a single occurrence of a recurring class
+func (h *Handlers) RescheduleClassOccurrence(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	startTime, err := parseLocalTime(r.FormValue("start_time"))
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return
+	}
+
+	endTime, err := parseLocalTime(r.FormValue("end_time"))
+	if err != nil {
+		http.Error(w, "Invalid end time", http.StatusBadRequest)
+		return
+	}
+
+	err = h.schedulingService.RescheduleOccurrence(classID, startTime, endTime)
+	if err != nil {
+		h.writeSeriesError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/classes", http.StatusSeeOther)
+}
+
+// EditClassSeries applies an edit to an occurrence and all following
+// occurrences of its series
+func (h *Handlers) EditClassSeries(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	class, err := h.getClassByID(classID)
+	if err != nil {
+		http.Error(w, "Class not found", http.StatusNotFound)
+		return
+	}
+
+	startTime, err := parseLocalTime(r.FormValue("start_time"))
+	if err != nil {
+		http.Error(w, "Invalid start time", http.StatusBadRequest)
+		return
+	}
+
+	endTime, err := parseLocalTime(r.FormValue("end_time"))
+	if err != nil {
+		http.Error(w, "Invalid end time", http.StatusBadRequest)
+		return
+	}
+
+	update := &models.ClassSeries{
+		Name:               r.FormValue("name"),
+		Description:        r.FormValue("description"),
+		InstructorID:       class.InstructorID,
+		DTStart:            startTime,
+		DurationMinutes:    int(endTime.Sub(startTime).Minutes()),
+		MaxCapacity:        class.MaxCapacity,
+		Price:              class.Price,
+		RequiresTicket:     r.FormValue("requires_ticket") == "on",
+		RequiresMembership: r.FormValue("requires_membership") == "on",
+	}
+	if update.Name == "" {
+		update.Name = class.Name
+	}
+	if update.CategoryID, err = klippCategoryFromForm(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.ResourceID, err = h.resourceFromForm(r, "resource_id", class.TenantID, class.ResourceID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.InductionFor, err = h.resourceFromForm(r, "induction_for", class.TenantID, class.InductionFor); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v, err := strconv.Atoi(r.FormValue("max_capacity")); err == nil {
+		update.MaxCapacity = v
+	}
+	if v, err := strconv.Atoi(r.FormValue("price")); err == nil {
+		update.Price = v
+	}
+	if r.FormValue("repeat") == "on" {
+		update.RRule, err = recurrenceFromForm(r, startTime)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := h.schedulingService.UpdateFollowing(classID, update); err != nil {
+		h.writeSeriesError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/classes", http.StatusSeeOther)
+}
+
+func (h *Handlers) writeSeriesError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, scheduling.ErrNotSeriesOccurrence):
+		http.Error(w, "Class is not part of a recurring series", http.StatusBadRequest)
+	case errors.Is(err, scheduling.ErrOccurrenceHasBookings):
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<div class="booking-error">This occurrence has bookings and cannot be skipped</div>`))
+	case errors.Is(err, scheduling.ErrInvalidRule):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, resources.ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Failed to update class series", http.StatusInternalServerError)
+	}
+}
+
+// klippCategoryFromForm returns the klippekort category selected in the
+// admin class form, or "" if the class cannot be paid for with klipp
+func klippCategoryFromForm(r *http.Request) (string, error) {
+	categoryID := r.FormValue("category_id")
+	if categoryID == "" {
+		return "", nil
+	}
+	if _, ok := config.GetCurrent().KlippekortCategoryByID(categoryID); !ok {
+		return "", fmt.Errorf("unknown klippekort category: %s", categoryID)
+	}
+	return categoryID, nil
+}
+
+// recurrenceFromForm builds an RRULE from the admin class form. The repeat
+// days default to the weekday of the first occurrence.
+func recurrenceFromForm(r *http.Request, start time.Time) (string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", err
+	}
+
+	parts := []string{"FREQ=WEEKLY"}
+
+	if interval, err := strconv.Atoi(r.FormValue("repeat_interval")); err == nil && interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", interval))
+	}
+
+	days := r.Form["repeat_days"]
+	if len(days) == 0 {
+		days = []string{strings.ToUpper(start.Weekday().String()[:2])}
+	}
+	parts = append(parts, "BYDAY="+strings.Join(days, ","))
+
+	switch r.FormValue("repeat_end") {
+	case "count":
+		count, err := strconv.Atoi(r.FormValue("repeat_count"))
+		if err != nil || count < 1 {
+			return "", fmt.Errorf("invalid number of occurrences")
+		}
+		parts = append(parts, fmt.Sprintf("COUNT=%d", count))
+	case "until":
+		until, err := time.Parse("2006-01-02", r.FormValue("repeat_until"))
+		if err != nil {
+			return "", fmt.Errorf("invalid repeat end date")
+		}
+		parts = append(parts, "UNTIL="+until.Format("20060102"))
+	}
+
+	rule := strings.Join(parts, ";")
+	if _, err := scheduling.ParseRule(rule); err != nil {
+		return "", err
+	}
+	return rule, nil
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"samskipnad/internal/booking"
+	"samskipnad/internal/config"
+	"samskipnad/internal/middleware"
+	"samskipnad/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Waitlist handlers
+
+// JoinWaitlist adds the current user to the waitlist of a full class
+func (h *Handlers) JoinWaitlist(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.bookingService.JoinWaitlist(user.ID, classID)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/html")
+		switch err {
+		case booking.ErrClassNotFound:
+			http.Error(w, "Class not found", http.StatusNotFound)
+		case booking.ErrAlreadyBooked:
+			w.Write([]byte(`<div class="booking-error">Already booked</div>`))
+		case booking.ErrAlreadyWaitlist:
+			existing, err := h.bookingService.WaitlistEntry(user.ID, classID)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			h.writeWaitlistPosition(w, existing)
+		case booking.ErrClassNotFull:
+			w.Write([]byte(`<div class="booking-error">A spot is available - book the class instead</div>`))
+		case booking.ErrWaitlistDisabled:
+			w.Write([]byte(`<div class="booking-error">Class is full</div>`))
+		default:
+			http.Error(w, "Failed to join waitlist", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("HX-Trigger", "booking-updated")
+	h.writeWaitlistPosition(w, entry)
+}
+
+// LeaveWaitlist removes the current user from a class waitlist
+func (h *Handlers) LeaveWaitlist(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUserFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	classID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid class ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.bookingService.LeaveWaitlist(user.ID, classID)
+	if err == booking.ErrNotOnWaitlist {
+		http.Error(w, "Not on the waitlist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to leave waitlist", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("HX-Trigger", "booking-updated")
+	w.Write([]byte(`<div class="booking-success">You have left the waitlist</div>`))
+}
+
+// writeClassFull renders the "class is full" fragment, offering the waitlist
+// when the community has it enabled
+func (h *Handlers) writeClassFull(w http.ResponseWriter, class *models.Class) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if !config.GetCurrent().Booking.Waitlist.Enabled {
+		w.Write([]byte(`<div class="booking-error">Class is full</div>`))
+		return
+	}
+
+	fmt.Fprintf(w, `<div class="booking-error">
+		Class is full
+		<button class="btn btn-outline-secondary btn-sm ms-2"
+				hx-post="/classes/%d/waitlist"
+				hx-target="closest div"
+				hx-swap="outerHTML">
+			Join waitlist
+		</button>
+	</div>`, class.ID)
+}
+
+func (h *Handlers) writeWaitlistPosition(w http.ResponseWriter, entry *booking.WaitlistEntry) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if entry.OfferExpiresAt != nil {
+		fmt.Fprintf(w, `<div class="booking-success">A spot is held for you until %s - book now to claim it</div>`,
+			template.HTMLEscapeString(config.GetCurrent().LocalTime(*entry.OfferExpiresAt).Format("Mon Jan 2 15:04")))
+		return
+	}
+
+	fmt.Fprintf(w, `<div class="booking-info">
+		You are #%d on the waitlist
+		<button class="btn btn-link btn-sm"
+				hx-post="/classes/%d/waitlist/leave"
+				hx-target="closest div"
+				hx-swap="outerHTML">
+			Leave waitlist
+		</button>
+	</div>`, entry.Position, entry.ClassID)
+}
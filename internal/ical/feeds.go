@@ -0,0 +1,200 @@
+package ical
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"samskipnad/internal/config"
+)
+
+// FeedHistory is how far back feeds reach, so recently cancelled classes
+// are still sent as cancelled rather than silently dropped
+const FeedHistory = 30 * 24 * time.Hour
+
+var (
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrFeedNotFound   = errors.New("calendar feed not found")
+)
+
+// Service builds iCalendar feeds of a tenant's class timetable and of each
+// member's bookings, and imports classes from calendars
+type Service struct {
+	db        *sql.DB
+	classes   ClassScheduler
+	community func() *config.Community
+	now       func() time.Time
+}
+
+func NewService(db *sql.DB, classes ClassScheduler) *Service {
+	return &Service{
+		db:        db,
+		classes:   classes,
+		community: config.GetCurrent,
+		now:       time.Now,
+	}
+}
+
+// TenantFeed returns the public timetable of the tenant with the given
+// slug: its classes from FeedHistory ago onwards. Cancelled classes are
+// marked CANCELLED.
+func (s *Service) TenantFeed(slug string) (*Calendar, error) {
+	var tenantID int
+	var name string
+	err := s.db.QueryRow(`SELECT id, name FROM tenants WHERE slug = ? AND active = true`, slug).Scan(&tenantID, &name)
+	if err == sql.ErrNoRows {
+		return nil, ErrTenantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT c.id, c.name, COALESCE(c.description, ''), COALESCE(r.name, ''), c.start_time, c.end_time,
+			c.active, c.updated_at
+		FROM classes c
+		LEFT JOIN resources r ON r.id = c.resource_id
+		WHERE c.tenant_id = ? AND c.start_time >= ?
+		ORDER BY c.start_time, c.id`, tenantID, s.now().Add(-FeedHistory).UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calendar := &Calendar{Name: name, Location: s.community().Location()}
+	for rows.Next() {
+		var e Event
+		var id int
+		var active bool
+		var modified sql.NullTime
+		if err := rows.Scan(&id, &e.Summary, &e.Description, &e.Location, &e.Start, &e.End, &active, &modified); err != nil {
+			return nil, err
+		}
+		e.UID = fmt.Sprintf("class-%d@%s.samskipnad", id, slug)
+		e.Status = StatusConfirmed
+		if !active {
+			e.Status = StatusCancelled
+		}
+		e.Modified = modified.Time
+		calendar.Events = append(calendar.Events, e)
+	}
+	return calendar, rows.Err()
+}
+
+// MemberFeed returns the bookings of the member whose feed token is given,
+// from FeedHistory ago onwards. Waitlist places are TENTATIVE; cancelled
+// bookings and bookings of cancelled classes are CANCELLED.
+func (s *Service) MemberFeed(token string) (*Calendar, error) {
+	if token == "" {
+		return nil, ErrFeedNotFound
+	}
+	var userID int
+	var slug, tenantName string
+	err := s.db.QueryRow(`
+		SELECT u.id, t.slug, t.name FROM users u
+		JOIN tenants t ON t.id = u.tenant_id
+		WHERE u.calendar_token = ? AND u.active = true`, token).Scan(&userID, &slug, &tenantName)
+	if err == sql.ErrNoRows {
+		return nil, ErrFeedNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT b.id, b.status, c.name, COALESCE(c.description, ''), COALESCE(r.name, ''), c.start_time, c.end_time,
+			c.active, b.updated_at, c.updated_at
+		FROM bookings b
+		JOIN classes c ON c.id = b.class_id
+		LEFT JOIN resources r ON r.id = c.resource_id
+		WHERE b.user_id = ? AND c.start_time >= ?
+		ORDER BY c.start_time, b.id`, userID, s.now().Add(-FeedHistory).UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calendar := &Calendar{Name: tenantName + " bookings", Location: s.community().Location()}
+	for rows.Next() {
+		var e Event
+		var id int
+		var status string
+		var active bool
+		var bookingModified, classModified sql.NullTime
+		err := rows.Scan(&id, &status, &e.Summary, &e.Description, &e.Location, &e.Start, &e.End, &active,
+			&bookingModified, &classModified)
+		if err != nil {
+			return nil, err
+		}
+		e.UID = fmt.Sprintf("booking-%d@%s.samskipnad", id, slug)
+		switch {
+		case status == "cancelled" || !active:
+			e.Status = StatusCancelled
+		case status == "waitlist":
+			e.Status = StatusTentative
+		default:
+			e.Status = StatusConfirmed
+		}
+		e.Modified = bookingModified.Time
+		if classModified.Time.After(e.Modified) {
+			e.Modified = classModified.Time
+		}
+		calendar.Events = append(calendar.Events, e)
+	}
+	return calendar, rows.Err()
+}
+
+// FeedToken returns the secret token in the URL of a member's booking
+// feed, creating it the first time
+func (s *Service) FeedToken(userID int) (string, error) {
+	var token sql.NullString
+	err := s.db.QueryRow(`SELECT calendar_token FROM users WHERE id = ?`, userID).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", ErrFeedNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if token.Valid && token.String != "" {
+		return token.String, nil
+	}
+	return s.ResetFeedToken(userID)
+}
+
+// ResetFeedToken replaces a member's feed token, so calendars subscribed
+// to the old URL stop receiving their bookings
+func (s *Service) ResetFeedToken(userID int) (string, error) {
+	token, err := newFeedToken()
+	if err != nil {
+		return "", err
+	}
+	result, err := s.db.Exec(`UPDATE users SET calendar_token = ? WHERE id = ?`, token, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to store calendar token: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", ErrFeedNotFound
+	}
+	return token, nil
+}
+
+func newFeedToken() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate calendar token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// TenantSlug returns the slug that identifies a tenant's public feed
+func (s *Service) TenantSlug(tenantID int) (string, error) {
+	var slug string
+	err := s.db.QueryRow(`SELECT slug FROM tenants WHERE id = ?`, tenantID).Scan(&slug)
+	if err == sql.ErrNoRows {
+		return "", ErrTenantNotFound
+	}
+	return slug, err
+}
@@ -0,0 +1,147 @@
+package ical
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/database"
+)
+
+// setupTestDB creates a migrated in-memory SQLite database for testing
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+type testEnv struct {
+	db      *sql.DB
+	service *Service
+	now     time.Time
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := setupTestDB(t)
+	env := &testEnv{
+		db:  db,
+		now: time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC),
+	}
+	community := &config.Community{}
+	community.Locale.Timezone = "Europe/Oslo"
+	env.service = NewService(db, &fakeScheduler{db: db})
+	env.service.community = func() *config.Community { return community }
+	env.service.now = func() time.Time { return env.now }
+	return env
+}
+
+func (env *testEnv) createClass(t *testing.T, name string, start time.Time) int {
+	result, err := env.db.Exec(`
+		INSERT INTO classes (tenant_id, name, instructor_id, start_time, end_time, max_capacity, price)
+		VALUES (1, ?, 1, ?, ?, 10, 0)`, name, start.UTC(), start.Add(time.Hour).UTC())
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func (env *testEnv) book(t *testing.T, userID, classID int, status string) int {
+	result, err := env.db.Exec(`INSERT INTO bookings (user_id, class_id, status) VALUES (?, ?, ?)`, userID, classID, status)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func statuses(calendar *Calendar) map[string]string {
+	byUID := make(map[string]string)
+	for _, e := range calendar.Events {
+		byUID[e.UID] = e.Status
+	}
+	return byUID
+}
+
+func TestTenantFeed(t *testing.T) {
+	env := newTestEnv(t)
+	old := env.createClass(t, "Long gone", env.now.Add(-FeedHistory-time.Hour))
+	recent := env.createClass(t, "Yesterday", env.now.Add(-24*time.Hour))
+	upcoming := env.createClass(t, "Vinyasa", env.now.Add(48*time.Hour))
+	cancelled := env.createClass(t, "Yin", env.now.Add(72*time.Hour))
+	_, err := env.db.Exec(`UPDATE classes SET active = false WHERE id = ?`, cancelled)
+	require.NoError(t, err)
+
+	calendar, err := env.service.TenantFeed("kjernekraft")
+	require.NoError(t, err)
+	assert.Equal(t, "Kjernekraft Oslo", calendar.Name)
+	assert.Equal(t, "Europe/Oslo", calendar.Location.String())
+	assert.Equal(t, map[string]string{
+		"class-" + strconv.Itoa(recent) + "@kjernekraft.samskipnad":    StatusConfirmed,
+		"class-" + strconv.Itoa(upcoming) + "@kjernekraft.samskipnad":  StatusConfirmed,
+		"class-" + strconv.Itoa(cancelled) + "@kjernekraft.samskipnad": StatusCancelled,
+	}, statuses(calendar))
+	assert.NotContains(t, statuses(calendar), "class-"+strconv.Itoa(old)+"@kjernekraft.samskipnad")
+
+	again, err := env.service.TenantFeed("kjernekraft")
+	require.NoError(t, err)
+	assert.Equal(t, calendar.Events, again.Events, "feeds are stable between fetches")
+
+	_, err = env.service.TenantFeed("nowhere")
+	assert.ErrorIs(t, err, ErrTenantNotFound)
+}
+
+func TestMemberFeed(t *testing.T) {
+	env := newTestEnv(t)
+	yoga := env.createClass(t, "Vinyasa", env.now.Add(48*time.Hour))
+	yin := env.createClass(t, "Yin", env.now.Add(72*time.Hour))
+	pilates := env.createClass(t, "Pilates", env.now.Add(96*time.Hour))
+	cancelledClass := env.createClass(t, "Kundalini", env.now.Add(120*time.Hour))
+	_, err := env.db.Exec(`UPDATE classes SET active = false WHERE id = ?`, cancelledClass)
+	require.NoError(t, err)
+
+	confirmed := env.book(t, 1, yoga, "confirmed")
+	waitlisted := env.book(t, 1, yin, "waitlist")
+	cancelled := env.book(t, 1, pilates, "cancelled")
+	classCancelled := env.book(t, 1, cancelledClass, "confirmed")
+
+	_, err = env.service.MemberFeed("")
+	assert.ErrorIs(t, err, ErrFeedNotFound)
+
+	token, err := env.service.FeedToken(1)
+	require.NoError(t, err)
+	require.Len(t, token, 40)
+	same, err := env.service.FeedToken(1)
+	require.NoError(t, err)
+	assert.Equal(t, token, same)
+
+	calendar, err := env.service.MemberFeed(token)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"booking-" + strconv.Itoa(confirmed) + "@kjernekraft.samskipnad":      StatusConfirmed,
+		"booking-" + strconv.Itoa(waitlisted) + "@kjernekraft.samskipnad":     StatusTentative,
+		"booking-" + strconv.Itoa(cancelled) + "@kjernekraft.samskipnad":      StatusCancelled,
+		"booking-" + strconv.Itoa(classCancelled) + "@kjernekraft.samskipnad": StatusCancelled,
+	}, statuses(calendar))
+
+	t.Run("Reset", func(t *testing.T) {
+		fresh, err := env.service.ResetFeedToken(1)
+		require.NoError(t, err)
+		assert.NotEqual(t, token, fresh)
+
+		_, err = env.service.MemberFeed(token)
+		assert.ErrorIs(t, err, ErrFeedNotFound)
+		_, err = env.service.MemberFeed(fresh)
+		assert.NoError(t, err)
+
+		_, err = env.service.ResetFeedToken(999)
+		assert.ErrorIs(t, err, ErrFeedNotFound)
+	})
+}
@@ -0,0 +1,210 @@
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Event statuses
+const (
+	StatusConfirmed = "CONFIRMED"
+	StatusTentative = "TENTATIVE"
+	StatusCancelled = "CANCELLED"
+)
+
+const (
+	dateTimeFormat    = "20060102T150405"
+	utcDateTimeFormat = "20060102T150405Z"
+	maxLineOctets     = 75
+)
+
+// Calendar is an iCalendar (RFC 5545) document of events. Event times are
+// written as local times in Location, with a VTIMEZONE describing its
+// offsets, so calendar apps keep them right across daylight saving changes.
+type Calendar struct {
+	Name     string
+	Location *time.Location
+	Events   []Event
+}
+
+// Event is a VEVENT. UID must stay the same every time the event is
+// written, so calendar apps update the event rather than adding a copy.
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	Status      string
+	Start       time.Time
+	End         time.Time
+	Modified    time.Time
+
+	// Read by Parse only; Encode writes single, timed events
+	AllDay       bool
+	Duration     time.Duration // Used when the event has no DTEND
+	RRule        string
+	ExDates      []time.Time
+	RecurrenceID time.Time // Set on an edited occurrence of a recurring event
+}
+
+// Encode writes the calendar to w. stamp is the DTSTAMP of every event, the
+// time the feed was generated.
+func (c *Calendar) Encode(w io.Writer, stamp time.Time) error {
+	out := &writer{w: bufio.NewWriter(w)}
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	out.line("BEGIN", "VCALENDAR")
+	out.line("VERSION", "2.0")
+	out.line("PRODID", "-//Samskipnad//Class Calendar//EN")
+	out.line("CALSCALE", "GREGORIAN")
+	out.line("METHOD", "PUBLISH")
+	if c.Name != "" {
+		out.line("X-WR-CALNAME", escape(c.Name))
+	}
+	if loc != time.UTC {
+		out.line("X-WR-TIMEZONE", loc.String())
+		from, to := c.span(stamp)
+		out.timezone(loc, from, to)
+	}
+
+	for _, e := range c.Events {
+		out.line("BEGIN", "VEVENT")
+		out.line("UID", e.UID)
+		out.line("DTSTAMP", stamp.UTC().Format(utcDateTimeFormat))
+		out.time("DTSTART", e.Start, loc)
+		out.time("DTEND", e.End, loc)
+		out.line("SUMMARY", escape(e.Summary))
+		if e.Description != "" {
+			out.line("DESCRIPTION", escape(e.Description))
+		}
+		if e.Location != "" {
+			out.line("LOCATION", escape(e.Location))
+		}
+		if e.Status != "" {
+			out.line("STATUS", e.Status)
+		}
+		if !e.Modified.IsZero() {
+			out.line("LAST-MODIFIED", e.Modified.UTC().Format(utcDateTimeFormat))
+		}
+		out.line("END", "VEVENT")
+	}
+
+	out.line("END", "VCALENDAR")
+	if out.err != nil {
+		return out.err
+	}
+	return out.w.Flush()
+}
+
+// span returns the whole years covered by the events and stamp, so the
+// VTIMEZONE includes every offset change an event could need
+func (c *Calendar) span(stamp time.Time) (time.Time, time.Time) {
+	from, to := stamp, stamp
+	for _, e := range c.Events {
+		if e.Start.Before(from) {
+			from = e.Start
+		}
+		if e.End.After(to) {
+			to = e.End
+		}
+	}
+	return time.Date(from.Year(), 1, 1, 0, 0, 0, 0, time.UTC), time.Date(to.Year()+1, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// line writes a content line, folded at 75 octets without splitting a
+// UTF-8 character, as RFC 5545 requires
+func (w *writer) line(name, value string) {
+	if w.err != nil {
+		return
+	}
+	s := name + ":" + value
+	limit := maxLineOctets
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		if _, w.err = w.w.WriteString(s[:cut] + "\r\n "); w.err != nil {
+			return
+		}
+		s = s[cut:]
+		limit = maxLineOctets - 1 // The leading space counts toward the next line
+	}
+	_, w.err = w.w.WriteString(s + "\r\n")
+}
+
+// time writes a date-time property as local time in loc, or in UTC when
+// loc is UTC
+func (w *writer) time(name string, t time.Time, loc *time.Location) {
+	if loc == time.UTC {
+		w.line(name, t.UTC().Format(utcDateTimeFormat))
+		return
+	}
+	w.line(name+";TZID="+loc.String(), t.In(loc).Format(dateTimeFormat))
+}
+
+// timezone writes a VTIMEZONE with one observance per offset change in loc
+// between from and to, plus the offset in force at from
+func (w *writer) timezone(loc *time.Location, from, to time.Time) {
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", loc.String())
+
+	t := from.In(loc)
+	name, offset := t.Zone()
+	w.observance(t, name, offset, offset, t.IsDST())
+	for {
+		_, end := t.ZoneBounds()
+		if end.IsZero() || !end.Before(to) {
+			break
+		}
+		t = end
+		name, next := t.Zone()
+		w.observance(t, name, offset, next, t.IsDST())
+		offset = next
+	}
+
+	w.line("END", "VTIMEZONE")
+}
+
+// observance writes a STANDARD or DAYLIGHT component. Its DTSTART is the
+// local time of the change on the clock before it, per RFC 5545.
+func (w *writer) observance(at time.Time, name string, from, to int, daylight bool) {
+	kind := "STANDARD"
+	if daylight {
+		kind = "DAYLIGHT"
+	}
+	w.line("BEGIN", kind)
+	w.line("DTSTART", at.In(time.FixedZone(name, from)).Format(dateTimeFormat))
+	w.line("TZOFFSETFROM", formatOffset(from))
+	w.line("TZOFFSETTO", formatOffset(to))
+	w.line("TZNAME", escape(name))
+	w.line("END", kind)
+}
+
+func formatOffset(seconds int) string {
+	sign := '+'
+	if seconds < 0 {
+		sign = '-'
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%c%02d%02d", sign, seconds/3600, seconds/60%60)
+}
+
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// escape escapes a TEXT property value
+func escape(s string) string {
+	return textEscaper.Replace(s)
+}
@@ -0,0 +1,101 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encode(t *testing.T, c *Calendar, stamp time.Time) string {
+	var buf bytes.Buffer
+	require.NoError(t, c.Encode(&buf, stamp))
+	return buf.String()
+}
+
+// unfold joins folded content lines back together
+func unfold(s string) []string {
+	return strings.Split(strings.TrimSuffix(strings.ReplaceAll(s, "\r\n ", ""), "\r\n"), "\r\n")
+}
+
+func TestEncode(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	require.NoError(t, err)
+	stamp := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	calendar := &Calendar{
+		Name:     "Kjernekraft Oslo",
+		Location: oslo,
+		Events: []Event{
+			{
+				UID:         "class-1@kjernekraft.samskipnad",
+				Summary:     "Yin; slow, deep",
+				Description: "Bring a blanket\nand socks",
+				Location:    "Studio A",
+				Status:      StatusConfirmed,
+				Start:       time.Date(2025, 3, 29, 17, 0, 0, 0, time.UTC),
+				End:         time.Date(2025, 3, 29, 18, 0, 0, 0, time.UTC),
+			},
+			{
+				UID:     "class-2@kjernekraft.samskipnad",
+				Summary: "Yin",
+				Status:  StatusCancelled,
+				Start:   time.Date(2025, 3, 31, 16, 0, 0, 0, time.UTC),
+				End:     time.Date(2025, 3, 31, 17, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+	out := encode(t, calendar, stamp)
+	lines := unfold(out)
+
+	assert.Equal(t, "BEGIN:VCALENDAR", lines[0])
+	assert.Equal(t, "END:VCALENDAR", lines[len(lines)-1])
+	assert.True(t, strings.HasSuffix(out, "\r\n"))
+	assert.Contains(t, lines, "X-WR-CALNAME:Kjernekraft Oslo")
+	assert.Contains(t, lines, "TZID:Europe/Oslo")
+
+	t.Run("LocalTimesAcrossDST", func(t *testing.T) {
+		// Both classes are at 18:00 in Oslo, an hour apart in UTC
+		assert.Contains(t, lines, "DTSTART;TZID=Europe/Oslo:20250329T180000")
+		assert.Contains(t, lines, "DTSTART;TZID=Europe/Oslo:20250331T180000")
+		assert.Contains(t, lines, "DTSTAMP:20250301T090000Z")
+	})
+
+	t.Run("Timezone", func(t *testing.T) {
+		assert.Contains(t, out, "BEGIN:DAYLIGHT\r\nDTSTART:20250330T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\nTZNAME:CEST\r\nEND:DAYLIGHT")
+		assert.Contains(t, out, "BEGIN:STANDARD\r\nDTSTART:20251026T030000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\nTZNAME:CET\r\nEND:STANDARD")
+	})
+
+	t.Run("Escaping", func(t *testing.T) {
+		assert.Contains(t, lines, `SUMMARY:Yin\; slow\, deep`)
+		assert.Contains(t, lines, `DESCRIPTION:Bring a blanket\nand socks`)
+		assert.Contains(t, lines, "STATUS:CANCELLED")
+	})
+
+	t.Run("UTC", func(t *testing.T) {
+		calendar := &Calendar{Events: calendar.Events[:1]}
+		lines := unfold(encode(t, calendar, stamp))
+		assert.Contains(t, lines, "DTSTART:20250329T170000Z")
+		assert.NotContains(t, strings.Join(lines, "\n"), "VTIMEZONE")
+	})
+}
+
+func TestLineFolding(t *testing.T) {
+	summary := strings.Repeat("Kveldsyoga på Grünerløkka ", 8)
+	calendar := &Calendar{Events: []Event{{
+		UID:     "class-1@kjernekraft.samskipnad",
+		Summary: summary,
+		Start:   time.Date(2025, 3, 1, 17, 0, 0, 0, time.UTC),
+		End:     time.Date(2025, 3, 1, 18, 0, 0, 0, time.UTC),
+	}}}
+	out := encode(t, calendar, time.Now())
+
+	for _, line := range strings.Split(out, "\r\n") {
+		assert.LessOrEqual(t, len(line), 75)
+		assert.True(t, strings.ToValidUTF8(line, "?") == line, "folding splits a character: %q", line)
+	}
+	assert.Contains(t, unfold(out), "SUMMARY:"+summary)
+}
@@ -0,0 +1,334 @@
+package ical
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"samskipnad/internal/models"
+	"samskipnad/internal/scheduling"
+)
+
+// Import change kinds
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeCancel = "cancel"
+)
+
+// ClassScheduler creates, updates and cancels classes, notifying and
+// refunding booked members. booking.Service implements it.
+type ClassScheduler interface {
+	CreateClass(class *models.Class) error
+	UpdateClass(update *models.Class) error
+	CancelClass(classID int) (int, error)
+}
+
+// Mapping turns calendar events into classes. The first rule whose Match
+// appears in an event's summary, ignoring case, sets its price and
+// capacity; the defaults apply to anything a rule leaves unset.
+type Mapping struct {
+	InstructorID int // Teaches new classes; updates keep the class's instructor
+	Price        int
+	Capacity     int
+	Rules        []Rule
+}
+
+// Rule maps events whose summary contains Match
+type Rule struct {
+	Match    string
+	Price    *int
+	Capacity *int
+}
+
+// Change is one difference between a calendar and the timetable
+type Change struct {
+	Kind     string
+	Class    models.Class  // The class after the change; the class being cancelled for cancellations
+	Previous *models.Class // The class before an update
+	Fields   []string      // What an update changes
+	Reason   string        // Why a class is cancelled
+	Err      error         // Set by ApplyImport when the change failed
+}
+
+// Skipped is a calendar event that is not imported
+type Skipped struct {
+	Summary string
+	Start   time.Time
+	Reason  string
+}
+
+// Plan previews an import: the changes applying it would make to the
+// timetable. Planning is repeatable, so a plan can be shown, then rebuilt
+// from the same file and applied.
+type Plan struct {
+	Source    string
+	Changes   []Change
+	Unchanged int
+	Skipped   []Skipped
+}
+
+// Count returns the number of changes of the given kind
+func (p *Plan) Count(kind string) int {
+	n := 0
+	for _, c := range p.Changes {
+		if c.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// occurrence is one class-sized event, keyed by the event's UID and, for
+// occurrences of recurring events, their original start
+type occurrence struct {
+	key   string
+	event Event
+}
+
+// PlanImport compares the events of a calendar with the classes imported
+// from it earlier. Classes are matched on the event's UID, so importing the
+// same calendar again only applies what changed. Events cancelled in the
+// calendar, and upcoming events that disappeared from the source since
+// the last import, cancel their classes. Recurring events are expanded up
+// to the scheduling horizon.
+func (s *Service) PlanImport(tenantID int, source string, events []Event, mapping Mapping) (*Plan, error) {
+	now := s.now()
+	plan := &Plan{Source: source}
+
+	existing, err := s.importedClasses(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, occ := range expand(events, now.Add(scheduling.DefaultHorizon), plan) {
+		e := occ.event
+		if !e.End.After(now) {
+			continue
+		}
+		seen[occ.key] = true
+		class, imported := existing[occ.key]
+
+		switch {
+		case e.Status == StatusCancelled:
+			if imported && class.Active {
+				plan.Changes = append(plan.Changes, Change{Kind: ChangeCancel, Class: *class, Reason: "cancelled in the calendar"})
+			}
+		case imported && !class.Active:
+			plan.Skipped = append(plan.Skipped, Skipped{Summary: e.Summary, Start: e.Start,
+				Reason: "the class was cancelled in the timetable"})
+		case imported:
+			update := *class
+			mapping.apply(&update, e)
+			if fields := changedFields(class, &update); len(fields) > 0 {
+				plan.Changes = append(plan.Changes, Change{Kind: ChangeUpdate, Class: update, Previous: class, Fields: fields})
+			} else {
+				plan.Unchanged++
+			}
+		default:
+			class := models.Class{
+				TenantID:     tenantID,
+				InstructorID: mapping.InstructorID,
+				ICalUID:      occ.key,
+				ICalSource:   source,
+			}
+			mapping.apply(&class, e)
+			plan.Changes = append(plan.Changes, Change{Kind: ChangeCreate, Class: class})
+		}
+	}
+
+	for key, class := range existing {
+		if !seen[key] && class.Active && class.ICalSource == source && class.StartTime.After(now) {
+			plan.Changes = append(plan.Changes, Change{Kind: ChangeCancel, Class: *class, Reason: "no longer in the calendar"})
+		}
+	}
+
+	sort.SliceStable(plan.Changes, func(i, j int) bool {
+		return plan.Changes[i].Class.StartTime.Before(plan.Changes[j].Class.StartTime)
+	})
+	return plan, nil
+}
+
+// ApplyImport makes the changes of a plan through the class scheduler, so
+// booked members are notified and refunded as for any other edit. A change
+// that fails, for example because its room is taken, records its error and
+// the rest still apply. It returns the number of changes applied.
+func (s *Service) ApplyImport(plan *Plan) int {
+	applied := 0
+	for i := range plan.Changes {
+		c := &plan.Changes[i]
+		switch c.Kind {
+		case ChangeCreate:
+			c.Err = s.classes.CreateClass(&c.Class)
+		case ChangeUpdate:
+			c.Err = s.classes.UpdateClass(&c.Class)
+		case ChangeCancel:
+			_, c.Err = s.classes.CancelClass(c.Class.ID)
+		}
+		if c.Err == nil {
+			applied++
+		}
+	}
+	return applied
+}
+
+// expand turns events into occurrences, recording the events that cannot
+// become classes in the plan
+func expand(events []Event, horizon time.Time, plan *Plan) []occurrence {
+	overrides := make(map[string]Event)
+	for _, e := range events {
+		if !e.RecurrenceID.IsZero() {
+			overrides[occurrenceKey(e.UID, e.RecurrenceID)] = e
+		}
+	}
+
+	var occurrences []occurrence
+	for _, e := range events {
+		if !e.RecurrenceID.IsZero() {
+			continue
+		}
+		if reason := unimportable(&e); reason != "" {
+			plan.Skipped = append(plan.Skipped, Skipped{Summary: e.Summary, Start: e.Start, Reason: reason})
+			continue
+		}
+		if e.RRule == "" {
+			occurrences = append(occurrences, occurrence{key: e.UID, event: e})
+			continue
+		}
+
+		rule, err := scheduling.ParseRule(e.RRule)
+		if err != nil {
+			plan.Skipped = append(plan.Skipped, Skipped{Summary: e.Summary, Start: e.Start,
+				Reason: "repeats in a way that cannot be imported (" + err.Error() + ")"})
+			continue
+		}
+		length := e.End.Sub(e.Start)
+	next:
+		for _, start := range rule.Occurrences(e.Start, horizon) {
+			for _, ex := range e.ExDates {
+				if ex.Equal(start) {
+					continue next
+				}
+			}
+			key := occurrenceKey(e.UID, start)
+			occ := e
+			occ.Start, occ.End = start, start.Add(length)
+			if override, ok := overrides[key]; ok {
+				delete(overrides, key)
+				if unimportable(&override) != "" {
+					continue
+				}
+				occ = override
+			}
+			occurrences = append(occurrences, occurrence{key: key, event: occ})
+		}
+	}
+	return occurrences
+}
+
+// unimportable returns why an event cannot become a class, filling in its
+// end from its duration
+func unimportable(e *Event) string {
+	switch {
+	case e.UID == "":
+		return "the event has no UID"
+	case e.AllDay:
+		return "all-day events are not classes"
+	case e.Start.IsZero():
+		return "the event has no start time"
+	}
+	if e.End.IsZero() {
+		e.End = e.Start.Add(e.Duration)
+	}
+	if !e.End.After(e.Start) {
+		return "the event has no length"
+	}
+	return ""
+}
+
+func occurrenceKey(uid string, start time.Time) string {
+	return uid + "/" + start.UTC().Format(utcDateTimeFormat)
+}
+
+// apply sets the parts of a class that come from its calendar event
+func (m Mapping) apply(class *models.Class, e Event) {
+	class.Name = e.Summary
+	class.Description = e.Description
+	class.StartTime = e.Start.UTC()
+	class.EndTime = e.End.UTC()
+	class.Price = m.Price
+	class.MaxCapacity = m.Capacity
+
+	summary := strings.ToLower(e.Summary)
+	for _, rule := range m.Rules {
+		if rule.Match == "" || !strings.Contains(summary, strings.ToLower(rule.Match)) {
+			continue
+		}
+		if rule.Price != nil {
+			class.Price = *rule.Price
+		}
+		if rule.Capacity != nil {
+			class.MaxCapacity = *rule.Capacity
+		}
+		return
+	}
+}
+
+func changedFields(before, after *models.Class) []string {
+	var fields []string
+	if before.Name != after.Name {
+		fields = append(fields, "name")
+	}
+	if before.Description != after.Description {
+		fields = append(fields, "description")
+	}
+	if !before.StartTime.Equal(after.StartTime) || !before.EndTime.Equal(after.EndTime) {
+		fields = append(fields, "time")
+	}
+	if before.Price != after.Price {
+		fields = append(fields, "price")
+	}
+	if before.MaxCapacity != after.MaxCapacity {
+		fields = append(fields, "capacity")
+	}
+	return fields
+}
+
+// importedClasses returns a tenant's classes that came from a calendar,
+// by event key
+func (s *Service) importedClasses(tenantID int) (map[string]*models.Class, error) {
+	rows, err := s.db.Query(`
+		SELECT id, tenant_id, name, COALESCE(description, ''), instructor_id, start_time, end_time, max_capacity,
+			price, requires_ticket, requires_membership, active, COALESCE(category_id, ''), resource_id,
+			induction_resource_id, ical_uid, COALESCE(ical_source, '')
+		FROM classes
+		WHERE tenant_id = ? AND ical_uid IS NOT NULL`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	classes := make(map[string]*models.Class)
+	for rows.Next() {
+		var c models.Class
+		var resourceID, inductionFor sql.NullInt64
+		err := rows.Scan(&c.ID, &c.TenantID, &c.Name, &c.Description, &c.InstructorID, &c.StartTime, &c.EndTime,
+			&c.MaxCapacity, &c.Price, &c.RequiresTicket, &c.RequiresMembership, &c.Active, &c.CategoryID,
+			&resourceID, &inductionFor, &c.ICalUID, &c.ICalSource)
+		if err != nil {
+			return nil, err
+		}
+		if resourceID.Valid {
+			id := int(resourceID.Int64)
+			c.ResourceID = &id
+		}
+		if inductionFor.Valid {
+			id := int(inductionFor.Int64)
+			c.InductionFor = &id
+		}
+		classes[c.ICalUID] = &c
+	}
+	return classes, rows.Err()
+}
@@ -0,0 +1,150 @@
+package ical
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/models"
+)
+
+// fakeScheduler stores classes directly, standing in for booking.Service
+type fakeScheduler struct {
+	db *sql.DB
+}
+
+func (f *fakeScheduler) CreateClass(class *models.Class) error {
+	result, err := f.db.Exec(`
+		INSERT INTO classes (tenant_id, name, description, instructor_id, start_time, end_time, max_capacity, price,
+			ical_uid, ical_source)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		class.TenantID, class.Name, class.Description, class.InstructorID, class.StartTime.UTC(), class.EndTime.UTC(),
+		class.MaxCapacity, class.Price, class.ICalUID, class.ICalSource)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	class.ID = int(id)
+	return err
+}
+
+func (f *fakeScheduler) UpdateClass(update *models.Class) error {
+	_, err := f.db.Exec(`
+		UPDATE classes SET name = ?, description = ?, start_time = ?, end_time = ?, max_capacity = ?, price = ?
+		WHERE id = ?`,
+		update.Name, update.Description, update.StartTime.UTC(), update.EndTime.UTC(), update.MaxCapacity,
+		update.Price, update.ID)
+	return err
+}
+
+func (f *fakeScheduler) CancelClass(classID int) (int, error) {
+	_, err := f.db.Exec(`UPDATE classes SET active = false WHERE id = ?`, classID)
+	return 0, err
+}
+
+func (env *testEnv) plan(t *testing.T, source, calendar string, mapping Mapping) *Plan {
+	events, err := Parse(strings.NewReader(calendar), env.service.community().Location())
+	require.NoError(t, err)
+	plan, err := env.service.PlanImport(1, source, events, mapping)
+	require.NoError(t, err)
+	return plan
+}
+
+func changesByName(plan *Plan) map[string]Change {
+	changes := make(map[string]Change)
+	for _, c := range plan.Changes {
+		changes[c.Class.Name+" "+c.Class.StartTime.Format("Jan 2")] = c
+	}
+	return changes
+}
+
+func TestImport(t *testing.T) {
+	env := newTestEnv(t)
+	flowPrice := 15000
+	mapping := Mapping{InstructorID: 1, Price: 20000, Capacity: 12, Rules: []Rule{
+		{Match: "FLOW", Price: &flowPrice},
+	}}
+	const source = "https://example.com/term.ics"
+
+	plan := env.plan(t, source, termCalendar, mapping)
+	require.Len(t, plan.Changes, 4)
+	assert.Equal(t, 4, plan.Count(ChangeCreate))
+	require.Len(t, plan.Skipped, 1)
+	assert.Equal(t, "Retreat", plan.Skipped[0].Summary)
+
+	changes := changesByName(plan)
+	yin := changes["Yin, slow Mar 5"]
+	assert.Equal(t, 20000, yin.Class.Price)
+	assert.Equal(t, 12, yin.Class.MaxCapacity)
+	assert.True(t, yin.Class.EndTime.Equal(time.Date(2025, 3, 5, 18, 15, 0, 0, time.UTC)))
+
+	assert.Contains(t, changes, "Morning flow Mar 6")
+	assert.NotContains(t, changes, "Morning flow Mar 13", "excluded occurrences are not imported")
+	moved := changes["Morning flow (late start) Mar 20"]
+	assert.True(t, moved.Class.StartTime.Equal(time.Date(2025, 3, 20, 7, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "flow@example.com/20250320T060000Z", moved.Class.ICalUID, "an edited occurrence keeps its key")
+	assert.Equal(t, 15000, moved.Class.Price)
+	assert.Equal(t, 12, moved.Class.MaxCapacity, "rules fall back to the default capacity")
+
+	assert.Equal(t, 4, env.service.ApplyImport(plan))
+
+	t.Run("Idempotent", func(t *testing.T) {
+		again := env.plan(t, source, termCalendar, mapping)
+		assert.Empty(t, again.Changes)
+		assert.Equal(t, 4, again.Unchanged)
+	})
+
+	t.Run("PlanIsPreview", func(t *testing.T) {
+		env.plan(t, source, strings.Replace(termCalendar, "Yin", "Yang", 1), mapping)
+		var name string
+		require.NoError(t, env.db.QueryRow(`SELECT name FROM classes WHERE ical_uid = 'yin-1@example.com'`).Scan(&name))
+		assert.Equal(t, "Yin, slow", name)
+	})
+
+	t.Run("Updates", func(t *testing.T) {
+		moved := strings.Replace(termCalendar, "20250305T180000", "20250305T190000", 1)
+		moved = strings.Replace(moved, "EXDATE:20250313T070000", "EXDATE:20250313T070000,20250327T070000", 1)
+
+		plan := env.plan(t, source, moved, mapping)
+		require.Len(t, plan.Changes, 2)
+
+		update := changesByName(plan)["Yin, slow Mar 5"]
+		assert.Equal(t, ChangeUpdate, update.Kind)
+		assert.Equal(t, []string{"time"}, update.Fields)
+		assert.True(t, update.Previous.StartTime.Equal(time.Date(2025, 3, 5, 17, 0, 0, 0, time.UTC)))
+
+		cancel := changesByName(plan)["Morning flow Mar 27"]
+		assert.Equal(t, ChangeCancel, cancel.Kind)
+		assert.Equal(t, "no longer in the calendar", cancel.Reason)
+
+		assert.Equal(t, 2, env.service.ApplyImport(plan))
+		assert.Empty(t, env.plan(t, source, moved, mapping).Changes)
+	})
+
+	t.Run("CancelledInCalendar", func(t *testing.T) {
+		cancelled := strings.Replace(termCalendar, "UID:yin-1@example.com\r\n", "UID:yin-1@example.com\r\nSTATUS:CANCELLED\r\n", 1)
+		plan := env.plan(t, source, cancelled, mapping)
+
+		cancel := changesByName(plan)["Yin, slow Mar 5"]
+		assert.Equal(t, ChangeCancel, cancel.Kind)
+		assert.Equal(t, "cancelled in the calendar", cancel.Reason)
+	})
+
+	t.Run("OtherSource", func(t *testing.T) {
+		plan := env.plan(t, "https://example.com/other.ics", "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", mapping)
+		assert.Empty(t, plan.Changes, "classes imported from another calendar are left alone")
+	})
+
+	t.Run("PastClassesUntouched", func(t *testing.T) {
+		env.now = time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+		plan := env.plan(t, source, "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", mapping)
+		for _, c := range plan.Changes {
+			assert.True(t, c.Class.StartTime.After(env.now), "%s is in the past", c.Class.Name)
+		}
+		assert.Equal(t, 1, plan.Count(ChangeCancel), "only the late-start flow is still upcoming")
+	})
+}
@@ -0,0 +1,234 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCalendar = errors.New("not an iCalendar file")
+
+// maxCalendarLine guards against unbounded lines in uploaded files
+const maxCalendarLine = 1 << 20
+
+// Parse reads the VEVENTs of an iCalendar document. Times with a TZID are
+// read in that timezone; floating times, and TZIDs Go does not know, are
+// read in loc. Properties the importer does not use are ignored.
+func Parse(r io.Reader, loc *time.Location) ([]Event, error) {
+	lines, err := unfoldLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	var event *Event
+	var components []string
+	sawCalendar := false
+	for n, raw := range lines {
+		if raw == "" {
+			continue
+		}
+		name, params, value, err := parseLine(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidCalendar, n+1, err)
+		}
+
+		switch name {
+		case "BEGIN":
+			component := strings.ToUpper(value)
+			if component == "VCALENDAR" {
+				sawCalendar = true
+			}
+			if component == "VEVENT" && len(components) > 0 && components[len(components)-1] == "VCALENDAR" {
+				event = &Event{}
+			}
+			components = append(components, component)
+			continue
+		case "END":
+			if len(components) == 0 || components[len(components)-1] != strings.ToUpper(value) {
+				return nil, fmt.Errorf("%w: line %d: unexpected END:%s", ErrInvalidCalendar, n+1, value)
+			}
+			components = components[:len(components)-1]
+			if strings.EqualFold(value, "VEVENT") && event != nil {
+				events = append(events, *event)
+				event = nil
+			}
+			continue
+		}
+
+		// Only the event's own properties, not those of a VALARM inside it
+		if event == nil || components[len(components)-1] != "VEVENT" {
+			continue
+		}
+		if err := event.set(name, params, value, loc); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidCalendar, n+1, err)
+		}
+	}
+
+	if !sawCalendar || len(components) > 0 {
+		return nil, ErrInvalidCalendar
+	}
+	return events, nil
+}
+
+// set reads one property of an event
+func (e *Event) set(name string, params map[string]string, value string, loc *time.Location) error {
+	var err error
+	switch name {
+	case "UID":
+		e.UID = value
+	case "SUMMARY":
+		e.Summary = unescape(value)
+	case "DESCRIPTION":
+		e.Description = unescape(value)
+	case "LOCATION":
+		e.Location = unescape(value)
+	case "STATUS":
+		e.Status = strings.ToUpper(value)
+	case "DTSTART":
+		e.Start, e.AllDay, err = parseTime(value, params, loc)
+	case "DTEND":
+		e.End, _, err = parseTime(value, params, loc)
+	case "DURATION":
+		e.Duration, err = parseDuration(value)
+	case "RRULE":
+		e.RRule = value
+	case "EXDATE":
+		for _, v := range strings.Split(value, ",") {
+			t, _, err := parseTime(v, params, loc)
+			if err != nil {
+				return err
+			}
+			e.ExDates = append(e.ExDates, t)
+		}
+	case "RECURRENCE-ID":
+		e.RecurrenceID, _, err = parseTime(value, params, loc)
+	case "LAST-MODIFIED":
+		e.Modified, _, err = parseTime(value, params, loc)
+	}
+	return err
+}
+
+// unfoldLines splits a document into content lines, joining the lines
+// RFC 5545 folds with a leading space or tab
+func unfoldLines(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxCalendarLine)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCalendar, err)
+	}
+	return lines, nil
+}
+
+// parseLine splits a content line into its upper-cased name, its
+// parameters and its value. Colons inside quoted parameter values do not
+// end the name.
+func parseLine(line string) (string, map[string]string, string, error) {
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, "", fmt.Errorf("missing value in %q", line)
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	params := make(map[string]string, len(parts)-1)
+	for _, p := range parts[1:] {
+		key, val, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(key)] = strings.Trim(val, `"`)
+	}
+	return strings.ToUpper(parts[0]), params, line[colon+1:], nil
+}
+
+// parseTime reads a DATE or DATE-TIME value and reports whether it was a
+// date, as used by all-day events
+func parseTime(value string, params map[string]string, loc *time.Location) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(utcDateTimeFormat, value)
+		return t, false, err
+	}
+	if tzid := params["TZID"]; tzid != "" {
+		if named, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+			loc = named
+		}
+	}
+	t, err := time.ParseInLocation(dateTimeFormat, value, loc)
+	return t, false, err
+}
+
+// parseDuration reads a DURATION value such as PT1H30M or P1D
+func parseDuration(value string) (time.Duration, error) {
+	s := strings.TrimPrefix(strings.TrimPrefix(value, "+"), "P")
+	if strings.HasPrefix(value, "-") || s == value {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	var d time.Duration
+	inTime := false
+	num := ""
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			num += string(c)
+		case c == 'T':
+			inTime = true
+		default:
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			num = ""
+			switch {
+			case c == 'W':
+				d += time.Duration(n) * 7 * 24 * time.Hour
+			case c == 'D':
+				d += time.Duration(n) * 24 * time.Hour
+			case c == 'H' && inTime:
+				d += time.Duration(n) * time.Hour
+			case c == 'M' && inTime:
+				d += time.Duration(n) * time.Minute
+			case c == 'S' && inTime:
+				d += time.Duration(n) * time.Second
+			default:
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+		}
+	}
+	if num != "" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+var textUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// unescape reverses escape for a TEXT property value
+func unescape(s string) string {
+	return textUnescaper.Replace(s)
+}
@@ -0,0 +1,134 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const termCalendar = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Example//Calendar//EN\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:Europe/Oslo\r\n" +
+	"BEGIN:STANDARD\r\n" +
+	"DTSTART:19701025T030000\r\n" +
+	"TZOFFSETFROM:+0200\r\n" +
+	"TZOFFSETTO:+0100\r\n" +
+	"END:STANDARD\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:yin-1@example.com\r\n" +
+	"DTSTART;TZID=\"Europe/Oslo\":20250305T180000\r\n" +
+	"DURATION:PT1H15M\r\n" +
+	"SUMMARY:Yin\\, slow\r\n" +
+	"DESCRIPTION:Bring a blanket\\nand socks. This description is long enough \r\n" +
+	" that it is folded.\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"DESCRIPTION:Reminder\r\n" +
+	"TRIGGER:-PT15M\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:flow@example.com\r\n" +
+	"DTSTART:20250306T070000\r\n" +
+	"DTEND:20250306T080000\r\n" +
+	"RRULE:FREQ=WEEKLY;COUNT=4\r\n" +
+	"EXDATE:20250313T070000\r\n" +
+	"SUMMARY:Morning flow\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:flow@example.com\r\n" +
+	"RECURRENCE-ID:20250320T070000\r\n" +
+	"DTSTART:20250320T080000\r\n" +
+	"DTEND:20250320T090000\r\n" +
+	"SUMMARY:Morning flow (late start)\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:retreat@example.com\r\n" +
+	"DTSTART;VALUE=DATE:20250310\r\n" +
+	"SUMMARY:Retreat\r\n" +
+	"STATUS:cancelled\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParse(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	require.NoError(t, err)
+
+	events, err := Parse(strings.NewReader(termCalendar), oslo)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+
+	yin := events[0]
+	assert.Equal(t, "yin-1@example.com", yin.UID)
+	assert.Equal(t, "Yin, slow", yin.Summary)
+	assert.Equal(t, "Bring a blanket\nand socks. This description is long enough that it is folded.", yin.Description,
+		"the VALARM's description is not the event's")
+	assert.True(t, yin.Start.Equal(time.Date(2025, 3, 5, 17, 0, 0, 0, time.UTC)))
+	assert.Equal(t, 75*time.Minute, yin.Duration)
+
+	flow := events[1]
+	assert.True(t, flow.Start.Equal(time.Date(2025, 3, 6, 6, 0, 0, 0, time.UTC)), "floating times are read in the community's timezone")
+	assert.Equal(t, "FREQ=WEEKLY;COUNT=4", flow.RRule)
+	require.Len(t, flow.ExDates, 1)
+	assert.True(t, flow.ExDates[0].Equal(time.Date(2025, 3, 13, 6, 0, 0, 0, time.UTC)))
+
+	moved := events[2]
+	assert.True(t, moved.RecurrenceID.Equal(time.Date(2025, 3, 20, 6, 0, 0, 0, time.UTC)))
+
+	retreat := events[3]
+	assert.True(t, retreat.AllDay)
+	assert.Equal(t, StatusCancelled, retreat.Status)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		calendar := &Calendar{Location: oslo, Events: []Event{{
+			UID: "class-1@kjernekraft.samskipnad", Summary: "Yin; slow, deep", Description: "Line one\nline two",
+			Start: time.Date(2025, 3, 29, 17, 0, 0, 0, time.UTC), End: time.Date(2025, 3, 29, 18, 0, 0, 0, time.UTC),
+		}}}
+		parsed, err := Parse(strings.NewReader(encode(t, calendar, time.Now())), time.UTC)
+		require.NoError(t, err)
+		require.Len(t, parsed, 1)
+		assert.Equal(t, calendar.Events[0].Summary, parsed[0].Summary)
+		assert.Equal(t, calendar.Events[0].Description, parsed[0].Description)
+		assert.True(t, calendar.Events[0].Start.Equal(parsed[0].Start))
+		assert.True(t, calendar.Events[0].End.Equal(parsed[0].End))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, doc := range []string{
+			"",
+			"not a calendar",
+			"BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VCALENDAR\r\n",
+			"BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART:tomorrow\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+		} {
+			_, err := Parse(strings.NewReader(doc), time.UTC)
+			assert.ErrorIs(t, err, ErrInvalidCalendar, "%q", doc)
+		}
+	})
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"PT1H":     time.Hour,
+		"PT1H30M":  90 * time.Minute,
+		"PT45M":    45 * time.Minute,
+		"P1D":      24 * time.Hour,
+		"P1DT2H":   26 * time.Hour,
+		"P1W":      7 * 24 * time.Hour,
+		"+PT1H15M": 75 * time.Minute,
+	} {
+		got, err := parseDuration(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+
+	for _, value := range []string{"", "1H", "-PT1H", "PT1X", "P1H", "PT1"} {
+		_, err := parseDuration(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,477 @@
+package instructors
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"samskipnad/internal/models"
+	"samskipnad/internal/services"
+)
+
+// Substitute request statuses
+const (
+	RequestOpen      = "open"
+	RequestFilled    = "filled"
+	RequestWithdrawn = "withdrawn"
+)
+
+// Event types published by the instructors service
+const (
+	EventInstructorAssigned  = "class.instructor_assigned"
+	EventSubstituteRequested = "class.substitute_requested"
+	EventSubstituteWithdrawn = "class.substitute_withdrawn"
+)
+
+var (
+	ErrClassNotFound   = errors.New("class not found")
+	ErrNotInstructor   = errors.New("user is not an instructor")
+	ErrNotClassTeacher = errors.New("you are not teaching this class")
+	ErrClassStarted    = errors.New("class has already started")
+	ErrRequestOpen     = errors.New("a substitute has already been requested for this class")
+	ErrRequestNotFound = errors.New("substitute request not found")
+)
+
+// ClassSummary is an upcoming class as shown to its instructor
+type ClassSummary struct {
+	models.Class
+	Booked     int
+	InProgress bool               // Started but not yet ended
+	Substitute *SubstituteRequest // Open substitute request, if any
+}
+
+// Attendee is a member with a confirmed booking for a class. Contact
+// details are only shown to staff with the view_students permission.
+type Attendee struct {
+	BookingID   int
+	UserID      int
+	FirstName   string
+	LastName    string
+	Email       string
+	Phone       string
+	BookedAt    time.Time
+	CheckedInAt *time.Time
+	NoShow      bool
+}
+
+// SubstituteRequest is an instructor asking for someone to cover a class
+type SubstituteRequest struct {
+	ID             int
+	ClassID        int
+	ClassName      string
+	ClassStart     time.Time
+	InstructorID   int
+	InstructorName string
+	Reason         string
+	Status         string
+	SubstituteID   *int
+	CreatedAt      time.Time
+}
+
+// Service manages class instructors
+type Service struct {
+	db     *sql.DB
+	events services.EventBusService
+	now    func() time.Time
+}
+
+func NewService(db *sql.DB, events services.EventBusService) *Service {
+	return &Service{
+		db:     db,
+		events: events,
+		now:    time.Now,
+	}
+}
+
+// Instructors returns the tenant's admins and instructors, who can be
+// assigned to teach a class
+func (s *Service) Instructors(tenantID int) ([]models.User, error) {
+	rows, err := s.db.Query(`
+		SELECT id, email, first_name, last_name, role, tenant_id FROM users
+		WHERE tenant_id = ? AND role IN ('admin', 'instructor') AND active = true
+		ORDER BY first_name, last_name`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var instructors []models.User
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.Email, &u.FirstName, &u.LastName, &u.Role, &u.TenantID); err != nil {
+			return nil, err
+		}
+		instructors = append(instructors, u)
+	}
+	return instructors, rows.Err()
+}
+
+// IsInstructor reports whether a user can teach classes for the tenant
+func (s *Service) IsInstructor(userID, tenantID int) (bool, error) {
+	return isInstructor(s.db, userID, tenantID)
+}
+
+func isInstructor(q queryer, userID, tenantID int) (bool, error) {
+	var n int
+	err := q.QueryRow(`
+		SELECT COUNT(*) FROM users
+		WHERE id = ? AND tenant_id = ? AND role IN ('admin', 'instructor') AND active = true`,
+		userID, tenantID).Scan(&n)
+	return n > 0, err
+}
+
+// Assign makes an instructor teach a class. An open substitute request for
+// the class is filled by anyone other than the instructor who made it. The
+// new instructor, and the one who asked for a substitute, are notified.
+func (s *Service) Assign(classID, instructorID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	announce, err := s.AssignTx(tx, classID, instructorID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	announce()
+	return nil
+}
+
+// AssignTx is Assign within tx, for saving the assignment with other
+// changes to the class. The returned function notifies the instructors
+// and must be called once tx is committed.
+func (s *Service) AssignTx(tx *sql.Tx, classID, instructorID int) (func(), error) {
+	class, err := s.getClass(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isInstructor(tx, instructorID, class.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotInstructor
+	}
+	if class.InstructorID == instructorID {
+		return func() {}, nil
+	}
+
+	now := s.now()
+	_, err = tx.Exec(`UPDATE classes SET instructor_id = ?, updated_at = ? WHERE id = ?`, instructorID, now, classID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign instructor: %w", err)
+	}
+
+	request, err := s.openRequest(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if request != nil && request.InstructorID != instructorID {
+		_, err = tx.Exec(`
+			UPDATE substitute_requests SET status = ?, substitute_id = ?, resolved_at = ?
+			WHERE id = ?`, RequestFilled, instructorID, now.UTC(), request.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fill substitute request: %w", err)
+		}
+	}
+
+	return func() {
+		data := map[string]interface{}{
+			"class_id":      classID,
+			"instructor_id": instructorID,
+		}
+		s.publish(EventInstructorAssigned, class.TenantID, instructorID, data)
+		s.notify(instructorID, &services.Notification{
+			Type:     EventInstructorAssigned,
+			Title:    "You are teaching " + class.Name,
+			Message:  fmt.Sprintf("You have been assigned to teach %s on %s.", class.Name, class.StartTime.Format("Mon Jan 2 15:04")),
+			Data:     data,
+			Priority: 2,
+		})
+		if request != nil && request.InstructorID != instructorID {
+			s.notify(request.InstructorID, &services.Notification{
+				Type:    EventInstructorAssigned,
+				Title:   "Substitute found for " + class.Name,
+				Message: fmt.Sprintf("Someone else will teach %s on %s.", class.Name, class.StartTime.Format("Mon Jan 2 15:04")),
+				Data:    data,
+			})
+		}
+	}, nil
+}
+
+// UpcomingClasses returns the active classes an instructor teaches that
+// have not ended yet, soonest first. Classes in progress are included so
+// latecomers can still be checked in.
+func (s *Service) UpcomingClasses(instructorID int) ([]ClassSummary, error) {
+	now := s.now()
+	rows, err := s.db.Query(`
+		SELECT c.id, c.tenant_id, c.name, COALESCE(c.description, ''), c.instructor_id, c.start_time, c.end_time,
+			c.max_capacity, c.price, COALESCE(c.category_id, ''),
+			(SELECT COUNT(*) FROM bookings b WHERE b.class_id = c.id AND b.status = 'confirmed')
+		FROM classes c
+		WHERE c.instructor_id = ? AND c.active = true AND c.end_time > ?
+		ORDER BY c.start_time`, instructorID, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	var classes []ClassSummary
+	for rows.Next() {
+		var c ClassSummary
+		err := rows.Scan(&c.ID, &c.TenantID, &c.Name, &c.Description, &c.InstructorID, &c.StartTime, &c.EndTime,
+			&c.MaxCapacity, &c.Price, &c.CategoryID, &c.Booked)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.Active = true
+		c.InProgress = !c.StartTime.After(now)
+		classes = append(classes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range classes {
+		classes[i].Substitute, err = s.openRequest(s.db, classes[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return classes, nil
+}
+
+// Roster returns the members booked for a class in booking order
+func (s *Service) Roster(classID int) ([]Attendee, error) {
+	rows, err := s.db.Query(`
+		SELECT b.id, u.id, u.first_name, u.last_name, u.email, COALESCE(u.phone, ''), b.created_at,
+			b.checked_in_at, COALESCE(b.no_show, false)
+		FROM bookings b
+		JOIN users u ON u.id = b.user_id
+		WHERE b.class_id = ? AND b.status = 'confirmed'
+		ORDER BY b.created_at, b.id`, classID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attendees []Attendee
+	for rows.Next() {
+		var a Attendee
+		var checkedInAt sql.NullTime
+		err := rows.Scan(&a.BookingID, &a.UserID, &a.FirstName, &a.LastName, &a.Email, &a.Phone, &a.BookedAt,
+			&checkedInAt, &a.NoShow)
+		if err != nil {
+			return nil, err
+		}
+		if checkedInAt.Valid {
+			a.CheckedInAt = &checkedInAt.Time
+		}
+		attendees = append(attendees, a)
+	}
+	return attendees, rows.Err()
+}
+
+// RequestSubstitute asks for someone to cover a class the instructor
+// teaches. The tenant's admins are notified so they can assign a
+// substitute.
+func (s *Service) RequestSubstitute(classID, instructorID int, reason string) (*SubstituteRequest, error) {
+	class, err := s.getClass(s.db, classID)
+	if err != nil {
+		return nil, err
+	}
+	if class.InstructorID != instructorID {
+		return nil, ErrNotClassTeacher
+	}
+	now := s.now()
+	if !class.StartTime.After(now) {
+		return nil, ErrClassStarted
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	existing, err := s.openRequest(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, ErrRequestOpen
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO substitute_requests (class_id, instructor_id, reason, status, created_at)
+		VALUES (?, ?, ?, ?, ?)`, classID, instructorID, reason, RequestOpen, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to request substitute: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	request := &SubstituteRequest{
+		ID:           int(id),
+		ClassID:      classID,
+		ClassName:    class.Name,
+		ClassStart:   class.StartTime,
+		InstructorID: instructorID,
+		Reason:       reason,
+		Status:       RequestOpen,
+		CreatedAt:    now,
+	}
+
+	data := map[string]interface{}{
+		"request_id": request.ID,
+		"class_id":   classID,
+	}
+	s.publish(EventSubstituteRequested, class.TenantID, instructorID, data)
+
+	admins, err := s.admins(class.TenantID)
+	if err != nil {
+		log.Printf("Failed to find admins to notify: %v", err)
+	}
+	message := fmt.Sprintf("A substitute is needed for %s on %s.", class.Name, class.StartTime.Format("Mon Jan 2 15:04"))
+	if reason != "" {
+		message += " Reason: " + reason
+	}
+	for _, adminID := range admins {
+		s.notify(adminID, &services.Notification{
+			Type:     EventSubstituteRequested,
+			Title:    "Substitute needed: " + class.Name,
+			Message:  message,
+			Data:     data,
+			Priority: 2,
+		})
+	}
+
+	return request, nil
+}
+
+// WithdrawSubstitute cancels the instructor's open substitute request for
+// a class
+func (s *Service) WithdrawSubstitute(classID, instructorID int) error {
+	result, err := s.db.Exec(`
+		UPDATE substitute_requests SET status = ?, resolved_at = ?
+		WHERE class_id = ? AND instructor_id = ? AND status = ?`,
+		RequestWithdrawn, s.now().UTC(), classID, instructorID, RequestOpen)
+	if err != nil {
+		return fmt.Errorf("failed to withdraw substitute request: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrRequestNotFound
+	}
+
+	if class, err := s.getClass(s.db, classID); err == nil {
+		s.publish(EventSubstituteWithdrawn, class.TenantID, instructorID, map[string]interface{}{
+			"class_id": classID,
+		})
+	}
+	return nil
+}
+
+// OpenRequests returns the tenant's unfilled substitute requests for
+// classes that have not started, soonest class first
+func (s *Service) OpenRequests(tenantID int) ([]SubstituteRequest, error) {
+	rows, err := s.db.Query(`
+		SELECT r.id, r.class_id, c.name, c.start_time, r.instructor_id, u.first_name || ' ' || u.last_name,
+			COALESCE(r.reason, ''), r.status, r.created_at
+		FROM substitute_requests r
+		JOIN classes c ON c.id = r.class_id
+		JOIN users u ON u.id = r.instructor_id
+		WHERE c.tenant_id = ? AND r.status = ? AND c.active = true AND c.start_time > ?
+		ORDER BY c.start_time`, tenantID, RequestOpen, s.now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []SubstituteRequest
+	for rows.Next() {
+		var r SubstituteRequest
+		err := rows.Scan(&r.ID, &r.ClassID, &r.ClassName, &r.ClassStart, &r.InstructorID, &r.InstructorName,
+			&r.Reason, &r.Status, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, r)
+	}
+	return requests, rows.Err()
+}
+
+// Helper methods
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *Service) getClass(q queryer, classID int) (*models.Class, error) {
+	var class models.Class
+	err := q.QueryRow(`
+		SELECT id, tenant_id, name, instructor_id, start_time, end_time, active
+		FROM classes WHERE id = ?`, classID).Scan(
+		&class.ID, &class.TenantID, &class.Name, &class.InstructorID, &class.StartTime, &class.EndTime, &class.Active)
+	if err == sql.ErrNoRows {
+		return nil, ErrClassNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &class, nil
+}
+
+func (s *Service) openRequest(q queryer, classID int) (*SubstituteRequest, error) {
+	var r SubstituteRequest
+	err := q.QueryRow(`
+		SELECT id, class_id, instructor_id, COALESCE(reason, ''), status, created_at
+		FROM substitute_requests WHERE class_id = ? AND status = ?`, classID, RequestOpen).Scan(
+		&r.ID, &r.ClassID, &r.InstructorID, &r.Reason, &r.Status, &r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *Service) admins(tenantID int) ([]int, error) {
+	rows, err := s.db.Query(`SELECT id FROM users WHERE tenant_id = ? AND role = 'admin' AND active = true`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// publish dispatches an event from the instructors service; see services.Publish
+func (s *Service) publish(eventType string, tenantID, userID int, data map[string]interface{}) {
+	services.Publish(s.events, "instructors", eventType, tenantID, userID, data)
+}
+
+func (s *Service) notify(userID int, notification *services.Notification) {
+	services.Notify(s.events, userID, notification)
+}
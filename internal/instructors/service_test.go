@@ -0,0 +1,200 @@
+package instructors
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/database"
+	"samskipnad/internal/services"
+)
+
+// setupTestDB creates a migrated in-memory SQLite database for testing
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// recordingBus captures published events and notifications
+type recordingBus struct {
+	services.EventBusService
+	events        []*services.Event
+	notifications map[int][]*services.Notification
+}
+
+func (b *recordingBus) Publish(ctx context.Context, event *services.Event) error {
+	b.events = append(b.events, event)
+	return nil
+}
+
+func (b *recordingBus) SendNotification(ctx context.Context, userID int, notification *services.Notification) error {
+	b.notifications[userID] = append(b.notifications[userID], notification)
+	return nil
+}
+
+type testEnv struct {
+	db      *sql.DB
+	service *Service
+	events  *recordingBus
+	now     time.Time
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := setupTestDB(t)
+	env := &testEnv{
+		db:     db,
+		events: &recordingBus{notifications: make(map[int][]*services.Notification)},
+		now:    time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC),
+	}
+	env.service = NewService(db, env.events)
+	env.service.now = func() time.Time { return env.now }
+	return env
+}
+
+func (env *testEnv) createUser(t *testing.T, email, role string) int {
+	result, err := env.db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, role, tenant_id)
+		VALUES (?, 'x', 'Test', ?, ?, 1)`, email, role, role)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func (env *testEnv) createClass(t *testing.T, instructorID int, start time.Time) int {
+	result, err := env.db.Exec(`
+		INSERT INTO classes (tenant_id, name, instructor_id, start_time, end_time, max_capacity, price)
+		VALUES (1, 'Vinyasa', ?, ?, ?, 10, 0)`, instructorID, start.UTC(), start.Add(time.Hour).UTC())
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func (env *testEnv) instructorOf(t *testing.T, classID int) int {
+	var id int
+	require.NoError(t, env.db.QueryRow(`SELECT instructor_id FROM classes WHERE id = ?`, classID).Scan(&id))
+	return id
+}
+
+func TestAssign(t *testing.T) {
+	env := newTestEnv(t)
+	teacher := env.createUser(t, "teacher@example.com", "instructor")
+	member := env.createUser(t, "member@example.com", "member")
+	classID := env.createClass(t, 1, env.now.Add(24*time.Hour))
+
+	assert.ErrorIs(t, env.service.Assign(classID, member), ErrNotInstructor)
+	assert.ErrorIs(t, env.service.Assign(classID+1, teacher), ErrClassNotFound)
+
+	require.NoError(t, env.service.Assign(classID, teacher))
+	assert.Equal(t, teacher, env.instructorOf(t, classID))
+	require.Len(t, env.events.notifications[teacher], 1)
+	assert.Equal(t, EventInstructorAssigned, env.events.notifications[teacher][0].Type)
+
+	classes, err := env.service.UpcomingClasses(teacher)
+	require.NoError(t, err)
+	require.Len(t, classes, 1)
+	assert.Equal(t, classID, classes[0].ID)
+	assert.Nil(t, classes[0].Substitute)
+}
+
+func TestSubstituteRequest(t *testing.T) {
+	env := newTestEnv(t)
+	teacher := env.createUser(t, "teacher@example.com", "instructor")
+	substitute := env.createUser(t, "sub@example.com", "instructor")
+	classID := env.createClass(t, teacher, env.now.Add(24*time.Hour))
+
+	_, err := env.service.RequestSubstitute(classID, substitute, "")
+	assert.ErrorIs(t, err, ErrNotClassTeacher)
+
+	request, err := env.service.RequestSubstitute(classID, teacher, "Sick")
+	require.NoError(t, err)
+	assert.Equal(t, RequestOpen, request.Status)
+
+	_, err = env.service.RequestSubstitute(classID, teacher, "Still sick")
+	assert.ErrorIs(t, err, ErrRequestOpen)
+
+	require.Len(t, env.events.notifications[1], 1, "the admin is asked to find a substitute")
+	assert.Contains(t, env.events.notifications[1][0].Message, "Reason: Sick")
+
+	open, err := env.service.OpenRequests(1)
+	require.NoError(t, err)
+	require.Len(t, open, 1)
+	assert.Equal(t, "Test instructor", open[0].InstructorName)
+
+	classes, err := env.service.UpcomingClasses(teacher)
+	require.NoError(t, err)
+	require.Len(t, classes, 1)
+	require.NotNil(t, classes[0].Substitute)
+
+	require.NoError(t, env.service.Assign(classID, substitute))
+	assert.Equal(t, substitute, env.instructorOf(t, classID))
+
+	var status string
+	var substituteID int
+	require.NoError(t, env.db.QueryRow(`SELECT status, substitute_id FROM substitute_requests WHERE id = ?`, request.ID).Scan(&status, &substituteID))
+	assert.Equal(t, RequestFilled, status)
+	assert.Equal(t, substitute, substituteID)
+	require.Len(t, env.events.notifications[teacher], 1, "the instructor hears a substitute was found")
+
+	open, err = env.service.OpenRequests(1)
+	require.NoError(t, err)
+	assert.Empty(t, open)
+
+	t.Run("Withdraw", func(t *testing.T) {
+		classID := env.createClass(t, teacher, env.now.Add(48*time.Hour))
+		_, err := env.service.RequestSubstitute(classID, teacher, "")
+		require.NoError(t, err)
+
+		require.NoError(t, env.service.WithdrawSubstitute(classID, teacher))
+		assert.ErrorIs(t, env.service.WithdrawSubstitute(classID, teacher), ErrRequestNotFound)
+
+		_, err = env.service.RequestSubstitute(classID, teacher, "")
+		assert.NoError(t, err, "a new request can be made after withdrawing")
+	})
+
+	t.Run("ClassStarted", func(t *testing.T) {
+		classID := env.createClass(t, teacher, env.now.Add(-time.Hour))
+		_, err := env.service.RequestSubstitute(classID, teacher, "")
+		assert.ErrorIs(t, err, ErrClassStarted)
+	})
+}
+
+func TestRoster(t *testing.T) {
+	env := newTestEnv(t)
+	teacher := env.createUser(t, "teacher@example.com", "instructor")
+	classID := env.createClass(t, teacher, env.now.Add(24*time.Hour))
+
+	first := env.createUser(t, "first@example.com", "member")
+	second := env.createUser(t, "second@example.com", "member")
+	cancelled := env.createUser(t, "cancelled@example.com", "member")
+	for i, userID := range []int{first, second, cancelled} {
+		status := "confirmed"
+		if userID == cancelled {
+			status = "cancelled"
+		}
+		_, err := env.db.Exec(`INSERT INTO bookings (user_id, class_id, status, created_at) VALUES (?, ?, ?, ?)`,
+			userID, classID, status, env.now.Add(time.Duration(i)*time.Minute).UTC())
+		require.NoError(t, err)
+	}
+
+	roster, err := env.service.Roster(classID)
+	require.NoError(t, err)
+	require.Len(t, roster, 2)
+	assert.Equal(t, "first@example.com", roster[0].Email)
+	assert.Equal(t, "second@example.com", roster[1].Email)
+
+	classes, err := env.service.UpcomingClasses(teacher)
+	require.NoError(t, err)
+	require.Len(t, classes, 1)
+	assert.Equal(t, 2, classes[0].Booked)
+}
@@ -0,0 +1,158 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 in points, the unit PDF measures in
+const (
+	pageWidth  = 595.28
+	pageHeight = 841.89
+)
+
+// pdfPage lays out a single page of text and rules and writes it as a PDF
+// document. It uses the standard Helvetica fonts, which every PDF reader
+// provides, so no fonts are embedded; text is limited to the Windows-1252
+// characters they encode, which covers Norwegian.
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+// text writes s with its left edge at x and its baseline y points from
+// the top of the page
+func (p *pdfPage) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pageHeight-y, pdfString(s))
+}
+
+// textRight writes s with its right edge at x, as for amounts in a column
+func (p *pdfPage) textRight(x, y, size float64, bold bool, s string) {
+	p.text(x-textWidth(s, size, bold), y, size, bold, s)
+}
+
+// rule draws a horizontal line y points from the top of the page
+func (p *pdfPage) rule(x1, x2, y float64) {
+	fmt.Fprintf(&p.content, "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, pageHeight-y, x2, pageHeight-y)
+}
+
+// bytes returns the page as a PDF document
+func (p *pdfPage) bytes() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> /Contents 4 0 R >>", pageWidth, pageHeight),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfString encodes s as the contents of a PDF string in Windows-1252, the
+// fonts' encoding. Characters it lacks are replaced with a question mark.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		c := winAnsi(r)
+		switch c {
+		case '(', ')', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// winAnsi returns the Windows-1252 code of r
+func winAnsi(r rune) byte {
+	switch {
+	case r >= 0x20 && r < 0x7f, r >= 0xa0 && r <= 0xff:
+		return byte(r)
+	}
+	switch r {
+	case '€':
+		return 0x80
+	case '–':
+		return 0x96
+	case '—':
+		return 0x97
+	case '‘':
+		return 0x91
+	case '’':
+		return 0x92
+	case '“':
+		return 0x93
+	case '”':
+		return 0x94
+	case '•':
+		return 0x95
+	case '\u202f', '\u2009':
+		// Narrow spaces, which some locales group digits with
+		return 0xa0
+	}
+	return '?'
+}
+
+// textWidth returns the width of s in points when set in Helvetica
+func textWidth(s string, size float64, bold bool) float64 {
+	widths := helveticaWidths
+	if bold {
+		widths = helveticaBoldWidths
+	}
+	total := 0
+	for _, r := range s {
+		c := winAnsi(r)
+		switch {
+		case c >= 0x20 && c < 0x7f:
+			total += widths[c-0x20]
+		case c == 0xa0:
+			total += widths[0]
+		default:
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// Glyph widths of the printable ASCII characters, in thousandths of the
+// font size, from the fonts' Adobe metrics
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
@@ -0,0 +1,77 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPDFStructure(t *testing.T) {
+	var page pdfPage
+	page.text(56, 80, 12, true, "Kvittering (kopi)")
+	page.rule(56, 539, 90)
+	doc := page.bytes()
+
+	assert.True(t, bytes.HasPrefix(doc, []byte("%PDF-1.4\n")))
+	assert.True(t, bytes.HasSuffix(doc, []byte("%%EOF\n")))
+	assert.Contains(t, string(doc), `(Kvittering \(kopi\)) Tj`)
+
+	// The cross-reference table points at each object
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(doc)
+	require.NotNil(t, startxref)
+	xref, err := strconv.Atoi(string(startxref[1]))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(doc[xref:], []byte("xref\n0 7\n")))
+
+	offsets := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(doc[xref:], -1)
+	require.Len(t, offsets, 6)
+	for i, offset := range offsets {
+		at, err := strconv.Atoi(string(offset[1]))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(doc[at:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))), "object %d", i+1)
+	}
+
+	// The content stream is as long as it says
+	stream := regexp.MustCompile(`(?s)/Length (\d+) >>\nstream\n(.*)endstream`).FindSubmatch(doc)
+	require.NotNil(t, stream)
+	assert.Equal(t, string(stream[1]), strconv.Itoa(len(stream[2])))
+}
+
+func TestPDFString(t *testing.T) {
+	assert.Equal(t, "Bl\xe5b\xe6r \xf8l", pdfString("Blåbær øl"))
+	assert.Equal(t, "\x80 12\xa0345", pdfString("€ 12 345"))
+	assert.Equal(t, "a\\\\b", pdfString(`a\b`))
+	assert.Equal(t, "?", pdfString("✓"))
+}
+
+func TestTextWidth(t *testing.T) {
+	assert.InDelta(t, 5.56*3, textWidth("123", 10, false), 0.001)
+	assert.Greater(t, textWidth("Total", 10, true), textWidth("Total", 10, false))
+}
+
+func TestReceiptPDF(t *testing.T) {
+	env := newTestEnv(t)
+	env.pay(t, "pi_1", 1, 59900, "membership", 0, `{"membership_type":"monthly"}`)
+	invoice, err := env.service.Issue("pi_1")
+	require.NoError(t, err)
+
+	doc := string(env.service.PDF(invoice))
+	for _, text := range []string{
+		"(Receipt) Tj",
+		"(No. 1) Tj",
+		"(Kjernekraft AS) Tj",
+		"(0155 Oslo) Tj",
+		"(Org.nr. 923 456 789 MVA) Tj",
+		"(Kari Nordmann) Tj",
+		"(Membership, monthly) Tj",
+		"(VAT \\(MVA\\) 25 %) Tj",
+		"(Paid in full. Payment reference pi_1.) Tj",
+	} {
+		assert.Contains(t, doc, text)
+	}
+}
@@ -0,0 +1,120 @@
+package invoices
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"samskipnad/internal/models"
+)
+
+// Receipt layout, in points from the top left of the page
+const (
+	left      = 56.0
+	right     = pageWidth - 56.0
+	vatColumn = right - 110.0
+)
+
+// PDF renders the receipt as a PDF document
+func (s *Service) PDF(invoice *models.Invoice) []byte {
+	community := s.community()
+	var page pdfPage
+
+	page.text(left, 80, 20, true, "Receipt")
+	page.textRight(right, 80, 11, true, fmt.Sprintf("No. %d", invoice.Number))
+	page.textRight(right, 96, 10, false, community.LocalTime(invoice.IssuedAt).Format("2 January 2006"))
+
+	y := 130.0
+	page.text(left, y, 11, true, invoice.SellerName)
+	for _, line := range strings.Split(invoice.SellerAddress, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			y += 14
+			page.text(left, y, 10, false, line)
+		}
+	}
+	if invoice.OrganisationNumber != "" {
+		y += 14
+		page.text(left, y, 10, false, OrganisationNumber(invoice))
+	}
+
+	y += 32
+	page.text(left, y, 9, true, "Billed to")
+	for _, line := range []string{invoice.BuyerName, invoice.BuyerEmail} {
+		if line != "" {
+			y += 14
+			page.text(left, y, 10, false, line)
+		}
+	}
+
+	y += 36
+	page.text(left, y, 9, true, "Description")
+	if invoice.VATRegistered {
+		page.textRight(vatColumn, y, 9, true, "VAT")
+	}
+	page.textRight(right, y, 9, true, "Amount")
+	y += 6
+	page.rule(left, right, y)
+	for _, line := range invoice.Lines {
+		y += 16
+		page.text(left, y, 10, false, line.Description)
+		if invoice.VATRegistered {
+			page.textRight(vatColumn, y, 10, false, fmt.Sprintf("%d %%", line.VATRate))
+		}
+		page.textRight(right, y, 10, false, s.format(invoice, line.Amount))
+	}
+	y += 8
+	page.rule(left, right, y)
+
+	if invoice.VATRegistered {
+		y += 16
+		page.text(vatColumn-100, y, 10, false, "Total excl. VAT")
+		page.textRight(right, y, 10, false, s.format(invoice, invoice.Total-invoice.VAT))
+		for _, rate := range vatRates(invoice) {
+			y += 16
+			page.text(vatColumn-100, y, 10, false, fmt.Sprintf("VAT (MVA) %d %%", rate.rate))
+			page.textRight(right, y, 10, false, s.format(invoice, rate.vat))
+		}
+	}
+	y += 20
+	page.text(vatColumn-100, y, 11, true, "Total")
+	page.textRight(right, y, 11, true, s.format(invoice, invoice.Total))
+
+	y += 40
+	page.text(left, y, 9, false, fmt.Sprintf("Paid in full. Payment reference %s.", invoice.PaymentID))
+
+	return page.bytes()
+}
+
+// OrganisationNumber returns the seller's organisation number as receipts
+// show it: in groups of three digits, followed by MVA when the seller is
+// registered for VAT
+func OrganisationNumber(invoice *models.Invoice) string {
+	number := strings.ReplaceAll(invoice.OrganisationNumber, " ", "")
+	if len(number) == 9 {
+		number = number[0:3] + " " + number[3:6] + " " + number[6:9]
+	}
+	number = "Org.nr. " + number
+	if invoice.VATRegistered {
+		number += " MVA"
+	}
+	return number
+}
+
+type vatRate struct {
+	rate int
+	vat  int
+}
+
+// vatRates returns the VAT included in the invoice by rate, highest first
+func vatRates(invoice *models.Invoice) []vatRate {
+	byRate := make(map[int]int)
+	for _, line := range invoice.Lines {
+		byRate[line.VATRate] += line.VAT
+	}
+	rates := make([]vatRate, 0, len(byRate))
+	for rate, vat := range byRate {
+		rates = append(rates, vatRate{rate, vat})
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].rate > rates[j].rate })
+	return rates
+}
@@ -0,0 +1,354 @@
+// Package invoices issues receipts for payments. Receipts are numbered in
+// sequence within each tenant and show the seller's organisation number
+// and the VAT (MVA) included in each payment, as Norwegian bookkeeping
+// rules require. They are rendered as PDF and emailed to members.
+package invoices
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/models"
+	"samskipnad/internal/money"
+	"samskipnad/internal/payments"
+	"samskipnad/internal/services"
+)
+
+// EventInvoiceIssued is published when a receipt is issued
+const EventInvoiceIssued = "invoice.issued"
+
+var (
+	ErrInvoiceNotFound = errors.New("invoice not found")
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrNotPaid         = errors.New("payment has not succeeded")
+)
+
+// Service issues receipts
+type Service struct {
+	db        *sql.DB
+	events    services.EventBusService
+	community func() *config.Community
+	now       func() time.Time
+}
+
+func NewService(db *sql.DB, events services.EventBusService) *Service {
+	return &Service{
+		db:        db,
+		events:    events,
+		community: config.GetCurrent,
+		now:       time.Now,
+	}
+}
+
+// PaymentSucceeded issues the receipt for a payment that has just
+// succeeded and emails it to the member. It implements
+// payments.ReceiptIssuer.
+func (s *Service) PaymentSucceeded(paymentID string) error {
+	invoice, err := s.Issue(paymentID)
+	if err != nil {
+		return err
+	}
+	if invoice.EmailedAt != nil {
+		return nil
+	}
+	return s.Send(invoice)
+}
+
+// Issue issues the receipt for a payment that has succeeded, taking the
+// tenant's next invoice number. What the receipt shows is taken from the
+// payment and the community's config as they are now. A payment has a
+// single receipt: issuing it again returns the receipt already issued.
+func (s *Service) Issue(paymentID string) (*models.Invoice, error) {
+	if invoice, err := s.ForPayment(paymentID); err == nil {
+		return invoice, nil
+	} else if !errors.Is(err, ErrInvoiceNotFound) {
+		return nil, err
+	}
+
+	payment, err := s.payment(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	switch payment.Status {
+	case payments.StatusSucceeded, payments.StatusPartiallyRefunded, payments.StatusRefunded:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNotPaid, payment.Status)
+	}
+
+	community := s.community()
+	lines, err := s.lines(payment)
+	if err != nil {
+		return nil, err
+	}
+	var total, vat int
+	for _, line := range lines {
+		total += line.Amount
+		vat += line.VAT
+	}
+	encoded, err := json.Marshal(lines)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode invoice lines: %w", err)
+	}
+
+	var buyerName, buyerEmail string
+	err = s.db.QueryRow(`SELECT TRIM(first_name || ' ' || last_name), email FROM users WHERE id = ?`, payment.UserID).
+		Scan(&buyerName, &buyerEmail)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get buyer: %w", err)
+	}
+
+	// Numbers are taken in the same statement that stores the invoice, so
+	// two invoices issued at once cannot take the same number
+	_, err = s.db.Exec(`
+		INSERT INTO invoices (tenant_id, user_id, payment_id, number, issued_at, currency, total, vat, lines,
+			seller_name, organisation_number, vat_registered, seller_address, buyer_name, buyer_email)
+		SELECT ?, ?, ?, COALESCE(MAX(number), 0) + 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		FROM invoices WHERE tenant_id = ?
+		ON CONFLICT (payment_id) DO NOTHING`,
+		payment.TenantID, payment.UserID, payment.ID, s.now().UTC(), strings.ToUpper(payment.Currency),
+		total, vat, string(encoded), community.SellerName(), community.Invoicing.OrganisationNumber,
+		community.Invoicing.VATRegistered, community.Invoicing.Address, buyerName, buyerEmail,
+		payment.TenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue invoice: %w", err)
+	}
+
+	invoice, err := s.ForPayment(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	s.publish(EventInvoiceIssued, invoice.TenantID, invoice.UserID, map[string]interface{}{
+		"invoice_id": invoice.ID,
+		"number":     invoice.Number,
+		"payment_id": invoice.PaymentID,
+	})
+	return invoice, nil
+}
+
+// Get returns an invoice by its ID
+func (s *Service) Get(id int) (*models.Invoice, error) {
+	return s.get(selectInvoice+` WHERE id = ?`, id)
+}
+
+// ForPayment returns the invoice issued for a payment
+func (s *Service) ForPayment(paymentID string) (*models.Invoice, error) {
+	return s.get(selectInvoice+` WHERE payment_id = ?`, paymentID)
+}
+
+// List returns the member's receipts, newest first
+func (s *Service) List(userID int) ([]*models.Invoice, error) {
+	rows, err := s.db.Query(selectInvoice+` WHERE user_id = ? ORDER BY issued_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invoices: %w", err)
+	}
+	defer rows.Close()
+
+	var invoices []*models.Invoice
+	for rows.Next() {
+		invoice, err := scanInvoice(rows)
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, invoice)
+	}
+	return invoices, rows.Err()
+}
+
+// Send emails the receipt to the member with the PDF attached
+func (s *Service) Send(invoice *models.Invoice) error {
+	if invoice.BuyerEmail == "" {
+		return nil
+	}
+	if s.events == nil {
+		return nil
+	}
+
+	pdf := s.PDF(invoice)
+	community := s.community()
+	subject := fmt.Sprintf("Receipt %d from %s", invoice.Number, invoice.SellerName)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Thank you for your payment. Your receipt is attached.\n\n")
+	for _, line := range invoice.Lines {
+		fmt.Fprintf(&body, "%s: %s\n", line.Description, s.format(invoice, line.Amount))
+	}
+	if invoice.VAT > 0 {
+		fmt.Fprintf(&body, "Of which VAT (MVA): %s\n", s.format(invoice, invoice.VAT))
+	}
+	fmt.Fprintf(&body, "\nYou can find all your receipts under Receipts at %s.\n", community.Name)
+
+	err := s.events.SendEmailWithAttachments(context.Background(), invoice.BuyerEmail, subject, body.String(),
+		[]services.Attachment{{
+			Filename:    Filename(invoice),
+			ContentType: "application/pdf",
+			Data:        pdf,
+		}})
+	if err != nil {
+		return fmt.Errorf("failed to email receipt: %w", err)
+	}
+
+	now := s.now()
+	if _, err := s.db.Exec(`UPDATE invoices SET emailed_at = ? WHERE id = ?`, now.UTC(), invoice.ID); err != nil {
+		return fmt.Errorf("failed to record emailed receipt: %w", err)
+	}
+	invoice.EmailedAt = &now
+	return nil
+}
+
+// Filename returns the name receipts are downloaded and attached as
+func Filename(invoice *models.Invoice) string {
+	return fmt.Sprintf("receipt-%d.pdf", invoice.Number)
+}
+
+// VAT returns the VAT included in amount at rate percent, rounded to the
+// nearest cent
+func VAT(amount, rate int) int {
+	if rate <= 0 {
+		return 0
+	}
+	return (2*amount*rate + 100 + rate) / (2 * (100 + rate))
+}
+
+// lines describe what a payment bought: the full price, and any discount
+// taken off it as a line of its own
+func (s *Service) lines(payment *models.Payment) ([]models.InvoiceLine, error) {
+	community := s.community()
+	var description string
+	switch payment.PaymentType {
+	case "class":
+		var name string
+		var start time.Time
+		err := s.db.QueryRow(`SELECT name, start_time FROM classes WHERE id = ?`, payment.ReferenceID).Scan(&name, &start)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to get class: %w", err)
+		}
+		if name == "" {
+			description = "Drop-in class"
+		} else {
+			description = fmt.Sprintf("Drop-in: %s, %s", name, community.LocalTime(start).Format("Mon Jan 2 2006 15:04"))
+		}
+	case "membership":
+		tier := payment.Metadata["membership_tier"]
+		if id, _ := strconv.Atoi(payment.Metadata["membership_id"]); id != 0 && tier == "" {
+			// Renewals are charged without the tier; it is the membership's
+			err := s.db.QueryRow(`SELECT tier FROM memberships WHERE id = ?`, id).Scan(&tier)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return nil, fmt.Errorf("failed to get membership: %w", err)
+			}
+		}
+		name := "Membership"
+		if t, ok := community.MembershipTierByID(tier); ok {
+			name = t.Name + " membership"
+		}
+		description = name
+		if plan := payment.Metadata["membership_type"]; plan != "" {
+			description = fmt.Sprintf("%s, %s", name, plan)
+		}
+	case "klippekort":
+		description = fmt.Sprintf("Klippekort: %s", community.CategoryName(payment.Metadata["category_id"]))
+		if klipp := payment.Metadata["klipp"]; klipp != "" {
+			description += fmt.Sprintf(", %s klipp", klipp)
+		}
+	default:
+		description = payment.PaymentType
+	}
+
+	rate := community.VATRate(payment.PaymentType)
+	price := payment.Amount + payment.DiscountAmount
+	lines := []models.InvoiceLine{{
+		Description: description,
+		ProductType: payment.PaymentType,
+		Amount:      price,
+		VATRate:     rate,
+		VAT:         VAT(price, rate),
+	}}
+	if payment.DiscountAmount > 0 {
+		// The discount takes off the VAT the price included beyond what
+		// was charged, so the lines add up to the VAT on the payment
+		lines = append(lines, models.InvoiceLine{
+			Description: strings.TrimSpace("Discount " + payment.Metadata["discount_code"]),
+			ProductType: payment.PaymentType,
+			Amount:      -payment.DiscountAmount,
+			VATRate:     rate,
+			VAT:         VAT(payment.Amount, rate) - VAT(price, rate),
+		})
+	}
+	return lines, nil
+}
+
+func (s *Service) payment(paymentID string) (*models.Payment, error) {
+	var payment models.Payment
+	var metadata string
+	err := s.db.QueryRow(`
+		SELECT id, user_id, tenant_id, amount, discount_amount, currency, status, payment_type, reference_id,
+			COALESCE(metadata, '')
+		FROM payments WHERE id = ?`, paymentID).Scan(
+		&payment.ID, &payment.UserID, &payment.TenantID, &payment.Amount, &payment.DiscountAmount, &payment.Currency,
+		&payment.Status, &payment.PaymentType, &payment.ReferenceID, &metadata)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+	if metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &payment.Metadata); err != nil {
+			return nil, fmt.Errorf("invalid payment metadata: %w", err)
+		}
+	}
+	return &payment, nil
+}
+
+// format formats an amount in the invoice's currency
+func (s *Service) format(invoice *models.Invoice, amount int) string {
+	return s.community().Format(money.New(int64(amount), invoice.Currency))
+}
+
+const selectInvoice = `
+	SELECT id, tenant_id, user_id, payment_id, number, issued_at, currency, total, vat, lines,
+		seller_name, organisation_number, vat_registered, seller_address, buyer_name, buyer_email, emailed_at, created_at
+	FROM invoices`
+
+func (s *Service) get(query string, args ...interface{}) (*models.Invoice, error) {
+	invoice, err := scanInvoice(s.db.QueryRow(query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvoiceNotFound
+	}
+	return invoice, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInvoice(row scanner) (*models.Invoice, error) {
+	var invoice models.Invoice
+	var lines string
+	var emailedAt sql.NullTime
+	err := row.Scan(&invoice.ID, &invoice.TenantID, &invoice.UserID, &invoice.PaymentID, &invoice.Number,
+		&invoice.IssuedAt, &invoice.Currency, &invoice.Total, &invoice.VAT, &lines,
+		&invoice.SellerName, &invoice.OrganisationNumber, &invoice.VATRegistered, &invoice.SellerAddress,
+		&invoice.BuyerName, &invoice.BuyerEmail, &emailedAt, &invoice.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(lines), &invoice.Lines); err != nil {
+		return nil, fmt.Errorf("invalid invoice lines: %w", err)
+	}
+	if emailedAt.Valid {
+		invoice.EmailedAt = &emailedAt.Time
+	}
+	return &invoice, nil
+}
+
+// publish dispatches an event from the invoices service; see services.Publish
+func (s *Service) publish(eventType string, tenantID, userID int, data map[string]interface{}) {
+	services.Publish(s.events, "invoices", eventType, tenantID, userID, data)
+}
@@ -0,0 +1,314 @@
+package invoices
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/database"
+	"samskipnad/internal/services"
+)
+
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// recordingBus captures emails and published events
+type recordingBus struct {
+	services.EventBusService
+	events []*services.Event
+	emails []email
+}
+
+type email struct {
+	to, subject, body string
+	attachments       []services.Attachment
+}
+
+func (b *recordingBus) Publish(ctx context.Context, event *services.Event) error {
+	b.events = append(b.events, event)
+	return nil
+}
+
+func (b *recordingBus) SendEmailWithAttachments(ctx context.Context, to, subject, body string, attachments []services.Attachment) error {
+	b.emails = append(b.emails, email{to, subject, body, attachments})
+	return nil
+}
+
+type testEnv struct {
+	db        *sql.DB
+	events    *recordingBus
+	community *config.Community
+	service   *Service
+	now       time.Time
+	userID    int
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := setupTestDB(t)
+	env := &testEnv{
+		db:        db,
+		events:    &recordingBus{},
+		community: &config.Community{Name: "Kjernekraft"},
+		now:       time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC),
+	}
+	env.community.Pricing.Currency = "NOK"
+	env.community.Locale.Language = "nb"
+	env.community.Locale.Country = "NO"
+	env.community.Locale.Timezone = "Europe/Oslo"
+	env.community.Pricing.MembershipTiers = []config.MembershipTier{{ID: "weekday", Name: "Weekday"}}
+	env.community.Pricing.Klippekort.Categories = []config.KlippekortCategory{{ID: "yoga", Name: "Yoga"}}
+	env.community.Invoicing.CompanyName = "Kjernekraft AS"
+	env.community.Invoicing.OrganisationNumber = "923456789"
+	env.community.Invoicing.VATRegistered = true
+	env.community.Invoicing.Address = "Storgata 1\n0155 Oslo"
+	env.community.Invoicing.VATRates = map[string]int{"default": 25, "class": 12}
+
+	env.service = NewService(db, env.events)
+	env.service.community = func() *config.Community { return env.community }
+	env.service.now = func() time.Time { return env.now }
+
+	result, err := db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, tenant_id)
+		VALUES ('kari@example.com', 'x', 'Kari', 'Nordmann', 1)`)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	env.userID = int(id)
+	return env
+}
+
+func (env *testEnv) pay(t *testing.T, id string, tenantID, amount int, paymentType string, referenceID int, metadata string) {
+	_, err := env.db.Exec(`
+		INSERT INTO payments (id, user_id, tenant_id, amount, currency, status, payment_type, reference_id, metadata)
+		VALUES (?, ?, ?, ?, 'nok', 'succeeded', ?, ?, ?)`, id, env.userID, tenantID, amount, paymentType, referenceID, metadata)
+	require.NoError(t, err)
+}
+
+func TestIssue(t *testing.T) {
+	env := newTestEnv(t)
+	env.pay(t, "pi_1", 1, 59900, "membership", 0, `{"membership_type":"monthly","membership_tier":"weekday"}`)
+
+	invoice, err := env.service.Issue("pi_1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, invoice.Number)
+	assert.Equal(t, "NOK", invoice.Currency)
+	assert.Equal(t, 59900, invoice.Total)
+	assert.Equal(t, 11980, invoice.VAT, "25% VAT is a fifth of the price")
+	assert.Equal(t, "Kjernekraft AS", invoice.SellerName)
+	assert.Equal(t, "Kari Nordmann", invoice.BuyerName)
+	assert.Equal(t, "kari@example.com", invoice.BuyerEmail)
+	require.Len(t, invoice.Lines, 1)
+	assert.Equal(t, "Weekday membership, monthly", invoice.Lines[0].Description)
+	assert.Equal(t, 25, invoice.Lines[0].VATRate)
+
+	again, err := env.service.Issue("pi_1")
+	require.NoError(t, err)
+	assert.Equal(t, invoice.ID, again.ID, "a payment has a single receipt")
+
+	env.community.Invoicing.CompanyName = "Kjernekraft Trening AS"
+	again, err = env.service.Get(invoice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Kjernekraft AS", again.SellerName, "receipts keep the details they were issued with")
+}
+
+func TestIssueNumbering(t *testing.T) {
+	env := newTestEnv(t)
+	_, err := env.db.Exec(`INSERT INTO tenants (id, name, slug) VALUES (2, 'Other', 'other')`)
+	require.NoError(t, err)
+
+	env.pay(t, "pi_1", 1, 10000, "class", 0, "")
+	env.pay(t, "pi_2", 2, 10000, "class", 0, "")
+	env.pay(t, "pi_3", 1, 10000, "class", 0, "")
+
+	numbers := map[string]int{}
+	for _, id := range []string{"pi_1", "pi_2", "pi_3"} {
+		invoice, err := env.service.Issue(id)
+		require.NoError(t, err)
+		numbers[id] = invoice.Number
+	}
+	assert.Equal(t, map[string]int{"pi_1": 1, "pi_2": 1, "pi_3": 2}, numbers, "numbered in sequence per tenant")
+}
+
+func TestIssueConcurrently(t *testing.T) {
+	env := newTestEnv(t)
+	ids := []string{"pi_1", "pi_2", "pi_3", "pi_4", "pi_5", "pi_6"}
+	for _, id := range ids {
+		env.pay(t, id, 1, 10000, "class", 0, "")
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range append(ids, ids...) {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			_, err := env.service.Issue(id)
+			assert.NoError(t, err)
+		}(id)
+	}
+	wg.Wait()
+
+	var count, max int
+	require.NoError(t, env.db.QueryRow(`SELECT COUNT(*), MAX(number) FROM invoices`).Scan(&count, &max))
+	assert.Equal(t, len(ids), count)
+	assert.Equal(t, len(ids), max, "numbers have no gaps")
+}
+
+func TestIssueNotPaid(t *testing.T) {
+	env := newTestEnv(t)
+	_, err := env.db.Exec(`
+		INSERT INTO payments (id, user_id, tenant_id, amount, status, payment_type, reference_id)
+		VALUES ('pi_pending', ?, 1, 10000, 'requires_payment_method', 'class', 0)`, env.userID)
+	require.NoError(t, err)
+
+	_, err = env.service.Issue("pi_pending")
+	assert.ErrorIs(t, err, ErrNotPaid)
+	_, err = env.service.Issue("pi_missing")
+	assert.ErrorIs(t, err, ErrPaymentNotFound)
+}
+
+func TestLines(t *testing.T) {
+	env := newTestEnv(t)
+	result, err := env.db.Exec(`
+		INSERT INTO classes (tenant_id, name, instructor_id, start_time, end_time, max_capacity, price)
+		VALUES (1, 'Morning Flow', 1, ?, ?, 10, 20000)`,
+		time.Date(2025, 3, 17, 7, 0, 0, 0, time.UTC), time.Date(2025, 3, 17, 8, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	classID, err := result.LastInsertId()
+	require.NoError(t, err)
+	result, err = env.db.Exec(`
+		INSERT INTO memberships (user_id, tenant_id, type, start_date, end_date, amount, tier)
+		VALUES (?, 1, 'monthly', ?, ?, 39900, 'weekday')`, env.userID, env.now, env.now.AddDate(0, 1, 0))
+	require.NoError(t, err)
+	membershipID, err := result.LastInsertId()
+	require.NoError(t, err)
+
+	env.pay(t, "pi_class", 1, 20000, "class", int(classID), "")
+	env.pay(t, "pi_renewal", 1, 39900, "membership", 0, `{"membership_type":"monthly","membership_id":"`+fmt.Sprint(membershipID)+`"}`)
+	env.pay(t, "pi_klipp", 1, 120000, "klippekort", 0, `{"category_id":"yoga","klipp":"10"}`)
+
+	tests := []struct {
+		paymentID   string
+		description string
+		rate        int
+		vat         int
+	}{
+		{"pi_class", "Drop-in: Morning Flow, Mon Mar 17 2025 08:00", 12, 2143},
+		{"pi_renewal", "Weekday membership, monthly", 25, 7980},
+		{"pi_klipp", "Klippekort: Yoga, 10 klipp", 25, 24000},
+	}
+	for _, tt := range tests {
+		invoice, err := env.service.Issue(tt.paymentID)
+		require.NoError(t, err)
+		require.Len(t, invoice.Lines, 1)
+		assert.Equal(t, tt.description, invoice.Lines[0].Description)
+		assert.Equal(t, tt.rate, invoice.Lines[0].VATRate, tt.paymentID)
+		assert.Equal(t, tt.vat, invoice.VAT, tt.paymentID)
+	}
+}
+
+func TestDiscountLine(t *testing.T) {
+	env := newTestEnv(t)
+	_, err := env.db.Exec(`
+		INSERT INTO payments (id, user_id, tenant_id, amount, discount_amount, currency, status, payment_type, reference_id, metadata)
+		VALUES ('pi_1', ?, 1, 96000, 24000, 'nok', 'succeeded', 'klippekort', 0, '{"category_id":"yoga","klipp":"10","discount_code":"INTRO20"}')`,
+		env.userID)
+	require.NoError(t, err)
+
+	invoice, err := env.service.Issue("pi_1")
+	require.NoError(t, err)
+	require.Len(t, invoice.Lines, 2)
+	assert.Equal(t, 120000, invoice.Lines[0].Amount, "the full price")
+	assert.Equal(t, "Discount INTRO20", invoice.Lines[1].Description)
+	assert.Equal(t, -24000, invoice.Lines[1].Amount)
+	assert.Equal(t, 96000, invoice.Total, "what was charged")
+	assert.Equal(t, 19200, invoice.VAT)
+	assert.Equal(t, invoice.VAT, invoice.Lines[0].VAT+invoice.Lines[1].VAT)
+
+	assert.Contains(t, string(env.service.PDF(invoice)), "(Discount INTRO20) Tj")
+}
+
+func TestNotVATRegistered(t *testing.T) {
+	env := newTestEnv(t)
+	env.community.Invoicing.VATRegistered = false
+	env.pay(t, "pi_1", 1, 59900, "membership", 0, "")
+
+	invoice, err := env.service.Issue("pi_1")
+	require.NoError(t, err)
+	assert.Zero(t, invoice.VAT)
+	assert.Equal(t, "Org.nr. 923 456 789", OrganisationNumber(invoice))
+}
+
+func TestPaymentSucceeded(t *testing.T) {
+	env := newTestEnv(t)
+	env.pay(t, "pi_1", 1, 59900, "membership", 0, "")
+
+	require.NoError(t, env.service.PaymentSucceeded("pi_1"))
+	require.NoError(t, env.service.PaymentSucceeded("pi_1"))
+	require.Len(t, env.events.emails, 1, "the receipt is emailed once")
+
+	sent := env.events.emails[0]
+	assert.Equal(t, "kari@example.com", sent.to)
+	assert.Equal(t, "Receipt 1 from Kjernekraft AS", sent.subject)
+	assert.Contains(t, sent.body, "Of which VAT (MVA)")
+	require.Len(t, sent.attachments, 1)
+	assert.Equal(t, "receipt-1.pdf", sent.attachments[0].Filename)
+	assert.Equal(t, "application/pdf", sent.attachments[0].ContentType)
+
+	invoice, err := env.service.ForPayment("pi_1")
+	require.NoError(t, err)
+	assert.NotNil(t, invoice.EmailedAt)
+	assert.Len(t, env.events.events, 1)
+	assert.Equal(t, EventInvoiceIssued, env.events.events[0].Type)
+}
+
+func TestList(t *testing.T) {
+	env := newTestEnv(t)
+	env.pay(t, "pi_1", 1, 10000, "class", 0, "")
+	env.pay(t, "pi_2", 1, 10000, "class", 0, "")
+	_, err := env.service.Issue("pi_1")
+	require.NoError(t, err)
+	env.now = env.now.Add(time.Hour)
+	_, err = env.service.Issue("pi_2")
+	require.NoError(t, err)
+
+	invoices, err := env.service.List(env.userID)
+	require.NoError(t, err)
+	require.Len(t, invoices, 2)
+	assert.Equal(t, 2, invoices[0].Number, "newest first")
+
+	invoices, err = env.service.List(env.userID + 1)
+	require.NoError(t, err)
+	assert.Empty(t, invoices)
+}
+
+func TestVAT(t *testing.T) {
+	tests := []struct {
+		amount, rate, want int
+	}{
+		{12500, 25, 2500},
+		{10000, 25, 2000},
+		{11200, 12, 1200},
+		{10000, 15, 1304},
+		{10000, 0, 0},
+		{1, 25, 0},
+	}
+	for _, tt := range tests {
+		if got := VAT(tt.amount, tt.rate); got != tt.want {
+			t.Errorf("VAT(%d, %d) = %d, want %d", tt.amount, tt.rate, got, tt.want)
+		}
+	}
+}
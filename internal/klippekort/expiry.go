@@ -0,0 +1,215 @@
+package klippekort
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"samskipnad/internal/services"
+)
+
+// Event types published by the klippekort service
+const (
+	EventKlippekortExpiring = "klippekort.expiring"
+	EventKlippekortExpired  = "klippekort.expired"
+)
+
+// DefaultExpiryInterval is how often the expiry job runs
+const DefaultExpiryInterval = time.Hour
+
+// ExpireCards empties cards whose expiry date has passed, recording the
+// forfeited klipp in each card's ledger. It returns the number of cards
+// expired.
+func (s *Service) ExpireCards() (int, error) {
+	now := s.now()
+
+	rows, err := s.db.Query(`
+		SELECT id, user_id, tenant_id, category_id, klipp_left FROM klippekort
+		WHERE klipp_left > 0 AND expiry_date <= ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	type expiring struct {
+		cardID     int
+		userID     int
+		tenantID   int
+		categoryID string
+		klipp      int
+	}
+	var cards []expiring
+	for rows.Next() {
+		var c expiring
+		if err := rows.Scan(&c.cardID, &c.userID, &c.tenantID, &c.categoryID, &c.klipp); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		cards = append(cards, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, c := range cards {
+		ok, err := s.expireCard(c.cardID, c.userID, c.tenantID, c.klipp, now)
+		if err != nil {
+			return expired, err
+		}
+		if !ok {
+			continue
+		}
+		expired++
+
+		s.publish(EventKlippekortExpired, c.tenantID, c.userID, map[string]interface{}{
+			"klippekort_id": c.cardID,
+			"category_id":   c.categoryID,
+			"klipp":         c.klipp,
+		})
+	}
+
+	return expired, nil
+}
+
+// SendExpiryReminders notifies members whose cards with klipp left expire
+// within the community's reminder period. Each card is reminded about once.
+// It returns the number of reminders sent.
+func (s *Service) SendExpiryReminders() (int, error) {
+	days := s.community().Pricing.Klippekort.ExpiryReminderDays
+	if days <= 0 {
+		return 0, nil
+	}
+
+	now := s.now()
+	rows, err := s.db.Query(`
+		SELECT id, user_id, tenant_id, category_id, klipp_left, expiry_date FROM klippekort
+		WHERE klipp_left > 0 AND expiry_date > ? AND expiry_date <= ? AND expiry_reminded_at IS NULL`,
+		now.UTC(), now.AddDate(0, 0, days).UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	type reminder struct {
+		cardID     int
+		userID     int
+		tenantID   int
+		categoryID string
+		klipp      int
+		expiry     time.Time
+	}
+	var reminders []reminder
+	for rows.Next() {
+		var r reminder
+		if err := rows.Scan(&r.cardID, &r.userID, &r.tenantID, &r.categoryID, &r.klipp, &r.expiry); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reminders = append(reminders, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, r := range reminders {
+		result, err := s.db.Exec(`
+			UPDATE klippekort SET expiry_reminded_at = ?
+			WHERE id = ? AND expiry_reminded_at IS NULL`, now.UTC(), r.cardID)
+		if err != nil {
+			return sent, fmt.Errorf("failed to record expiry reminder: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		sent++
+
+		name := r.categoryID
+		if category, ok := s.community().KlippekortCategoryByID(r.categoryID); ok {
+			name = category.Name
+		}
+
+		data := map[string]interface{}{
+			"klippekort_id": r.cardID,
+			"category_id":   r.categoryID,
+			"klipp":         r.klipp,
+			"expiry_date":   r.expiry,
+		}
+		s.publish(EventKlippekortExpiring, r.tenantID, r.userID, data)
+		s.notify(r.userID, &services.Notification{
+			Type:     EventKlippekortExpiring,
+			Title:    "Your " + name + " klipp expire soon",
+			Message:  fmt.Sprintf("You have %d klipp left on your %s klippekort. They expire on %s, so book a class before then.", r.klipp, name, r.expiry.Format("Mon Jan 2")),
+			Data:     data,
+			Priority: 1,
+		})
+	}
+
+	return sent, nil
+}
+
+// StartExpiryJob expires cards and sends expiry reminders every interval
+// until the returned stop function is called
+func (s *Service) StartExpiryJob(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			if _, err := s.ExpireCards(); err != nil {
+				log.Printf("Failed to expire klippekort: %v", err)
+			}
+			if _, err := s.SendExpiryReminders(); err != nil {
+				log.Printf("Failed to send klippekort expiry reminders: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// expireCard empties a card holding klipp klipp and records the expiry. It
+// returns false if the card changed since it was read, in which case the
+// next run picks it up again.
+func (s *Service) expireCard(cardID, userID, tenantID, klipp int, now time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE klippekort SET klipp_left = 0, updated_at = ?
+		WHERE id = ? AND klipp_left = ?`, now, cardID, klipp)
+	if err != nil {
+		return false, fmt.Errorf("failed to expire klippekort: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	if _, err := record(tx, cardID, userID, tenantID, KindExpiry, -klipp, 0, Entry{Note: "Expired"}, now); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// publish dispatches an event from the klippekort service; see services.Publish
+func (s *Service) publish(eventType string, tenantID, userID int, data map[string]interface{}) {
+	services.Publish(s.events, "klippekort", eventType, tenantID, userID, data)
+}
+
+func (s *Service) notify(userID int, notification *services.Notification) {
+	services.Notify(s.events, userID, notification)
+}
@@ -0,0 +1,89 @@
+package klippekort
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/models"
+)
+
+func TestExpireCards(t *testing.T) {
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	service := newTestService(t, now)
+	bus := service.events.(*recordingBus)
+
+	expiry := now.Add(-time.Minute)
+	expiring := &models.Klippekort{UserID: 1, TenantID: 1, CategoryID: "yoga", OriginalKlipp: 10, ExpiryDate: &expiry}
+	require.NoError(t, Issue(service.db, expiring, now.AddDate(0, -3, 0)))
+	valid := &models.Klippekort{UserID: 1, TenantID: 1, CategoryID: "yoga", OriginalKlipp: 5}
+	require.NoError(t, Issue(service.db, valid, now.AddDate(0, -1, 0)))
+
+	balances, err := service.Balances(1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"yoga": 5}, balances, "expired klipp are not counted before the job runs")
+
+	expired, err := service.ExpireCards()
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	assert.Equal(t, 0, klippLeft(t, service.db, expiring.ID))
+	assert.Equal(t, 5, klippLeft(t, service.db, valid.ID))
+
+	ledger, err := service.Ledger(expiring.ID)
+	require.NoError(t, err)
+	assert.Equal(t, KindExpiry, ledger[0].Kind)
+	assert.Equal(t, -10, ledger[0].Delta)
+
+	require.Len(t, bus.events, 1)
+	assert.Equal(t, EventKlippekortExpired, bus.events[0].Type)
+
+	expired, err = service.ExpireCards()
+	require.NoError(t, err)
+	assert.Equal(t, 0, expired, "expired cards are only emptied once")
+
+	discrepancies, err := service.Reconcile(1)
+	require.NoError(t, err)
+	assert.Empty(t, discrepancies)
+}
+
+func TestSendExpiryReminders(t *testing.T) {
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	service := newTestService(t, now)
+	bus := service.events.(*recordingBus)
+
+	community := &config.Community{}
+	community.Pricing.Klippekort.ExpiryReminderDays = 7
+	community.Pricing.Klippekort.Categories = []config.KlippekortCategory{{ID: "yoga", Name: "Yoga"}}
+	service.community = func() *config.Community { return community }
+
+	soon := now.AddDate(0, 0, 5)
+	later := now.AddDate(0, 0, 30)
+	require.NoError(t, Issue(service.db, &models.Klippekort{UserID: 1, TenantID: 1, CategoryID: "yoga", OriginalKlipp: 10, ExpiryDate: &soon}, now))
+	require.NoError(t, Issue(service.db, &models.Klippekort{UserID: 1, TenantID: 1, CategoryID: "yoga", OriginalKlipp: 10, ExpiryDate: &later}, now))
+	used := &models.Klippekort{UserID: 1, TenantID: 1, CategoryID: "yoga", OriginalKlipp: 1, ExpiryDate: &soon}
+	require.NoError(t, Issue(service.db, used, now))
+	_, err := service.Adjust(used.ID, -1, "Used up", 1)
+	require.NoError(t, err)
+
+	sent, err := service.SendExpiryReminders()
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	require.Len(t, bus.notifications[1], 1)
+	assert.Equal(t, "Your Yoga klipp expire soon", bus.notifications[1][0].Title)
+
+	sent, err = service.SendExpiryReminders()
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent, "each card is reminded about once")
+
+	t.Run("Disabled", func(t *testing.T) {
+		community.Pricing.Klippekort.ExpiryReminderDays = 0
+		service.now = func() time.Time { return now.AddDate(0, 0, 25) }
+
+		sent, err := service.SendExpiryReminders()
+		require.NoError(t, err)
+		assert.Equal(t, 0, sent)
+	})
+}
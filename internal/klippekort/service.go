@@ -0,0 +1,511 @@
+package klippekort
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/models"
+	"samskipnad/internal/services"
+)
+
+// Ledger transaction kinds
+const (
+	KindPurchase   = "purchase"
+	KindUse        = "use"
+	KindRefund     = "refund"
+	KindExpiry     = "expiry"
+	KindAdjustment = "adjustment"
+)
+
+var (
+	ErrNoKlipp             = errors.New("no klipp left")
+	ErrCardNotFound        = errors.New("klippekort not found")
+	ErrNegativeBalance     = errors.New("adjustment would make the balance negative")
+	ErrInvalidAdjustment   = errors.New("adjustment must change the balance")
+	ErrAdjustmentNoteEmpty = errors.New("adjustments need a note")
+)
+
+// Entry describes why a card's balance changed. It is stored with the
+// ledger transaction.
+type Entry struct {
+	UserID    int    // Member the change is attributed to, if not the card owner
+	BookingID int    // Booking the klipp was used for or returned from
+	PaymentID string // Payment that bought the card
+	Note      string
+	CreatedBy int // Admin who made an adjustment
+}
+
+// Transaction is one change to a card's balance in the klipp_transactions
+// ledger. The ledger is append-only.
+type Transaction struct {
+	ID           int
+	CardID       int
+	UserID       int
+	TenantID     int
+	Kind         string
+	Delta        int
+	BalanceAfter int
+	BookingID    *int
+	PaymentID    string
+	Note         string
+	CreatedBy    *int
+	CreatedAt    time.Time
+	ClassName    string // Class of the booking, loaded for display
+	UserName     string // Member the transaction is attributed to, loaded for display
+}
+
+// Statement is a card with its ledger, newest transaction first. Holders
+// are only loaded for the card's owner.
+type Statement struct {
+	Card         models.Klippekort
+	Shared       bool // The card belongs to another member who shares it
+	Holders      []Holder
+	Transactions []Transaction
+}
+
+// Discrepancy is a card whose balance does not match its ledger
+type Discrepancy struct {
+	Card          models.Klippekort
+	LedgerBalance int
+}
+
+// Service manages klippekort balances and their ledger
+type Service struct {
+	db        *sql.DB
+	events    services.EventBusService
+	community func() *config.Community
+	now       func() time.Time
+}
+
+func NewService(db *sql.DB, events services.EventBusService) *Service {
+	return &Service{
+		db:        db,
+		events:    events,
+		community: config.GetCurrent,
+		now:       time.Now,
+	}
+}
+
+// Execer runs statements, either directly on the database or inside a
+// caller's transaction
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Use deducts one klipp from the member's oldest non-expired card in the
+// category and returns the card's ID
+func (s *Service) Use(userID, tenantID int, categoryID string) (int, error) {
+	return Deduct(s.db, userID, tenantID, categoryID, Entry{}, s.now())
+}
+
+// Balance returns the klipp left on the non-expired cards in the category
+// that the member owns or shares
+func (s *Service) Balance(userID, tenantID int, categoryID string) (int, error) {
+	return Available(s.db, userID, tenantID, categoryID, s.now())
+}
+
+// Card returns a klippekort by ID
+func (s *Service) Card(cardID int) (*models.Klippekort, error) {
+	return getCard(s.db, cardID)
+}
+
+// Balances returns the klipp left on the non-expired cards the member owns
+// or shares, by category
+func (s *Service) Balances(userID, tenantID int) (map[string]int, error) {
+	rows, err := s.db.Query(`
+		SELECT k.category_id, SUM(k.klipp_left) FROM klippekort k
+		WHERE `+usableBy+` AND k.tenant_id = ? AND k.klipp_left > 0
+			AND (k.expiry_date IS NULL OR k.expiry_date > ?)
+		GROUP BY k.category_id`, userID, userID, tenantID, s.now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := make(map[string]int)
+	for rows.Next() {
+		var categoryID string
+		var balance int
+		if err := rows.Scan(&categoryID, &balance); err != nil {
+			return nil, err
+		}
+		balances[categoryID] = balance
+	}
+
+	return balances, rows.Err()
+}
+
+// Adjust changes a card's balance by delta on an admin's behalf. The note
+// explains the adjustment to the member and is required.
+func (s *Service) Adjust(cardID, delta int, note string, adminID int) (*Transaction, error) {
+	if delta == 0 {
+		return nil, ErrInvalidAdjustment
+	}
+	if note == "" {
+		return nil, ErrAdjustmentNoteEmpty
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+	var userID, tenantID, balance int
+	err = tx.QueryRow(`
+		UPDATE klippekort SET klipp_left = klipp_left + ?, updated_at = ?
+		WHERE id = ? AND klipp_left + ? >= 0
+		RETURNING user_id, tenant_id, klipp_left`, delta, now, cardID, delta).Scan(&userID, &tenantID, &balance)
+	if err == sql.ErrNoRows {
+		if _, err := getCard(tx, cardID); err != nil {
+			return nil, err
+		}
+		return nil, ErrNegativeBalance
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to adjust klippekort: %w", err)
+	}
+
+	entry := Entry{Note: note, CreatedBy: adminID}
+	t, err := record(tx, cardID, userID, tenantID, KindAdjustment, delta, balance, entry, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, tx.Commit()
+}
+
+// Statements returns the cards the member owns or shares, newest first, each
+// with its ledger
+func (s *Service) Statements(userID, tenantID int) ([]Statement, error) {
+	rows, err := s.db.Query(`
+		SELECT k.id, k.user_id, k.tenant_id, k.category_id, k.klipp_left, k.original_klipp, k.expiry_date,
+			COALESCE(k.payment_id, ''), k.created_at, k.updated_at
+		FROM klippekort k
+		WHERE `+usableBy+` AND k.tenant_id = ?
+		ORDER BY k.created_at DESC, k.id DESC`, userID, userID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []Statement
+	for rows.Next() {
+		card, err := scanCard(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		statements = append(statements, Statement{Card: *card, Shared: card.UserID != userID})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range statements {
+		statements[i].Transactions, err = s.Ledger(statements[i].Card.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !statements[i].Shared {
+			statements[i].Holders, err = s.Holders(statements[i].Card.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return statements, nil
+}
+
+// Ledger returns a card's transactions, newest first
+func (s *Service) Ledger(cardID int) ([]Transaction, error) {
+	rows, err := s.db.Query(`
+		SELECT t.id, t.klippekort_id, t.user_id, t.tenant_id, t.kind, t.delta, t.balance_after, t.booking_id,
+			COALESCE(t.payment_id, ''), COALESCE(t.note, ''), t.created_by, t.created_at, COALESCE(c.name, ''),
+			COALESCE(u.first_name || ' ' || u.last_name, '')
+		FROM klipp_transactions t
+		LEFT JOIN users u ON u.id = t.user_id
+		LEFT JOIN bookings b ON b.id = t.booking_id
+		LEFT JOIN classes c ON c.id = b.class_id
+		WHERE t.klippekort_id = ?
+		ORDER BY t.id DESC`, cardID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transactions []Transaction
+	for rows.Next() {
+		var t Transaction
+		var bookingID, createdBy sql.NullInt64
+		err := rows.Scan(&t.ID, &t.CardID, &t.UserID, &t.TenantID, &t.Kind, &t.Delta, &t.BalanceAfter, &bookingID,
+			&t.PaymentID, &t.Note, &createdBy, &t.CreatedAt, &t.ClassName, &t.UserName)
+		if err != nil {
+			return nil, err
+		}
+		if bookingID.Valid {
+			id := int(bookingID.Int64)
+			t.BookingID = &id
+		}
+		if createdBy.Valid {
+			id := int(createdBy.Int64)
+			t.CreatedBy = &id
+		}
+		transactions = append(transactions, t)
+	}
+
+	return transactions, rows.Err()
+}
+
+// Reconcile returns the tenant's cards whose balance differs from the sum of
+// their ledger transactions
+func (s *Service) Reconcile(tenantID int) ([]Discrepancy, error) {
+	rows, err := s.db.Query(`
+		SELECT k.id, k.user_id, k.tenant_id, k.category_id, k.klipp_left, k.original_klipp, k.expiry_date,
+			COALESCE(k.payment_id, ''), k.created_at, k.updated_at, COALESCE(SUM(t.delta), 0)
+		FROM klippekort k
+		LEFT JOIN klipp_transactions t ON t.klippekort_id = k.id
+		WHERE k.tenant_id = ?
+		GROUP BY k.id
+		HAVING k.klipp_left != COALESCE(SUM(t.delta), 0)
+		ORDER BY k.id`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discrepancies []Discrepancy
+	for rows.Next() {
+		var d Discrepancy
+		var expiryDate sql.NullTime
+		err := rows.Scan(&d.Card.ID, &d.Card.UserID, &d.Card.TenantID, &d.Card.CategoryID, &d.Card.KlippLeft,
+			&d.Card.OriginalKlipp, &expiryDate, &d.Card.PaymentID, &d.Card.CreatedAt, &d.Card.UpdatedAt,
+			&d.LedgerBalance)
+		if err != nil {
+			return nil, err
+		}
+		if expiryDate.Valid {
+			d.Card.ExpiryDate = &expiryDate.Time
+		}
+		discrepancies = append(discrepancies, d)
+	}
+
+	return discrepancies, rows.Err()
+}
+
+// Issue creates a newly bought card, sets its ID and records the purchase
+func Issue(q Execer, card *models.Klippekort, now time.Time) error {
+	var paymentID, expiryDate interface{}
+	if card.PaymentID != "" {
+		paymentID = card.PaymentID
+	}
+	if card.ExpiryDate != nil {
+		expiryDate = card.ExpiryDate.UTC()
+	}
+
+	result, err := q.Exec(`
+		INSERT INTO klippekort (user_id, tenant_id, category_id, klipp_left, original_klipp, expiry_date, payment_id,
+			created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		card.UserID, card.TenantID, card.CategoryID, card.OriginalKlipp, card.OriginalKlipp, expiryDate, paymentID,
+		now.UTC(), now.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to create klippekort: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	card.ID = int(id)
+	card.KlippLeft = card.OriginalKlipp
+	card.CreatedAt = now
+	card.UpdatedAt = now
+
+	entry := Entry{PaymentID: card.PaymentID}
+	_, err = record(q, card.ID, card.UserID, card.TenantID, KindPurchase, card.OriginalKlipp, card.KlippLeft, entry, now)
+	return err
+}
+
+// Deduct takes one klipp from the member's oldest non-expired card in the
+// category and records the use against the member. Cards shared with the
+// member are only used once their own cards are empty. The card is picked
+// and decremented in a single statement, so concurrent deductions never
+// take the same klipp twice.
+func Deduct(q Execer, userID, tenantID int, categoryID string, entry Entry, now time.Time) (int, error) {
+	var cardID, balance int
+	err := q.QueryRow(`
+		UPDATE klippekort SET klipp_left = klipp_left - 1, updated_at = ?
+		WHERE id = (
+			SELECT k.id FROM klippekort k
+			WHERE `+usableBy+` AND k.tenant_id = ? AND k.category_id = ? AND k.klipp_left > 0
+				AND (k.expiry_date IS NULL OR k.expiry_date > ?)
+			ORDER BY k.user_id = ? DESC, k.created_at ASC, k.id ASC
+			LIMIT 1)
+		RETURNING id, klipp_left`, now, userID, userID, tenantID, categoryID, now.UTC(), userID).Scan(&cardID, &balance)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoKlipp
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to use klipp: %w", err)
+	}
+
+	if _, err := record(q, cardID, userID, tenantID, KindUse, -1, balance, entry, now); err != nil {
+		return 0, err
+	}
+	return cardID, nil
+}
+
+// Available returns the klipp left at now on the cards in the category that
+// the member owns or shares, for callers checking inside a transaction
+func Available(q Execer, userID, tenantID int, categoryID string, now time.Time) (int, error) {
+	var balance int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(k.klipp_left), 0) FROM klippekort k
+		WHERE `+usableBy+` AND k.tenant_id = ? AND k.category_id = ? AND k.klipp_left > 0
+			AND (k.expiry_date IS NULL OR k.expiry_date > ?)`,
+		userID, userID, tenantID, categoryID, now.UTC()).Scan(&balance)
+	return balance, err
+}
+
+// Return puts a klipp back on a card, for example when a booking paid with
+// it is cancelled in time, and records the refund
+func Return(q Execer, cardID int, entry Entry, now time.Time) error {
+	var userID, tenantID, balance int
+	err := q.QueryRow(`
+		UPDATE klippekort SET klipp_left = klipp_left + 1, updated_at = ?
+		WHERE id = ?
+		RETURNING user_id, tenant_id, klipp_left`, now, cardID).Scan(&userID, &tenantID, &balance)
+	if err == sql.ErrNoRows {
+		return ErrCardNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to return klipp: %w", err)
+	}
+	if entry.UserID != 0 {
+		userID = entry.UserID
+	}
+
+	_, err = record(q, cardID, userID, tenantID, KindRefund, 1, balance, entry, now)
+	return err
+}
+
+// Revoke empties the card bought with a payment that has been refunded and
+// records the klipp taken back as an adjustment. Klipp already used stay
+// used. It returns the number of klipp taken back, and ErrCardNotFound if
+// no card was bought with the payment.
+func Revoke(q Execer, paymentID string, entry Entry, now time.Time) (int, error) {
+	var cardID, userID, tenantID, klipp int
+	err := q.QueryRow(`
+		SELECT id, user_id, tenant_id, klipp_left FROM klippekort WHERE payment_id = ?`, paymentID).Scan(
+		&cardID, &userID, &tenantID, &klipp)
+	if err == sql.ErrNoRows {
+		return 0, ErrCardNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if klipp == 0 {
+		return 0, nil
+	}
+
+	_, err = q.Exec(`UPDATE klippekort SET klipp_left = 0, updated_at = ? WHERE id = ?`, now, cardID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke klippekort: %w", err)
+	}
+	entry.PaymentID = paymentID
+	if _, err := record(q, cardID, userID, tenantID, KindAdjustment, -klipp, 0, entry, now); err != nil {
+		return 0, err
+	}
+	return klipp, nil
+}
+
+// Helper methods
+
+// usableBy restricts a query on klippekort k to the cards a member owns or
+// is an active holder of. It takes the member's ID twice.
+const usableBy = `(k.user_id = ? OR EXISTS (
+	SELECT 1 FROM klippekort_holders h
+	WHERE h.klippekort_id = k.id AND h.user_id = ? AND h.accepted_at IS NOT NULL AND h.revoked_at IS NULL))`
+
+// record appends a transaction to the ledger
+func record(q Execer, cardID, userID, tenantID int, kind string, delta, balanceAfter int, entry Entry, now time.Time) (*Transaction, error) {
+	t := &Transaction{
+		CardID:       cardID,
+		UserID:       userID,
+		TenantID:     tenantID,
+		Kind:         kind,
+		Delta:        delta,
+		BalanceAfter: balanceAfter,
+		PaymentID:    entry.PaymentID,
+		Note:         entry.Note,
+		CreatedAt:    now,
+	}
+
+	var bookingID, paymentID, note, createdBy interface{}
+	if entry.BookingID != 0 {
+		bookingID = entry.BookingID
+		t.BookingID = &entry.BookingID
+	}
+	if entry.PaymentID != "" {
+		paymentID = entry.PaymentID
+	}
+	if entry.Note != "" {
+		note = entry.Note
+	}
+	if entry.CreatedBy != 0 {
+		createdBy = entry.CreatedBy
+		t.CreatedBy = &entry.CreatedBy
+	}
+
+	result, err := q.Exec(`
+		INSERT INTO klipp_transactions (klippekort_id, user_id, tenant_id, kind, delta, balance_after, booking_id,
+			payment_id, note, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		cardID, userID, tenantID, kind, delta, balanceAfter, bookingID, paymentID, note, createdBy, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to record klipp transaction: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	t.ID = int(id)
+	return t, nil
+}
+
+func getCard(q Execer, cardID int) (*models.Klippekort, error) {
+	card, err := scanCard(q.QueryRow(`
+		SELECT id, user_id, tenant_id, category_id, klipp_left, original_klipp, expiry_date,
+			COALESCE(payment_id, ''), created_at, updated_at
+		FROM klippekort WHERE id = ?`, cardID))
+	if err == sql.ErrNoRows {
+		return nil, ErrCardNotFound
+	}
+	return card, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCard(row scanner) (*models.Klippekort, error) {
+	var card models.Klippekort
+	var expiryDate sql.NullTime
+	err := row.Scan(&card.ID, &card.UserID, &card.TenantID, &card.CategoryID, &card.KlippLeft, &card.OriginalKlipp,
+		&expiryDate, &card.PaymentID, &card.CreatedAt, &card.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiryDate.Valid {
+		card.ExpiryDate = &expiryDate.Time
+	}
+	return &card, nil
+}
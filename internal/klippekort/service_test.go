@@ -0,0 +1,186 @@
+package klippekort
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/database"
+	"samskipnad/internal/models"
+	"samskipnad/internal/services"
+)
+
+// setupTestDB creates a migrated in-memory SQLite database for testing
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// recordingBus captures published events, notifications and emails
+type recordingBus struct {
+	services.EventBusService
+	events        []*services.Event
+	notifications map[int][]*services.Notification
+	emails        map[string][]string
+}
+
+func (b *recordingBus) Publish(ctx context.Context, event *services.Event) error {
+	b.events = append(b.events, event)
+	return nil
+}
+
+func (b *recordingBus) SendNotification(ctx context.Context, userID int, notification *services.Notification) error {
+	b.notifications[userID] = append(b.notifications[userID], notification)
+	return nil
+}
+
+func (b *recordingBus) SendEmail(ctx context.Context, to, subject, body string) error {
+	b.emails[to] = append(b.emails[to], body)
+	return nil
+}
+
+func newTestService(t *testing.T, now time.Time) *Service {
+	service := NewService(setupTestDB(t), &recordingBus{
+		notifications: make(map[int][]*services.Notification),
+		emails:        make(map[string][]string),
+	})
+	service.community = func() *config.Community { return &config.Community{} }
+	service.now = func() time.Time { return now }
+	return service
+}
+
+func addCard(t *testing.T, db *sql.DB, categoryID string, klipp int, bought time.Time, expiry *time.Time) int {
+	var expiryDate interface{}
+	if expiry != nil {
+		expiryDate = expiry.UTC()
+	}
+	result, err := db.Exec(`
+		INSERT INTO klippekort (user_id, tenant_id, category_id, klipp_left, original_klipp, expiry_date, created_at)
+		VALUES (1, 1, ?, ?, ?, ?, ?)`, categoryID, klipp, klipp, expiryDate, bought.UTC())
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func klippLeft(t *testing.T, db *sql.DB, cardID int) int {
+	var left int
+	require.NoError(t, db.QueryRow(`SELECT klipp_left FROM klippekort WHERE id = ?`, cardID).Scan(&left))
+	return left
+}
+
+func TestUseTakesOldestValidCard(t *testing.T) {
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	service := newTestService(t, now)
+	expired := now.Add(-time.Hour)
+
+	expiredCard := addCard(t, service.db, "yoga", 5, now.AddDate(0, -3, 0), &expired)
+	oldest := addCard(t, service.db, "yoga", 1, now.AddDate(0, -2, 0), nil)
+	newest := addCard(t, service.db, "yoga", 10, now.AddDate(0, -1, 0), nil)
+	otherCategory := addCard(t, service.db, "pilates", 10, now.AddDate(0, -4, 0), nil)
+
+	balance, err := service.Balance(1, 1, "yoga")
+	require.NoError(t, err)
+	assert.Equal(t, 11, balance, "expired cards do not count")
+
+	cardID, err := service.Use(1, 1, "yoga")
+	require.NoError(t, err)
+	assert.Equal(t, oldest, cardID)
+
+	cardID, err = service.Use(1, 1, "yoga")
+	require.NoError(t, err)
+	assert.Equal(t, newest, cardID, "empty cards are skipped")
+
+	assert.Equal(t, 5, klippLeft(t, service.db, expiredCard))
+	assert.Equal(t, 0, klippLeft(t, service.db, oldest))
+	assert.Equal(t, 9, klippLeft(t, service.db, newest))
+	assert.Equal(t, 10, klippLeft(t, service.db, otherCategory))
+
+	t.Run("Return", func(t *testing.T) {
+		require.NoError(t, Return(service.db, oldest, Entry{Note: "cancelled"}, now))
+		assert.Equal(t, 1, klippLeft(t, service.db, oldest))
+	})
+}
+
+func TestUseWithoutKlipp(t *testing.T) {
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	service := newTestService(t, now)
+	addCard(t, service.db, "yoga", 0, now.AddDate(0, -1, 0), nil)
+
+	_, err := service.Use(1, 1, "yoga")
+	assert.ErrorIs(t, err, ErrNoKlipp)
+
+	_, err = service.Use(1, 1, "pilates")
+	assert.ErrorIs(t, err, ErrNoKlipp)
+}
+
+func TestLedger(t *testing.T) {
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	service := newTestService(t, now)
+
+	card := &models.Klippekort{UserID: 1, TenantID: 1, CategoryID: "yoga", OriginalKlipp: 10}
+	require.NoError(t, Issue(service.db, card, now))
+	assert.Equal(t, 10, card.KlippLeft)
+
+	_, err := Deduct(service.db, 1, 1, "yoga", Entry{}, now)
+	require.NoError(t, err)
+	_, err = Deduct(service.db, 1, 1, "yoga", Entry{}, now)
+	require.NoError(t, err)
+	require.NoError(t, Return(service.db, card.ID, Entry{}, now))
+
+	adjustment, err := service.Adjust(card.ID, -3, "Klipp used at the front desk", 1)
+	require.NoError(t, err)
+	assert.Equal(t, 6, adjustment.BalanceAfter)
+
+	ledger, err := service.Ledger(card.ID)
+	require.NoError(t, err)
+	var kinds []string
+	balance := 0
+	for _, tx := range ledger {
+		kinds = append(kinds, tx.Kind)
+		balance += tx.Delta
+	}
+	assert.Equal(t, []string{KindAdjustment, KindRefund, KindUse, KindUse, KindPurchase}, kinds)
+	assert.Equal(t, klippLeft(t, service.db, card.ID), balance, "the ledger sums to the balance")
+	assert.Equal(t, "Klipp used at the front desk", ledger[0].Note)
+
+	discrepancies, err := service.Reconcile(1)
+	require.NoError(t, err)
+	assert.Empty(t, discrepancies)
+
+	t.Run("InvalidAdjustments", func(t *testing.T) {
+		_, err := service.Adjust(card.ID, -7, "Too many", 1)
+		assert.ErrorIs(t, err, ErrNegativeBalance)
+		_, err = service.Adjust(card.ID, 1, "", 1)
+		assert.ErrorIs(t, err, ErrAdjustmentNoteEmpty)
+		_, err = service.Adjust(card.ID+1, 1, "Missing", 1)
+		assert.ErrorIs(t, err, ErrCardNotFound)
+	})
+
+	t.Run("AppendOnly", func(t *testing.T) {
+		_, err := service.db.Exec(`UPDATE klipp_transactions SET delta = 100 WHERE klippekort_id = ?`, card.ID)
+		assert.Error(t, err)
+		_, err = service.db.Exec(`DELETE FROM klipp_transactions WHERE klippekort_id = ?`, card.ID)
+		assert.Error(t, err)
+	})
+
+	t.Run("Reconcile", func(t *testing.T) {
+		_, err := service.db.Exec(`UPDATE klippekort SET klipp_left = 20 WHERE id = ?`, card.ID)
+		require.NoError(t, err)
+
+		discrepancies, err := service.Reconcile(1)
+		require.NoError(t, err)
+		require.Len(t, discrepancies, 1)
+		assert.Equal(t, 6, discrepancies[0].LedgerBalance)
+	})
+}
@@ -0,0 +1,274 @@
+package klippekort
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"samskipnad/internal/services"
+)
+
+// Event types published when cards are shared
+const (
+	EventHolderInvited  = "klippekort.holder_invited"
+	EventHolderAccepted = "klippekort.holder_accepted"
+	EventHolderRevoked  = "klippekort.holder_revoked"
+)
+
+var (
+	ErrNotOwner            = errors.New("only the owner can share this klippekort")
+	ErrSharingDisabled     = errors.New("klippekort in this category cannot be shared")
+	ErrTooManyHolders      = errors.New("this klippekort is already shared with as many members as allowed")
+	ErrAlreadyHolder       = errors.New("this member can already use this klippekort")
+	ErrHolderEmailEmpty    = errors.New("an email address is required to share a klippekort")
+	ErrHolderNotFound      = errors.New("klippekort holder not found")
+	ErrInviteNotFound      = errors.New("this invitation is no longer valid")
+	ErrInviteEmailMismatch = errors.New("this invitation was sent to a different email address")
+)
+
+// Holder is a member invited to use a card owned by someone else. UserID
+// is set once the invitation has been accepted.
+type Holder struct {
+	ID         int
+	CardID     int
+	Email      string
+	UserID     int
+	Name       string // Holder's name, loaded for display
+	InvitedAt  time.Time
+	AcceptedAt *time.Time
+}
+
+// Invite lets the card's owner share it with the member using email. The
+// invitation is emailed with a link to acceptURL. Inviting a revoked holder
+// again restores their access once they accept the new invitation.
+func (s *Service) Invite(cardID, ownerID int, email, acceptURL string) (*Holder, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return nil, ErrHolderEmailEmpty
+	}
+
+	card, err := getCard(s.db, cardID)
+	if err != nil {
+		return nil, err
+	}
+	if card.UserID != ownerID {
+		return nil, ErrNotOwner
+	}
+	category, ok := s.community().KlippekortCategoryByID(card.CategoryID)
+	if !ok || category.MaxHolders <= 0 {
+		return nil, ErrSharingDisabled
+	}
+
+	var ownerEmail string
+	if err := s.db.QueryRow(`SELECT email FROM users WHERE id = ?`, ownerID).Scan(&ownerEmail); err != nil {
+		return nil, fmt.Errorf("failed to get klippekort owner: %w", err)
+	}
+	if strings.EqualFold(ownerEmail, email) {
+		return nil, ErrAlreadyHolder
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var holders int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM klippekort_holders
+		WHERE klippekort_id = ? AND revoked_at IS NULL AND email != ?`, cardID, email).Scan(&holders)
+	if err != nil {
+		return nil, err
+	}
+	if holders >= category.MaxHolders {
+		return nil, ErrTooManyHolders
+	}
+
+	var holderID int
+	var revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT id, revoked_at FROM klippekort_holders
+		WHERE klippekort_id = ? AND email = ?`, cardID, email).Scan(&holderID, &revokedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		result, err := tx.Exec(`
+			INSERT INTO klippekort_holders (klippekort_id, email, token, invited_at)
+			VALUES (?, ?, ?, ?)`, cardID, email, token, now.UTC())
+		if err != nil {
+			return nil, fmt.Errorf("failed to invite klippekort holder: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		holderID = int(id)
+	case err != nil:
+		return nil, err
+	case !revokedAt.Valid:
+		return nil, ErrAlreadyHolder
+	default:
+		_, err = tx.Exec(`
+			UPDATE klippekort_holders
+			SET token = ?, user_id = NULL, invited_at = ?, accepted_at = NULL, revoked_at = NULL
+			WHERE id = ?`, token, now.UTC(), holderID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to invite klippekort holder: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.publish(EventHolderInvited, card.TenantID, ownerID, map[string]interface{}{
+		"klippekort_id": cardID,
+		"holder_id":     holderID,
+		"email":         email,
+	})
+	s.sendEmail(email, "You have been invited to share a "+category.Name+" klippekort",
+		fmt.Sprintf("You have been invited to book %s classes with a shared klippekort. Log in with this email address and accept the invitation here: %s?token=%s",
+			category.Name, acceptURL, token))
+
+	return &Holder{ID: holderID, CardID: cardID, Email: email, InvitedAt: now}, nil
+}
+
+// Accept gives the logged in member access to the card they were invited
+// to. The member must be logged in with the email the invitation was sent to.
+func (s *Service) Accept(token string, userID, tenantID int, email string) (*Holder, error) {
+	var holder Holder
+	err := s.db.QueryRow(`
+		SELECT id, klippekort_id, email, invited_at FROM klippekort_holders
+		WHERE token = ? AND revoked_at IS NULL`, token).Scan(&holder.ID, &holder.CardID, &holder.Email, &holder.InvitedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	card, err := getCard(s.db, holder.CardID)
+	if err != nil {
+		return nil, err
+	}
+	if card.TenantID != tenantID {
+		return nil, ErrInviteNotFound
+	}
+	if !strings.EqualFold(holder.Email, strings.TrimSpace(email)) {
+		return nil, ErrInviteEmailMismatch
+	}
+	if card.UserID == userID {
+		return nil, ErrAlreadyHolder
+	}
+
+	now := s.now()
+	_, err = s.db.Exec(`
+		UPDATE klippekort_holders SET user_id = ?, accepted_at = COALESCE(accepted_at, ?)
+		WHERE id = ?`, userID, now.UTC(), holder.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept klippekort invitation: %w", err)
+	}
+	holder.UserID = userID
+	holder.AcceptedAt = &now
+
+	data := map[string]interface{}{
+		"klippekort_id": card.ID,
+		"holder_id":     holder.ID,
+		"user_id":       userID,
+	}
+	s.publish(EventHolderAccepted, card.TenantID, card.UserID, data)
+	s.notify(card.UserID, &services.Notification{
+		Type:    EventHolderAccepted,
+		Title:   "Your klippekort is now shared",
+		Message: holder.Email + " accepted your invitation and can now book with your klippekort.",
+		Data:    data,
+	})
+
+	return &holder, nil
+}
+
+// Revoke removes a holder's access to the owner's card. Klipp the holder
+// has already used stay used.
+func (s *Service) Revoke(cardID, ownerID, holderID int) error {
+	card, err := getCard(s.db, cardID)
+	if err != nil {
+		return err
+	}
+	if card.UserID != ownerID {
+		return ErrNotOwner
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE klippekort_holders SET revoked_at = ?
+		WHERE id = ? AND klippekort_id = ? AND revoked_at IS NULL`, s.now().UTC(), holderID, cardID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke klippekort holder: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrHolderNotFound
+	}
+
+	s.publish(EventHolderRevoked, card.TenantID, ownerID, map[string]interface{}{
+		"klippekort_id": cardID,
+		"holder_id":     holderID,
+	})
+	return nil
+}
+
+// Holders returns the members a card is shared with, including invitations
+// that have not been accepted yet
+func (s *Service) Holders(cardID int) ([]Holder, error) {
+	rows, err := s.db.Query(`
+		SELECT h.id, h.klippekort_id, h.email, COALESCE(h.user_id, 0),
+			COALESCE(u.first_name || ' ' || u.last_name, ''), h.invited_at, h.accepted_at
+		FROM klippekort_holders h
+		LEFT JOIN users u ON u.id = h.user_id
+		WHERE h.klippekort_id = ? AND h.revoked_at IS NULL
+		ORDER BY h.invited_at, h.id`, cardID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holders []Holder
+	for rows.Next() {
+		var h Holder
+		var acceptedAt sql.NullTime
+		if err := rows.Scan(&h.ID, &h.CardID, &h.Email, &h.UserID, &h.Name, &h.InvitedAt, &acceptedAt); err != nil {
+			return nil, err
+		}
+		if acceptedAt.Valid {
+			h.AcceptedAt = &acceptedAt.Time
+		}
+		holders = append(holders, h)
+	}
+	return holders, rows.Err()
+}
+
+func (s *Service) sendEmail(to, subject, body string) {
+	if s.events == nil {
+		return
+	}
+	if err := s.events.SendEmail(context.Background(), to, subject, body); err != nil {
+		log.Printf("Failed to email %s: %v", to, err)
+	}
+}
+
+func newInviteToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate invitation token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,144 @@
+package klippekort
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+)
+
+func addUser(t *testing.T, db *sql.DB, email, firstName string) int {
+	result, err := db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, tenant_id)
+		VALUES (?, 'x', ?, 'Hansen', 1)`, email, firstName)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func TestSharing(t *testing.T) {
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	service := newTestService(t, now)
+	service.community = func() *config.Community {
+		community := &config.Community{}
+		community.Pricing.Klippekort.Categories = []config.KlippekortCategory{
+			{ID: "yoga", Name: "Yoga", MaxHolders: 1},
+			{ID: "pilates", Name: "Pilates"},
+		}
+		return community
+	}
+
+	parent := addUser(t, service.db, "parent@example.com", "Kari")
+	teen := addUser(t, service.db, "teen@example.com", "Ola")
+	card := addCard(t, service.db, "yoga", 10, now.AddDate(0, -1, 0), nil)
+	_, err := service.db.Exec(`UPDATE klippekort SET user_id = ? WHERE id = ?`, parent, card)
+	require.NoError(t, err)
+
+	holder, err := service.Invite(card, parent, " Teen@Example.com ", "https://studio.example/klippekort/shared/accept")
+	require.NoError(t, err)
+	assert.Equal(t, "teen@example.com", holder.Email)
+
+	var token string
+	require.NoError(t, service.db.QueryRow(`SELECT token FROM klippekort_holders WHERE id = ?`, holder.ID).Scan(&token))
+	emails := service.events.(*recordingBus).emails["teen@example.com"]
+	require.Len(t, emails, 1)
+	assert.Contains(t, emails[0], "https://studio.example/klippekort/shared/accept?token="+token)
+
+	_, err = Deduct(service.db, teen, 1, "yoga", Entry{}, now)
+	assert.ErrorIs(t, err, ErrNoKlipp, "invitations must be accepted before the card can be used")
+
+	_, err = service.Accept(token, parent, 1, "parent@example.com")
+	assert.ErrorIs(t, err, ErrInviteEmailMismatch)
+	_, err = service.Accept("unknown", teen, 1, "teen@example.com")
+	assert.ErrorIs(t, err, ErrInviteNotFound)
+	_, err = service.Accept(token, teen, 1, "teen@example.com")
+	require.NoError(t, err)
+
+	balance, err := service.Balance(teen, 1, "yoga")
+	require.NoError(t, err)
+	assert.Equal(t, 10, balance)
+
+	t.Run("UsageIsAttributedToHolder", func(t *testing.T) {
+		cardID, err := Deduct(service.db, teen, 1, "yoga", Entry{}, now)
+		require.NoError(t, err)
+		assert.Equal(t, card, cardID)
+		require.NoError(t, Return(service.db, card, Entry{UserID: teen, Note: "Booking cancelled"}, now))
+		_, err = Deduct(service.db, teen, 1, "yoga", Entry{}, now)
+		require.NoError(t, err)
+
+		ledger, err := service.Ledger(card)
+		require.NoError(t, err)
+		require.Len(t, ledger, 3)
+		for _, tx := range ledger {
+			assert.Equal(t, teen, tx.UserID)
+			assert.Equal(t, "Ola Hansen", tx.UserName)
+		}
+		assert.Equal(t, 9, klippLeft(t, service.db, card))
+	})
+
+	t.Run("OwnCardsFirst", func(t *testing.T) {
+		own := addCard(t, service.db, "yoga", 1, now.AddDate(0, 0, -1), nil)
+		_, err := service.db.Exec(`UPDATE klippekort SET user_id = ? WHERE id = ?`, teen, own)
+		require.NoError(t, err)
+
+		cardID, err := Deduct(service.db, teen, 1, "yoga", Entry{}, now)
+		require.NoError(t, err)
+		assert.Equal(t, own, cardID, "the holder's own card is used before the shared one")
+	})
+
+	t.Run("Statements", func(t *testing.T) {
+		statements, err := service.Statements(parent, 1)
+		require.NoError(t, err)
+		require.Len(t, statements, 1)
+		assert.False(t, statements[0].Shared)
+		require.Len(t, statements[0].Holders, 1)
+		assert.Equal(t, teen, statements[0].Holders[0].UserID)
+
+		statements, err = service.Statements(teen, 1)
+		require.NoError(t, err)
+		require.Len(t, statements, 2)
+		assert.True(t, statements[1].Shared)
+		assert.Empty(t, statements[1].Holders)
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		addUser(t, service.db, "other@example.com", "Per")
+		_, err := service.Invite(card, parent, "other@example.com", "")
+		assert.ErrorIs(t, err, ErrTooManyHolders)
+		_, err = service.Invite(card, parent, "teen@example.com", "")
+		assert.ErrorIs(t, err, ErrAlreadyHolder)
+		_, err = service.Invite(card, parent, "parent@example.com", "")
+		assert.ErrorIs(t, err, ErrAlreadyHolder)
+		_, err = service.Invite(card, teen, "other@example.com", "")
+		assert.ErrorIs(t, err, ErrNotOwner)
+
+		pilates := addCard(t, service.db, "pilates", 10, now, nil)
+		_, err = service.db.Exec(`UPDATE klippekort SET user_id = ? WHERE id = ?`, parent, pilates)
+		require.NoError(t, err)
+		_, err = service.Invite(pilates, parent, "teen@example.com", "")
+		assert.ErrorIs(t, err, ErrSharingDisabled)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		assert.ErrorIs(t, service.Revoke(card, teen, holder.ID), ErrNotOwner)
+		require.NoError(t, service.Revoke(card, parent, holder.ID))
+		assert.ErrorIs(t, service.Revoke(card, parent, holder.ID), ErrHolderNotFound)
+
+		_, err := Deduct(service.db, teen, 1, "yoga", Entry{}, now)
+		assert.ErrorIs(t, err, ErrNoKlipp)
+		_, err = service.Accept(token, teen, 1, "teen@example.com")
+		assert.ErrorIs(t, err, ErrInviteNotFound, "revoked invitations cannot be accepted again")
+
+		ledger, err := service.Ledger(card)
+		require.NoError(t, err)
+		assert.Len(t, ledger, 3, "klipp used before revoking stay used")
+
+		_, err = service.Invite(card, parent, "other@example.com", "")
+		assert.NoError(t, err, "revoking frees a place")
+	})
+}
@@ -0,0 +1,331 @@
+package memberships
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"samskipnad/internal/models"
+	"samskipnad/internal/payments"
+	"samskipnad/internal/services"
+)
+
+// DefaultRenewalInterval is how often the renewal job runs
+const DefaultRenewalInterval = time.Hour
+
+// renewalClaimTimeout is how long a membership is left to the run renewing
+// it, after which the run is taken to have stopped
+const renewalClaimTimeout = 30 * time.Minute
+
+// RenewDue charges the subscriptions whose period has ended, and retries
+// declined renewals that are due again. Members whose renewal is declined
+// are notified and keep access for the community's grace period. Each
+// renewal is charged once: memberships being renewed by another run, or
+// with a renewal payment for the period in progress, are skipped, and
+// charges whose outcome is unknown are tried again on the next run with
+// the same idempotency key. It returns the number of memberships renewed.
+func (s *Service) RenewDue() (int, error) {
+	now := s.now()
+	due, err := s.query(selectMembership+`
+		WHERE auto_renew = true
+		AND ((status = ? AND end_date <= ?) OR (status = ? AND next_attempt <= ?))`,
+		StatusActive, now.UTC(), StatusPastDue, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	renewed := 0
+	for _, m := range due {
+		claimed, err := s.claimRenewal(m.ID, now)
+		if err != nil {
+			return renewed, err
+		}
+		if !claimed {
+			continue
+		}
+
+		ok, err := s.chargeRenewal(m, now)
+		if releaseErr := s.releaseRenewal(m.ID); releaseErr != nil {
+			log.Printf("Failed to release renewal of membership %d: %v", m.ID, releaseErr)
+		}
+		if err != nil {
+			return renewed, err
+		}
+		if ok {
+			renewed++
+		}
+	}
+	return renewed, nil
+}
+
+// chargeRenewal charges a membership's renewal and reports whether it
+// succeeded. Declined renewals are recorded with renewalFailed.
+func (s *Service) chargeRenewal(m *models.Membership, now time.Time) (bool, error) {
+	pending, err := s.renewalPending(m)
+	if err != nil || pending {
+		// The renewal is completed when the provider confirms it
+		return false, err
+	}
+
+	var pi *payments.Intent
+	if m.PaymentMethod != "" {
+		pi, err = s.billing.ChargeRenewal(m.UserID, m.ID, m.Type, m.Amount, m.PaymentMethod, renewalKey(m))
+		if err != nil {
+			log.Printf("Failed to renew membership %d: %v", m.ID, err)
+		}
+		if pi == nil && err != nil && !errors.Is(err, payments.ErrRecurringNotSupported) {
+			// The card may or may not have been charged; the next run
+			// charges again with the same key and learns which
+			return false, nil
+		}
+	}
+
+	reason := "The payment could not be completed."
+	switch {
+	case pi != nil && pi.Status == payments.StatusSucceeded:
+		// Charged; a renewal that failed to be recorded is
+		// recorded when the provider's webhook confirms it
+		return true, nil
+	case pi != nil && pi.Status == payments.StatusRequiresAction:
+		reason = "Your bank asks you to confirm the payment."
+	case pi != nil && pi.FailureMessage != "":
+		reason = pi.FailureMessage
+	}
+	return false, s.renewalFailed(m, reason, now)
+}
+
+// renewalKey identifies a membership's renewal charge for its current
+// period with the payment provider. Retries of declined renewals are new
+// charges, and get keys of their own.
+func renewalKey(m *models.Membership) string {
+	key := renewalPeriod(m)
+	if m.FailedAttempts > 0 {
+		key += fmt.Sprintf("-retry-%d", m.FailedAttempts)
+	}
+	return key
+}
+
+// renewalPeriod starts the renewal keys of a membership's current period
+func renewalPeriod(m *models.Membership) string {
+	return fmt.Sprintf("renewal-%d-%s", m.ID, m.EndDate.UTC().Format("20060102"))
+}
+
+// renewalPending reports whether a membership has a renewal payment for
+// its current period that went through or is going through
+func (s *Service) renewalPending(m *models.Membership) (bool, error) {
+	period := renewalPeriod(m)
+	var pending bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM payments
+			WHERE payment_type = 'membership' AND reference_id = ? AND status IN (?, ?)
+			AND (json_extract(metadata, '$.renewal_key') = ? OR json_extract(metadata, '$.renewal_key') LIKE ?)
+		)`, m.ID, payments.StatusProcessing, payments.StatusSucceeded, period, period+"-retry-%").Scan(&pending)
+	if err != nil {
+		return false, fmt.Errorf("failed to check renewal payments: %w", err)
+	}
+	return pending, nil
+}
+
+// claimRenewal marks a membership as being renewed, unless another run is
+// renewing it
+func (s *Service) claimRenewal(id int, now time.Time) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE memberships SET renewing_at = ?
+		WHERE id = ? AND (renewing_at IS NULL OR renewing_at <= ?)`,
+		now.UTC(), id, now.Add(-renewalClaimTimeout).UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to claim renewal: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// releaseRenewal lets the next run renew the membership
+func (s *Service) releaseRenewal(id int) error {
+	_, err := s.db.Exec(`UPDATE memberships SET renewing_at = NULL WHERE id = ?`, id)
+	return err
+}
+
+// ResumePaused resumes the memberships whose pause has ended. It returns
+// the number of memberships resumed.
+func (s *Service) ResumePaused() (int, error) {
+	now := s.now()
+	paused, err := s.query(selectMembership+` WHERE status = ? AND paused_until <= ?`, StatusPaused, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	resumed := 0
+	for _, m := range paused {
+		m, err := s.resume(m, *m.PausedUntil)
+		if err != nil {
+			return resumed, err
+		}
+		resumed++
+
+		s.notify(m.UserID, &services.Notification{
+			Type:    EventMembershipResumed,
+			Title:   "Your membership is active again",
+			Message: fmt.Sprintf("Welcome back! Your membership now runs until %s.", m.EndDate.Format("Mon Jan 2 2006")),
+			Data:    map[string]interface{}{"membership_id": m.ID, "end_date": m.EndDate},
+		})
+	}
+	return resumed, nil
+}
+
+// ExpireMemberships ends the memberships members no longer have access
+// with: those that do not renew once their period is over, and
+// subscriptions whose renewal was declined once the grace period is over
+// and no retries are left. Members whose grace period is over while
+// retries are still due lose access until a renewal succeeds. It returns
+// the number of memberships expired.
+func (s *Service) ExpireMemberships() (int, error) {
+	now := s.now()
+	ended, err := s.query(selectMembership+`
+		WHERE (status IN (?, ?) AND auto_renew = false AND end_date <= ?)
+		OR (status = ? AND next_attempt IS NULL AND (grace_until IS NULL OR grace_until <= ?))`,
+		StatusActive, StatusCancelled, now.UTC(), StatusPastDue, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range ended {
+		if err := s.expire(m.ID, now); err != nil {
+			return 0, err
+		}
+
+		data := map[string]interface{}{"membership_id": m.ID}
+		s.publish(EventMembershipExpired, m.TenantID, m.UserID, data)
+		s.notify(m.UserID, &services.Notification{
+			Type:     EventMembershipExpired,
+			Title:    "Your membership has ended",
+			Message:  "Your membership has ended. You can start a new one under Memberships whenever you like.",
+			Data:     data,
+			Priority: 1,
+		})
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE memberships SET active = false, updated_at = ?
+		WHERE status = ? AND active = true AND grace_until <= ?`, now.UTC(), StatusPastDue, now.UTC())
+	if err != nil {
+		return len(ended), fmt.Errorf("failed to end grace periods: %w", err)
+	}
+
+	return len(ended), nil
+}
+
+// StartRenewalJob resumes paused memberships, renews subscriptions and
+// expires memberships every interval until the returned stop function is
+// called
+func (s *Service) StartRenewalJob(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			if _, err := s.ResumePaused(); err != nil {
+				log.Printf("Failed to resume paused memberships: %v", err)
+			}
+			if _, err := s.RenewDue(); err != nil {
+				log.Printf("Failed to renew memberships: %v", err)
+			}
+			if _, err := s.ExpireMemberships(); err != nil {
+				log.Printf("Failed to expire memberships: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// renewalFailed records a declined renewal, schedules the next retry and
+// notifies the member. Retries are due the community's retry days after
+// the renewal date; the member keeps access until the grace period after
+// it is over.
+func (s *Service) renewalFailed(m *models.Membership, reason string, now time.Time) error {
+	community := s.community()
+	grace := m.EndDate.AddDate(0, 0, community.Pricing.Subscriptions.GraceDays)
+
+	var next *time.Time
+	for _, days := range community.RenewalRetryDays() {
+		if retry := m.EndDate.AddDate(0, 0, days); retry.After(now) {
+			next = &retry
+			break
+		}
+	}
+	var nextAttempt interface{}
+	if next != nil {
+		nextAttempt = next.UTC()
+	}
+
+	_, err := s.db.Exec(`
+		UPDATE memberships SET status = ?, active = ?, failed_attempts = failed_attempts + 1, next_attempt = ?,
+			grace_until = ?, updated_at = ?
+		WHERE id = ?`, StatusPastDue, now.Before(grace), nextAttempt, grace.UTC(), now.UTC(), m.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record declined renewal: %w", err)
+	}
+
+	message := fmt.Sprintf("We could not renew your %s membership. %s", m.Type, reason)
+	if next != nil {
+		message += fmt.Sprintf(" We will try again on %s.", next.Format("Mon Jan 2"))
+	}
+	if now.Before(grace) {
+		message += fmt.Sprintf(" Pay for it with another card under Memberships to keep access after %s.", grace.Format("Mon Jan 2"))
+	} else {
+		message += " Pay for it with another card under Memberships to get access again."
+	}
+
+	data := map[string]interface{}{
+		"membership_id":   m.ID,
+		"failed_attempts": m.FailedAttempts + 1,
+		"grace_until":     grace,
+	}
+	if next != nil {
+		data["next_attempt"] = *next
+	}
+	s.publish(EventRenewalFailed, m.TenantID, m.UserID, data)
+	s.notify(m.UserID, &services.Notification{
+		Type:     EventRenewalFailed,
+		Title:    "Your membership payment failed",
+		Message:  message,
+		Data:     data,
+		Priority: 2,
+	})
+	return nil
+}
+
+// query returns the memberships a query selects
+func (s *Service) query(query string, args ...interface{}) ([]*models.Membership, error) {
+	return queryMemberships(s.db, query, args...)
+}
+
+func queryMemberships(q Queryer, query string, args ...interface{}) ([]*models.Membership, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []*models.Membership
+	for rows.Next() {
+		m, err := scanMembership(rows)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
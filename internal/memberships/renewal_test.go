@@ -0,0 +1,206 @@
+package memberships
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenewDue(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+
+	renewed, err := env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Zero(t, renewed, "the period has not ended")
+
+	env.now = m.end.Add(time.Hour)
+	renewed, err = env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Equal(t, 1, renewed)
+	assert.Equal(t, []int{m.id}, env.billing.charged)
+
+	membership, err := env.service.Get(m.id)
+	require.NoError(t, err)
+	assert.True(t, membership.EndDate.Equal(time.Date(2025, 3, 28, 9, 0, 0, 0, time.UTC)), "the next period follows on: %s", membership.EndDate)
+	assert.Equal(t, "pi_renewal_1", membership.PaymentID)
+	assert.Equal(t, "pm_1", membership.PaymentMethod, "renewals keep the saved card")
+	assert.Equal(t, 1, env.events.published(EventMembershipRenewed))
+
+	renewed, err = env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Zero(t, renewed, "renewed once")
+}
+
+func TestRenewalDeclined(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+	env.billing.declines = 3
+
+	// Charged at the end of the period, then retried a day and three
+	// days later, as the community's retry days say
+	env.now = m.end.Add(time.Hour)
+	_, err := env.service.RenewDue()
+	require.NoError(t, err)
+	membership, err := env.service.Get(m.id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPastDue, membership.Status)
+	assert.True(t, membership.Active, "the member keeps access during the grace period")
+	assert.Equal(t, 1, membership.FailedAttempts)
+	require.NotNil(t, membership.NextAttempt)
+	assert.True(t, membership.NextAttempt.Equal(m.end.AddDate(0, 0, 1)))
+	require.NotNil(t, membership.GraceUntil)
+	assert.True(t, membership.GraceUntil.Equal(m.end.AddDate(0, 0, 7)))
+
+	notifications := env.events.notifications[env.userID]
+	require.Len(t, notifications, 1)
+	assert.Equal(t, EventRenewalFailed, notifications[0].Type)
+	assert.Contains(t, notifications[0].Message, "Your card was declined.")
+
+	_, err = env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Len(t, env.billing.charged, 1, "not retried before the next attempt is due")
+
+	env.now = m.end.AddDate(0, 0, 1).Add(time.Hour)
+	_, err = env.service.RenewDue()
+	require.NoError(t, err)
+	env.now = m.end.AddDate(0, 0, 3).Add(time.Hour)
+	_, err = env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Len(t, env.billing.charged, 3)
+	membership, err = env.service.Get(m.id)
+	require.NoError(t, err)
+	assert.Equal(t, 3, membership.FailedAttempts)
+	assert.Nil(t, membership.NextAttempt, "no retries are left")
+
+	expired, err := env.service.ExpireMemberships()
+	require.NoError(t, err)
+	assert.Zero(t, expired, "the grace period is not over")
+
+	// The member pays with another card instead
+	_, err = env.service.CreateSubscription(env.userID, "", PlanMonthly, nil)
+	require.NoError(t, err)
+	assert.Equal(t, m.id, env.billing.started[1].membershipID, "pays for the membership that is due")
+
+	env.now = m.end.AddDate(0, 0, 7).Add(time.Hour)
+	expired, err = env.service.ExpireMemberships()
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	membership, err = env.service.Get(m.id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusExpired, membership.Status)
+	assert.False(t, membership.Active)
+	assert.Len(t, env.events.notifications[env.userID], 4)
+	assert.Equal(t, EventMembershipExpired, env.events.notifications[env.userID][3].Type)
+}
+
+func TestRenewalRetrySucceeds(t *testing.T) {
+	env := newTestEnv(t)
+	env.community.Pricing.Subscriptions.GraceDays = 0
+	m := env.subscribe(t, PlanMonthly)
+	env.billing.declines = 1
+
+	env.now = m.end.Add(time.Hour)
+	_, err := env.service.RenewDue()
+	require.NoError(t, err)
+	_, err = env.service.ExpireMemberships()
+	require.NoError(t, err)
+	membership, err := env.service.Get(m.id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPastDue, membership.Status, "retries are still due")
+	assert.False(t, membership.Active, "there is no grace period")
+
+	env.now = m.end.AddDate(0, 0, 1).Add(time.Hour)
+	renewed, err := env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Equal(t, 1, renewed)
+	membership, err = env.service.Get(m.id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusActive, membership.Status)
+	assert.True(t, membership.Active)
+	assert.Zero(t, membership.FailedAttempts)
+	assert.Nil(t, membership.NextAttempt)
+	assert.True(t, membership.EndDate.Equal(env.now.AddDate(0, 1, 0)), "the lapsed member's period starts when paid: %s", membership.EndDate)
+}
+
+func TestRenewalOutcomeUnknown(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+	env.billing.failures = 1
+
+	env.now = m.end.Add(time.Hour)
+	renewed, err := env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Zero(t, renewed)
+	membership := env.membership(t, m.id)
+	assert.Equal(t, StatusActive, membership.status, "an unknown outcome is not a decline")
+	assert.Empty(t, env.events.notifications[env.userID])
+
+	env.now = env.now.Add(time.Hour)
+	renewed, err = env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Equal(t, 1, renewed)
+	require.Len(t, env.billing.keys, 2)
+	assert.Equal(t, env.billing.keys[0], env.billing.keys[1], "charged again with the same key")
+	assert.Equal(t, fmt.Sprintf("renewal-%d-%s", m.id, m.end.Format("20060102")), env.billing.keys[0])
+}
+
+func TestRenewalRetryKeys(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+	env.billing.declines = 1
+
+	env.now = m.end.Add(time.Hour)
+	_, err := env.service.RenewDue()
+	require.NoError(t, err)
+	env.now = m.end.AddDate(0, 0, 1).Add(time.Hour)
+	_, err = env.service.RenewDue()
+	require.NoError(t, err)
+
+	require.Len(t, env.billing.keys, 2)
+	assert.Equal(t, env.billing.keys[0]+"-retry-1", env.billing.keys[1], "a retry is a new charge")
+}
+
+func TestRenewalInProgressSkipped(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+	env.now = m.end.Add(time.Hour)
+
+	// Another run is renewing the membership
+	_, err := env.db.Exec(`UPDATE memberships SET renewing_at = ? WHERE id = ?`, env.now.Add(-time.Minute), m.id)
+	require.NoError(t, err)
+	_, err = env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Empty(t, env.billing.charged)
+
+	// The run stopped, and the renewal is charged by the next one, but
+	// its payment is still being processed
+	env.now = env.now.Add(time.Hour)
+	_, err = env.db.Exec(`
+		INSERT INTO payments (id, user_id, tenant_id, amount, status, payment_type, reference_id, metadata)
+		VALUES ('pi_renewal', ?, 1, 59900, 'processing', 'membership', ?, json_object('renewal_key', ?))`,
+		env.userID, m.id, fmt.Sprintf("renewal-%d-%s", m.id, m.end.Format("20060102")))
+	require.NoError(t, err)
+	_, err = env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Empty(t, env.billing.charged, "the renewal is completed when the provider confirms it")
+	assert.Equal(t, StatusActive, env.membership(t, m.id).status)
+}
+
+func TestPausedNotRenewed(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+	env.now = m.end.AddDate(0, 0, -2)
+	require.NoError(t, env.service.Pause(m.id, env.now.AddDate(0, 0, 10)))
+
+	env.now = m.end.Add(time.Hour)
+	_, err := env.service.RenewDue()
+	require.NoError(t, err)
+	_, err = env.service.ExpireMemberships()
+	require.NoError(t, err)
+	assert.Empty(t, env.billing.charged)
+	assert.Equal(t, StatusPaused, env.membership(t, m.id).status)
+}
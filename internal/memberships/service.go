@@ -0,0 +1,497 @@
+// Package memberships keeps members' memberships: subscriptions billed
+// monthly or yearly that renew themselves, and memberships bought for a
+// single period. It maintains memberships.active, which grants access.
+package memberships
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/models"
+	"samskipnad/internal/payments"
+	"samskipnad/internal/services"
+)
+
+// Plans members can subscribe to
+const (
+	PlanMonthly = "monthly"
+	PlanYearly  = "yearly"
+)
+
+// Membership statuses
+const (
+	StatusActive    = "active"
+	StatusPastDue   = "past_due"  // A renewal was declined; the member keeps access during the grace period
+	StatusPaused    = "paused"    // Frozen, as for an injury or a holiday; the paused time is added to the period
+	StatusCancelled = "cancelled" // Will not renew; the member keeps access until the end of the period
+	StatusExpired   = "expired"
+)
+
+// Event types published by the membership service
+const (
+	EventMembershipStarted   = "membership.started"
+	EventMembershipRenewed   = "membership.renewed"
+	EventRenewalFailed       = "membership.renewal_failed"
+	EventMembershipCancelled = "membership.cancelled"
+	EventMembershipPaused    = "membership.paused"
+	EventMembershipResumed   = "membership.resumed"
+	EventMembershipExpired   = "membership.expired"
+)
+
+var (
+	ErrUnknownPlan        = errors.New("unknown membership plan")
+	ErrAlreadySubscribed  = errors.New("already subscribed")
+	ErrMembershipNotFound = errors.New("membership not found")
+	ErrNotRenewing        = errors.New("membership does not renew")
+	ErrPauseNotAllowed    = errors.New("memberships cannot be paused")
+	ErrPauseTooLong       = errors.New("pause is longer than allowed")
+	ErrInvalidPause       = errors.New("pause must end in the future")
+	ErrCannotPause        = errors.New("only active memberships can be paused")
+	ErrNotPaused          = errors.New("membership is not paused")
+)
+
+// Biller takes membership payments. payments.Service implements it.
+type Biller interface {
+	CreateSubscriptionPaymentIntent(userID int, tier, plan string, membershipID int, amount int64, discount *payments.Discount) (*payments.Intent, error)
+	ChargeRenewal(userID, membershipID int, plan string, amount int, paymentMethod, idempotencyKey string) (*payments.Intent, error)
+}
+
+// Service manages memberships and renews subscriptions
+type Service struct {
+	db        *sql.DB
+	events    services.EventBusService
+	billing   Biller
+	community func() *config.Community
+	now       func() time.Time
+}
+
+func NewService(db *sql.DB, events services.EventBusService, billing Biller) *Service {
+	return &Service{
+		db:        db,
+		events:    events,
+		billing:   billing,
+		community: config.GetCurrent,
+		now:       time.Now,
+	}
+}
+
+// Price returns the price of a period of the plan in cents, from the
+// community's pricing. Tier "" is the standard membership; other tiers are
+// priced by the community's membership tiers.
+func (s *Service) Price(tier, plan string) (int, error) {
+	community := s.community()
+	monthly, yearly := community.Pricing.Monthly, community.Pricing.Yearly
+	if tier != "" {
+		t, ok := community.MembershipTierByID(tier)
+		if !ok {
+			return 0, fmt.Errorf("%w: tier %s", ErrUnknownPlan, tier)
+		}
+		monthly, yearly = t.Monthly, t.Yearly
+	}
+
+	var price int
+	switch plan {
+	case PlanMonthly:
+		price = monthly
+	case PlanYearly:
+		price = yearly
+	}
+	if price <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownPlan, plan)
+	}
+	return int(community.Price(price).Amount), nil
+}
+
+// CreateSubscription starts the payment for the first period of a
+// subscription to the plan of a membership tier. The membership starts once the payment
+// succeeds, and is renewed with the saved payment method at the end of
+// each period until it is cancelled. A member whose renewal was declined
+// pays for their membership again instead, in the same tier. A discount
+// is taken off the first payment only. It returns
+// payments.ErrRecurringNotSupported if the community's payment provider
+// cannot charge renewals.
+func (s *Service) CreateSubscription(userID int, tier, plan string, discount *payments.Discount) (*payments.Intent, error) {
+	price, err := s.Price(tier, plan)
+	if err != nil {
+		return nil, err
+	}
+
+	membershipID := 0
+	current, err := s.Current(userID)
+	switch {
+	case errors.Is(err, ErrMembershipNotFound):
+	case err != nil:
+		return nil, err
+	case current.Status == StatusPastDue && current.Tier == tier:
+		membershipID = current.ID
+	case current.Status == StatusPastDue:
+		return nil, ErrAlreadySubscribed
+	case current.AutoRenew:
+		return nil, ErrAlreadySubscribed
+	}
+
+	return s.billing.CreateSubscriptionPaymentIntent(userID, tier, plan, membershipID, int64(price), discount)
+}
+
+// Current returns the member's latest membership that has not expired,
+// or ErrMembershipNotFound
+func (s *Service) Current(userID int) (*models.Membership, error) {
+	m, err := scanMembership(s.db.QueryRow(selectMembership+`
+		WHERE user_id = ? AND status != ?
+		ORDER BY end_date DESC, id DESC LIMIT 1`, userID, StatusExpired))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMembershipNotFound
+	}
+	return m, err
+}
+
+// Get returns a membership by its ID
+func (s *Service) Get(membershipID int) (*models.Membership, error) {
+	m, err := scanMembership(s.db.QueryRow(selectMembership+` WHERE id = ?`, membershipID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMembershipNotFound
+	}
+	return m, err
+}
+
+// Queryer runs queries, as *sql.DB and *sql.Tx do
+type Queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Active returns the member's memberships that give them access at now:
+// those in the period they paid for and those in the grace period of a
+// declined renewal, but not paused ones. It takes a Queryer so bookings
+// can check membership inside their own transaction.
+func Active(q Queryer, userID int, now time.Time) ([]*models.Membership, error) {
+	return queryMemberships(q, selectMembership+`
+		WHERE user_id = ? AND active = true AND (end_date > ? OR (status = ? AND grace_until > ?))
+		ORDER BY end_date DESC, id DESC`, userID, now.UTC(), StatusPastDue, now.UTC())
+}
+
+// MembershipPaid starts the membership a payment was for, or renews it
+// for another period. Renewals paid after the membership expired start
+// the new period when they are paid.
+func (s *Service) MembershipPaid(paid payments.PaidMembership) error {
+	now := s.now()
+	if paid.MembershipID != 0 {
+		return s.renew(paid, now)
+	}
+
+	var tenantID int
+	if err := s.db.QueryRow(`SELECT tenant_id FROM users WHERE id = ?`, paid.UserID).Scan(&tenantID); err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	result, err := s.db.Exec(`
+		INSERT INTO memberships (user_id, tenant_id, type, tier, start_date, end_date, active, status, auto_renew,
+			amount, payment_id, customer_id, payment_method, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, true, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		paid.UserID, tenantID, paid.Plan, paid.Tier, now.UTC(), period(paid.Plan, now).UTC(), StatusActive, paid.Renew,
+		paid.Amount, paid.PaymentID, nullString(paid.CustomerID), nullString(paid.PaymentMethod), now.UTC(), now.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to create membership: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	s.publish(EventMembershipStarted, tenantID, paid.UserID, map[string]interface{}{
+		"membership_id": int(id),
+		"plan":          paid.Plan,
+		"tier":          paid.Tier,
+		"renews":        paid.Renew,
+	})
+	return nil
+}
+
+// EndRefunded ends the membership whose current period a refunded payment
+// paid for
+func (s *Service) EndRefunded(paymentID string) error {
+	now := s.now()
+	rows, err := s.db.Query(`SELECT id, user_id, tenant_id FROM memberships WHERE payment_id = ? AND status != ?`,
+		paymentID, StatusExpired)
+	if err != nil {
+		return err
+	}
+	type ending struct{ id, userID, tenantID int }
+	var ended []ending
+	for rows.Next() {
+		var e ending
+		if err := rows.Scan(&e.id, &e.userID, &e.tenantID); err != nil {
+			rows.Close()
+			return err
+		}
+		ended = append(ended, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range ended {
+		if err := s.expire(e.id, now); err != nil {
+			return err
+		}
+		s.publish(EventMembershipExpired, e.tenantID, e.userID, map[string]interface{}{
+			"membership_id": e.id,
+			"refunded":      true,
+		})
+	}
+	return nil
+}
+
+// Cancel stops a subscription from renewing. The member keeps access
+// until the end of the period they paid for, or loses it now if their
+// renewal was declined. Paused memberships are resumed first.
+func (s *Service) Cancel(membershipID int) error {
+	m, err := s.Get(membershipID)
+	if err != nil {
+		return err
+	}
+	if !m.AutoRenew {
+		return ErrNotRenewing
+	}
+
+	now := s.now()
+	if m.Status == StatusPaused {
+		if m, err = s.resume(m, now); err != nil {
+			return err
+		}
+	}
+
+	if m.Status == StatusPastDue {
+		if err := s.expire(m.ID, now); err != nil {
+			return err
+		}
+	} else {
+		_, err = s.db.Exec(`
+			UPDATE memberships SET status = ?, auto_renew = false, cancelled_at = ?, updated_at = ?
+			WHERE id = ?`, StatusCancelled, now.UTC(), now.UTC(), m.ID)
+		if err != nil {
+			return fmt.Errorf("failed to cancel membership: %w", err)
+		}
+	}
+
+	message := "Your membership has ended."
+	if m.Status != StatusPastDue {
+		message = fmt.Sprintf("Your membership will not renew. You keep access until %s.", m.EndDate.Format("Mon Jan 2 2006"))
+	}
+	data := map[string]interface{}{"membership_id": m.ID, "end_date": m.EndDate}
+	s.publish(EventMembershipCancelled, m.TenantID, m.UserID, data)
+	s.notify(m.UserID, &services.Notification{
+		Type:     EventMembershipCancelled,
+		Title:    "Your membership is cancelled",
+		Message:  message,
+		Data:     data,
+		Priority: 1,
+	})
+	return nil
+}
+
+// Pause freezes an active membership until the given time, as for an
+// injury or a holiday. The member has no access while it is paused, and
+// the paused time is added to the period, postponing the next renewal.
+// The community's pricing.subscriptions.max_pause_days limits how long
+// a pause can be.
+func (s *Service) Pause(membershipID int, until time.Time) error {
+	maxDays := s.community().Pricing.Subscriptions.MaxPauseDays
+	if maxDays <= 0 {
+		return ErrPauseNotAllowed
+	}
+
+	m, err := s.Get(membershipID)
+	if err != nil {
+		return err
+	}
+	if m.Status != StatusActive {
+		return ErrCannotPause
+	}
+
+	now := s.now()
+	switch {
+	case !until.After(now):
+		return ErrInvalidPause
+	case until.After(now.AddDate(0, 0, maxDays)):
+		return fmt.Errorf("%w: at most %d days", ErrPauseTooLong, maxDays)
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE memberships SET status = ?, active = false, paused_at = ?, paused_until = ?, updated_at = ?
+		WHERE id = ? AND status = ?`, StatusPaused, now.UTC(), until.UTC(), now.UTC(), m.ID, StatusActive)
+	if err != nil {
+		return fmt.Errorf("failed to pause membership: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrCannotPause
+	}
+
+	s.publish(EventMembershipPaused, m.TenantID, m.UserID, map[string]interface{}{
+		"membership_id": m.ID,
+		"paused_until":  until,
+	})
+	return nil
+}
+
+// Resume ends a pause early. The time the membership was paused is added
+// to its period.
+func (s *Service) Resume(membershipID int) error {
+	m, err := s.Get(membershipID)
+	if err != nil {
+		return err
+	}
+	if m.Status != StatusPaused {
+		return ErrNotPaused
+	}
+	_, err = s.resume(m, s.now())
+	return err
+}
+
+// renew extends a membership by a period once its renewal is paid
+func (s *Service) renew(paid payments.PaidMembership, now time.Time) error {
+	m, err := s.Get(paid.MembershipID)
+	if err != nil {
+		return err
+	}
+
+	// Members who lost access start the new period now
+	from := m.EndDate
+	if !m.Active {
+		from = now
+	}
+	end := period(paid.Plan, from)
+
+	_, err = s.db.Exec(`
+		UPDATE memberships SET type = ?, end_date = ?, active = true, status = ?, auto_renew = auto_renew OR ?,
+			amount = ?, payment_id = ?, customer_id = COALESCE(?, customer_id),
+			payment_method = COALESCE(?, payment_method), failed_attempts = 0, next_attempt = NULL,
+			grace_until = NULL, cancelled_at = NULL, updated_at = ?
+		WHERE id = ?`,
+		paid.Plan, end.UTC(), StatusActive, paid.Renew, paid.Amount, paid.PaymentID,
+		nullString(paid.CustomerID), nullString(paid.PaymentMethod), now.UTC(), m.ID)
+	if err != nil {
+		return fmt.Errorf("failed to renew membership: %w", err)
+	}
+
+	s.publish(EventMembershipRenewed, m.TenantID, m.UserID, map[string]interface{}{
+		"membership_id": m.ID,
+		"plan":          paid.Plan,
+		"end_date":      end,
+	})
+	return nil
+}
+
+// resume ends a pause at the given time, adding the time paused to the
+// membership's period
+func (s *Service) resume(m *models.Membership, at time.Time) (*models.Membership, error) {
+	end := m.EndDate
+	if m.PausedAt != nil && at.After(*m.PausedAt) {
+		end = end.Add(at.Sub(*m.PausedAt))
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE memberships SET status = ?, active = true, end_date = ?, paused_at = NULL, paused_until = NULL,
+			updated_at = ?
+		WHERE id = ? AND status = ?`, StatusActive, end.UTC(), s.now().UTC(), m.ID, StatusPaused)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resume membership: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, ErrNotPaused
+	}
+
+	s.publish(EventMembershipResumed, m.TenantID, m.UserID, map[string]interface{}{
+		"membership_id": m.ID,
+		"end_date":      end,
+	})
+
+	resumed := *m
+	resumed.Status = StatusActive
+	resumed.Active = true
+	resumed.EndDate = end
+	resumed.PausedAt, resumed.PausedUntil = nil, nil
+	return &resumed, nil
+}
+
+// expire ends a membership now
+func (s *Service) expire(membershipID int, now time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE memberships SET status = ?, active = false, auto_renew = false, end_date = MIN(end_date, ?),
+			next_attempt = NULL, updated_at = ?
+		WHERE id = ?`, StatusExpired, now.UTC(), now.UTC(), membershipID)
+	if err != nil {
+		return fmt.Errorf("failed to end membership: %w", err)
+	}
+	return nil
+}
+
+// period returns the end of a period of the plan starting at from.
+// Memberships bought before plans were recorded are monthly. Periods
+// starting late in a month end on the last day of shorter months, so a
+// membership started on January 31st renews on February 28th.
+func period(plan string, from time.Time) time.Time {
+	months := 1
+	if plan == PlanYearly {
+		months = 12
+	}
+	end := from.AddDate(0, months, 0)
+	if end.Day() != from.Day() {
+		// Went past the end of the month; step back to its last day
+		end = end.AddDate(0, 0, -end.Day())
+	}
+	return end
+}
+
+const selectMembership = `
+	SELECT id, user_id, tenant_id, type, tier, start_date, end_date, active, status, auto_renew, amount,
+		COALESCE(payment_id, ''), COALESCE(payment_method, ''), failed_attempts, next_attempt, grace_until,
+		paused_at, paused_until, cancelled_at, created_at, updated_at
+	FROM memberships`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMembership(row scanner) (*models.Membership, error) {
+	var m models.Membership
+	var nextAttempt, graceUntil, pausedAt, pausedUntil, cancelledAt sql.NullTime
+	err := row.Scan(&m.ID, &m.UserID, &m.TenantID, &m.Type, &m.Tier, &m.StartDate, &m.EndDate, &m.Active, &m.Status,
+		&m.AutoRenew, &m.Amount, &m.PaymentID, &m.PaymentMethod, &m.FailedAttempts, &nextAttempt, &graceUntil,
+		&pausedAt, &pausedUntil, &cancelledAt, &m.CreatedAt, &m.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	m.NextAttempt = nullTime(nextAttempt)
+	m.GraceUntil = nullTime(graceUntil)
+	m.PausedAt = nullTime(pausedAt)
+	m.PausedUntil = nullTime(pausedUntil)
+	m.CancelledAt = nullTime(cancelledAt)
+	return &m, nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// publish dispatches an event from the memberships service; see services.Publish
+func (s *Service) publish(eventType string, tenantID, userID int, data map[string]interface{}) {
+	services.Publish(s.events, "memberships", eventType, tenantID, userID, data)
+}
+
+func (s *Service) notify(userID int, notification *services.Notification) {
+	services.Notify(s.events, userID, notification)
+}
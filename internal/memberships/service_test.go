@@ -0,0 +1,391 @@
+package memberships
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/database"
+	"samskipnad/internal/payments"
+	"samskipnad/internal/services"
+)
+
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// recordingBus captures published events and notifications
+type recordingBus struct {
+	services.EventBusService
+	events        []*services.Event
+	notifications map[int][]*services.Notification
+}
+
+func (b *recordingBus) Publish(ctx context.Context, event *services.Event) error {
+	b.events = append(b.events, event)
+	return nil
+}
+
+func (b *recordingBus) SendNotification(ctx context.Context, userID int, notification *services.Notification) error {
+	b.notifications[userID] = append(b.notifications[userID], notification)
+	return nil
+}
+
+func (b *recordingBus) published(eventType string) int {
+	n := 0
+	for _, e := range b.events {
+		if e.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+// fakeBiller stands in for payments.Service: renewals are charged straight
+// away, and succeed unless declines or failures are left. Failures leave
+// the outcome of the charge unknown.
+type fakeBiller struct {
+	service  *Service
+	declines int
+	failures int
+	started  []startedPayment
+	charged  []int
+	keys     []string
+}
+
+type startedPayment struct {
+	userID       int
+	tier         string
+	plan         string
+	membershipID int
+	amount       int64
+}
+
+func (b *fakeBiller) CreateSubscriptionPaymentIntent(userID int, tier, plan string, membershipID int, amount int64, discount *payments.Discount) (*payments.Intent, error) {
+	b.started = append(b.started, startedPayment{userID, tier, plan, membershipID, amount})
+	return &payments.Intent{
+		ID:     fmt.Sprintf("pi_%d", len(b.started)),
+		Status: payments.StatusRequiresPaymentMethod,
+		Amount: int(amount),
+	}, nil
+}
+
+func (b *fakeBiller) ChargeRenewal(userID, membershipID int, plan string, amount int, paymentMethod, idempotencyKey string) (*payments.Intent, error) {
+	b.keys = append(b.keys, idempotencyKey)
+	if b.failures > 0 {
+		b.failures--
+		return nil, errors.New("connection reset")
+	}
+	b.charged = append(b.charged, membershipID)
+	id := fmt.Sprintf("pi_renewal_%d", len(b.charged))
+	if b.declines > 0 {
+		b.declines--
+		return &payments.Intent{ID: id, Status: payments.StatusRequiresPaymentMethod, FailureMessage: "Your card was declined."}, nil
+	}
+	err := b.service.MembershipPaid(payments.PaidMembership{
+		UserID:       userID,
+		Plan:         plan,
+		PaymentID:    id,
+		Amount:       amount,
+		MembershipID: membershipID,
+		Renew:        true,
+	})
+	return &payments.Intent{ID: id, Status: payments.StatusSucceeded}, err
+}
+
+type testEnv struct {
+	db        *sql.DB
+	events    *recordingBus
+	billing   *fakeBiller
+	community *config.Community
+	service   *Service
+	now       time.Time
+	userID    int
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := setupTestDB(t)
+	env := &testEnv{
+		db:        db,
+		events:    &recordingBus{notifications: make(map[int][]*services.Notification)},
+		billing:   &fakeBiller{},
+		community: &config.Community{},
+		now:       time.Date(2025, 1, 31, 9, 0, 0, 0, time.UTC),
+	}
+	env.community.Pricing.Currency = "NOK"
+	env.community.Pricing.Monthly = 599
+	env.community.Pricing.Yearly = 5990
+	env.community.Pricing.Subscriptions.GraceDays = 7
+	env.community.Pricing.Subscriptions.RetryDays = []int{1, 3}
+	env.community.Pricing.Subscriptions.MaxPauseDays = 30
+	env.community.Pricing.MembershipTiers = []config.MembershipTier{
+		{ID: "weekday", Name: "Weekday", Monthly: 399, Categories: []string{"all_levels"}},
+	}
+
+	env.service = NewService(db, env.events, env.billing)
+	env.service.community = func() *config.Community { return env.community }
+	env.service.now = func() time.Time { return env.now }
+	env.billing.service = env.service
+
+	result, err := db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, tenant_id)
+		VALUES ('kari@example.com', 'x', 'Kari', 'Nordmann', 1)`)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	env.userID = int(id)
+	return env
+}
+
+// subscribe starts a subscription to the plan and pays for it
+func (env *testEnv) subscribe(t *testing.T, plan string) *testMembership {
+	pi, err := env.service.CreateSubscription(env.userID, "", plan, nil)
+	require.NoError(t, err)
+	require.NoError(t, env.service.MembershipPaid(payments.PaidMembership{
+		UserID:        env.userID,
+		Plan:          plan,
+		PaymentID:     pi.ID,
+		Amount:        pi.Amount,
+		Renew:         true,
+		CustomerID:    "cus_1",
+		PaymentMethod: "pm_1",
+	}))
+	return env.current(t)
+}
+
+type testMembership struct {
+	id     int
+	status string
+	active bool
+	end    time.Time
+}
+
+func (env *testEnv) current(t *testing.T) *testMembership {
+	m, err := env.service.Current(env.userID)
+	require.NoError(t, err)
+	return &testMembership{id: m.ID, status: m.Status, active: m.Active, end: m.EndDate}
+}
+
+func (env *testEnv) membership(t *testing.T, id int) *testMembership {
+	m, err := env.service.Get(id)
+	require.NoError(t, err)
+	return &testMembership{id: m.ID, status: m.Status, active: m.Active, end: m.EndDate}
+}
+
+func TestCreateSubscription(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.service.CreateSubscription(env.userID, "", "weekly", nil)
+	assert.ErrorIs(t, err, ErrUnknownPlan)
+	_, err = env.service.Current(env.userID)
+	assert.ErrorIs(t, err, ErrMembershipNotFound)
+
+	m := env.subscribe(t, PlanMonthly)
+	require.Len(t, env.billing.started, 1)
+	assert.Equal(t, int64(59900), env.billing.started[0].amount, "billed from the monthly price")
+	assert.Zero(t, env.billing.started[0].membershipID)
+	assert.Equal(t, StatusActive, m.status)
+	assert.True(t, m.active)
+	assert.True(t, m.end.Equal(time.Date(2025, 2, 28, 9, 0, 0, 0, time.UTC)), "the end of next month: %s", m.end)
+	assert.Equal(t, 1, env.events.published(EventMembershipStarted))
+
+	_, err = env.service.CreateSubscription(env.userID, "", PlanYearly, nil)
+	assert.ErrorIs(t, err, ErrAlreadySubscribed)
+
+	membership, err := env.service.Get(m.id)
+	require.NoError(t, err)
+	assert.True(t, membership.AutoRenew)
+	assert.Equal(t, 59900, membership.Amount)
+	assert.Equal(t, "pm_1", membership.PaymentMethod)
+}
+
+func TestMembershipTier(t *testing.T) {
+	env := newTestEnv(t)
+
+	_, err := env.service.CreateSubscription(env.userID, "weekday", PlanYearly, nil)
+	assert.ErrorIs(t, err, ErrUnknownPlan, "the tier is not sold yearly")
+	_, err = env.service.CreateSubscription(env.userID, "weekend", PlanMonthly, nil)
+	assert.ErrorIs(t, err, ErrUnknownPlan)
+
+	pi, err := env.service.CreateSubscription(env.userID, "weekday", PlanMonthly, nil)
+	require.NoError(t, err)
+	require.Len(t, env.billing.started, 1)
+	assert.Equal(t, "weekday", env.billing.started[0].tier)
+	assert.Equal(t, int64(39900), env.billing.started[0].amount, "billed from the tier's price")
+
+	require.NoError(t, env.service.MembershipPaid(payments.PaidMembership{
+		UserID: env.userID, Plan: PlanMonthly, Tier: "weekday", PaymentID: pi.ID, Amount: pi.Amount, Renew: true,
+	}))
+	membership, err := env.service.Current(env.userID)
+	require.NoError(t, err)
+	assert.Equal(t, "weekday", membership.Tier)
+}
+
+func TestActive(t *testing.T) {
+	env := newTestEnv(t)
+	active, err := Active(env.db, env.userID, env.now)
+	require.NoError(t, err)
+	assert.Empty(t, active)
+
+	m := env.subscribe(t, PlanMonthly)
+	active, err = Active(env.db, env.userID, env.now)
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	assert.Equal(t, m.id, active[0].ID)
+
+	env.billing.declines = 1
+	env.now = m.end.Add(time.Hour)
+	_, err = env.service.RenewDue()
+	require.NoError(t, err)
+	active, err = Active(env.db, env.userID, env.now)
+	require.NoError(t, err)
+	assert.Len(t, active, 1, "in the grace period")
+	active, err = Active(env.db, env.userID, m.end.AddDate(0, 0, 8))
+	require.NoError(t, err)
+	assert.Empty(t, active, "the grace period is over")
+
+	t.Run("Paused", func(t *testing.T) {
+		env := newTestEnv(t)
+		m := env.subscribe(t, PlanMonthly)
+		require.NoError(t, env.service.Pause(m.id, env.now.AddDate(0, 0, 7)))
+		active, err := Active(env.db, env.userID, env.now)
+		require.NoError(t, err)
+		assert.Empty(t, active)
+	})
+}
+
+func TestOneOffMembership(t *testing.T) {
+	env := newTestEnv(t)
+	require.NoError(t, env.service.MembershipPaid(payments.PaidMembership{
+		UserID: env.userID, Plan: PlanYearly, PaymentID: "pi_1", Amount: 599000,
+	}))
+	m := env.current(t)
+	assert.True(t, m.end.Equal(env.now.AddDate(1, 0, 0)))
+
+	assert.ErrorIs(t, env.service.Cancel(m.id), ErrNotRenewing)
+
+	env.now = m.end.Add(time.Minute)
+	renewed, err := env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Zero(t, renewed)
+	assert.Empty(t, env.billing.charged, "memberships bought once are not renewed")
+
+	expired, err := env.service.ExpireMemberships()
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	m = env.membership(t, m.id)
+	assert.Equal(t, StatusExpired, m.status)
+	assert.False(t, m.active)
+	assert.Len(t, env.events.notifications[env.userID], 1)
+
+	_, err = env.service.Current(env.userID)
+	assert.ErrorIs(t, err, ErrMembershipNotFound)
+}
+
+func TestCancelSubscription(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+
+	require.NoError(t, env.service.Cancel(m.id))
+	cancelled := env.membership(t, m.id)
+	assert.Equal(t, StatusCancelled, cancelled.status)
+	assert.True(t, cancelled.active, "the member keeps the period they paid for")
+	assert.Len(t, env.events.notifications[env.userID], 1)
+	assert.ErrorIs(t, env.service.Cancel(m.id), ErrNotRenewing)
+
+	env.now = m.end.Add(time.Hour)
+	_, err := env.service.RenewDue()
+	require.NoError(t, err)
+	assert.Empty(t, env.billing.charged)
+	_, err = env.service.ExpireMemberships()
+	require.NoError(t, err)
+	assert.False(t, env.membership(t, m.id).active)
+
+	t.Run("PastDue", func(t *testing.T) {
+		env := newTestEnv(t)
+		m := env.subscribe(t, PlanMonthly)
+		env.billing.declines = 1
+		env.now = m.end.Add(time.Hour)
+		_, err := env.service.RenewDue()
+		require.NoError(t, err)
+		assert.True(t, env.membership(t, m.id).active, "in the grace period")
+
+		require.NoError(t, env.service.Cancel(m.id))
+		ended := env.membership(t, m.id)
+		assert.Equal(t, StatusExpired, ended.status)
+		assert.False(t, ended.active, "the unpaid period is not kept")
+	})
+}
+
+func TestPauseMembership(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+
+	assert.ErrorIs(t, env.service.Pause(m.id, env.now.AddDate(0, 0, 31)), ErrPauseTooLong)
+	assert.ErrorIs(t, env.service.Pause(m.id, env.now.Add(-time.Hour)), ErrInvalidPause)
+	assert.ErrorIs(t, env.service.Resume(m.id), ErrNotPaused)
+
+	require.NoError(t, env.service.Pause(m.id, env.now.AddDate(0, 0, 14)))
+	paused := env.membership(t, m.id)
+	assert.Equal(t, StatusPaused, paused.status)
+	assert.False(t, paused.active, "no access while paused")
+	assert.ErrorIs(t, env.service.Pause(m.id, env.now.AddDate(0, 0, 7)), ErrCannotPause)
+
+	env.now = env.now.AddDate(0, 0, 15)
+	resumed, err := env.service.ResumePaused()
+	require.NoError(t, err)
+	assert.Equal(t, 1, resumed)
+	m2 := env.membership(t, m.id)
+	assert.Equal(t, StatusActive, m2.status)
+	assert.True(t, m2.active)
+	assert.True(t, m2.end.Equal(m.end.AddDate(0, 0, 14)), "the 14 days paused are added: %s", m2.end)
+
+	t.Run("ResumedEarly", func(t *testing.T) {
+		env := newTestEnv(t)
+		m := env.subscribe(t, PlanMonthly)
+		require.NoError(t, env.service.Pause(m.id, env.now.AddDate(0, 0, 14)))
+		env.now = env.now.AddDate(0, 0, 3)
+		require.NoError(t, env.service.Resume(m.id))
+		assert.True(t, env.membership(t, m.id).end.Equal(m.end.AddDate(0, 0, 3)))
+	})
+
+	t.Run("NotAllowed", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.community.Pricing.Subscriptions.MaxPauseDays = 0
+		m := env.subscribe(t, PlanMonthly)
+		assert.ErrorIs(t, env.service.Pause(m.id, env.now.AddDate(0, 0, 7)), ErrPauseNotAllowed)
+	})
+}
+
+func TestEndRefunded(t *testing.T) {
+	env := newTestEnv(t)
+	m := env.subscribe(t, PlanMonthly)
+
+	env.now = m.end.Add(time.Hour)
+	_, err := env.service.RenewDue()
+	require.NoError(t, err)
+	renewal := env.membership(t, m.id)
+	require.True(t, renewal.active)
+
+	require.NoError(t, env.service.EndRefunded("pi_1"), "the first period was refunded")
+	assert.True(t, env.membership(t, m.id).active, "the renewed period is paid for")
+
+	require.NoError(t, env.service.EndRefunded("pi_renewal_1"))
+	ended := env.membership(t, m.id)
+	assert.Equal(t, StatusExpired, ended.status)
+	assert.False(t, ended.active)
+	assert.True(t, ended.end.Equal(env.now))
+}
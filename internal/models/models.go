@@ -33,20 +33,52 @@ type Tenant struct {
 
 // Class represents a yoga class or event
 type Class struct {
-	ID                 int       `json:"id" db:"id"`
-	TenantID           int       `json:"tenant_id" db:"tenant_id"`
-	Name               string    `json:"name" db:"name"`
-	Description        string    `json:"description" db:"description"`
-	InstructorID       int       `json:"instructor_id" db:"instructor_id"`
-	StartTime          time.Time `json:"start_time" db:"start_time"`
-	EndTime            time.Time `json:"end_time" db:"end_time"`
-	MaxCapacity        int       `json:"max_capacity" db:"max_capacity"`
-	Price              int       `json:"price" db:"price"` // in cents
-	RequiresTicket     bool      `json:"requires_ticket" db:"requires_ticket"`
-	RequiresMembership bool      `json:"requires_membership" db:"requires_membership"`
-	Active             bool      `json:"active" db:"active"`
-	CreatedAt          time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt          time.Time `json:"updated_at" db:"updated_at"`
+	ID                 int        `json:"id" db:"id"`
+	TenantID           int        `json:"tenant_id" db:"tenant_id"`
+	Name               string     `json:"name" db:"name"`
+	Description        string     `json:"description" db:"description"`
+	InstructorID       int        `json:"instructor_id" db:"instructor_id"`
+	StartTime          time.Time  `json:"start_time" db:"start_time"`
+	EndTime            time.Time  `json:"end_time" db:"end_time"`
+	MaxCapacity        int        `json:"max_capacity" db:"max_capacity"`
+	Price              int        `json:"price" db:"price"` // in cents
+	RequiresTicket     bool       `json:"requires_ticket" db:"requires_ticket"`
+	RequiresMembership bool       `json:"requires_membership" db:"requires_membership"`
+	Active             bool       `json:"active" db:"active"`
+	CategoryID         string     `json:"category_id,omitempty" db:"category_id"`             // Klippekort category whose klipp pay for the class
+	ResourceID         *int       `json:"resource_id,omitempty" db:"resource_id"`             // Room or equipment the class uses
+	InductionFor       *int       `json:"induction_for,omitempty" db:"induction_resource_id"` // Equipment members are inducted on by attending
+	SeriesID           *int       `json:"series_id,omitempty" db:"series_id"`                 // Set when materialised from a ClassSeries
+	OccurrenceStart    *time.Time `json:"occurrence_start,omitempty" db:"occurrence_start"`   // Original start within the series
+	ICalUID            string     `json:"ical_uid,omitempty" db:"ical_uid"`                   // Key of the calendar event the class was imported from
+	ICalSource         string     `json:"ical_source,omitempty" db:"ical_source"`             // Calendar file or URL the class was imported from
+	CreatedAt          time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// ClassSeries represents a recurring class schedule that materialises
+// individual Class rows ahead of time
+type ClassSeries struct {
+	ID                 int        `json:"id" db:"id"`
+	TenantID           int        `json:"tenant_id" db:"tenant_id"`
+	Name               string     `json:"name" db:"name"`
+	Description        string     `json:"description" db:"description"`
+	InstructorID       int        `json:"instructor_id" db:"instructor_id"`
+	DTStart            time.Time  `json:"dtstart" db:"dtstart"`
+	Timezone           string     `json:"timezone" db:"timezone"` // IANA zone the rule is expanded in
+	DurationMinutes    int        `json:"duration_minutes" db:"duration_minutes"`
+	RRule              string     `json:"rrule" db:"rrule"` // RFC 5545 RRULE subset
+	MaxCapacity        int        `json:"max_capacity" db:"max_capacity"`
+	Price              int        `json:"price" db:"price"` // in cents
+	RequiresTicket     bool       `json:"requires_ticket" db:"requires_ticket"`
+	RequiresMembership bool       `json:"requires_membership" db:"requires_membership"`
+	CategoryID         string     `json:"category_id,omitempty" db:"category_id"`             // Klippekort category of the classes
+	ResourceID         *int       `json:"resource_id,omitempty" db:"resource_id"`             // Room or equipment the classes use
+	InductionFor       *int       `json:"induction_for,omitempty" db:"induction_resource_id"` // Equipment members are inducted on by attending
+	MaterialisedUntil  *time.Time `json:"materialised_until" db:"materialised_until"`
+	Active             bool       `json:"active" db:"active"`
+	CreatedAt          time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at" db:"updated_at"`
 }
 
 // Booking represents a user's booking for a class
@@ -58,20 +90,88 @@ type Booking struct {
 	PaymentID string    `json:"payment_id" db:"payment_id"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+
+	KlippekortID     *int       `json:"klippekort_id,omitempty" db:"klippekort_id"` // Card the booking was paid from
+	TicketID         *int       `json:"ticket_id,omitempty" db:"ticket_id"`         // Ticket the booking used
+	CancelledAt      *time.Time `json:"cancelled_at,omitempty" db:"cancelled_at"`
+	LateCancellation bool       `json:"late_cancellation" db:"late_cancellation"`
+	NoShow           bool       `json:"no_show" db:"no_show"`
+	CheckedInAt      *time.Time `json:"checked_in_at,omitempty" db:"checked_in_at"`
+
+	Class *Class `json:"class,omitempty" db:"-"` // Loaded for display
 }
 
-// Membership represents a user's membership
+// Resource represents a room or piece of equipment that classes and
+// member reservations are scheduled into
+type Resource struct {
+	ID                int       `json:"id" db:"id"`
+	TenantID          int       `json:"tenant_id" db:"tenant_id"`
+	Name              string    `json:"name" db:"name"`
+	Kind              string    `json:"kind" db:"kind"` // room, equipment
+	Description       string    `json:"description" db:"description"`
+	Reservable        bool      `json:"reservable" db:"reservable"`                 // Members can reserve it outside classes
+	RequiresInduction bool      `json:"requires_induction" db:"requires_induction"` // Members must be inducted before reserving
+	MaxSlotMinutes    int       `json:"max_slot_minutes" db:"max_slot_minutes"`     // Longest reservation a member can make, 0 for no limit
+	CategoryID        string    `json:"category_id,omitempty" db:"category_id"`     // Klippekort category charged one klipp per reservation
+	Active            bool      `json:"active" db:"active"`
+	CreatedAt         time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// ResourceReservation represents a member reserving a resource for a
+// period of time
+type ResourceReservation struct {
+	ID           int        `json:"id" db:"id"`
+	ResourceID   int        `json:"resource_id" db:"resource_id"`
+	UserID       int        `json:"user_id" db:"user_id"`
+	TenantID     int        `json:"tenant_id" db:"tenant_id"`
+	StartTime    time.Time  `json:"start_time" db:"start_time"`
+	EndTime      time.Time  `json:"end_time" db:"end_time"`
+	Note         string     `json:"note" db:"note"`
+	KlippekortID *int       `json:"klippekort_id,omitempty" db:"klippekort_id"` // Card charged for the reservation
+	CancelledAt  *time.Time `json:"cancelled_at,omitempty" db:"cancelled_at"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+
+	Resource *Resource `json:"resource,omitempty" db:"-"` // Loaded for display
+}
+
+// ResourceInduction records that a member has been trained on a piece of
+// equipment, either by attending an induction class or by an admin
+type ResourceInduction struct {
+	ID          int       `json:"id" db:"id"`
+	ResourceID  int       `json:"resource_id" db:"resource_id"`
+	UserID      int       `json:"user_id" db:"user_id"`
+	ClassID     *int      `json:"class_id,omitempty" db:"class_id"`     // Induction class the member attended
+	GrantedBy   *int      `json:"granted_by,omitempty" db:"granted_by"` // Admin who recorded it by hand
+	CompletedAt time.Time `json:"completed_at" db:"completed_at"`
+
+	UserName string `json:"user_name,omitempty" db:"-"` // Loaded for display
+}
+
+// Membership represents a user's membership. Subscriptions renew at the
+// end of each period; other memberships end with their period.
 type Membership struct {
-	ID        int       `json:"id" db:"id"`
-	UserID    int       `json:"user_id" db:"user_id"`
-	TenantID  int       `json:"tenant_id" db:"tenant_id"`
-	Type      string    `json:"type" db:"type"` // monthly, yearly, unlimited
-	StartDate time.Time `json:"start_date" db:"start_date"`
-	EndDate   time.Time `json:"end_date" db:"end_date"`
-	Active    bool      `json:"active" db:"active"`
-	PaymentID string    `json:"payment_id" db:"payment_id"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ID             int        `json:"id" db:"id"`
+	UserID         int        `json:"user_id" db:"user_id"`
+	TenantID       int        `json:"tenant_id" db:"tenant_id"`
+	Type           string     `json:"type" db:"type"` // monthly, yearly, unlimited
+	Tier           string     `json:"tier" db:"tier"` // Membership tier from config; empty for the standard membership
+	StartDate      time.Time  `json:"start_date" db:"start_date"`
+	EndDate        time.Time  `json:"end_date" db:"end_date"` // End of the paid period
+	Active         bool       `json:"active" db:"active"`     // Whether the member has access now
+	Status         string     `json:"status" db:"status"`     // active, past_due, paused, cancelled, expired
+	AutoRenew      bool       `json:"auto_renew" db:"auto_renew"`
+	Amount         int        `json:"amount" db:"amount"` // Price of a period in cents
+	PaymentID      string     `json:"payment_id" db:"payment_id"`
+	PaymentMethod  string     `json:"-" db:"payment_method"` // Saved with the provider for renewals
+	FailedAttempts int        `json:"failed_attempts" db:"failed_attempts"`
+	NextAttempt    *time.Time `json:"next_attempt,omitempty" db:"next_attempt"` // When a failed renewal is tried again
+	GraceUntil     *time.Time `json:"grace_until,omitempty" db:"grace_until"`   // Access ends then unless a renewal succeeds
+	PausedAt       *time.Time `json:"paused_at,omitempty" db:"paused_at"`
+	PausedUntil    *time.Time `json:"paused_until,omitempty" db:"paused_until"`
+	CancelledAt    *time.Time `json:"cancelled_at,omitempty" db:"cancelled_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
 }
 
 // Klippekort represents a user's klippekort credits
@@ -103,17 +203,78 @@ type Ticket struct {
 
 // Payment represents a payment transaction
 type Payment struct {
-	ID          string    `json:"id" db:"id"` // Stripe payment intent ID
-	UserID      int       `json:"user_id" db:"user_id"`
-	TenantID    int       `json:"tenant_id" db:"tenant_id"`
-	Amount      int       `json:"amount" db:"amount"` // in cents
-	Currency    string    `json:"currency" db:"currency"`
-	Status      string    `json:"status" db:"status"`
-	PaymentType string    `json:"payment_type" db:"payment_type"` // class, membership, ticket
-	ReferenceID int       `json:"reference_id" db:"reference_id"` // ID of class, membership, or ticket
-	StripeData  string    `json:"stripe_data" db:"stripe_data"`   // JSON data from Stripe
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	ID             string            `json:"id" db:"id"`             // The provider's payment intent ID or reference
+	Provider       string            `json:"provider" db:"provider"` // Provider the payment was taken with
+	UserID         int               `json:"user_id" db:"user_id"`
+	TenantID       int               `json:"tenant_id" db:"tenant_id"`
+	Amount         int               `json:"amount" db:"amount"` // in cents
+	Currency       string            `json:"currency" db:"currency"`
+	Status         string            `json:"status" db:"status"`
+	PaymentType    string            `json:"payment_type" db:"payment_type"`       // class, membership, ticket
+	ReferenceID    int               `json:"reference_id" db:"reference_id"`       // ID of class, membership, or ticket
+	StripeData     string            `json:"stripe_data" db:"stripe_data"`         // JSON data from Stripe
+	Metadata       map[string]string `json:"metadata" db:"metadata"`               // What was bought, stored as JSON
+	RefundedAmount int               `json:"refunded_amount" db:"refunded_amount"` // in cents
+	DiscountCodeID *int              `json:"discount_code_id,omitempty" db:"discount_code_id"`
+	DiscountAmount int               `json:"discount_amount" db:"discount_amount"` // Taken off the price, in cents; Amount is what was charged
+	CreatedAt      time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// DiscountCode is a code members enter at checkout to pay less, as for an
+// introductory offer. It takes either a percentage or a fixed amount off
+// the price.
+type DiscountCode struct {
+	ID             int        `json:"id" db:"id"`
+	TenantID       int        `json:"tenant_id" db:"tenant_id"`
+	Code           string     `json:"code" db:"code"` // Upper case; members may enter it in any case
+	Description    string     `json:"description" db:"description"`
+	PercentOff     int        `json:"percent_off" db:"percent_off"`
+	AmountOff      int        `json:"amount_off" db:"amount_off"` // in cents
+	ValidFrom      *time.Time `json:"valid_from,omitempty" db:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until,omitempty" db:"valid_until"`
+	MaxUses        int        `json:"max_uses" db:"max_uses"`                   // 0 for no limit
+	MaxUsesPerUser int        `json:"max_uses_per_user" db:"max_uses_per_user"` // 0 for no limit
+	Products       []string   `json:"products" db:"products"`                   // class, klippekort, membership; empty for all
+	Categories     []string   `json:"categories" db:"categories"`               // Klippekort categories of the classes and cards it is for; empty for all
+	Tiers          []string   `json:"tiers" db:"tiers"`                         // Membership tiers it is for, "standard" for the standard membership; empty for all
+	Active         bool       `json:"active" db:"active"`
+	Uses           int        `json:"uses" db:"-"` // Payments that have succeeded with the code
+	CreatedBy      *int       `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Invoice is the receipt issued for a payment. What it shows is fixed when
+// it is issued, so it reads the same after prices or the community's
+// details change.
+type Invoice struct {
+	ID                 int           `json:"id" db:"id"`
+	TenantID           int           `json:"tenant_id" db:"tenant_id"`
+	UserID             int           `json:"user_id" db:"user_id"`
+	PaymentID          string        `json:"payment_id" db:"payment_id"`
+	Number             int           `json:"number" db:"number"` // Sequential per tenant
+	IssuedAt           time.Time     `json:"issued_at" db:"issued_at"`
+	Currency           string        `json:"currency" db:"currency"`
+	Total              int           `json:"total" db:"total"` // in cents, VAT included
+	VAT                int           `json:"vat" db:"vat"`     // in cents
+	Lines              []InvoiceLine `json:"lines" db:"lines"` // Stored as JSON
+	SellerName         string        `json:"seller_name" db:"seller_name"`
+	OrganisationNumber string        `json:"organisation_number" db:"organisation_number"`
+	VATRegistered      bool          `json:"vat_registered" db:"vat_registered"`
+	SellerAddress      string        `json:"seller_address" db:"seller_address"`
+	BuyerName          string        `json:"buyer_name" db:"buyer_name"`
+	BuyerEmail         string        `json:"buyer_email" db:"buyer_email"`
+	EmailedAt          *time.Time    `json:"emailed_at,omitempty" db:"emailed_at"`
+	CreatedAt          time.Time     `json:"created_at" db:"created_at"`
+}
+
+// InvoiceLine is one product on an invoice
+type InvoiceLine struct {
+	Description string `json:"description"`
+	ProductType string `json:"product_type"` // class, membership, klippekort
+	Amount      int    `json:"amount"`       // in cents, VAT included
+	VATRate     int    `json:"vat_rate"`     // Percent
+	VAT         int    `json:"vat"`          // in cents
 }
 
 // Role represents a role in the system
@@ -0,0 +1,191 @@
+// Package money represents amounts of money in the minor unit of their
+// currency, such as øre or cents, and formats them for a locale
+package money
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Money is an amount in the minor unit of an ISO 4217 currency
+type Money struct {
+	Amount   int64  // In the currency's minor unit, such as øre
+	Currency string // ISO 4217 code, such as NOK
+}
+
+// New returns an amount given in the currency's minor unit
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// FromMajor returns an amount given in whole units of the currency, such
+// as kroner, as prices are written in community configuration
+func FromMajor(amount int64, currency string) Money {
+	m := New(amount, currency)
+	for i := 0; i < MinorUnits(m.Currency); i++ {
+		m.Amount *= 10
+	}
+	return m
+}
+
+// Parse reads an amount written in whole units of the currency, as
+// entered in forms: "150", "149.50" and "1 349,50" are all accepted
+func Parse(value, currency string) (Money, error) {
+	value = strings.NewReplacer(" ", "", "\u00a0", "").Replace(strings.TrimSpace(value))
+	whole, fraction := value, ""
+	if i := strings.LastIndexAny(value, ".,"); i >= 0 {
+		whole, fraction = value[:i], value[i+1:]
+	}
+	units := MinorUnits(currency)
+	if whole == "" || len(fraction) > units || strings.ContainsAny(whole, ".,") {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+	fraction += strings.Repeat("0", units-len(fraction))
+
+	amount, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || strings.HasPrefix(whole, "-") || strings.HasPrefix(whole, "+") {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+	return New(amount, currency), nil
+}
+
+// minorUnits lists the ISO 4217 currencies that do not have two decimals
+var minorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// MinorUnits returns the number of decimals of the currency, as ISO 4217
+// defines them: 2 for NOK and USD, 0 for JPY and ISK. Unknown currencies
+// are taken to have 2.
+func MinorUnits(currency string) int {
+	if units, ok := minorUnits[strings.ToUpper(currency)]; ok {
+		return units
+	}
+	return 2
+}
+
+// symbol is how a currency is written, and the country it is written that
+// way in; elsewhere the ISO code is used. Symbols without a country are
+// understood everywhere.
+type symbol struct {
+	text    string
+	country string
+}
+
+var symbols = map[string]symbol{
+	"NOK": {"kr", "NO"},
+	"SEK": {"kr", "SE"},
+	"DKK": {"kr.", "DK"},
+	"ISK": {"kr", "IS"},
+	"USD": {"$", "US"},
+	"CAD": {"$", "CA"},
+	"AUD": {"$", "AU"},
+	"CHF": {"CHF", ""},
+	"EUR": {"€", ""},
+	"GBP": {"£", ""},
+	"JPY": {"¥", ""},
+}
+
+// format is how a language writes amounts of money
+type format struct {
+	group, decimal string
+	symbolAfter    bool
+}
+
+var formats = map[string]format{
+	"en": {",", ".", false},
+	"nb": {" ", ",", false},
+	"nn": {" ", ",", false},
+	"no": {" ", ",", false},
+	"sv": {" ", ",", true},
+	"da": {".", ",", true},
+	"fi": {" ", ",", true},
+	"de": {".", ",", true},
+	"fr": {" ", ",", true},
+}
+
+// Format writes the amount the way the language writes money, such as
+// "kr 1 349,00" in Norwegian and "$1,349.00" in English. The country
+// decides whether the currency's own symbol is clear; otherwise its code
+// is written, as in "NOK 1,349.00". Unknown languages are written as
+// English.
+func (m Money) Format(language, country string) string {
+	f, ok := formats[strings.ToLower(language)]
+	if !ok {
+		f = formats["en"]
+	}
+
+	sign := ""
+	if m.Amount < 0 {
+		sign = "-"
+	}
+	number := m.number(f.group, f.decimal)
+
+	// Symbols that are words, like kr, are spaced from the number
+	sym := m.symbol(country)
+	switch {
+	case sym == "":
+		return sign + number
+	case f.symbolAfter:
+		return sign + number + " " + sym
+	case unicode.IsLetter([]rune(sym)[0]):
+		return sign + sym + " " + number
+	default:
+		return sign + sym + number
+	}
+}
+
+// Decimal writes the amount as a plain decimal number, such as "1349.50",
+// as form fields that Parse reads are filled in with
+func (m Money) Decimal() string {
+	if m.Amount < 0 {
+		return "-" + m.number("", ".")
+	}
+	return m.number("", ".")
+}
+
+// number writes the amount without its sign, grouping thousands and
+// separating the minor unit as given
+func (m Money) number(group, decimal string) string {
+	amount := m.Amount
+	if amount < 0 {
+		amount = -amount
+	}
+
+	units := MinorUnits(m.Currency)
+	digits := strconv.FormatInt(amount, 10)
+	if len(digits) <= units {
+		digits = strings.Repeat("0", units-len(digits)+1) + digits
+	}
+	whole, fraction := digits[:len(digits)-units], digits[len(digits)-units:]
+
+	var number strings.Builder
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			number.WriteString(group)
+		}
+		number.WriteRune(d)
+	}
+	if units > 0 {
+		number.WriteString(decimal + fraction)
+	}
+	return number.String()
+}
+
+// String formats the amount in English
+func (m Money) String() string {
+	return m.Format("en", "")
+}
+
+func (m Money) symbol(country string) string {
+	s, ok := symbols[m.Currency]
+	if !ok || (s.country != "" && country != "" && !strings.EqualFold(s.country, country)) {
+		return m.Currency
+	}
+	return s.text
+}
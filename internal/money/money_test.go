@@ -0,0 +1,83 @@
+package money
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinorUnits(t *testing.T) {
+	assert.Equal(t, 2, MinorUnits("NOK"))
+	assert.Equal(t, 2, MinorUnits("usd"))
+	assert.Equal(t, 0, MinorUnits("JPY"))
+	assert.Equal(t, 0, MinorUnits("ISK"))
+	assert.Equal(t, 3, MinorUnits("KWD"))
+	assert.Equal(t, 2, MinorUnits("XYZ"), "unknown currencies have two decimals")
+}
+
+func TestFromMajor(t *testing.T) {
+	assert.Equal(t, New(59900, "NOK"), FromMajor(599, "nok"))
+	assert.Equal(t, New(599, "JPY"), FromMajor(599, "JPY"))
+	assert.Equal(t, New(5000, "KWD"), FromMajor(5, "KWD"))
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		money             Money
+		language, country string
+		want              string
+	}{
+		{New(134900, "NOK"), "nb", "NO", "kr 1 349,00"},
+		{New(134900, "NOK"), "en", "NO", "kr 1,349.00"},
+		{New(134900, "NOK"), "en", "US", "NOK 1,349.00"},
+		{New(134900, "USD"), "en", "US", "$1,349.00"},
+		{New(134900, "SEK"), "sv", "SE", "1 349,00 kr"},
+		{New(134900, "EUR"), "de", "DE", "1.349,00 €"},
+		{New(134900, "EUR"), "en", "", "€1,349.00"},
+		{New(1349, "JPY"), "en", "", "¥1,349"},
+		{New(1349, "KWD"), "en", "", "KWD 1.349"},
+		{New(5, "NOK"), "nb", "NO", "kr 0,05"},
+		{New(-150000, "NOK"), "nb", "NO", "-kr 1 500,00"},
+		{New(123456789, "USD"), "en", "US", "$1,234,567.89"},
+		{New(134900, "NOK"), "xx", "", "kr 1,349.00"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.money.Format(tt.language, tt.country), "%d %s in %s-%s",
+			tt.money.Amount, tt.money.Currency, tt.language, tt.country)
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	assert.Equal(t, "1349.50", New(134950, "NOK").Decimal())
+	assert.Equal(t, "0.05", New(5, "NOK").Decimal())
+	assert.Equal(t, "1349", New(1349, "JPY").Decimal())
+	assert.Equal(t, "-12.00", New(-1200, "USD").Decimal())
+}
+
+func TestParse(t *testing.T) {
+	for value, want := range map[string]int64{
+		"150":      15000,
+		"149.50":   14950,
+		"149,5":    14950,
+		"1 349,00": 134900,
+		"0,05":     5,
+	} {
+		m, err := Parse(value, "NOK")
+		require.NoError(t, err, value)
+		assert.Equal(t, New(want, "NOK"), m, value)
+	}
+
+	m, err := Parse("1349", "JPY")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1349), m.Amount)
+
+	for _, value := range []string{"", "abc", "1.349,00", "12.345", "-5", ",50", "1349.5"} {
+		currency := "NOK"
+		if value == "1349.5" {
+			currency = "JPY"
+		}
+		_, err := Parse(value, currency)
+		assert.Error(t, err, value)
+	}
+}
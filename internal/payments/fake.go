@@ -0,0 +1,369 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+// Scenario is how a fake payment turns out when the member pays
+type Scenario string
+
+const (
+	ScenarioSucceed      Scenario = "succeed"      // The card is charged
+	ScenarioDecline      Scenario = "decline"      // The card is declined
+	ScenarioAuthenticate Scenario = "authenticate" // The bank asks for 3D Secure first
+	ScenarioUnavailable  Scenario = "unavailable"  // The payment cannot be started
+)
+
+// Scenarios are all the ways a fake payment can turn out
+var Scenarios = []Scenario{ScenarioSucceed, ScenarioDecline, ScenarioAuthenticate, ScenarioUnavailable}
+
+func (s Scenario) valid() bool {
+	for _, scenario := range Scenarios {
+		if s == scenario {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrNotAwaitingAuthentication = errors.New("payment is not waiting for authentication")
+
+// FakeWebhookSecret signs the webhooks built by FakeProvider.Webhook
+const FakeWebhookSecret = "whsec_fake"
+
+// FakeProvider keeps payments in memory. Payments succeed unless a test
+// scripts another outcome with Script, and are paid with Pay, standing in
+// for the member completing the payment in the browser.
+type FakeProvider struct {
+	// AutoPay pays every payment the first time it is looked up, as if
+	// the member paid straight away, and authenticated when asked
+	AutoPay bool
+
+	// Scenario is how payments turn out once the script is used up. They
+	// succeed if it is empty.
+	Scenario Scenario
+
+	// ReturnURL, if set, is where members are sent to complete payments,
+	// with the payment's ID in the payment_intent parameter, as they are
+	// to the payment pages of providers that have them
+	ReturnURL string
+
+	mu        sync.Mutex
+	script    []Scenario
+	intents   map[string]*fakeIntent
+	keys      map[string]string // Payments started by idempotency key
+	refunds   map[string]bool   // Refunds made, by idempotency key
+	customers map[string]string
+	nextID    int
+	events    int
+}
+
+type fakeIntent struct {
+	Intent
+	scenario Scenario
+	refunded int
+	save     bool // Save the payment method once paid
+}
+
+// NewFakeProvider creates an empty fake provider
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		intents:   make(map[string]*fakeIntent),
+		keys:      make(map[string]string),
+		refunds:   make(map[string]bool),
+		customers: make(map[string]string),
+	}
+}
+
+// Script sets how the next payments started turn out, in order. Payments
+// started after the script is used up succeed.
+func (p *FakeProvider) Script(scenarios ...Scenario) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.script = append(p.script, scenarios...)
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) CreateIntent(params IntentParams) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, err := p.newIntent(params)
+	if err != nil {
+		return nil, err
+	}
+	if p.ReturnURL != "" {
+		intent.RedirectURL = p.ReturnURL + "?payment_intent=" + url.QueryEscape(intent.ID)
+	}
+	return intent.copy(), nil
+}
+
+// ChargeSaved charges a payment method saved by an earlier payment. The
+// charge turns out as the next scripted scenario says, straight away.
+// Charging again with the same idempotency key returns the first charge.
+func (p *FakeProvider) ChargeSaved(params IntentParams, paymentMethod string) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.keys[params.IdempotencyKey]; ok {
+		return p.intents[id].copy(), nil
+	}
+
+	saved := false
+	for _, intent := range p.intents {
+		if intent.PaymentMethod == paymentMethod && intent.CustomerID == params.CustomerID {
+			saved = true
+			break
+		}
+	}
+	if !saved {
+		return nil, fmt.Errorf("no saved payment method %s", paymentMethod)
+	}
+
+	intent, err := p.newIntent(params)
+	if err != nil {
+		return nil, err
+	}
+	intent.PaymentMethod = paymentMethod
+	intent.save = false
+	intent.pay()
+	if params.IdempotencyKey != "" {
+		p.keys[params.IdempotencyKey] = intent.ID
+	}
+	return intent.copy(), nil
+}
+
+// newIntent starts a payment that turns out as the next scripted scenario
+// says
+func (p *FakeProvider) newIntent(params IntentParams) (*fakeIntent, error) {
+	scenario := ScenarioSucceed
+	if p.Scenario != "" {
+		scenario = p.Scenario
+	}
+	if len(p.script) > 0 {
+		scenario, p.script = p.script[0], p.script[1:]
+	}
+	if scenario == ScenarioUnavailable {
+		return nil, ErrProviderUnavailable
+	}
+
+	p.nextID++
+	id := fmt.Sprintf("pi_fake_%d", p.nextID)
+	intent := &fakeIntent{
+		Intent: Intent{
+			ID:           id,
+			ClientSecret: id + "_secret_fake",
+			Status:       StatusRequiresPaymentMethod,
+			Amount:       params.Amount,
+			Currency:     params.Currency,
+			CustomerID:   params.CustomerID,
+			Metadata:     copyMetadata(params.Metadata),
+		},
+		scenario: scenario,
+		save:     params.SaveMethod,
+	}
+	p.intents[id] = intent
+	return intent, nil
+}
+
+func (p *FakeProvider) GetIntent(id string) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[id]
+	if !ok {
+		return nil, ErrIntentNotFound
+	}
+	if p.AutoPay && intent.Status == StatusRequiresPaymentMethod && intent.FailureMessage == "" {
+		intent.pay()
+		if intent.Status == StatusRequiresAction {
+			intent.succeed()
+		}
+	}
+	return intent.copy(), nil
+}
+
+// Pay completes a payment the way its scenario says: charged, declined or
+// waiting for the member to authenticate. A member whose card was declined
+// can pay again, and that attempt succeeds.
+func (p *FakeProvider) Pay(id string) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[id]
+	if !ok {
+		return nil, ErrIntentNotFound
+	}
+	if intent.Status != StatusRequiresPaymentMethod {
+		return nil, fmt.Errorf("payment cannot be paid: %s", intent.Status)
+	}
+	intent.pay()
+	return intent.copy(), nil
+}
+
+// Authenticate completes or fails the 3D Secure check of a payment
+// waiting for it
+func (p *FakeProvider) Authenticate(id string, approve bool) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[id]
+	if !ok {
+		return nil, ErrIntentNotFound
+	}
+	if intent.Status != StatusRequiresAction {
+		return nil, ErrNotAwaitingAuthentication
+	}
+	if approve {
+		intent.succeed()
+	} else {
+		intent.Status = StatusRequiresPaymentMethod
+		intent.FailureMessage = "The card could not be authenticated."
+	}
+	return intent.copy(), nil
+}
+
+// Capture fails: fake payments are charged when they are paid
+func (p *FakeProvider) Capture(intentID string, amount int) (*Intent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return nil, ErrIntentNotFound
+	}
+	return nil, fmt.Errorf("payment cannot be captured: %s", intent.Status)
+}
+
+func (p *FakeProvider) Refund(intentID string, amount int, idempotencyKey string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.refunds[idempotencyKey] {
+		return nil
+	}
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return ErrIntentNotFound
+	}
+	if intent.Status != StatusSucceeded {
+		return fmt.Errorf("payment cannot be refunded: %s", intent.Status)
+	}
+	if amount <= 0 || intent.refunded+amount > intent.Amount {
+		return fmt.Errorf("invalid refund amount %d, %d refundable", amount, intent.Amount-intent.refunded)
+	}
+	intent.refunded += amount
+	p.refunds[idempotencyKey] = true
+	return nil
+}
+
+// Refunded returns how much of a payment has been refunded, in cents
+func (p *FakeProvider) Refunded(intentID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if intent, ok := p.intents[intentID]; ok {
+		return intent.refunded
+	}
+	return 0
+}
+
+func (p *FakeProvider) Customer(params CustomerParams) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.customers[params.Email]; ok {
+		return id, nil
+	}
+	id := fmt.Sprintf("cus_fake_%d", len(p.customers)+1)
+	p.customers[params.Email] = id
+	return id, nil
+}
+
+// Webhook builds the webhook Stripe would send about a payment, with its
+// signature header. Events are shaped as Stripe's, so the fake provider's
+// webhooks go through the same verification.
+func (p *FakeProvider) Webhook(eventType, intentID string) ([]byte, string, error) {
+	p.mu.Lock()
+	intent, ok := p.intents[intentID]
+	if !ok {
+		p.mu.Unlock()
+		return nil, "", ErrIntentNotFound
+	}
+	p.events++
+	object := map[string]interface{}{"id": intentID, "object": "payment_intent", "status": intent.Status}
+	if eventType == EventChargeRefunded {
+		object = map[string]interface{}{
+			"id":              fmt.Sprintf("ch_fake_%d", p.events),
+			"object":          "charge",
+			"payment_intent":  intentID,
+			"amount":          intent.Amount,
+			"amount_refunded": intent.refunded,
+			"refunded":        intent.refunded == intent.Amount,
+		}
+	}
+	event := map[string]interface{}{
+		"id":     fmt.Sprintf("evt_fake_%d", p.events),
+		"object": "event",
+		"type":   eventType,
+		"data":   map[string]interface{}{"object": object},
+	}
+	p.mu.Unlock()
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", err
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: FakeWebhookSecret})
+	return payload, signed.Header, nil
+}
+
+// ParseWebhook verifies webhooks built by Webhook
+func (p *FakeProvider) ParseWebhook(payload []byte, signature string) (*WebhookEvent, error) {
+	return parseStripeWebhook(payload, signature, FakeWebhookSecret)
+}
+
+// pay applies the payment's scenario. Later attempts succeed.
+func (i *fakeIntent) pay() {
+	switch i.scenario {
+	case ScenarioDecline:
+		i.FailureMessage = "Your card was declined."
+	case ScenarioAuthenticate:
+		i.Status = StatusRequiresAction
+		i.FailureMessage = ""
+	default:
+		i.succeed()
+	}
+	i.scenario = ScenarioSucceed
+}
+
+func (i *fakeIntent) succeed() {
+	i.Status = StatusSucceeded
+	i.FailureMessage = ""
+	if i.save {
+		i.PaymentMethod = "pm_" + i.ID
+	}
+}
+
+func (i *fakeIntent) copy() *Intent {
+	intent := i.Intent
+	intent.Metadata = copyMetadata(i.Metadata)
+	return &intent
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	return copied
+}
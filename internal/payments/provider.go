@@ -0,0 +1,167 @@
+package payments
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"samskipnad/internal/config"
+)
+
+// Payment intent statuses, as Stripe names them. Refunded payments are
+// only tracked in the payments table.
+const (
+	StatusRequiresPaymentMethod = "requires_payment_method"
+	StatusRequiresAction        = "requires_action"
+	StatusRequiresCapture       = "requires_capture"
+	StatusProcessing            = "processing"
+	StatusSucceeded             = "succeeded"
+	StatusCanceled              = "canceled"
+	StatusPartiallyRefunded     = "partially_refunded"
+	StatusRefunded              = "refunded"
+)
+
+var (
+	ErrIntentNotFound        = errors.New("payment intent not found")
+	ErrProviderUnavailable   = errors.New("payment provider unavailable")
+	ErrRecurringNotSupported = errors.New("payment provider cannot charge renewals")
+)
+
+// PaymentProvider takes payments. StripeProvider takes card payments
+// through Stripe and VippsProvider takes Vipps MobilePay payments;
+// FakeProvider keeps payments in memory for tests and local development.
+type PaymentProvider interface {
+	// Name identifies the provider in logs and stored payments
+	Name() string
+	// CreateIntent starts a payment the member then completes in the browser
+	CreateIntent(params IntentParams) (*Intent, error)
+	// GetIntent returns the current state of a payment
+	GetIntent(id string) (*Intent, error)
+	// Capture charges amount (in cents) of a payment the member has
+	// authorized but that is not yet charged
+	Capture(intentID string, amount int) (*Intent, error)
+	// Refund returns amount (in cents) of a succeeded payment. Calls with
+	// the same idempotency key refund once. Errors wrapping
+	// ErrProviderUnavailable leave it unknown whether the refund was made.
+	Refund(intentID string, amount int, idempotencyKey string) error
+	// Customer finds the provider's customer with the email, creating
+	// one if there is none, and returns its ID
+	Customer(params CustomerParams) (string, error)
+}
+
+// OffSessionCharger is implemented by providers that can charge a saved
+// payment method while the member is away, as subscription renewals are.
+// StripeProvider and FakeProvider implement it; Vipps MobilePay needs
+// recurring agreements for that, which are not supported.
+type OffSessionCharger interface {
+	// ChargeSaved charges paymentMethod, saved by an earlier payment
+	// started with SaveMethod. Declined charges are returned as intents
+	// that have not succeeded, with the reason in FailureMessage.
+	ChargeSaved(params IntentParams, paymentMethod string) (*Intent, error)
+}
+
+// IntentParams describes a payment to start
+type IntentParams struct {
+	Amount      int // In cents
+	Currency    string
+	CustomerID  string
+	Description string // Shown to the member while paying
+	Metadata    map[string]string
+	SaveMethod  bool // Keep the payment method for charging renewals; see OffSessionCharger
+
+	// IdempotencyKey makes a repeated request with the same key return
+	// the payment the first one started instead of charging again
+	IdempotencyKey string
+}
+
+// Intent is a payment as the provider sees it
+type Intent struct {
+	ID             string
+	ClientSecret   string // Lets the browser complete the payment
+	RedirectURL    string // Where the member completes the payment, for providers with their own payment pages
+	Status         string
+	Amount         int
+	Currency       string
+	CustomerID     string
+	PaymentMethod  string // Saved payment method of payments started with SaveMethod
+	Metadata       map[string]string
+	FailureMessage string // Why the last attempt to pay failed, if it did
+}
+
+// CustomerParams describes the member paying
+type CustomerParams struct {
+	Email    string
+	Name     string
+	Metadata map[string]string
+}
+
+// ProviderFromEnv returns the Stripe provider for STRIPE_SECRET_KEY,
+// verifying webhooks with STRIPE_WEBHOOK_SECRET. In development,
+// PAYMENT_PROVIDER=fake keeps payments in memory instead; the fake's
+// webhook secret is public, so it is refused anywhere else. Members
+// checking out with the fake return straight to /payment/success, and
+// their payments turn out as FAKE_PAYMENT_SCENARIO says: succeed, decline,
+// authenticate or unavailable. They succeed if it is not set.
+func ProviderFromEnv() (PaymentProvider, error) {
+	if strings.EqualFold(os.Getenv("PAYMENT_PROVIDER"), "fake") {
+		if !config.Development() {
+			return nil, errors.New("PAYMENT_PROVIDER=fake is only allowed with APP_ENV=development")
+		}
+		scenario := ScenarioSucceed
+		if value := os.Getenv("FAKE_PAYMENT_SCENARIO"); value != "" {
+			scenario = Scenario(strings.ToLower(value))
+			if !scenario.valid() {
+				return nil, fmt.Errorf("unknown FAKE_PAYMENT_SCENARIO %q, use one of %v", value, Scenarios)
+			}
+		}
+		log.Printf("PAYMENT_PROVIDER is fake; payments are kept in memory and never charged, and %s", scenario)
+		provider := NewFakeProvider()
+		provider.AutoPay = true
+		provider.Scenario = scenario
+		provider.ReturnURL = "/payment/success"
+		return provider, nil
+	}
+
+	key := os.Getenv("STRIPE_SECRET_KEY")
+	if key == "" {
+		return nil, errors.New("stripe payments need STRIPE_SECRET_KEY")
+	}
+	provider := NewStripeProvider(key)
+	provider.WebhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
+	return provider, nil
+}
+
+// ProviderFor returns the provider the community takes payments with.
+// Vipps needs VIPPS_CLIENT_ID, VIPPS_CLIENT_SECRET, VIPPS_SUBSCRIPTION_KEY
+// and, to accept webhooks, VIPPS_WEBHOOK_SECRET in the environment.
+func ProviderFor(community *config.Community) (PaymentProvider, error) {
+	settings := community.Payments
+	switch strings.ToLower(settings.Provider) {
+	case "", "stripe":
+		return ProviderFromEnv()
+	case "vipps":
+		vipps := VippsConfig{
+			BaseURL:              settings.Vipps.BaseURL,
+			ClientID:             os.Getenv("VIPPS_CLIENT_ID"),
+			ClientSecret:         os.Getenv("VIPPS_CLIENT_SECRET"),
+			SubscriptionKey:      os.Getenv("VIPPS_SUBSCRIPTION_KEY"),
+			MerchantSerialNumber: settings.Vipps.MerchantSerialNumber,
+			ReturnURL:            settings.Vipps.ReturnURL,
+			WebhookSecret:        os.Getenv("VIPPS_WEBHOOK_SECRET"),
+		}
+		if vipps.ClientID == "" || vipps.ClientSecret == "" || vipps.SubscriptionKey == "" {
+			return nil, errors.New("vipps payments need VIPPS_CLIENT_ID, VIPPS_CLIENT_SECRET and VIPPS_SUBSCRIPTION_KEY")
+		}
+		if vipps.MerchantSerialNumber == "" || vipps.ReturnURL == "" {
+			return nil, errors.New("vipps payments need payments.vipps.merchant_serial_number and return_url")
+		}
+		if vipps.WebhookSecret == "" {
+			log.Printf("VIPPS_WEBHOOK_SECRET is not set; Vipps payments are only confirmed when members return")
+		}
+		return NewVippsProvider(vipps), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", settings.Provider)
+	}
+}
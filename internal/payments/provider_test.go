@@ -0,0 +1,86 @@
+package payments
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderFromEnv(t *testing.T) {
+	t.Setenv("STRIPE_SECRET_KEY", "")
+	t.Setenv("PAYMENT_PROVIDER", "")
+	t.Setenv("APP_ENV", "")
+
+	_, err := ProviderFromEnv()
+	assert.Error(t, err, "payments are not simulated without being asked to")
+
+	t.Setenv("PAYMENT_PROVIDER", "fake")
+	_, err = ProviderFromEnv()
+	assert.Error(t, err, "the fake provider is refused outside development")
+
+	t.Setenv("APP_ENV", "development")
+	provider, err := ProviderFromEnv()
+	require.NoError(t, err)
+	require.IsType(t, &FakeProvider{}, provider)
+
+	t.Setenv("FAKE_PAYMENT_SCENARIO", "bounce")
+	_, err = ProviderFromEnv()
+	assert.Error(t, err, "unknown scenarios are refused")
+	t.Setenv("FAKE_PAYMENT_SCENARIO", "")
+
+	t.Setenv("PAYMENT_PROVIDER", "")
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
+	provider, err = ProviderFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "stripe", provider.Name())
+}
+
+func TestFakeProviderFromEnv(t *testing.T) {
+	t.Setenv("PAYMENT_PROVIDER", "fake")
+	t.Setenv("APP_ENV", "development")
+
+	for _, tt := range []struct {
+		scenario string
+		status   string
+	}{
+		{"", StatusSucceeded},
+		{"succeed", StatusSucceeded},
+		{"decline", StatusRequiresPaymentMethod},
+		{"Authenticate", StatusSucceeded},
+	} {
+		t.Run("Scenario"+tt.scenario, func(t *testing.T) {
+			t.Setenv("FAKE_PAYMENT_SCENARIO", tt.scenario)
+			provider, err := ProviderFromEnv()
+			require.NoError(t, err)
+			env := newTestEnv(t)
+			env.useProvider(provider)
+
+			pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+			require.NoError(t, err)
+			assert.Equal(t, "/payment/success?payment_intent="+pi.ID, pi.RedirectURL,
+				"the member returns without paying in a form")
+
+			err = env.service.ConfirmPayment(pi.ID)
+			assert.Equal(t, tt.status, env.status(t, pi.ID))
+			if tt.status == StatusSucceeded {
+				require.NoError(t, err)
+				assert.Equal(t, []string{pi.ID}, env.booker.confirmed)
+			} else {
+				assert.ErrorIs(t, err, ErrPaymentNotSucceeded)
+				assert.Empty(t, env.booker.confirmed)
+			}
+		})
+	}
+
+	t.Run("Unavailable", func(t *testing.T) {
+		t.Setenv("FAKE_PAYMENT_SCENARIO", "unavailable")
+		provider, err := ProviderFromEnv()
+		require.NoError(t, err)
+		env := newTestEnv(t)
+		env.useProvider(provider)
+
+		_, err = env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+		assert.ErrorIs(t, err, ErrProviderUnavailable)
+	})
+}
@@ -0,0 +1,425 @@
+package payments
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/models"
+)
+
+// What a refund reversed, as recorded in the audit trail
+const (
+	ReversedBooking    = "booking"
+	ReversedMembership = "membership"
+	ReversedKlippekort = "klippekort"
+)
+
+// refundReasonAutomatic is recorded for refunds made by the system, such
+// as when a member cancels a paid booking
+const refundReasonAutomatic = "Refunded automatically"
+
+var (
+	ErrNotRefundable        = errors.New("payment cannot be refunded")
+	ErrInvalidRefundAmount  = errors.New("invalid refund amount")
+	ErrRefundReasonRequired = errors.New("refunds need a reason")
+	ErrRefundPending        = errors.New("refund is pending with the provider")
+)
+
+// Refund is one refund of a payment in the payment_refunds audit trail
+type Refund struct {
+	ID         int
+	PaymentID  string
+	Amount     int // in cents
+	Reason     string
+	RefundedBy *int   // Admin who issued the refund; nil for refunds made by the system or with the provider
+	AdminName  string // Name of the admin, loaded for display
+	Reversed   string // What the refund reversed, such as ReversedBooking, if anything
+	Pending    bool   // The provider may not have made it; it stays reserved until known
+	CreatedAt  time.Time
+}
+
+// PaymentSummary is a payment with the member who made it, for listing
+type PaymentSummary struct {
+	models.Payment
+	MemberName  string
+	MemberEmail string
+}
+
+// IssueRefund refunds amount (in cents) of a payment on an admin's behalf.
+// The reason is required and recorded with the admin in the payment's
+// audit trail. Once a payment is refunded in full, what it bought is
+// reversed: the booking is cancelled, the membership ended, or the klipp
+// left on the klippekort taken back. Partial refunds leave it in place.
+// Refunds the provider did not answer are recorded as pending and fail
+// with ErrRefundPending; issuing a refund again retries them first.
+func (s *Service) IssueRefund(paymentID string, amount int, reason string, adminID int) (*Refund, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, ErrRefundReasonRequired
+	}
+
+	payment, err := s.getPaymentByID(paymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	refund, full, err := s.refund(payment, amount, reason, adminID)
+	if err != nil {
+		return nil, err
+	}
+	if !full {
+		return refund, nil
+	}
+
+	if refund.Reversed, err = s.reverse(payment, adminID); err != nil {
+		return refund, fmt.Errorf("refunded, but failed to reverse the %s: %w", payment.PaymentType, err)
+	}
+	if err := s.recordReversal(refund.ID, refund.Reversed); err != nil {
+		return refund, err
+	}
+	return refund, nil
+}
+
+// Refunds returns the audit trail of a payment's refunds, oldest first
+func (s *Service) Refunds(paymentID string) ([]Refund, error) {
+	rows, err := s.db.Query(`
+		SELECT r.id, r.payment_id, r.amount, r.reason, r.refunded_by,
+			COALESCE(u.first_name || ' ' || u.last_name, ''), COALESCE(r.reversed, ''), r.pending, r.created_at
+		FROM payment_refunds r
+		LEFT JOIN users u ON u.id = r.refunded_by
+		WHERE r.payment_id = ?
+		ORDER BY r.created_at, r.id`, paymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refunds: %w", err)
+	}
+	defer rows.Close()
+
+	var refunds []Refund
+	for rows.Next() {
+		var r Refund
+		var refundedBy sql.NullInt64
+		if err := rows.Scan(&r.ID, &r.PaymentID, &r.Amount, &r.Reason, &refundedBy, &r.AdminName, &r.Reversed,
+			&r.Pending, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		if refundedBy.Valid {
+			id := int(refundedBy.Int64)
+			r.RefundedBy = &id
+		}
+		refunds = append(refunds, r)
+	}
+	return refunds, rows.Err()
+}
+
+// ListPayments returns the tenant's most recent payments, newest first,
+// optionally only those with a status
+func (s *Service) ListPayments(tenantID int, status string, limit int) ([]PaymentSummary, error) {
+	query := `
+		SELECT p.id, p.provider, p.user_id, p.tenant_id, p.amount, p.currency, p.status, p.payment_type,
+			p.reference_id, p.refunded_amount, p.created_at, p.updated_at,
+			COALESCE(u.first_name || ' ' || u.last_name, ''), COALESCE(u.email, '')
+		FROM payments p
+		LEFT JOIN users u ON u.id = p.user_id
+		WHERE p.tenant_id = ?`
+	args := []interface{}{tenantID}
+	if status != "" {
+		query += ` AND p.status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY p.created_at DESC, p.rowid DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payments: %w", err)
+	}
+	defer rows.Close()
+
+	var payments []PaymentSummary
+	for rows.Next() {
+		var p PaymentSummary
+		if err := rows.Scan(&p.ID, &p.Provider, &p.UserID, &p.TenantID, &p.Amount, &p.Currency, &p.Status,
+			&p.PaymentType, &p.ReferenceID, &p.RefundedAmount, &p.CreatedAt, &p.UpdatedAt,
+			&p.MemberName, &p.MemberEmail); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// refund returns amount of a payment with the provider and records it in
+// the audit trail, attributed to adminID unless it is 0. It reports
+// whether the refund completed the payment's refund in full.
+func (s *Service) refund(payment *models.Payment, amount int, reason string, adminID int) (*Refund, bool, error) {
+	// Refunds left pending are settled first, so retrying one that timed
+	// out does not refund the member twice
+	settled, err := s.settlePending(payment)
+	if err != nil {
+		return nil, false, err
+	}
+	if settled {
+		if payment, err = s.getPaymentByID(payment.ID); err != nil {
+			return nil, false, fmt.Errorf("failed to get payment: %w", err)
+		}
+	}
+
+	if payment.Status != StatusSucceeded && payment.Status != StatusPartiallyRefunded {
+		return nil, false, fmt.Errorf("%w: %s", ErrNotRefundable, payment.Status)
+	}
+
+	refundable := payment.Amount - payment.RefundedAmount
+	if amount <= 0 || amount > refundable {
+		return nil, false, fmt.Errorf("%w: %d, %d refundable", ErrInvalidRefundAmount, amount, refundable)
+	}
+
+	if payment.Provider != s.provider.Name() {
+		return nil, false, fmt.Errorf("payment was taken with %s, not %s", payment.Provider, s.provider.Name())
+	}
+
+	// The amount is reserved before the provider refunds it, so concurrent
+	// refunds cannot together refund more than was paid, and the provider's
+	// webhook about this refund finds it already recorded
+	var refunded, paid int
+	err = s.db.QueryRow(`
+		UPDATE payments
+		SET refunded_amount = refunded_amount + ?,
+			status = CASE WHEN refunded_amount + ? >= amount THEN ? ELSE ? END,
+			updated_at = datetime('now')
+		WHERE id = ? AND status IN (?, ?) AND refunded_amount + ? <= amount
+		RETURNING refunded_amount, amount`,
+		amount, amount, StatusRefunded, StatusPartiallyRefunded,
+		payment.ID, StatusSucceeded, StatusPartiallyRefunded, amount).Scan(&refunded, &paid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, fmt.Errorf("%w: %d, the payment was refunded meanwhile", ErrInvalidRefundAmount, amount)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to record refund: %w", err)
+	}
+
+	// Each reservation ends at a different total, so the key names this
+	// refund alone and retries of it are refunded once
+	key := fmt.Sprintf("refund-%s-%d", payment.ID, refunded)
+	err = s.provider.Refund(payment.ID, amount, key)
+	if errors.Is(err, ErrProviderUnavailable) {
+		// The provider may have made the refund, so the amount stays
+		// reserved until a retry with the same key tells
+		if _, recordErr := s.recordRefund(payment.ID, amount, reason, adminID, "", key); recordErr != nil {
+			log.Printf("Failed to record pending refund of %d from payment %s: %v", amount, payment.ID, recordErr)
+		}
+		return nil, false, fmt.Errorf("%w: %v", ErrRefundPending, err)
+	}
+	if err != nil {
+		if releaseErr := s.releaseRefund(payment.ID, amount); releaseErr != nil {
+			log.Printf("Failed to release refund of %d from payment %s: %v", amount, payment.ID, releaseErr)
+		}
+		return nil, false, fmt.Errorf("failed to create refund: %w", err)
+	}
+
+	refund, err := s.recordRefund(payment.ID, amount, reason, adminID, "", "")
+	return refund, refunded >= paid, err
+}
+
+// settlePending retries a payment's pending refunds with their idempotency
+// keys. Refunds the provider made are confirmed, and those it refused are
+// released and dropped from the audit trail. It reports whether any were
+// settled, and fails with ErrRefundPending while the provider cannot say.
+func (s *Service) settlePending(payment *models.Payment) (bool, error) {
+	pending, err := s.pendingRefunds(payment.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range pending {
+		err := s.provider.Refund(payment.ID, r.amount, r.key)
+		if errors.Is(err, ErrProviderUnavailable) {
+			return true, fmt.Errorf("%w: %v", ErrRefundPending, err)
+		}
+		if err != nil {
+			log.Printf("Pending refund of %d from payment %s was not made: %v", r.amount, payment.ID, err)
+			if err := s.releaseRefund(payment.ID, r.amount); err != nil {
+				return true, fmt.Errorf("failed to release refund: %w", err)
+			}
+			if _, err := s.db.Exec(`DELETE FROM payment_refunds WHERE id = ?`, r.id); err != nil {
+				return true, fmt.Errorf("failed to drop refund: %w", err)
+			}
+			continue
+		}
+		if err := s.confirmRefund(payment, r.id, r.adminID); err != nil {
+			return true, err
+		}
+	}
+	return len(pending) > 0, nil
+}
+
+// pendingRefund is a refund whose outcome the provider left unknown
+type pendingRefund struct {
+	id      int
+	amount  int
+	adminID int
+	key     string
+}
+
+func (s *Service) pendingRefunds(paymentID string) ([]pendingRefund, error) {
+	rows, err := s.db.Query(`
+		SELECT id, amount, COALESCE(refunded_by, 0), idempotency_key
+		FROM payment_refunds
+		WHERE payment_id = ? AND pending
+		ORDER BY id`, paymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending refunds: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []pendingRefund
+	for rows.Next() {
+		var r pendingRefund
+		if err := rows.Scan(&r.id, &r.amount, &r.adminID, &r.key); err != nil {
+			return nil, err
+		}
+		pending = append(pending, r)
+	}
+	return pending, rows.Err()
+}
+
+// confirmPending confirms all of a payment's pending refunds
+func (s *Service) confirmPending(payment *models.Payment) error {
+	pending, err := s.pendingRefunds(payment.ID)
+	if err != nil {
+		return err
+	}
+	for _, r := range pending {
+		if err := s.confirmRefund(payment, r.id, r.adminID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// confirmRefund records that the provider made a pending refund. The
+// last one to be confirmed of a payment refunded in full reverses what
+// the payment bought.
+func (s *Service) confirmRefund(payment *models.Payment, refundID, adminID int) error {
+	result, err := s.db.Exec(`UPDATE payment_refunds SET pending = false WHERE id = ? AND pending`, refundID)
+	if err != nil {
+		return fmt.Errorf("failed to confirm refund: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	var refunded, paid, pending int
+	err = s.db.QueryRow(`
+		SELECT refunded_amount, amount,
+			(SELECT COUNT(*) FROM payment_refunds WHERE payment_id = payments.id AND pending)
+		FROM payments WHERE id = ?`, payment.ID).Scan(&refunded, &paid, &pending)
+	if err != nil {
+		return err
+	}
+	if refunded < paid || pending > 0 {
+		return nil
+	}
+
+	reversed, err := s.reverse(payment, adminID)
+	if err != nil {
+		return fmt.Errorf("refunded, but failed to reverse the %s: %w", payment.PaymentType, err)
+	}
+	return s.recordReversal(refundID, reversed)
+}
+
+// releaseRefund gives back amount reserved by a refund the provider did
+// not make
+func (s *Service) releaseRefund(paymentID string, amount int) error {
+	_, err := s.db.Exec(`
+		UPDATE payments
+		SET refunded_amount = refunded_amount - ?,
+			status = CASE WHEN refunded_amount - ? > 0 THEN ? ELSE ? END,
+			updated_at = datetime('now')
+		WHERE id = ?`, amount, amount, StatusPartiallyRefunded, StatusSucceeded, paymentID)
+	return err
+}
+
+// recordRefund appends a refund to the audit trail. Refunds learned of
+// from the provider's webhooks carry the event's ID, and are recorded once
+// per event. Refunds recorded with the idempotency key they were sent with
+// are pending until the provider confirms them.
+func (s *Service) recordRefund(paymentID string, amount int, reason string, adminID int, eventID, pendingKey string) (*Refund, error) {
+	refund := &Refund{PaymentID: paymentID, Amount: amount, Reason: reason, Pending: pendingKey != "",
+		CreatedAt: time.Now().UTC()}
+	var refundedBy, providerEventID, idempotencyKey interface{}
+	if adminID != 0 {
+		refundedBy = adminID
+		refund.RefundedBy = &adminID
+	}
+	if eventID != "" {
+		providerEventID = eventID
+	}
+	if pendingKey != "" {
+		idempotencyKey = pendingKey
+	}
+
+	result, err := s.db.Exec(`
+		INSERT INTO payment_refunds (payment_id, amount, reason, refunded_by, provider_event_id,
+			idempotency_key, pending, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, paymentID, amount, reason, refundedBy, providerEventID,
+		idempotencyKey, refund.Pending, refund.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record refund: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	refund.ID = int(id)
+	return refund, nil
+}
+
+func (s *Service) recordReversal(refundID int, reversed string) error {
+	if reversed == "" {
+		return nil
+	}
+	if _, err := s.db.Exec(`UPDATE payment_refunds SET reversed = ? WHERE id = ?`, reversed, refundID); err != nil {
+		return fmt.Errorf("failed to record reversal: %w", err)
+	}
+	return nil
+}
+
+// reverse undoes what a fully refunded payment bought and returns what was
+// reversed, or "" if there was nothing left to reverse
+func (s *Service) reverse(payment *models.Payment, adminID int) (string, error) {
+	switch payment.PaymentType {
+	case "class":
+		if s.classes == nil {
+			return "", fmt.Errorf("no class booker configured")
+		}
+		return ReversedBooking, s.classes.CancelRefunded(payment.ID)
+
+	case "membership":
+		if s.memberships == nil {
+			return "", fmt.Errorf("no membership issuer configured")
+		}
+		return ReversedMembership, s.memberships.EndRefunded(payment.ID)
+
+	case "klippekort":
+		tx, err := s.db.Begin()
+		if err != nil {
+			return "", err
+		}
+		defer tx.Rollback()
+
+		entry := klippekort.Entry{Note: "Payment refunded", CreatedBy: adminID}
+		klipp, err := klippekort.Revoke(tx, payment.ID, entry, time.Now())
+		if errors.Is(err, klippekort.ErrCardNotFound) || (err == nil && klipp == 0) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return ReversedKlippekort, tx.Commit()
+	}
+	return "", nil
+}
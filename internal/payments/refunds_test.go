@@ -0,0 +1,330 @@
+package payments
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// paid starts a payment of the type with the fake provider and confirms it
+func (env *testEnv) paid(t *testing.T, paymentType string) *Intent {
+	env.provider.AutoPay = true
+	var pi *Intent
+	var err error
+	switch paymentType {
+	case "class":
+		pi, err = env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	case "membership":
+		pi, err = env.service.CreateMembershipPaymentIntent(env.userID, "", "monthly", 59900, nil)
+	case "klippekort":
+		pi, err = env.service.CreateKlippekortPaymentIntent(env.userID, "yoga", 10, 0, 150000, nil)
+	}
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	return pi
+}
+
+func TestIssueRefund(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "class")
+
+	_, err := env.service.IssueRefund(pi.ID, 5000, "  ", env.userID)
+	assert.ErrorIs(t, err, ErrRefundReasonRequired)
+	_, err = env.service.IssueRefund(pi.ID, 25000, "Too much", env.userID)
+	assert.ErrorIs(t, err, ErrInvalidRefundAmount)
+
+	partial, err := env.service.IssueRefund(pi.ID, 5000, "Instructor was late", env.userID)
+	require.NoError(t, err)
+	assert.Empty(t, partial.Reversed, "partial refunds keep the booking")
+	assert.Empty(t, env.booker.cancelled)
+	assert.Equal(t, StatusPartiallyRefunded, env.status(t, pi.ID))
+
+	full, err := env.service.IssueRefund(pi.ID, 15000, "Member moved away", env.userID)
+	require.NoError(t, err)
+	assert.Equal(t, ReversedBooking, full.Reversed)
+	assert.Equal(t, []string{pi.ID}, env.booker.cancelled)
+	assert.Equal(t, StatusRefunded, env.status(t, pi.ID))
+	assert.Equal(t, 20000, env.provider.Refunded(pi.ID))
+
+	_, err = env.service.IssueRefund(pi.ID, 1, "Again", env.userID)
+	assert.ErrorIs(t, err, ErrNotRefundable)
+
+	refunds, err := env.service.Refunds(pi.ID)
+	require.NoError(t, err)
+	require.Len(t, refunds, 2)
+	assert.Equal(t, 5000, refunds[0].Amount)
+	assert.Equal(t, "Instructor was late", refunds[0].Reason)
+	require.NotNil(t, refunds[0].RefundedBy)
+	assert.Equal(t, env.userID, *refunds[0].RefundedBy)
+	assert.Equal(t, "Kari Nordmann", refunds[0].AdminName)
+	assert.Empty(t, refunds[0].Reversed)
+	assert.Equal(t, ReversedBooking, refunds[1].Reversed)
+}
+
+func TestRefundReversesMembership(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "membership")
+
+	refund, err := env.service.IssueRefund(pi.ID, 59900, "Charged twice", env.userID)
+	require.NoError(t, err)
+	assert.Equal(t, ReversedMembership, refund.Reversed)
+	assert.Equal(t, []string{pi.ID}, env.issuer.ended)
+}
+
+func TestRefundReversesKlippekort(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "klippekort")
+	_, err := env.db.Exec(`UPDATE klippekort SET klipp_left = 7 WHERE payment_id = ?`, pi.ID)
+	require.NoError(t, err)
+
+	refund, err := env.service.IssueRefund(pi.ID, 150000, "Studio closed", env.userID)
+	require.NoError(t, err)
+	assert.Equal(t, ReversedKlippekort, refund.Reversed)
+
+	var klipp int
+	require.NoError(t, env.db.QueryRow(`SELECT klipp_left FROM klippekort WHERE payment_id = ?`, pi.ID).Scan(&klipp))
+	assert.Zero(t, klipp)
+
+	var delta, createdBy int
+	var note string
+	require.NoError(t, env.db.QueryRow(`
+		SELECT delta, note, created_by FROM klipp_transactions
+		WHERE payment_id = ? AND kind = 'adjustment'`, pi.ID).Scan(&delta, &note, &createdBy))
+	assert.Equal(t, -7, delta, "the klipp left are taken back")
+	assert.Equal(t, "Payment refunded", note)
+	assert.Equal(t, env.userID, createdBy)
+}
+
+// hookedProvider is a fake provider whose refunds fail with err, or call
+// refunded once made, before Refund returns. With timeout set, refunds are
+// made but answered as if the response never arrived.
+type hookedProvider struct {
+	*FakeProvider
+	err      error
+	timeout  bool
+	refunded func(intentID string)
+	keys     []string
+}
+
+func (p *hookedProvider) Refund(intentID string, amount int, idempotencyKey string) error {
+	p.keys = append(p.keys, idempotencyKey)
+	if p.err != nil {
+		return p.err
+	}
+	if err := p.FakeProvider.Refund(intentID, amount, idempotencyKey); err != nil {
+		return err
+	}
+	if p.timeout {
+		return ErrProviderUnavailable
+	}
+	if p.refunded != nil {
+		p.refunded(intentID)
+	}
+	return nil
+}
+
+func TestRefundFailedWithProvider(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "class")
+	env.service.provider = &hookedProvider{FakeProvider: env.provider, err: errors.New("network error")}
+
+	_, err := env.service.IssueRefund(pi.ID, 5000, "Instructor was late", env.userID)
+	assert.Error(t, err)
+
+	payment, err := env.service.GetPayment(pi.ID)
+	require.NoError(t, err)
+	assert.Zero(t, payment.RefundedAmount, "the reserved refund is given back")
+	assert.Equal(t, StatusSucceeded, payment.Status)
+
+	env.service.provider = env.provider
+	_, err = env.service.IssueRefund(pi.ID, 20000, "Instructor was late", env.userID)
+	require.NoError(t, err, "the whole payment can still be refunded")
+}
+
+func TestRefundWithUnknownOutcome(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "class")
+	provider := &hookedProvider{FakeProvider: env.provider, timeout: true}
+	env.service.provider = provider
+
+	_, err := env.service.IssueRefund(pi.ID, 20000, "Member moved away", env.userID)
+	assert.ErrorIs(t, err, ErrRefundPending)
+
+	payment, err := env.service.GetPayment(pi.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 20000, payment.RefundedAmount, "the refund stays reserved")
+	refunds, err := env.service.Refunds(pi.ID)
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	assert.True(t, refunds[0].Pending)
+	assert.Empty(t, env.booker.cancelled)
+
+	_, err = env.service.IssueRefund(pi.ID, 20000, "Member moved away", env.userID)
+	assert.ErrorIs(t, err, ErrRefundPending, "the provider still cannot say")
+
+	provider.timeout = false
+	_, err = env.service.IssueRefund(pi.ID, 20000, "Member moved away", env.userID)
+	assert.ErrorIs(t, err, ErrNotRefundable, "the retried refund refunded the whole payment")
+	assert.Equal(t, 20000, env.provider.Refunded(pi.ID), "the member is refunded once")
+	require.Len(t, provider.keys, 3)
+	assert.Equal(t, provider.keys[0], provider.keys[2], "retries are sent with the same key")
+
+	refunds, err = env.service.Refunds(pi.ID)
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	assert.False(t, refunds[0].Pending)
+	assert.Equal(t, ReversedBooking, refunds[0].Reversed)
+	assert.Equal(t, []string{pi.ID}, env.booker.cancelled)
+}
+
+func TestPendingRefundRefused(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "class")
+	provider := &hookedProvider{FakeProvider: env.provider, err: ErrProviderUnavailable}
+	env.service.provider = provider
+
+	_, err := env.service.IssueRefund(pi.ID, 5000, "Instructor was late", env.userID)
+	assert.ErrorIs(t, err, ErrRefundPending)
+
+	// The provider answers the retry: the refund was never made
+	provider.err = errors.New("payment not found")
+	_, err = env.service.IssueRefund(pi.ID, 20000, "Member moved away", env.userID)
+	assert.Error(t, err)
+
+	payment, err := env.service.GetPayment(pi.ID)
+	require.NoError(t, err)
+	assert.Zero(t, payment.RefundedAmount, "the pending refund is released")
+	refunds, err := env.service.Refunds(pi.ID)
+	require.NoError(t, err)
+	assert.Empty(t, refunds)
+
+	env.service.provider = env.provider
+	_, err = env.service.IssueRefund(pi.ID, 20000, "Member moved away", env.userID)
+	require.NoError(t, err, "the whole payment can still be refunded")
+}
+
+func TestPendingRefundConfirmedByWebhook(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "class")
+	env.service.provider = &hookedProvider{FakeProvider: env.provider, timeout: true}
+
+	_, err := env.service.IssueRefund(pi.ID, 20000, "Member moved away", env.userID)
+	assert.ErrorIs(t, err, ErrRefundPending)
+
+	payload, signature := env.webhook(t, EventChargeRefunded, pi.ID)
+	require.NoError(t, env.service.HandleWebhook("fake", payload, signature))
+
+	refunds, err := env.service.Refunds(pi.ID)
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	assert.False(t, refunds[0].Pending)
+	assert.Equal(t, ReversedBooking, refunds[0].Reversed)
+	assert.Equal(t, []string{pi.ID}, env.booker.cancelled)
+}
+
+func TestConcurrentRefunds(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "class")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := env.service.IssueRefund(pi.ID, 8000, "Charged twice", env.userID)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	refunded := 0
+	for err := range errs {
+		if err == nil {
+			refunded++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrInvalidRefundAmount)
+	}
+	assert.Equal(t, 2, refunded)
+
+	payment, err := env.service.GetPayment(pi.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 16000, payment.RefundedAmount)
+	assert.Equal(t, 16000, env.provider.Refunded(pi.ID))
+}
+
+func TestRefundWebhookDuringRefund(t *testing.T) {
+	env := newTestEnv(t)
+	pi := env.paid(t, "class")
+	env.service.provider = &hookedProvider{FakeProvider: env.provider, refunded: func(intentID string) {
+		// The provider's webhook arrives before IssueRefund has finished
+		payload, signature := env.webhook(t, EventChargeRefunded, intentID)
+		assert.NoError(t, env.service.HandleWebhook("fake", payload, signature))
+	}}
+
+	refund, err := env.service.IssueRefund(pi.ID, 20000, "Member moved away", env.userID)
+	require.NoError(t, err)
+	assert.Equal(t, ReversedBooking, refund.Reversed)
+
+	refunds, err := env.service.Refunds(pi.ID)
+	require.NoError(t, err)
+	assert.Len(t, refunds, 1, "the refund is recorded once")
+	assert.Equal(t, []string{pi.ID}, env.booker.cancelled, "the booking is cancelled once")
+}
+
+func TestRefundAuditTrail(t *testing.T) {
+	t.Run("Automatic", func(t *testing.T) {
+		env := newTestEnv(t)
+		pi := env.paid(t, "class")
+		require.NoError(t, env.service.RefundPayment(pi.ID, 20000))
+
+		refunds, err := env.service.Refunds(pi.ID)
+		require.NoError(t, err)
+		require.Len(t, refunds, 1)
+		assert.Nil(t, refunds[0].RefundedBy)
+		assert.Equal(t, refundReasonAutomatic, refunds[0].Reason)
+		assert.Empty(t, env.booker.cancelled, "whoever refunds through RefundPayment cancels the booking")
+	})
+
+	t.Run("WithProvider", func(t *testing.T) {
+		env := newTestEnv(t)
+		pi := env.paid(t, "class")
+		require.NoError(t, env.provider.Refund(pi.ID, 20000, "re_dashboard"))
+		payload, signature := env.webhook(t, EventChargeRefunded, pi.ID)
+		require.NoError(t, env.service.HandleWebhook("fake", payload, signature))
+
+		refunds, err := env.service.Refunds(pi.ID)
+		require.NoError(t, err)
+		require.Len(t, refunds, 1)
+		assert.Equal(t, "Refunded with fake", refunds[0].Reason)
+		assert.Equal(t, ReversedBooking, refunds[0].Reversed)
+		assert.Equal(t, []string{pi.ID}, env.booker.cancelled)
+	})
+}
+
+func TestListPayments(t *testing.T) {
+	env := newTestEnv(t)
+	refunded := env.paid(t, "class")
+	kept := env.paid(t, "membership")
+	_, err := env.service.IssueRefund(refunded.ID, 20000, "Cancelled", env.userID)
+	require.NoError(t, err)
+
+	all, err := env.service.ListPayments(1, "", 10)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "kari@example.com", all[0].MemberEmail)
+
+	succeeded, err := env.service.ListPayments(1, StatusSucceeded, 10)
+	require.NoError(t, err)
+	require.Len(t, succeeded, 1)
+	assert.Equal(t, kept.ID, succeeded[0].ID)
+
+	other, err := env.service.ListPayments(2, "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, other)
+}
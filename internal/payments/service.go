@@ -2,244 +2,439 @@ package payments
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"log"
+	"samskipnad/internal/config"
+	"samskipnad/internal/klippekort"
 	"samskipnad/internal/models"
 	"strconv"
-
-	"github.com/stripe/stripe-go/v76"
-	"github.com/stripe/stripe-go/v76/customer"
-	"github.com/stripe/stripe-go/v76/paymentintent"
+	"strings"
+	"time"
 )
 
-type Service struct {
-	db *sql.DB
-}
+var ErrPaymentNotSucceeded = errors.New("payment not successful")
 
-func NewService(db *sql.DB) *Service {
-	// Initialize Stripe with API key
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	if stripe.Key == "" {
-		stripe.Key = "sk_test_..." // Use a test key for development
-	}
+// ErrInvalidDiscount is returned for a discount that would leave nothing
+// to pay
+var ErrInvalidDiscount = errors.New("discount must be less than the price")
 
-	return &Service{
-		db: db,
-	}
+// ErrDiscountUsedUp is returned for a payment whose discount code was used
+// up by other payments while the member paid. The payment has been
+// refunded in full.
+var ErrDiscountUsedUp = errors.New("discount code was used up while paying, and the payment was refunded")
+
+// refundReasonDiscountUsedUp is recorded for payments refunded because
+// their discount code was used up
+const refundReasonDiscountUsedUp = "Discount code used up"
+
+// ClassBooker confirms class bookings once they are paid for, and cancels
+// them when their payment is refunded. booking.Service implements it.
+type ClassBooker interface {
+	ConfirmPaid(userID, classID int, paymentID string) error
+	CancelRefunded(paymentID string) error
 }
 
-// CreatePaymentIntent creates a Stripe payment intent for a class booking
-func (s *Service) CreatePaymentIntent(userID int, classID int, amount int64) (*stripe.PaymentIntent, error) {
-	// Get user details for customer creation
-	user, err := s.getUserByID(userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %w", err)
-	}
+// MembershipIssuer starts and renews memberships once they are paid for,
+// and ends them when their payment is refunded. memberships.Service
+// implements it.
+type MembershipIssuer interface {
+	MembershipPaid(paid PaidMembership) error
+	EndRefunded(paymentID string) error
+}
 
-	// Create or get Stripe customer
-	stripeCustomer, err := s.getOrCreateStripeCustomer(user)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create customer: %w", err)
-	}
+// ReceiptIssuer issues and sends the receipt for a payment once it has
+// succeeded. invoices.Service implements it.
+type ReceiptIssuer interface {
+	PaymentSucceeded(paymentID string) error
+}
 
-	// Create payment intent
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(amount),
-		Currency: stripe.String(string(stripe.CurrencyUSD)),
-		Customer: stripe.String(stripeCustomer.ID),
-		Metadata: map[string]string{
-			"user_id":  fmt.Sprintf("%d", userID),
-			"class_id": fmt.Sprintf("%d", classID),
-			"type":     "class_booking",
-		},
-	}
+// Discount is taken off the price of a payment by a discount code
+type Discount struct {
+	CodeID int
+	Code   string
+	Amount int // in cents
+}
 
-	pi, err := paymentintent.New(params)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create payment intent: %w", err)
-	}
+// PaidMembership is a membership payment that has succeeded
+type PaidMembership struct {
+	UserID        int
+	Plan          string // monthly or yearly
+	Tier          string // Membership tier from config; empty for the standard membership
+	PaymentID     string
+	Amount        int    // In cents
+	MembershipID  int    // Membership the payment renews; 0 for a new membership
+	Renew         bool   // Bill the membership again at the end of each period
+	CustomerID    string // The provider's customer and saved payment method renewals are charged to
+	PaymentMethod string
+}
 
-	// Store payment record in database
-	err = s.storePayment(&models.Payment{
-		ID:          pi.ID,
-		UserID:      userID,
-		TenantID:    user.TenantID,
-		Amount:      int(amount),
-		Currency:    "usd",
-		Status:      string(pi.Status),
-		PaymentType: "class",
-		ReferenceID: classID,
-		StripeData:  "", // We could store the full JSON here if needed
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to store payment: %w", err)
+type Service struct {
+	db          *sql.DB
+	provider    PaymentProvider
+	classes     ClassBooker
+	memberships MembershipIssuer
+	receipts    ReceiptIssuer
+	community   func() *config.Community
+}
+
+// NewService creates a payment service taking payments through provider;
+// see ProviderFor
+func NewService(db *sql.DB, provider PaymentProvider) *Service {
+	return &Service{
+		db:        db,
+		provider:  provider,
+		community: config.GetCurrent,
 	}
+}
 
-	return pi, nil
+// Provider returns the provider payments are taken with
+func (s *Service) Provider() PaymentProvider {
+	return s.provider
 }
 
-// CreateMembershipPaymentIntent creates a payment intent for membership
-func (s *Service) CreateMembershipPaymentIntent(userID int, membershipType string, amount int64) (*stripe.PaymentIntent, error) {
-	user, err := s.getUserByID(userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %w", err)
-	}
+// SetClassBooker sets the service that turns paid class payments into
+// bookings, honouring the seat held while the member paid
+func (s *Service) SetClassBooker(classes ClassBooker) {
+	s.classes = classes
+}
 
-	stripeCustomer, err := s.getOrCreateStripeCustomer(user)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create customer: %w", err)
-	}
+// SetMembershipIssuer sets the service that starts and renews memberships
+// once they are paid for
+func (s *Service) SetMembershipIssuer(memberships MembershipIssuer) {
+	s.memberships = memberships
+}
 
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(amount),
-		Currency: stripe.String(string(stripe.CurrencyUSD)),
-		Customer: stripe.String(stripeCustomer.ID),
-		Metadata: map[string]string{
-			"user_id":         fmt.Sprintf("%d", userID),
-			"membership_type": membershipType,
-			"type":            "membership",
-		},
-	}
+// SetReceiptIssuer sets the service that issues receipts for payments
+// once they succeed
+func (s *Service) SetReceiptIssuer(receipts ReceiptIssuer) {
+	s.receipts = receipts
+}
 
-	pi, err := paymentintent.New(params)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create payment intent: %w", err)
-	}
+// CreatePaymentIntent creates a payment intent for a class booking. The
+// member is charged amount less the discount, if any.
+func (s *Service) CreatePaymentIntent(userID int, classID int, amount int64, discount *Discount) (*Intent, error) {
+	return s.startPayment(userID, int(amount), discount, "class", classID, "Class booking", false, map[string]string{
+		"user_id":  fmt.Sprintf("%d", userID),
+		"class_id": fmt.Sprintf("%d", classID),
+		"type":     "class_booking",
+	})
+}
 
-	// Store payment record
-	err = s.storePayment(&models.Payment{
-		ID:          pi.ID,
-		UserID:      userID,
-		TenantID:    user.TenantID,
-		Amount:      int(amount),
-		Currency:    "usd",
-		Status:      string(pi.Status),
-		PaymentType: "membership",
-		ReferenceID: 0, // Will be set when membership is created
-		StripeData:  "",
+// CreateMembershipPaymentIntent creates a payment intent for a membership
+// of the tier that lasts one period and is not renewed
+func (s *Service) CreateMembershipPaymentIntent(userID int, tier, membershipType string, amount int64, discount *Discount) (*Intent, error) {
+	// The membership is created once the payment succeeds
+	return s.startPayment(userID, int(amount), discount, "membership", 0, "Membership", false, map[string]string{
+		"user_id":         fmt.Sprintf("%d", userID),
+		"membership_type": membershipType,
+		"membership_tier": tier,
+		"type":            "membership",
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to store payment: %w", err)
-	}
+}
 
-	return pi, nil
+// CreateSubscriptionPaymentIntent creates a payment intent for the first
+// period of a subscription to a membership of the tier, saving the member's payment method
+// so later periods can be charged with ChargeRenewal. Paying for a
+// membershipID other than 0 renews that membership instead, as when a
+// member whose renewal failed pays with another card. A discount is taken
+// off this payment only; renewals are charged amount. It returns
+// ErrRecurringNotSupported if the provider cannot charge renewals.
+func (s *Service) CreateSubscriptionPaymentIntent(userID int, tier, plan string, membershipID int, amount int64, discount *Discount) (*Intent, error) {
+	if _, ok := s.provider.(OffSessionCharger); !ok {
+		return nil, ErrRecurringNotSupported
+	}
+	return s.startPayment(userID, int(amount), discount, "membership", membershipID, "Membership subscription", true, map[string]string{
+		"user_id":         fmt.Sprintf("%d", userID),
+		"membership_type": plan,
+		"membership_tier": tier,
+		"membership_id":   fmt.Sprintf("%d", membershipID),
+		"renew":           "true",
+		"type":            "membership",
+	})
 }
 
-// CreateKlippekortPaymentIntent creates a payment intent for klippekort purchase
-func (s *Service) CreateKlippekortPaymentIntent(userID int, categoryID string, klipp int, amount int64) (*stripe.PaymentIntent, error) {
+// ChargeRenewal charges the payment method saved for a membership
+// subscription for its next period, renewing the membership if the charge
+// succeeds. Declined charges are recorded and returned as intents that
+// have not succeeded, with the reason in FailureMessage. The provider
+// charges once per idempotency key, so a renewal whose outcome was lost
+// can be charged again with the same key; the key is recorded in the
+// payment's metadata as renewal_key.
+func (s *Service) ChargeRenewal(userID, membershipID int, plan string, amount int, paymentMethod, idempotencyKey string) (*Intent, error) {
+	charger, ok := s.provider.(OffSessionCharger)
+	if !ok {
+		return nil, ErrRecurringNotSupported
+	}
+
 	user, err := s.getUserByID(userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
-
-	stripeCustomer, err := s.getOrCreateStripeCustomer(user)
+	customerID, err := s.customer(user)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create customer: %w", err)
 	}
 
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(amount),
-		Currency: stripe.String(string(stripe.CurrencyUSD)),
-		Customer: stripe.String(stripeCustomer.ID),
-		Metadata: map[string]string{
-			"user_id":     fmt.Sprintf("%d", userID),
-			"category_id": categoryID,
-			"klipp":       fmt.Sprintf("%d", klipp),
-			"type":        "klippekort",
-		},
-	}
-
-	pi, err := paymentintent.New(params)
+	metadata := map[string]string{
+		"user_id":         fmt.Sprintf("%d", userID),
+		"membership_type": plan,
+		"membership_id":   fmt.Sprintf("%d", membershipID),
+		"renew":           "true",
+		"type":            "membership_renewal",
+		"renewal_key":     idempotencyKey,
+	}
+	pi, err := charger.ChargeSaved(IntentParams{
+		Amount:         amount,
+		Currency:       s.currency(),
+		CustomerID:     customerID,
+		Description:    "Membership renewal",
+		Metadata:       metadata,
+		IdempotencyKey: idempotencyKey,
+	}, paymentMethod)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create payment intent: %w", err)
+		return nil, fmt.Errorf("failed to charge renewal: %w", err)
+	}
+
+	// A charge repeated with the same key may have been stored the first
+	// time; it is confirmed again below
+	_, err = s.getPaymentByID(pi.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+	stored := err == nil
+
+	// A charge that succeeded is recorded as processing, so confirming it
+	// below renews the membership like any other payment
+	status := pi.Status
+	if status == StatusSucceeded {
+		status = StatusProcessing
+	}
+	if !stored {
+		err = s.storePayment(&models.Payment{
+			ID:          pi.ID,
+			Provider:    s.provider.Name(),
+			UserID:      userID,
+			TenantID:    user.TenantID,
+			Amount:      amount,
+			Currency:    pi.Currency,
+			Status:      status,
+			PaymentType: "membership",
+			ReferenceID: membershipID,
+			Metadata:    metadata,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to store payment: %w", err)
+		}
+	}
+
+	if pi.Status == StatusSucceeded {
+		if err := s.ConfirmPayment(pi.ID); err != nil {
+			return pi, err
+		}
 	}
+	return pi, nil
+}
 
-	// Store payment record
-	err = s.storePayment(&models.Payment{
-		ID:          pi.ID,
-		UserID:      userID,
-		TenantID:    user.TenantID,
-		Amount:      int(amount),
-		Currency:    "usd",
-		Status:      string(pi.Status),
-		PaymentType: "klippekort",
-		ReferenceID: 0, // Will be set when klippekort is created
-		StripeData:  "",
+// CreateKlippekortPaymentIntent creates a payment intent for klippekort purchase
+// validDays is how long the card can be used after purchase, 0 for no expiry.
+func (s *Service) CreateKlippekortPaymentIntent(userID int, categoryID string, klipp, validDays int, amount int64, discount *Discount) (*Intent, error) {
+	// The klippekort is created once the payment succeeds
+	return s.startPayment(userID, int(amount), discount, "klippekort", 0, "Klippekort", false, map[string]string{
+		"user_id":     fmt.Sprintf("%d", userID),
+		"category_id": categoryID,
+		"klipp":       fmt.Sprintf("%d", klipp),
+		"valid_days":  fmt.Sprintf("%d", validDays),
+		"type":        "klippekort",
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to store payment: %w", err)
-	}
-
-	return pi, nil
 }
 
-// ConfirmPayment processes a successful payment
+// ConfirmPayment processes a successful payment. Payments the member has
+// authorized but that are not charged yet, as with Vipps, are captured
+// first. It is safe to call more than once, as when a provider's webhook
+// and the member's return both confirm a payment: only the first call
+// books the class or issues the membership or klippekort. A payment whose
+// discount code was used up by other payments meanwhile is refunded
+// instead, and ErrDiscountUsedUp returned.
 func (s *Service) ConfirmPayment(paymentIntentID string) error {
 	// Get payment from database
 	payment, err := s.getPaymentByID(paymentIntentID)
 	if err != nil {
 		return fmt.Errorf("failed to get payment: %w", err)
 	}
+	switch payment.Status {
+	case StatusSucceeded, StatusPartiallyRefunded, StatusRefunded:
+		return nil
+	}
+	if payment.Provider != s.provider.Name() {
+		return fmt.Errorf("payment was taken with %s, not %s", payment.Provider, s.provider.Name())
+	}
 
-	// Get updated payment intent from Stripe
-	pi, err := paymentintent.Get(paymentIntentID, nil)
+	// Get updated payment intent from the provider
+	pi, err := s.provider.GetIntent(paymentIntentID)
 	if err != nil {
 		return fmt.Errorf("failed to get payment intent: %w", err)
 	}
 
-	if pi.Status != stripe.PaymentIntentStatusSucceeded {
-		return fmt.Errorf("payment not successful: %s", pi.Status)
+	if pi.Status == StatusRequiresCapture {
+		pi, err = s.provider.Capture(paymentIntentID, payment.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to capture payment: %w", err)
+		}
 	}
 
-	// Update payment status
-	err = s.updatePaymentStatus(paymentIntentID, string(pi.Status))
+	if pi.Status != StatusSucceeded {
+		if err := s.updatePendingStatus(paymentIntentID, pi.Status); err != nil {
+			return fmt.Errorf("failed to update payment status: %w", err)
+		}
+		return fmt.Errorf("%w: %s", ErrPaymentNotSucceeded, pi.Status)
+	}
+
+	// Mark the payment succeeded; whoever does so processes it
+	claimed, err := s.claimPayment(paymentIntentID)
 	if err != nil {
 		return fmt.Errorf("failed to update payment status: %w", err)
 	}
+	if !claimed {
+		return s.refundDiscountUsedUp(payment)
+	}
+
+	// Payments started before their metadata was stored have it only
+	// with the provider
+	metadata := payment.Metadata
+	if len(metadata) == 0 {
+		metadata = pi.Metadata
+	}
 
 	// Process the payment based on type
 	switch payment.PaymentType {
 	case "class":
-		err = s.processClassBooking(payment.UserID, payment.ReferenceID)
+		err = s.processClassBooking(payment.UserID, payment.ReferenceID, payment.ID)
 	case "membership":
-		err = s.processMembershipPayment(payment.UserID, pi.Metadata["membership_type"])
+		err = s.processMembershipPayment(payment, metadata, pi)
 	case "klippekort":
-		err = s.processKlippekortPayment(payment.UserID, pi.Metadata["category_id"], pi.Metadata["klipp"])
+		err = s.processKlippekortPayment(payment.UserID, metadata["category_id"], metadata["klipp"], metadata["valid_days"], payment.ID)
 	default:
-		return fmt.Errorf("unknown payment type: %s", payment.PaymentType)
+		err = fmt.Errorf("unknown payment type: %s", payment.PaymentType)
 	}
 
 	if err != nil {
+		// Let a later confirmation process it again
+		if releaseErr := s.releaseClaim(paymentIntentID, payment.Status); releaseErr != nil {
+			log.Printf("Failed to release payment %s: %v", paymentIntentID, releaseErr)
+		}
 		return fmt.Errorf("failed to process payment: %w", err)
 	}
 
+	// The member has what they paid for; a receipt that fails to be
+	// issued can be issued again from the payment
+	if s.receipts != nil {
+		if err := s.receipts.PaymentSucceeded(payment.ID); err != nil {
+			log.Printf("Failed to issue receipt for payment %s: %v", payment.ID, err)
+		}
+	}
+
 	return nil
 }
 
+// GetPayment returns a payment by its ID
+func (s *Service) GetPayment(paymentID string) (*models.Payment, error) {
+	return s.getPaymentByID(paymentID)
+}
+
+// RefundPayment returns amount (in cents) of a succeeded payment to the
+// customer, as when a booking is cancelled. Partial refunds can be
+// repeated until the payment is fully refunded. The caller undoes what the
+// payment bought; see IssueRefund for refunds that do so themselves.
+func (s *Service) RefundPayment(paymentID string, amount int) error {
+	payment, err := s.getPaymentByID(paymentID)
+	if err != nil {
+		return fmt.Errorf("failed to get payment: %w", err)
+	}
+	_, _, err = s.refund(payment, amount, refundReasonAutomatic, 0)
+	return err
+}
+
 // Helper methods
 
-func (s *Service) getOrCreateStripeCustomer(user *models.User) (*stripe.Customer, error) {
-	// Try to find existing customer first
-	params := &stripe.CustomerListParams{
-		Email: stripe.String(user.Email),
+// startPayment starts a payment with the provider and records it,
+// saving the payment method for renewals if saveMethod is set
+func (s *Service) startPayment(userID, amount int, discount *Discount, paymentType string, referenceID int, description string, saveMethod bool, metadata map[string]string) (*Intent, error) {
+	var discountCodeID *int
+	discountAmount := 0
+	if discount != nil {
+		if discount.Amount <= 0 || discount.Amount >= amount {
+			return nil, fmt.Errorf("%w: %d off %d", ErrInvalidDiscount, discount.Amount, amount)
+		}
+		discountCodeID = &discount.CodeID
+		discountAmount = discount.Amount
+		amount -= discount.Amount
+		metadata["discount_code"] = discount.Code
+		metadata["discount"] = fmt.Sprintf("%d", discount.Amount)
 	}
 
-	customers := customer.List(params)
-	for customers.Next() {
-		return customers.Customer(), nil
+	// Get user details for customer creation
+	user, err := s.getUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	// Create new customer
-	customerParams := &stripe.CustomerParams{
-		Email: stripe.String(user.Email),
-		Name:  stripe.String(fmt.Sprintf("%s %s", user.FirstName, user.LastName)),
+	customerID, err := s.customer(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create customer: %w", err)
+	}
+
+	pi, err := s.provider.CreateIntent(IntentParams{
+		Amount:      amount,
+		Currency:    s.currency(),
+		CustomerID:  customerID,
+		Description: description,
+		Metadata:    metadata,
+		SaveMethod:  saveMethod,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create payment intent: %w", err)
+	}
+
+	// Store payment record in database
+	err = s.storePayment(&models.Payment{
+		ID:             pi.ID,
+		Provider:       s.provider.Name(),
+		UserID:         userID,
+		TenantID:       user.TenantID,
+		Amount:         amount,
+		Currency:       pi.Currency,
+		Status:         pi.Status,
+		PaymentType:    paymentType,
+		ReferenceID:    referenceID,
+		StripeData:     "", // We could store the full JSON here if needed
+		Metadata:       metadata,
+		DiscountCodeID: discountCodeID,
+		DiscountAmount: discountAmount,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store payment: %w", err)
+	}
+
+	return pi, nil
+}
+
+// customer creates or gets the provider's customer for the user
+func (s *Service) customer(user *models.User) (string, error) {
+	return s.provider.Customer(CustomerParams{
+		Email: user.Email,
+		Name:  fmt.Sprintf("%s %s", user.FirstName, user.LastName),
 		Metadata: map[string]string{
 			"user_id":   fmt.Sprintf("%d", user.ID),
 			"tenant_id": fmt.Sprintf("%d", user.TenantID),
 		},
-	}
+	})
+}
 
-	return customer.New(customerParams)
+// currency returns the community's currency in the lower case providers use
+func (s *Service) currency() string {
+	return strings.ToLower(s.community().Currency())
 }
 
 func (s *Service) getUserByID(userID int) (*models.User, error) {
@@ -261,77 +456,167 @@ func (s *Service) getUserByID(userID int) (*models.User, error) {
 }
 
 func (s *Service) storePayment(payment *models.Payment) error {
-	query := `INSERT INTO payments (id, user_id, tenant_id, amount, currency, status, payment_type, reference_id, stripe_data, created_at, updated_at)
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'), datetime('now'))`
+	metadata, err := json.Marshal(payment.Metadata)
+	if err != nil {
+		return err
+	}
 
-	_, err := s.db.Exec(query, payment.ID, payment.UserID, payment.TenantID,
+	query := `INSERT INTO payments (id, provider, user_id, tenant_id, amount, currency, status, payment_type, reference_id, stripe_data, metadata,
+			  discount_code_id, discount_amount, created_at, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'), datetime('now'))`
+
+	_, err = s.db.Exec(query, payment.ID, payment.Provider, payment.UserID, payment.TenantID,
 		payment.Amount, payment.Currency, payment.Status, payment.PaymentType,
-		payment.ReferenceID, payment.StripeData)
+		payment.ReferenceID, payment.StripeData, string(metadata), payment.DiscountCodeID, payment.DiscountAmount)
 
 	return err
 }
 
 func (s *Service) getPaymentByID(paymentID string) (*models.Payment, error) {
-	query := `SELECT id, user_id, tenant_id, amount, currency, status, payment_type, reference_id, stripe_data, created_at, updated_at
+	query := `SELECT id, provider, user_id, tenant_id, amount, currency, status, payment_type, reference_id, stripe_data,
+			  COALESCE(metadata, ''), refunded_amount, discount_code_id, discount_amount, created_at, updated_at
 			  FROM payments WHERE id = ?`
 
 	var payment models.Payment
+	var metadata string
+	var discountCodeID sql.NullInt64
 	err := s.db.QueryRow(query, paymentID).Scan(
-		&payment.ID, &payment.UserID, &payment.TenantID, &payment.Amount,
+		&payment.ID, &payment.Provider, &payment.UserID, &payment.TenantID, &payment.Amount,
 		&payment.Currency, &payment.Status, &payment.PaymentType,
-		&payment.ReferenceID, &payment.StripeData, &payment.CreatedAt, &payment.UpdatedAt,
+		&payment.ReferenceID, &payment.StripeData, &metadata, &payment.RefundedAmount,
+		&discountCodeID, &payment.DiscountAmount, &payment.CreatedAt, &payment.UpdatedAt,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &payment.Metadata); err != nil {
+			return nil, fmt.Errorf("invalid payment metadata: %w", err)
+		}
+	}
+	if discountCodeID.Valid {
+		id := int(discountCodeID.Int64)
+		payment.DiscountCodeID = &id
+	}
+
 	return &payment, nil
 }
 
-func (s *Service) updatePaymentStatus(paymentID, status string) error {
-	query := `UPDATE payments SET status = ?, updated_at = datetime('now') WHERE id = ?`
-	_, err := s.db.Exec(query, status, paymentID)
+// updatePendingStatus records the status of a payment that has not
+// succeeded yet
+func (s *Service) updatePendingStatus(paymentID, status string) error {
+	query := `UPDATE payments SET status = ?, updated_at = datetime('now')
+			  WHERE id = ? AND status NOT IN (?, ?, ?)`
+	_, err := s.db.Exec(query, status, paymentID, StatusSucceeded, StatusPartiallyRefunded, StatusRefunded)
 	return err
 }
 
-func (s *Service) processClassBooking(userID, classID int) error {
-	// Create booking record
-	query := `INSERT INTO bookings (user_id, class_id, status, created_at, updated_at)
-			  VALUES (?, ?, 'confirmed', datetime('now'), datetime('now'))`
-
-	_, err := s.db.Exec(query, userID, classID)
-	return err
+// claimPayment marks a payment succeeded, reporting whether this call did
+// so rather than an earlier one. A payment with a discount code is not
+// claimed if the payments that succeeded with the code meanwhile used it
+// up; the limits are checked in the same statement, so payments confirmed
+// at the same time cannot together use a code more often than it allows.
+func (s *Service) claimPayment(paymentID string) (bool, error) {
+	query := `UPDATE payments SET status = ?, updated_at = datetime('now')
+			  WHERE id = ? AND status NOT IN (?, ?, ?)
+			  AND NOT EXISTS (
+				SELECT 1 FROM discount_codes d
+				WHERE d.id = payments.discount_code_id
+				AND ((d.max_uses > 0 AND d.max_uses <= (
+					SELECT COUNT(*) FROM payments p WHERE p.discount_code_id = d.id AND p.status IN (?, ?, ?)))
+				OR (d.max_uses_per_user > 0 AND d.max_uses_per_user <= (
+					SELECT COUNT(*) FROM payments p WHERE p.discount_code_id = d.id AND p.user_id = payments.user_id
+					AND p.status IN (?, ?, ?)))))`
+	paid := []interface{}{StatusSucceeded, StatusPartiallyRefunded, StatusRefunded}
+	args := append([]interface{}{StatusSucceeded, paymentID}, paid...)
+	args = append(append(args, paid...), paid...)
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
 }
 
-func (s *Service) processMembershipPayment(userID int, membershipType string) error {
-	// Create membership record
-	user, err := s.getUserByID(userID)
+// refundDiscountUsedUp refunds a succeeded payment that could not be
+// claimed because its discount code was used up. The payment no longer
+// counts as a use of the code. It does nothing for a payment an earlier
+// call claimed.
+func (s *Service) refundDiscountUsedUp(payment *models.Payment) error {
+	result, err := s.db.Exec(`
+		UPDATE payments SET status = ?, discount_code_id = NULL, updated_at = datetime('now')
+		WHERE id = ? AND status NOT IN (?, ?, ?)`,
+		StatusSucceeded, payment.ID, StatusSucceeded, StatusPartiallyRefunded, StatusRefunded)
 	if err != nil {
+		return fmt.Errorf("failed to update payment status: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
 		return err
 	}
 
-	// Calculate membership dates based on type
-	startDate := "datetime('now')"
-	var endDate string
-	switch membershipType {
-	case "monthly":
-		endDate = "datetime('now', '+1 month')"
-	case "yearly":
-		endDate = "datetime('now', '+1 year')"
-	default:
-		endDate = "datetime('now', '+1 month')" // Default to monthly
+	payment.Status = StatusSucceeded
+	payment.DiscountCodeID = nil
+	if _, _, err := s.refund(payment, payment.Amount, refundReasonDiscountUsedUp, 0); err != nil {
+		// The payment is left succeeded for an admin to refund
+		return fmt.Errorf("failed to refund payment over its discount code's limit: %w", err)
 	}
+	return ErrDiscountUsedUp
+}
 
-	query := fmt.Sprintf(`INSERT INTO memberships (user_id, tenant_id, type, start_date, end_date, active, created_at, updated_at)
-						  VALUES (?, ?, ?, %s, %s, true, datetime('now'), datetime('now'))`, startDate, endDate)
-
-	_, err = s.db.Exec(query, userID, user.TenantID, membershipType)
+// releaseClaim puts a claimed payment that could not be processed back to
+// its earlier status
+func (s *Service) releaseClaim(paymentID, status string) error {
+	query := `UPDATE payments SET status = ?, updated_at = datetime('now') WHERE id = ? AND status = ?`
+	_, err := s.db.Exec(query, status, paymentID, StatusSucceeded)
 	return err
 }
 
-// processKlippekortPayment creates klippekort record after successful payment
-func (s *Service) processKlippekortPayment(userID int, categoryID, klippStr string) error {
+func (s *Service) processClassBooking(userID, classID int, paymentID string) error {
+	if s.classes == nil {
+		return fmt.Errorf("no class booker configured")
+	}
+	return s.classes.ConfirmPaid(userID, classID, paymentID)
+}
+
+// processMembershipPayment starts or renews the membership a payment was
+// for. Payments started before membership plans were recorded are for a
+// monthly membership.
+func (s *Service) processMembershipPayment(payment *models.Payment, metadata map[string]string, pi *Intent) error {
+	if s.memberships == nil {
+		return fmt.Errorf("no membership issuer configured")
+	}
+
+	paid := PaidMembership{
+		UserID:    payment.UserID,
+		Plan:      metadata["membership_type"],
+		Tier:      metadata["membership_tier"],
+		PaymentID: payment.ID,
+		Amount:    payment.Amount + payment.DiscountAmount, // Renewals are charged the full price
+		Renew:     metadata["renew"] == "true",
+	}
+	if paid.Plan == "" {
+		paid.Plan = "monthly"
+	}
+	if id := metadata["membership_id"]; id != "" {
+		membershipID, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid membership: %w", err)
+		}
+		paid.MembershipID = membershipID
+	}
+	if paid.Renew {
+		paid.CustomerID = pi.CustomerID
+		paid.PaymentMethod = pi.PaymentMethod
+	}
+
+	return s.memberships.MembershipPaid(paid)
+}
+
+// processKlippekortPayment creates klippekort record after successful payment.
+// Cards bought with a validity period expire that many days after purchase.
+func (s *Service) processKlippekortPayment(userID int, categoryID, klippStr, validDaysStr, paymentID string) error {
 	user, err := s.getUserByID(userID)
 	if err != nil {
 		return err
@@ -342,10 +627,37 @@ func (s *Service) processKlippekortPayment(userID int, categoryID, klippStr stri
 		return fmt.Errorf("invalid klipp count: %w", err)
 	}
 
-	// Create klippekort record
-	query := `INSERT INTO klippekort (user_id, tenant_id, category_id, klipp_left, original_klipp, created_at, updated_at)
-			  VALUES (?, ?, ?, ?, ?, datetime('now'), datetime('now'))`
+	// Payments started before validity periods were recorded have none
+	validDays := 0
+	if validDaysStr != "" {
+		validDays, err = strconv.Atoi(validDaysStr)
+		if err != nil {
+			return fmt.Errorf("invalid validity period: %w", err)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err = s.db.Exec(query, userID, user.TenantID, categoryID, klipp, klipp)
-	return err
+	// Create klippekort record and its purchase in the klipp ledger
+	now := time.Now()
+	card := &models.Klippekort{
+		UserID:        userID,
+		TenantID:      user.TenantID,
+		CategoryID:    categoryID,
+		OriginalKlipp: klipp,
+		PaymentID:     paymentID,
+	}
+	if validDays > 0 {
+		expiry := now.AddDate(0, 0, validDays)
+		card.ExpiryDate = &expiry
+	}
+	if err := klippekort.Issue(tx, card, now); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
@@ -0,0 +1,401 @@
+package payments
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/database"
+)
+
+// setupTestDB creates a migrated in-memory SQLite database for testing
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// recordingBooker records the class payments it confirms and cancels
+type recordingBooker struct {
+	confirmed []string
+	cancelled []string
+}
+
+func (b *recordingBooker) ConfirmPaid(userID, classID int, paymentID string) error {
+	b.confirmed = append(b.confirmed, paymentID)
+	return nil
+}
+
+func (b *recordingBooker) CancelRefunded(paymentID string) error {
+	b.cancelled = append(b.cancelled, paymentID)
+	return nil
+}
+
+// recordingIssuer records the membership payments it is given and the
+// memberships it ends
+type recordingIssuer struct {
+	paid  []PaidMembership
+	ended []string
+}
+
+func (i *recordingIssuer) MembershipPaid(paid PaidMembership) error {
+	i.paid = append(i.paid, paid)
+	return nil
+}
+
+func (i *recordingIssuer) EndRefunded(paymentID string) error {
+	i.ended = append(i.ended, paymentID)
+	return nil
+}
+
+// recordingReceipts records the payments it issues receipts for, failing
+// when fail is set
+type recordingReceipts struct {
+	issued []string
+	fail   bool
+}
+
+func (r *recordingReceipts) PaymentSucceeded(paymentID string) error {
+	if r.fail {
+		return errors.New("receipts unavailable")
+	}
+	r.issued = append(r.issued, paymentID)
+	return nil
+}
+
+type testEnv struct {
+	db       *sql.DB
+	provider *FakeProvider
+	booker   *recordingBooker
+	issuer   *recordingIssuer
+	service  *Service
+	userID   int
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := setupTestDB(t)
+	env := &testEnv{
+		db:       db,
+		provider: NewFakeProvider(),
+		booker:   &recordingBooker{},
+		issuer:   &recordingIssuer{},
+	}
+	env.useProvider(env.provider)
+
+	result, err := db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, phone, tenant_id)
+		VALUES ('kari@example.com', 'x', 'Kari', 'Nordmann', '', 1)`)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	env.userID = int(id)
+	return env
+}
+
+// useProvider takes the environment's payments through provider
+func (env *testEnv) useProvider(provider PaymentProvider) {
+	community := &config.Community{}
+	community.Pricing.Currency = "NOK"
+	env.service = NewService(env.db, provider)
+	env.service.community = func() *config.Community { return community }
+	env.service.SetClassBooker(env.booker)
+	env.service.SetMembershipIssuer(env.issuer)
+}
+
+func (env *testEnv) status(t *testing.T, paymentID string) string {
+	payment, err := env.service.GetPayment(paymentID)
+	require.NoError(t, err)
+	return payment.Status
+}
+
+func TestClassPayment(t *testing.T) {
+	env := newTestEnv(t)
+
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, pi.ClientSecret)
+	assert.Equal(t, "nok", pi.Currency, "payments are in the community's currency")
+	assert.Equal(t, StatusRequiresPaymentMethod, env.status(t, pi.ID))
+
+	assert.ErrorIs(t, env.service.ConfirmPayment(pi.ID), ErrPaymentNotSucceeded, "the member has not paid yet")
+	assert.Empty(t, env.booker.confirmed)
+
+	_, err = env.provider.Pay(pi.ID)
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	assert.Equal(t, []string{pi.ID}, env.booker.confirmed)
+	assert.Equal(t, StatusSucceeded, env.status(t, pi.ID))
+
+	again, err := env.service.CreatePaymentIntent(env.userID, 8, 20000, nil)
+	require.NoError(t, err)
+	assert.Equal(t, pi.CustomerID, again.CustomerID, "the member is one customer")
+}
+
+func TestReceiptIssued(t *testing.T) {
+	env := newTestEnv(t)
+	receipts := &recordingReceipts{}
+	env.service.SetReceiptIssuer(receipts)
+	env.provider.AutoPay = true
+
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	assert.Equal(t, []string{pi.ID}, receipts.issued, "a receipt is issued once the payment is processed")
+
+	receipts.fail = true
+	pi, err = env.service.CreatePaymentIntent(env.userID, 8, 20000, nil)
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(pi.ID), "the member has what they paid for without a receipt")
+	assert.Equal(t, StatusSucceeded, env.status(t, pi.ID))
+}
+
+func TestPaymentScenarios(t *testing.T) {
+	t.Run("Declined", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.provider.Script(ScenarioDecline)
+		pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+		require.NoError(t, err)
+
+		declined, err := env.provider.Pay(pi.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusRequiresPaymentMethod, declined.Status)
+		assert.NotEmpty(t, declined.FailureMessage)
+		assert.ErrorIs(t, env.service.ConfirmPayment(pi.ID), ErrPaymentNotSucceeded)
+		assert.Empty(t, env.booker.confirmed)
+
+		_, err = env.provider.Pay(pi.ID)
+		require.NoError(t, err)
+		require.NoError(t, env.service.ConfirmPayment(pi.ID), "paying again with another card succeeds")
+	})
+
+	t.Run("ThreeDSecure", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.provider.Script(ScenarioAuthenticate, ScenarioAuthenticate)
+		approved, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+		require.NoError(t, err)
+		refused, err := env.service.CreatePaymentIntent(env.userID, 8, 20000, nil)
+		require.NoError(t, err)
+
+		for _, pi := range []*Intent{approved, refused} {
+			paid, err := env.provider.Pay(pi.ID)
+			require.NoError(t, err)
+			assert.Equal(t, StatusRequiresAction, paid.Status)
+			assert.ErrorIs(t, env.service.ConfirmPayment(pi.ID), ErrPaymentNotSucceeded)
+			assert.Equal(t, StatusRequiresAction, env.status(t, pi.ID))
+		}
+
+		_, err = env.provider.Authenticate(approved.ID, true)
+		require.NoError(t, err)
+		require.NoError(t, env.service.ConfirmPayment(approved.ID))
+
+		failed, err := env.provider.Authenticate(refused.ID, false)
+		require.NoError(t, err)
+		assert.Equal(t, StatusRequiresPaymentMethod, failed.Status)
+		assert.ErrorIs(t, env.service.ConfirmPayment(refused.ID), ErrPaymentNotSucceeded)
+
+		_, err = env.provider.Authenticate(approved.ID, true)
+		assert.ErrorIs(t, err, ErrNotAwaitingAuthentication)
+		assert.Equal(t, []string{approved.ID}, env.booker.confirmed)
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.provider.Script(ScenarioUnavailable)
+		_, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+		assert.ErrorIs(t, err, ErrProviderUnavailable)
+
+		var payments int
+		require.NoError(t, env.db.QueryRow(`SELECT COUNT(*) FROM payments`).Scan(&payments))
+		assert.Zero(t, payments, "payments that never started are not recorded")
+
+		_, err = env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+		assert.NoError(t, err, "the script is used up")
+	})
+
+	t.Run("AutoPay", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.provider.AutoPay = true
+		pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+		require.NoError(t, err)
+		require.NoError(t, env.service.ConfirmPayment(pi.ID))
+		assert.Equal(t, []string{pi.ID}, env.booker.confirmed)
+	})
+}
+
+func TestKlippekortPayment(t *testing.T) {
+	env := newTestEnv(t)
+	env.provider.AutoPay = true
+
+	pi, err := env.service.CreateKlippekortPaymentIntent(env.userID, "yoga", 10, 90, 150000, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10", pi.Metadata["klipp"])
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+
+	var klipp int
+	var paymentID string
+	require.NoError(t, env.db.QueryRow(`SELECT klipp_left, payment_id FROM klippekort WHERE user_id = ?`, env.userID).
+		Scan(&klipp, &paymentID))
+	assert.Equal(t, 10, klipp)
+	assert.Equal(t, pi.ID, paymentID)
+}
+
+func TestRefundPayment(t *testing.T) {
+	env := newTestEnv(t)
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+
+	assert.Error(t, env.service.RefundPayment(pi.ID, 5000), "unpaid payments cannot be refunded")
+
+	_, err = env.provider.Pay(pi.ID)
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+
+	require.NoError(t, env.service.RefundPayment(pi.ID, 5000))
+	assert.Equal(t, StatusPartiallyRefunded, env.status(t, pi.ID))
+	assert.Error(t, env.service.RefundPayment(pi.ID, 20000), "more than is left")
+
+	require.NoError(t, env.service.RefundPayment(pi.ID, 15000))
+	assert.Equal(t, StatusRefunded, env.status(t, pi.ID))
+	assert.Equal(t, 20000, env.provider.Refunded(pi.ID))
+	assert.Error(t, env.service.RefundPayment(pi.ID, 1))
+}
+
+func TestSubscriptionPayment(t *testing.T) {
+	env := newTestEnv(t)
+	env.provider.AutoPay = true
+
+	pi, err := env.service.CreateSubscriptionPaymentIntent(env.userID, "weekday", "yearly", 0, 599000, nil)
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	require.Len(t, env.issuer.paid, 1)
+	paid := env.issuer.paid[0]
+	assert.Equal(t, "yearly", paid.Plan)
+	assert.Equal(t, "weekday", paid.Tier)
+	assert.True(t, paid.Renew)
+	assert.Zero(t, paid.MembershipID)
+	assert.Equal(t, 599000, paid.Amount)
+	assert.Equal(t, pi.CustomerID, paid.CustomerID)
+	assert.NotEmpty(t, paid.PaymentMethod, "the card is saved for renewals")
+
+	one, err := env.service.CreateMembershipPaymentIntent(env.userID, "", "monthly", 59900, nil)
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(one.ID))
+	require.Len(t, env.issuer.paid, 2)
+	assert.False(t, env.issuer.paid[1].Renew)
+	assert.Empty(t, env.issuer.paid[1].Tier, "the standard membership")
+	assert.Empty(t, env.issuer.paid[1].PaymentMethod)
+
+	t.Run("NotSupported", func(t *testing.T) {
+		// Hides the fake provider's ChargeSaved, as Vipps has none
+		env.useProvider(struct{ PaymentProvider }{env.provider})
+		_, err := env.service.CreateSubscriptionPaymentIntent(env.userID, "", "monthly", 0, 59900, nil)
+		assert.ErrorIs(t, err, ErrRecurringNotSupported)
+		_, err = env.service.ChargeRenewal(env.userID, 1, "yearly", 599000, paid.PaymentMethod, "renewal-1")
+		assert.ErrorIs(t, err, ErrRecurringNotSupported)
+	})
+}
+
+func TestDiscountedPayment(t *testing.T) {
+	env := newTestEnv(t)
+	env.provider.AutoPay = true
+	discount := &Discount{CodeID: 3, Code: "WELCOME", Amount: 14975}
+
+	pi, err := env.service.CreateSubscriptionPaymentIntent(env.userID, "", "monthly", 0, 59900, discount)
+	require.NoError(t, err)
+	assert.Equal(t, 44925, pi.Amount, "the member is charged the discounted price")
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+
+	payment, err := env.service.GetPayment(pi.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 44925, payment.Amount)
+	assert.Equal(t, 14975, payment.DiscountAmount)
+	require.NotNil(t, payment.DiscountCodeID)
+	assert.Equal(t, 3, *payment.DiscountCodeID)
+	assert.Equal(t, "WELCOME", payment.Metadata["discount_code"])
+
+	require.Len(t, env.issuer.paid, 1)
+	assert.Equal(t, 59900, env.issuer.paid[0].Amount, "renewals are charged the full price")
+
+	_, err = env.service.CreatePaymentIntent(env.userID, 7, 20000, &Discount{CodeID: 3, Code: "WELCOME", Amount: 20000})
+	assert.ErrorIs(t, err, ErrInvalidDiscount, "a discount cannot make a payment free")
+}
+
+func TestDiscountUsedUp(t *testing.T) {
+	env := newTestEnv(t)
+	result, err := env.db.Exec(`
+		INSERT INTO discount_codes (tenant_id, code, percent_off, max_uses, max_uses_per_user)
+		VALUES (1, 'LAST', 10, 1, 0)`)
+	require.NoError(t, err)
+	codeID, err := result.LastInsertId()
+	require.NoError(t, err)
+	discount := &Discount{CodeID: int(codeID), Code: "LAST", Amount: 2000}
+
+	// Two members start paying with the code's last use
+	first, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, discount)
+	require.NoError(t, err)
+	second, err := env.service.CreatePaymentIntent(env.userID, 8, 20000, discount)
+	require.NoError(t, err)
+	for _, pi := range []*Intent{first, second} {
+		_, err = env.provider.Pay(pi.ID)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, env.service.ConfirmPayment(first.ID))
+	assert.ErrorIs(t, env.service.ConfirmPayment(second.ID), ErrDiscountUsedUp)
+	assert.Equal(t, []string{first.ID}, env.booker.confirmed, "only the first payment books its class")
+	assert.Equal(t, StatusRefunded, env.status(t, second.ID))
+	assert.Equal(t, 18000, env.provider.Refunded(second.ID))
+
+	payment, err := env.service.GetPayment(second.ID)
+	require.NoError(t, err)
+	assert.Nil(t, payment.DiscountCodeID, "the refunded payment is not a use of the code")
+	refunds, err := env.service.Refunds(second.ID)
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	assert.Equal(t, refundReasonDiscountUsedUp, refunds[0].Reason)
+
+	require.NoError(t, env.service.ConfirmPayment(second.ID), "confirming again does nothing")
+	assert.Len(t, env.booker.confirmed, 1)
+}
+
+func TestChargeRenewal(t *testing.T) {
+	env := newTestEnv(t)
+	env.provider.AutoPay = true
+	pi, err := env.service.CreateSubscriptionPaymentIntent(env.userID, "", "monthly", 0, 59900, nil)
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	method := env.issuer.paid[0].PaymentMethod
+
+	renewal, err := env.service.ChargeRenewal(env.userID, 3, "monthly", 59900, method, "renewal-3-20250301")
+	require.NoError(t, err)
+	assert.Equal(t, StatusSucceeded, renewal.Status)
+	assert.Equal(t, StatusSucceeded, env.status(t, renewal.ID))
+	require.Len(t, env.issuer.paid, 2)
+	assert.Equal(t, 3, env.issuer.paid[1].MembershipID)
+	assert.Equal(t, renewal.ID, env.issuer.paid[1].PaymentID)
+
+	again, err := env.service.ChargeRenewal(env.userID, 3, "monthly", 59900, method, "renewal-3-20250301")
+	require.NoError(t, err)
+	assert.Equal(t, renewal.ID, again.ID, "charging with the same key returns the first charge")
+	assert.Len(t, env.issuer.paid, 2, "the membership is renewed once")
+
+	env.provider.Script(ScenarioDecline)
+	declined, err := env.service.ChargeRenewal(env.userID, 3, "monthly", 59900, method, "renewal-3-20250401")
+	require.NoError(t, err)
+	assert.Equal(t, StatusRequiresPaymentMethod, declined.Status)
+	assert.NotEmpty(t, declined.FailureMessage)
+	assert.Equal(t, StatusRequiresPaymentMethod, env.status(t, declined.ID), "the declined charge is recorded")
+	assert.Len(t, env.issuer.paid, 2)
+
+	_, err = env.service.ChargeRenewal(env.userID, 3, "monthly", 59900, "pm_unknown", "renewal-3-20250501")
+	assert.Error(t, err)
+}
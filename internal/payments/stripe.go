@@ -0,0 +1,161 @@
+package payments
+
+import (
+	"fmt"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/client"
+)
+
+// StripeProvider takes payments through Stripe
+type StripeProvider struct {
+	// WebhookSecret is the signing secret of the webhook endpoint;
+	// webhooks are rejected without it
+	WebhookSecret string
+
+	api *client.API
+}
+
+// NewStripeProvider creates a provider using the Stripe secret key
+func NewStripeProvider(key string) *StripeProvider {
+	return &StripeProvider{api: client.New(key, nil)}
+}
+
+func (p *StripeProvider) Name() string {
+	return "stripe"
+}
+
+// ParseWebhook verifies a webhook with the Stripe-Signature header it
+// came with
+func (p *StripeProvider) ParseWebhook(payload []byte, signature string) (*WebhookEvent, error) {
+	return parseStripeWebhook(payload, signature, p.WebhookSecret)
+}
+
+func (p *StripeProvider) CreateIntent(params IntentParams) (*Intent, error) {
+	pi, err := p.api.PaymentIntents.New(stripeIntentParams(params))
+	if err != nil {
+		return nil, err
+	}
+	return stripeIntent(pi), nil
+}
+
+// ChargeSaved charges a card saved with the customer, confirming the
+// payment straight away. Cards that are declined or need the member to
+// authenticate come back as intents that have not succeeded.
+func (p *StripeProvider) ChargeSaved(params IntentParams, paymentMethod string) (*Intent, error) {
+	piParams := stripeIntentParams(params)
+	piParams.PaymentMethod = stripe.String(paymentMethod)
+	piParams.OffSession = stripe.Bool(true)
+	piParams.Confirm = stripe.Bool(true)
+
+	pi, err := p.api.PaymentIntents.New(piParams)
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.PaymentIntent != nil {
+			intent := stripeIntent(stripeErr.PaymentIntent)
+			if intent.FailureMessage == "" {
+				intent.FailureMessage = stripeErr.Msg
+			}
+			return intent, nil
+		}
+		return nil, err
+	}
+	return stripeIntent(pi), nil
+}
+
+func (p *StripeProvider) GetIntent(id string) (*Intent, error) {
+	pi, err := p.api.PaymentIntents.Get(id, nil)
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+			return nil, ErrIntentNotFound
+		}
+		return nil, err
+	}
+	return stripeIntent(pi), nil
+}
+
+func (p *StripeProvider) Capture(intentID string, amount int) (*Intent, error) {
+	pi, err := p.api.PaymentIntents.Capture(intentID, &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: stripe.Int64(int64(amount)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stripeIntent(pi), nil
+}
+
+func (p *StripeProvider) Refund(intentID string, amount int, idempotencyKey string) error {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(intentID),
+		Amount:        stripe.Int64(int64(amount)),
+	}
+	params.SetIdempotencyKey(idempotencyKey)
+	_, err := p.api.Refunds.New(params)
+	if err == nil {
+		return nil
+	}
+	// Only errors Stripe answered with below 500 are known not to have refunded
+	if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.HTTPStatusCode < 500 {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+}
+
+func (p *StripeProvider) Customer(params CustomerParams) (string, error) {
+	customers := p.api.Customers.List(&stripe.CustomerListParams{
+		Email: stripe.String(params.Email),
+	})
+	if customers.Next() {
+		return customers.Customer().ID, nil
+	}
+	if err := customers.Err(); err != nil {
+		return "", err
+	}
+
+	c, err := p.api.Customers.New(&stripe.CustomerParams{
+		Email:    stripe.String(params.Email),
+		Name:     stripe.String(params.Name),
+		Metadata: params.Metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+func stripeIntentParams(params IntentParams) *stripe.PaymentIntentParams {
+	piParams := &stripe.PaymentIntentParams{
+		Amount:      stripe.Int64(int64(params.Amount)),
+		Currency:    stripe.String(params.Currency),
+		Customer:    stripe.String(params.CustomerID),
+		Description: stripe.String(params.Description),
+		Metadata:    params.Metadata,
+	}
+	if params.SaveMethod {
+		piParams.SetupFutureUsage = stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession))
+	}
+	if params.IdempotencyKey != "" {
+		piParams.SetIdempotencyKey(params.IdempotencyKey)
+	}
+	return piParams
+}
+
+func stripeIntent(pi *stripe.PaymentIntent) *Intent {
+	intent := &Intent{
+		ID:           pi.ID,
+		ClientSecret: pi.ClientSecret,
+		Status:       string(pi.Status),
+		Amount:       int(pi.Amount),
+		Currency:     string(pi.Currency),
+		Metadata:     pi.Metadata,
+	}
+	if pi.Customer != nil {
+		intent.CustomerID = pi.Customer.ID
+	}
+	if pi.PaymentMethod != nil {
+		intent.PaymentMethod = pi.PaymentMethod.ID
+	}
+	if pi.LastPaymentError != nil {
+		intent.FailureMessage = pi.LastPaymentError.Msg
+	}
+	return intent
+}
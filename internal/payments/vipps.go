@@ -0,0 +1,407 @@
+package payments
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VippsProductionURL is the base URL of the Vipps MobilePay API;
+// https://apitest.vipps.no is the test environment
+const VippsProductionURL = "https://api.vipps.no"
+
+// vippsWebhookTolerance is how far a webhook's x-ms-date may be from now
+const vippsWebhookTolerance = 5 * time.Minute
+
+// Vipps ePayment states
+const (
+	vippsCreated    = "CREATED"
+	vippsAuthorized = "AUTHORIZED"
+	vippsAborted    = "ABORTED"
+	vippsExpired    = "EXPIRED"
+	vippsTerminated = "TERMINATED"
+)
+
+var ErrUnsupportedCurrency = errors.New("currency not supported by the payment provider")
+
+// VippsConfig holds a merchant's Vipps MobilePay API credentials
+type VippsConfig struct {
+	BaseURL              string // VippsProductionURL if empty
+	ClientID             string
+	ClientSecret         string
+	SubscriptionKey      string
+	MerchantSerialNumber string
+	ReturnURL            string // Where members land after paying; the payment is added as ?payment_intent=
+	WebhookSecret        string // Signs the webhooks Vipps sends about payments
+}
+
+// VippsProvider takes payments in the Vipps MobilePay app through the
+// ePayment API. Members are sent to Vipps to approve a payment and come
+// back to the return URL; the payment is then captured.
+type VippsProvider struct {
+	config VippsConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewVippsProvider creates a provider for the merchant
+func NewVippsProvider(config VippsConfig) *VippsProvider {
+	if config.BaseURL == "" {
+		config.BaseURL = VippsProductionURL
+	}
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	return &VippsProvider{
+		config: config,
+		client: &http.Client{Timeout: 15 * time.Second},
+		now:    time.Now,
+	}
+}
+
+func (p *VippsProvider) Name() string {
+	return "vipps"
+}
+
+// vippsAmount is an amount in øre
+type vippsAmount struct {
+	Currency string `json:"currency"`
+	Value    int    `json:"value"`
+}
+
+// vippsPayment is a payment as the ePayment API returns it
+type vippsPayment struct {
+	Reference string      `json:"reference"`
+	State     string      `json:"state"`
+	Amount    vippsAmount `json:"amount"`
+	Aggregate struct {
+		AuthorizedAmount vippsAmount `json:"authorizedAmount"`
+		CapturedAmount   vippsAmount `json:"capturedAmount"`
+		RefundedAmount   vippsAmount `json:"refundedAmount"`
+		CancelledAmount  vippsAmount `json:"cancelledAmount"`
+	} `json:"aggregate"`
+}
+
+// vippsProblem is the body of a failed API call
+type vippsProblem struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (p *VippsProvider) CreateIntent(params IntentParams) (*Intent, error) {
+	if !strings.EqualFold(params.Currency, "NOK") {
+		return nil, fmt.Errorf("%w: Vipps only takes NOK, not %s", ErrUnsupportedCurrency, params.Currency)
+	}
+
+	reference, err := vippsReference()
+	if err != nil {
+		return nil, err
+	}
+	returnURL, err := withQuery(p.config.ReturnURL, "payment_intent", reference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vipps return URL: %w", err)
+	}
+
+	body := map[string]interface{}{
+		"amount":             vippsAmount{Currency: "NOK", Value: params.Amount},
+		"paymentMethod":      map[string]string{"type": "WALLET"},
+		"reference":          reference,
+		"returnUrl":          returnURL,
+		"userFlow":           "WEB_REDIRECT",
+		"paymentDescription": params.Description,
+	}
+	var created struct {
+		RedirectURL string `json:"redirectUrl"`
+		Reference   string `json:"reference"`
+	}
+	if err := p.call(http.MethodPost, "/epayment/v1/payments", reference, body, &created); err != nil {
+		return nil, err
+	}
+
+	return &Intent{
+		ID:          created.Reference,
+		RedirectURL: created.RedirectURL,
+		Status:      StatusRequiresPaymentMethod,
+		Amount:      params.Amount,
+		Currency:    "nok",
+		Metadata:    params.Metadata,
+	}, nil
+}
+
+func (p *VippsProvider) GetIntent(id string) (*Intent, error) {
+	var payment vippsPayment
+	if err := p.call(http.MethodGet, "/epayment/v1/payments/"+url.PathEscape(id), "", nil, &payment); err != nil {
+		return nil, err
+	}
+	return payment.intent(), nil
+}
+
+// Capture charges an authorized payment. Klippekort, memberships and
+// class seats are delivered as soon as they are paid for, so payments are
+// captured when they are confirmed.
+func (p *VippsProvider) Capture(intentID string, amount int) (*Intent, error) {
+	body := map[string]interface{}{"modificationAmount": vippsAmount{Currency: "NOK", Value: amount}}
+	var payment vippsPayment
+	path := "/epayment/v1/payments/" + url.PathEscape(intentID) + "/capture"
+	if err := p.call(http.MethodPost, path, "capture-"+intentID, body, &payment); err != nil {
+		return nil, err
+	}
+	return payment.intent(), nil
+}
+
+func (p *VippsProvider) Refund(intentID string, amount int, idempotencyKey string) error {
+	body := map[string]interface{}{"modificationAmount": vippsAmount{Currency: "NOK", Value: amount}}
+	path := "/epayment/v1/payments/" + url.PathEscape(intentID) + "/refund"
+	return p.call(http.MethodPost, path, idempotencyKey, body, nil)
+}
+
+// Customer returns no ID: members identify themselves in the Vipps app
+func (p *VippsProvider) Customer(params CustomerParams) (string, error) {
+	return "", nil
+}
+
+// intent maps a Vipps payment onto a payment intent. An authorized
+// payment has succeeded once all of it is captured.
+func (v *vippsPayment) intent() *Intent {
+	intent := &Intent{
+		ID:       v.Reference,
+		Amount:   v.Amount.Value,
+		Currency: strings.ToLower(v.Amount.Currency),
+	}
+	switch v.State {
+	case vippsCreated:
+		intent.Status = StatusRequiresPaymentMethod
+	case vippsAuthorized:
+		intent.Status = StatusRequiresCapture
+		if v.Aggregate.CapturedAmount.Value >= v.Amount.Value {
+			intent.Status = StatusSucceeded
+		}
+	case vippsAborted:
+		intent.Status = StatusCanceled
+		intent.FailureMessage = "The payment was cancelled in Vipps."
+	case vippsExpired:
+		intent.Status = StatusCanceled
+		intent.FailureMessage = "The payment was not approved in Vipps in time."
+	case vippsTerminated:
+		intent.Status = StatusCanceled
+	default:
+		intent.Status = StatusProcessing
+	}
+	return intent
+}
+
+// call makes an authenticated ePayment API call, decoding the response
+// into out if it is not nil. Calls that change payments send an
+// idempotency key so Vipps applies a retried call only once.
+func (p *VippsProvider) call(method, path, idempotencyKey string, body, out interface{}) error {
+	token, err := p.accessToken()
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, p.config.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Ocp-Apim-Subscription-Key", p.config.SubscriptionKey)
+	req.Header.Set("Merchant-Serial-Number", p.config.MerchantSerialNumber)
+	req.Header.Set("Vipps-System-Name", "samskipnad")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrIntentNotFound
+	}
+	if resp.StatusCode >= 300 {
+		var problem vippsProblem
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&problem)
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("%w: Vipps returned %s", ErrProviderUnavailable, resp.Status)
+		}
+		return fmt.Errorf("Vipps returned %s: %s %s", resp.Status, problem.Title, problem.Detail)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// accessToken returns a cached access token, fetching a new one shortly
+// before the old one expires
+func (p *VippsProvider) accessToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && p.now().Before(p.tokenExpiry) {
+		return p.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.config.BaseURL+"/accesstoken/get", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("client_id", p.config.ClientID)
+	req.Header.Set("client_secret", p.config.ClientSecret)
+	req.Header.Set("Ocp-Apim-Subscription-Key", p.config.SubscriptionKey)
+	req.Header.Set("Merchant-Serial-Number", p.config.MerchantSerialNumber)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get Vipps access token: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"` // Seconds, sent as a string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to read Vipps access token: %w", err)
+	}
+	seconds, err := token.ExpiresIn.Int64()
+	if err != nil {
+		return "", fmt.Errorf("failed to read Vipps access token: %w", err)
+	}
+
+	p.token = token.AccessToken
+	p.tokenExpiry = p.now().Add(time.Duration(seconds)*time.Second - time.Minute)
+	return p.token, nil
+}
+
+// VippsEvent is a webhook Vipps sends when a payment changes
+type VippsEvent struct {
+	Reference    string      `json:"reference"`
+	PSPReference string      `json:"pspReference"` // Vipps' reference of the change, kept on redeliveries
+	Name         string      `json:"name"`         // CREATED, AUTHORIZED, CAPTURED, REFUNDED, ABORTED, EXPIRED, CANCELLED or TERMINATED
+	Amount       vippsAmount `json:"amount"`
+	Success      bool        `json:"success"`
+}
+
+// ParseWebhookRequest verifies a webhook request, whose body has already
+// been read, and reads its event for Service.HandleWebhookEvent. Refund
+// events carry only the amount of that refund, so the total refunded is
+// looked up with Vipps.
+func (p *VippsProvider) ParseWebhookRequest(r *http.Request, body []byte) (*WebhookEvent, error) {
+	event, err := p.VerifyWebhook(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &WebhookEvent{ID: event.Name + ":" + event.PSPReference, IntentID: event.Reference}
+	switch event.Name {
+	case "REFUNDED":
+		var payment vippsPayment
+		path := "/epayment/v1/payments/" + url.PathEscape(event.Reference)
+		if err := p.call(http.MethodGet, path, "", nil, &payment); err != nil {
+			return nil, err
+		}
+		parsed.Type = EventChargeRefunded
+		parsed.RefundedAmount = payment.Aggregate.RefundedAmount.Value
+	case "ABORTED", "EXPIRED", "CANCELLED", "TERMINATED":
+		parsed.Type = EventPaymentFailed
+	default:
+		// Payments are looked up again when confirmed, so events
+		// arriving out of order do no harm
+		parsed.Type = EventPaymentSucceeded
+	}
+	return parsed, nil
+}
+
+// VerifyWebhook checks the HMAC signature of a webhook request, whose
+// body has already been read, and returns its event
+func (p *VippsProvider) VerifyWebhook(r *http.Request, body []byte) (*VippsEvent, error) {
+	if p.config.WebhookSecret == "" {
+		return nil, fmt.Errorf("%w: no webhook secret configured", ErrInvalidWebhook)
+	}
+
+	sum := sha256.Sum256(body)
+	contentHash := base64.StdEncoding.EncodeToString(sum[:])
+	if r.Header.Get("X-Ms-Content-Sha256") != contentHash {
+		return nil, fmt.Errorf("%w: content hash does not match", ErrInvalidWebhook)
+	}
+
+	date := r.Header.Get("X-Ms-Date")
+	sent, err := http.ParseTime(date)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid date", ErrInvalidWebhook)
+	}
+	if age := p.now().Sub(sent); age > vippsWebhookTolerance || age < -vippsWebhookTolerance {
+		return nil, fmt.Errorf("%w: sent at %s", ErrInvalidWebhook, date)
+	}
+
+	signed := vippsSignature(p.config.WebhookSecret, r.Method, r.URL.RequestURI(), date, r.Host, contentHash)
+	_, signature, _ := strings.Cut(r.Header.Get("Authorization"), "&Signature=")
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(signed)) != 1 {
+		return nil, ErrInvalidWebhook
+	}
+
+	var event VippsEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+	return &event, nil
+}
+
+// vippsSignature signs a webhook the way Vipps does: an HMAC-SHA256 of the
+// method, path and query, date, host and content hash
+func vippsSignature(secret, method, pathAndQuery, date, host, contentHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + pathAndQuery + "\n" + date + ";" + host + ";" + contentHash))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// vippsReference returns a new payment reference; Vipps allows 8-64
+// letters, digits and dashes
+func vippsReference() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "samskipnad-" + hex.EncodeToString(b), nil
+}
+
+func withQuery(rawURL, key, value string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,198 @@
+package payments
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/payments/vippstest"
+)
+
+const testWebhookSecret = "webhook-secret"
+
+func newVippsProvider(t *testing.T) (*VippsProvider, *vippstest.Server) {
+	stub := vippstest.NewServer()
+	t.Cleanup(stub.Close)
+	provider := NewVippsProvider(VippsConfig{
+		BaseURL:              stub.URL,
+		ClientID:             vippstest.ClientID,
+		ClientSecret:         vippstest.ClientSecret,
+		SubscriptionKey:      vippstest.SubscriptionKey,
+		MerchantSerialNumber: vippstest.MerchantSerialNumber,
+		ReturnURL:            "https://studio.example/payment/success",
+		WebhookSecret:        testWebhookSecret,
+	})
+	return provider, stub
+}
+
+func TestVippsPayment(t *testing.T) {
+	env := newTestEnv(t)
+	provider, stub := newVippsProvider(t)
+	env.useProvider(provider)
+
+	pi, err := env.service.CreateKlippekortPaymentIntent(env.userID, "yoga", 10, 0, 135000, nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(pi.RedirectURL, stub.URL), "members approve the payment with Vipps")
+
+	sent, ok := stub.Payment(pi.ID)
+	require.True(t, ok)
+	assert.Equal(t, 135000, sent.Amount)
+	assert.Equal(t, "Klippekort", sent.Description)
+	returnURL, err := url.Parse(sent.ReturnURL)
+	require.NoError(t, err)
+	assert.Equal(t, pi.ID, returnURL.Query().Get("payment_intent"))
+
+	assert.ErrorIs(t, env.service.ConfirmPayment(pi.ID), ErrPaymentNotSucceeded, "not approved yet")
+
+	require.NoError(t, stub.Approve(pi.ID))
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	captured, _ := stub.Payment(pi.ID)
+	assert.Equal(t, 135000, captured.Captured, "approved payments are captured")
+	assert.Equal(t, StatusSucceeded, env.status(t, pi.ID))
+
+	require.NoError(t, env.service.ConfirmPayment(pi.ID), "the webhook and the member's return both confirm")
+	var cards, klipp int
+	require.NoError(t, env.db.QueryRow(`SELECT COUNT(*), SUM(klipp_left) FROM klippekort WHERE payment_id = ?`, pi.ID).
+		Scan(&cards, &klipp))
+	assert.Equal(t, 1, cards)
+	assert.Equal(t, 10, klipp, "what was bought is kept with the payment, not in Vipps")
+
+	require.NoError(t, env.service.RefundPayment(pi.ID, 13500))
+	refunded, _ := stub.Payment(pi.ID)
+	assert.Equal(t, 13500, refunded.Refunded)
+	assert.Equal(t, StatusPartiallyRefunded, env.status(t, pi.ID))
+	require.NoError(t, env.service.RefundPayment(pi.ID, 13500), "a second refund of the same amount is not a retry")
+	refunded, _ = stub.Payment(pi.ID)
+	assert.Equal(t, 27000, refunded.Refunded)
+
+	t.Run("Aborted", func(t *testing.T) {
+		pi, err := env.service.CreatePaymentIntent(env.userID, 7, 25000, nil)
+		require.NoError(t, err)
+		require.NoError(t, stub.Abort(pi.ID))
+
+		assert.ErrorIs(t, env.service.ConfirmPayment(pi.ID), ErrPaymentNotSucceeded)
+		assert.Equal(t, StatusCanceled, env.status(t, pi.ID))
+		assert.Empty(t, env.booker.confirmed)
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		stub.Fail(http.StatusServiceUnavailable)
+		_, err := env.service.CreatePaymentIntent(env.userID, 7, 25000, nil)
+		assert.ErrorIs(t, err, ErrProviderUnavailable)
+	})
+
+	t.Run("OnlyNOK", func(t *testing.T) {
+		community := &config.Community{}
+		community.Pricing.Currency = "USD"
+		env.service.community = func() *config.Community { return community }
+		_, err := env.service.CreatePaymentIntent(env.userID, 7, 25000, nil)
+		assert.ErrorIs(t, err, ErrUnsupportedCurrency)
+	})
+
+	t.Run("OtherProvider", func(t *testing.T) {
+		env.useProvider(NewFakeProvider())
+		assert.Error(t, env.service.RefundPayment(pi.ID, 100), "Vipps payments are refunded through Vipps")
+	})
+}
+
+func TestVippsWebhook(t *testing.T) {
+	provider, stub := newVippsProvider(t)
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	provider.now = func() time.Time { return now }
+	const target = "https://studio.example/webhooks/vipps?tenant=1"
+
+	verify := func(req *http.Request) (*VippsEvent, error) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		return provider.VerifyWebhook(req, body)
+	}
+
+	req, err := stub.WebhookRequest(target, testWebhookSecret, "samskipnad-abc123", "AUTHORIZED", now)
+	require.NoError(t, err)
+	event, err := verify(req)
+	require.NoError(t, err)
+	assert.Equal(t, "samskipnad-abc123", event.Reference)
+	assert.Equal(t, "AUTHORIZED", event.Name)
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		req, err := stub.WebhookRequest(target, "guessed", "samskipnad-abc123", "AUTHORIZED", now)
+		require.NoError(t, err)
+		_, err = verify(req)
+		assert.ErrorIs(t, err, ErrInvalidWebhook)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		req, err := stub.WebhookRequest(target, testWebhookSecret, "samskipnad-abc123", "AUTHORIZED", now)
+		require.NoError(t, err)
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		req.Body = io.NopCloser(bytes.NewReader(bytes.Replace(body, []byte("abc123"), []byte("xyz789"), 1)))
+		_, err = verify(req)
+		assert.ErrorIs(t, err, ErrInvalidWebhook)
+	})
+
+	t.Run("Replayed", func(t *testing.T) {
+		req, err := stub.WebhookRequest(target, testWebhookSecret, "samskipnad-abc123", "AUTHORIZED", now.Add(-time.Hour))
+		require.NoError(t, err)
+		_, err = verify(req)
+		assert.ErrorIs(t, err, ErrInvalidWebhook)
+	})
+}
+
+func TestVippsRefundWebhook(t *testing.T) {
+	env := newTestEnv(t)
+	provider, stub := newVippsProvider(t)
+	env.useProvider(provider)
+	now := time.Now()
+	const target = "https://studio.example/webhooks/vipps"
+
+	parse := func(reference, name string) *WebhookEvent {
+		req, err := stub.WebhookRequest(target, testWebhookSecret, reference, name, now)
+		require.NoError(t, err)
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		event, err := provider.ParseWebhookRequest(req, body)
+		require.NoError(t, err)
+		return event
+	}
+
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 25000, nil)
+	require.NoError(t, err)
+	require.NoError(t, stub.Approve(pi.ID))
+	authorized := parse(pi.ID, "AUTHORIZED")
+	assert.Equal(t, EventPaymentSucceeded, authorized.Type)
+	require.NoError(t, env.service.HandleWebhookEvent("vipps", authorized))
+	assert.Equal(t, StatusSucceeded, env.status(t, pi.ID))
+
+	// Refunded in the Vipps portal
+	require.NoError(t, provider.Refund(pi.ID, 10000, "portal-1"))
+	refunded := parse(pi.ID, "REFUNDED")
+	assert.Equal(t, EventChargeRefunded, refunded.Type)
+	assert.Equal(t, 10000, refunded.RefundedAmount)
+	require.NoError(t, env.service.HandleWebhookEvent("vipps", refunded))
+	require.NoError(t, env.service.HandleWebhookEvent("vipps", refunded), "redeliveries are ignored")
+
+	payment, err := env.service.GetPayment(pi.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10000, payment.RefundedAmount)
+	assert.Equal(t, StatusPartiallyRefunded, payment.Status)
+
+	require.NoError(t, provider.Refund(pi.ID, 15000, "portal-2"))
+	require.NoError(t, env.service.HandleWebhookEvent("vipps", parse(pi.ID, "REFUNDED")))
+
+	refunds, err := env.service.Refunds(pi.ID)
+	require.NoError(t, err)
+	require.Len(t, refunds, 2)
+	assert.Equal(t, "Refunded with vipps", refunds[1].Reason)
+	assert.Equal(t, ReversedBooking, refunds[1].Reversed)
+	assert.Equal(t, []string{pi.ID}, env.booker.cancelled)
+	assert.Equal(t, StatusRefunded, env.status(t, pi.ID))
+}
@@ -0,0 +1,352 @@
+// Package vippstest runs a local stand-in for the Vipps MobilePay
+// ePayment API, for tests and for trying Vipps payments without a
+// merchant agreement
+package vippstest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials the server accepts
+const (
+	ClientID             = "test-client-id"
+	ClientSecret         = "test-client-secret"
+	SubscriptionKey      = "test-subscription-key"
+	MerchantSerialNumber = "123456"
+)
+
+// Payment is a payment as the server keeps it, amounts in øre
+type Payment struct {
+	Reference   string
+	State       string
+	Amount      int
+	Authorized  int
+	Captured    int
+	Refunded    int
+	Description string
+	ReturnURL   string
+
+	createdWith string // Idempotency key of the call that created it
+}
+
+// Server is an httptest server answering the access token and ePayment
+// endpoints the payments package uses. Members approving payments in the
+// app is simulated with Approve and Abort.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	payments map[string]*Payment
+	keys     map[string]bool // Idempotency keys of captures and refunds already applied
+	tokens   map[string]bool
+	failures []int
+	webhooks int
+}
+
+// NewServer starts a server; close it with Close
+func NewServer() *Server {
+	s := &Server{
+		payments: make(map[string]*Payment),
+		keys:     make(map[string]bool),
+		tokens:   make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /accesstoken/get", s.accessToken)
+	mux.HandleFunc("POST /epayment/v1/payments", s.authorized(s.create))
+	mux.HandleFunc("GET /epayment/v1/payments/{reference}", s.authorized(s.get))
+	mux.HandleFunc("POST /epayment/v1/payments/{reference}/capture", s.authorized(s.capture))
+	mux.HandleFunc("POST /epayment/v1/payments/{reference}/refund", s.authorized(s.refund))
+	mux.HandleFunc("GET /landing", s.landing)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Approve approves a payment in the app, authorizing its full amount
+func (s *Server) Approve(reference string) error {
+	return s.transition(reference, func(p *Payment) {
+		p.State = "AUTHORIZED"
+		p.Authorized = p.Amount
+	})
+}
+
+// Abort cancels a payment in the app
+func (s *Server) Abort(reference string) error {
+	return s.transition(reference, func(p *Payment) { p.State = "ABORTED" })
+}
+
+// Expire lets a payment time out without being approved
+func (s *Server) Expire(reference string) error {
+	return s.transition(reference, func(p *Payment) { p.State = "EXPIRED" })
+}
+
+// Payment returns a copy of the payment with the reference
+func (s *Server) Payment(reference string) (Payment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.payments[reference]
+	if !ok {
+		return Payment{}, false
+	}
+	return *p, true
+}
+
+// Fail makes the next ePayment calls answer with the status codes, in
+// order, as when Vipps has an outage
+func (s *Server) Fail(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// WebhookRequest builds the signed webhook Vipps sends to target when a
+// payment changes
+func (s *Server) WebhookRequest(target, secret, reference, name string, sent time.Time) (*http.Request, error) {
+	s.mu.Lock()
+	p, ok := s.payments[reference]
+	amount := 0
+	if ok {
+		amount = p.Amount
+	}
+	s.webhooks++
+	pspReference := fmt.Sprintf("%s-%d", reference, s.webhooks)
+	s.mu.Unlock()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"msn":          MerchantSerialNumber,
+		"reference":    reference,
+		"pspReference": pspReference,
+		"name":         name,
+		"amount":       map[string]interface{}{"currency": "NOK", "value": amount},
+		"timestamp":    sent.UTC().Format(time.RFC3339),
+		"success":      true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	contentHash := base64.StdEncoding.EncodeToString(sum[:])
+	date := sent.UTC().Format(http.TimeFormat)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s;%s;%s", req.Method, req.URL.RequestURI(), date, req.Host, contentHash)
+
+	req.Header.Set("X-Ms-Date", date)
+	req.Header.Set("X-Ms-Content-Sha256", contentHash)
+	req.Header.Set("Authorization", "HMAC-SHA256 SignedHeaders=x-ms-date;host;x-ms-content-sha256&Signature="+
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return req, nil
+}
+
+func (s *Server) transition(reference string, change func(*Payment)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.payments[reference]
+	if !ok {
+		return fmt.Errorf("no payment %q", reference)
+	}
+	if p.State != "CREATED" {
+		return fmt.Errorf("payment %q is %s", reference, p.State)
+	}
+	change(p)
+	return nil
+}
+
+func (s *Server) accessToken(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("client_id") != ClientID || r.Header.Get("client_secret") != ClientSecret ||
+		r.Header.Get("Ocp-Apim-Subscription-Key") != SubscriptionKey {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	token := fmt.Sprintf("token-%d", len(s.tokens)+1)
+	s.tokens[token] = true
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"token_type":   "Bearer",
+		"expires_in":   "3600",
+		"access_token": token,
+	})
+}
+
+// authorized checks the headers every ePayment call must send and
+// answers with any failure scripted with Fail
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		validToken := s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		failure := 0
+		if len(s.failures) > 0 {
+			failure, s.failures = s.failures[0], s.failures[1:]
+		}
+		s.mu.Unlock()
+
+		switch {
+		case !validToken || r.Header.Get("Ocp-Apim-Subscription-Key") != SubscriptionKey:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case r.Header.Get("Merchant-Serial-Number") != MerchantSerialNumber:
+			problem(w, http.StatusForbidden, "Unknown merchant")
+		case failure != 0:
+			problem(w, failure, "Scripted failure")
+		default:
+			next(w, r)
+		}
+	}
+}
+
+type amount struct {
+	Currency string `json:"currency"`
+	Value    int    `json:"value"`
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Amount             amount `json:"amount"`
+		Reference          string `json:"reference"`
+		ReturnURL          string `json:"returnUrl"`
+		UserFlow           string `json:"userFlow"`
+		PaymentDescription string `json:"paymentDescription"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch {
+	case req.Amount.Currency != "NOK" || req.Amount.Value <= 0:
+		problem(w, http.StatusBadRequest, "Invalid amount")
+		return
+	case len(req.Reference) < 8 || len(req.Reference) > 64:
+		problem(w, http.StatusBadRequest, "Invalid reference")
+		return
+	case req.UserFlow != "WEB_REDIRECT" || req.ReturnURL == "":
+		problem(w, http.StatusBadRequest, "A return URL is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := r.Header.Get("Idempotency-Key")
+	if existing, ok := s.payments[req.Reference]; ok && (key == "" || existing.createdWith != key) {
+		problem(w, http.StatusConflict, "Reference already used")
+		return
+	} else if !ok {
+		s.payments[req.Reference] = &Payment{
+			Reference:   req.Reference,
+			State:       "CREATED",
+			Amount:      req.Amount.Value,
+			Description: req.PaymentDescription,
+			ReturnURL:   req.ReturnURL,
+			createdWith: key,
+		}
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"redirectUrl": s.URL + "/landing?reference=" + req.Reference,
+		"reference":   req.Reference,
+	})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.payments[r.PathValue("reference")]
+	if !ok {
+		problem(w, http.StatusNotFound, "Payment not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, p.response())
+}
+
+func (s *Server) capture(w http.ResponseWriter, r *http.Request) {
+	s.modify(w, r, func(p *Payment, value int) string {
+		if p.State != "AUTHORIZED" || p.Captured+value > p.Authorized {
+			return "Cannot capture more than is authorized"
+		}
+		p.Captured += value
+		return ""
+	})
+}
+
+func (s *Server) refund(w http.ResponseWriter, r *http.Request) {
+	s.modify(w, r, func(p *Payment, value int) string {
+		if p.Refunded+value > p.Captured {
+			return "Cannot refund more than is captured"
+		}
+		p.Refunded += value
+		return ""
+	})
+}
+
+// modify applies a capture or refund once per idempotency key
+func (s *Server) modify(w http.ResponseWriter, r *http.Request, apply func(*Payment, int) string) {
+	var req struct {
+		ModificationAmount amount `json:"modificationAmount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ModificationAmount.Value <= 0 {
+		problem(w, http.StatusBadRequest, "Invalid amount")
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		problem(w, http.StatusBadRequest, "An idempotency key is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.payments[r.PathValue("reference")]
+	if !ok {
+		problem(w, http.StatusNotFound, "Payment not found")
+		return
+	}
+	if !s.keys[key] {
+		if reason := apply(p, req.ModificationAmount.Value); reason != "" {
+			problem(w, http.StatusBadRequest, reason)
+			return
+		}
+		s.keys[key] = true
+	}
+	writeJSON(w, http.StatusOK, p.response())
+}
+
+// landing is where members are sent to approve a payment; the server
+// shows the reference instead of the Vipps app
+func (s *Server) landing(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Approve payment %s in Vipps\n", r.URL.Query().Get("reference"))
+}
+
+func (p *Payment) response() map[string]interface{} {
+	return map[string]interface{}{
+		"reference": p.Reference,
+		"state":     p.State,
+		"amount":    amount{Currency: "NOK", Value: p.Amount},
+		"aggregate": map[string]amount{
+			"authorizedAmount": {Currency: "NOK", Value: p.Authorized},
+			"capturedAmount":   {Currency: "NOK", Value: p.Captured},
+			"refundedAmount":   {Currency: "NOK", Value: p.Refunded},
+			"cancelledAmount":  {Currency: "NOK", Value: 0},
+		},
+	}
+}
+
+func problem(w http.ResponseWriter, status int, title string) {
+	writeJSON(w, status, map[string]string{"title": title, "detail": title})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
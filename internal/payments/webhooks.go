@@ -0,0 +1,197 @@
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+// Webhook event types HandleWebhook acts on, as Stripe names them
+const (
+	EventPaymentSucceeded = "payment_intent.succeeded"
+	EventPaymentFailed    = "payment_intent.payment_failed"
+	EventChargeRefunded   = "charge.refunded"
+)
+
+var (
+	ErrInvalidWebhook      = errors.New("invalid webhook signature")
+	ErrWebhookNotSupported = errors.New("webhooks are not handled for this payment provider")
+)
+
+// WebhookEvent is a provider's notification about a payment
+type WebhookEvent struct {
+	ID             string
+	Type           string
+	IntentID       string
+	RefundedAmount int // Total refunded so far, in cents, for refunds
+}
+
+// WebhookParser is implemented by providers whose webhooks HandleWebhook
+// processes
+type WebhookParser interface {
+	// ParseWebhook verifies a webhook's signature and reads its event
+	ParseWebhook(payload []byte, signature string) (*WebhookEvent, error)
+}
+
+type webhookSignatureKey struct{}
+
+// WithWebhookSignature returns a context carrying the signature header of
+// a webhook, for services.PaymentService.HandleWebhook
+func WithWebhookSignature(ctx context.Context, signature string) context.Context {
+	return context.WithValue(ctx, webhookSignatureKey{}, signature)
+}
+
+// WebhookSignature returns the webhook signature carried by ctx
+func WebhookSignature(ctx context.Context) string {
+	signature, _ := ctx.Value(webhookSignatureKey{}).(string)
+	return signature
+}
+
+// HandleWebhook verifies and processes a webhook from the provider:
+// succeeded and failed payments are confirmed as when the member returns,
+// and refunds made with the provider directly are recorded. Events are
+// processed once; deliveries of an event already processed or being
+// processed are ignored, as are events about payments not started here.
+func (s *Service) HandleWebhook(provider string, payload []byte, signature string) error {
+	parser, ok := s.provider.(WebhookParser)
+	if !ok || provider != s.provider.Name() {
+		return ErrWebhookNotSupported
+	}
+	event, err := parser.ParseWebhook(payload, signature)
+	if err != nil {
+		return err
+	}
+	return s.HandleWebhookEvent(provider, event)
+}
+
+// HandleWebhookEvent processes an event of a webhook already verified, for
+// providers such as Vipps whose webhooks are verified against the whole
+// request. Events are processed once, however often they are delivered.
+func (s *Service) HandleWebhookEvent(provider string, event *WebhookEvent) error {
+	if provider != s.provider.Name() {
+		return ErrWebhookNotSupported
+	}
+
+	// The event is recorded before it is processed, so of concurrent
+	// deliveries only the one that records it processes it
+	result, err := s.db.Exec(`INSERT OR IGNORE INTO webhook_events (provider, event_id, event_type) VALUES (?, ?, ?)`,
+		provider, event.ID, event.Type)
+	if err != nil {
+		return fmt.Errorf("failed to record webhook event: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return nil
+	}
+
+	switch event.Type {
+	case EventPaymentSucceeded, EventPaymentFailed:
+		err = s.ConfirmPayment(event.IntentID)
+		if errors.Is(err, ErrPaymentNotSucceeded) || errors.Is(err, ErrDiscountUsedUp) {
+			// The payment's failed status or refund is recorded
+			err = nil
+		}
+	case EventChargeRefunded:
+		err = s.recordRefunded(event.IntentID, event.RefundedAmount, event.ID)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		// Forgotten so the provider's next delivery processes it again
+		if _, deleteErr := s.db.Exec(`DELETE FROM webhook_events WHERE provider = ? AND event_id = ?`,
+			provider, event.ID); deleteErr != nil {
+			log.Printf("Failed to forget webhook event %s: %v", event.ID, deleteErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// recordRefunded records that total (in cents) of a payment has been
+// refunded, as the provider's event eventID reports. Refunds already
+// recorded, such as those made by RefundPayment, which are recorded before
+// the provider makes them, are not counted again; the rest were made with
+// the provider directly and are added to the audit trail, reversing the
+// purchase as IssueRefund does once the payment is refunded in full.
+func (s *Service) recordRefunded(paymentID string, total int, eventID string) error {
+	payment, err := s.getPaymentByID(paymentID)
+	if err != nil {
+		return err
+	}
+	if total >= payment.RefundedAmount {
+		// The provider has made every refund reserved so far
+		if err := s.confirmPending(payment); err != nil {
+			return err
+		}
+	}
+	if total <= payment.RefundedAmount {
+		return nil
+	}
+
+	// Recorded only if no refund was recorded since the payment was read
+	result, err := s.db.Exec(`
+		UPDATE payments
+		SET refunded_amount = ?,
+			status = CASE WHEN ? >= amount THEN ? ELSE ? END,
+			updated_at = datetime('now')
+		WHERE id = ? AND refunded_amount = ?`,
+		total, total, StatusRefunded, StatusPartiallyRefunded, paymentID, payment.RefundedAmount)
+	if err != nil {
+		return fmt.Errorf("failed to record refund: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("payment %s was refunded while recording a refund", paymentID)
+	}
+
+	refund, err := s.recordRefund(paymentID, total-payment.RefundedAmount, "Refunded with "+payment.Provider, 0, eventID, "")
+	if err != nil || total < payment.Amount {
+		return err
+	}
+	reversed, err := s.reverse(payment, 0)
+	if err != nil {
+		// The refund is recorded, so a redelivery would not reverse it either
+		log.Printf("Failed to reverse refunded payment %s: %v", paymentID, err)
+		return nil
+	}
+	return s.recordReversal(refund.ID, reversed)
+}
+
+// parseStripeWebhook verifies a webhook signed the way Stripe signs them
+func parseStripeWebhook(payload []byte, signature, secret string) (*WebhookEvent, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("%w: no webhook secret configured", ErrInvalidWebhook)
+	}
+	event, err := webhook.ConstructEventWithOptions(payload, signature, secret, webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+
+	parsed := &WebhookEvent{ID: event.ID, Type: string(event.Type)}
+	switch parsed.Type {
+	case EventPaymentSucceeded, EventPaymentFailed:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+		}
+		parsed.IntentID = pi.ID
+	case EventChargeRefunded:
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+		}
+		if charge.PaymentIntent != nil {
+			parsed.IntentID = charge.PaymentIntent.ID
+		}
+		parsed.RefundedAmount = int(charge.AmountRefunded)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,187 @@
+package payments
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingBooker fails the first class payments it confirms
+type failingBooker struct {
+	recordingBooker
+	failures int
+}
+
+func (b *failingBooker) ConfirmPaid(userID, classID int, paymentID string) error {
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("database is locked")
+	}
+	return b.recordingBooker.ConfirmPaid(userID, classID, paymentID)
+}
+
+// eventCheckingBooker records whether the webhook event being processed
+// was already recorded when the class payment is confirmed
+type eventCheckingBooker struct {
+	recordingBooker
+	db       *sql.DB
+	recorded []bool
+}
+
+func (b *eventCheckingBooker) ConfirmPaid(userID, classID int, paymentID string) error {
+	var recorded bool
+	if err := b.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM webhook_events)`).Scan(&recorded); err != nil {
+		return err
+	}
+	b.recorded = append(b.recorded, recorded)
+	return b.recordingBooker.ConfirmPaid(userID, classID, paymentID)
+}
+
+func (env *testEnv) webhook(t *testing.T, eventType, intentID string) ([]byte, string) {
+	payload, signature, err := env.provider.Webhook(eventType, intentID)
+	require.NoError(t, err)
+	return payload, signature
+}
+
+func TestWebhookConfirmsPayment(t *testing.T) {
+	env := newTestEnv(t)
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+	_, err = env.provider.Pay(pi.ID)
+	require.NoError(t, err)
+
+	payload, signature := env.webhook(t, EventPaymentSucceeded, pi.ID)
+	require.NoError(t, env.service.HandleWebhook("fake", payload, signature))
+	assert.Equal(t, StatusSucceeded, env.status(t, pi.ID))
+	assert.Equal(t, []string{pi.ID}, env.booker.confirmed, "the member never returned")
+
+	require.NoError(t, env.service.HandleWebhook("fake", payload, signature), "the event is delivered again")
+	require.NoError(t, env.service.ConfirmPayment(pi.ID), "the member returns after all")
+	assert.Equal(t, []string{pi.ID}, env.booker.confirmed, "the class is booked once")
+
+	var events int
+	require.NoError(t, env.db.QueryRow(`SELECT COUNT(*) FROM webhook_events`).Scan(&events))
+	assert.Equal(t, 1, events)
+}
+
+func TestWebhookRecordedBeforeProcessing(t *testing.T) {
+	env := newTestEnv(t)
+	booker := &eventCheckingBooker{db: env.db}
+	env.service.SetClassBooker(booker)
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+	_, err = env.provider.Pay(pi.ID)
+	require.NoError(t, err)
+
+	payload, signature := env.webhook(t, EventPaymentSucceeded, pi.ID)
+	require.NoError(t, env.service.HandleWebhook("fake", payload, signature))
+	assert.Equal(t, []bool{true}, booker.recorded, "a delivery arriving meanwhile is ignored")
+}
+
+func TestWebhookPaymentFailed(t *testing.T) {
+	env := newTestEnv(t)
+	env.provider.Script(ScenarioAuthenticate)
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+	_, err = env.provider.Pay(pi.ID)
+	require.NoError(t, err)
+
+	payload, signature := env.webhook(t, EventPaymentFailed, pi.ID)
+	require.NoError(t, env.service.HandleWebhook("fake", payload, signature))
+	assert.Equal(t, StatusRequiresAction, env.status(t, pi.ID))
+	assert.Empty(t, env.booker.confirmed)
+}
+
+func TestWebhookRefund(t *testing.T) {
+	env := newTestEnv(t)
+	env.provider.AutoPay = true
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+
+	require.NoError(t, env.service.RefundPayment(pi.ID, 5000))
+	payload, signature := env.webhook(t, EventChargeRefunded, pi.ID)
+	require.NoError(t, env.service.HandleWebhook("fake", payload, signature))
+	payment, err := env.service.GetPayment(pi.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 5000, payment.RefundedAmount, "the refund made here is not counted twice")
+	assert.Equal(t, StatusPartiallyRefunded, payment.Status)
+
+	// Refunded in the provider's dashboard
+	require.NoError(t, env.provider.Refund(pi.ID, 15000, "re_dashboard"))
+	payload, signature = env.webhook(t, EventChargeRefunded, pi.ID)
+	require.NoError(t, env.service.HandleWebhook("fake", payload, signature))
+	payment, err = env.service.GetPayment(pi.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 20000, payment.RefundedAmount)
+	assert.Equal(t, StatusRefunded, payment.Status)
+}
+
+func TestWebhookRejected(t *testing.T) {
+	env := newTestEnv(t)
+	env.provider.AutoPay = true
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+	payload, signature := env.webhook(t, EventPaymentSucceeded, pi.ID)
+
+	t.Run("WrongSignature", func(t *testing.T) {
+		err := env.service.HandleWebhook("fake", payload, "t=1,v1=00")
+		assert.ErrorIs(t, err, ErrInvalidWebhook)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		tampered := append([]byte(nil), payload...)
+		tampered[len(tampered)-2] = ' '
+		err := env.service.HandleWebhook("fake", tampered, signature)
+		assert.ErrorIs(t, err, ErrInvalidWebhook)
+	})
+
+	t.Run("OtherProvider", func(t *testing.T) {
+		err := env.service.HandleWebhook("stripe", payload, signature)
+		assert.ErrorIs(t, err, ErrWebhookNotSupported)
+	})
+
+	t.Run("UnknownPayment", func(t *testing.T) {
+		// Started with the provider by something other than this service
+		other, err := env.provider.CreateIntent(IntentParams{Amount: 100, Currency: "nok"})
+		require.NoError(t, err)
+		payload, signature := env.webhook(t, EventPaymentSucceeded, other.ID)
+		assert.NoError(t, env.service.HandleWebhook("fake", payload, signature), "events about other payments are acknowledged")
+	})
+
+	assert.Empty(t, env.booker.confirmed)
+}
+
+func TestConfirmPaymentRetried(t *testing.T) {
+	env := newTestEnv(t)
+	booker := &failingBooker{failures: 1}
+	env.service.SetClassBooker(booker)
+	env.provider.AutoPay = true
+	pi, err := env.service.CreatePaymentIntent(env.userID, 7, 20000, nil)
+	require.NoError(t, err)
+
+	payload, signature := env.webhook(t, EventPaymentSucceeded, pi.ID)
+	assert.Error(t, env.service.HandleWebhook("fake", payload, signature))
+	assert.Equal(t, StatusRequiresPaymentMethod, env.status(t, pi.ID), "the payment is left to be processed again")
+
+	require.NoError(t, env.service.HandleWebhook("fake", payload, signature), "the provider delivers the event again")
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	assert.Equal(t, []string{pi.ID}, booker.confirmed)
+}
+
+func TestKlippekortConfirmedTwice(t *testing.T) {
+	env := newTestEnv(t)
+	env.provider.AutoPay = true
+	pi, err := env.service.CreateKlippekortPaymentIntent(env.userID, "yoga", 10, 90, 150000, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+	require.NoError(t, env.service.ConfirmPayment(pi.ID))
+
+	var cards int
+	require.NoError(t, env.db.QueryRow(`SELECT COUNT(*) FROM klippekort WHERE user_id = ?`, env.userID).Scan(&cards))
+	assert.Equal(t, 1, cards)
+}
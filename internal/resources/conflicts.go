@@ -0,0 +1,114 @@
+package resources
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Slot kinds
+const (
+	SlotClass       = "class"
+	SlotReservation = "reservation"
+)
+
+// Slot is a class or member reservation occupying a resource
+type Slot struct {
+	Kind      string
+	ID        int
+	Title     string
+	UserID    int // Member who made a reservation
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// Exclude leaves a class or reservation out of a conflict check, so that
+// moving it is not reported as a conflict with itself
+type Exclude struct {
+	ClassID       int
+	ReservationID int
+}
+
+// ConflictError reports the slots that overlap a requested period. It
+// matches ErrConflict with errors.Is.
+type ConflictError struct {
+	Resource  string
+	Conflicts []Slot
+}
+
+func (e *ConflictError) Error() string {
+	taken := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		taken[i] = fmt.Sprintf("%s %s–%s", c.Title, c.StartTime.Format("Mon Jan 2 15:04"), c.EndTime.Format("15:04"))
+	}
+	return fmt.Sprintf("%s is already booked: %s", e.Resource, strings.Join(taken, ", "))
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Queryer runs queries, either directly on the database or inside a
+// caller's transaction
+type Queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// CheckAvailable returns a *ConflictError if any active class or
+// reservation uses the resource between start and end. Run it in the
+// transaction that schedules the new slot so two slots cannot be
+// scheduled into the same period at once.
+func CheckAvailable(q Queryer, resourceID int, start, end time.Time, exclude Exclude) error {
+	if !end.After(start) {
+		return ErrInvalidTime
+	}
+
+	var name string
+	err := q.QueryRow(`SELECT name FROM resources WHERE id = ? AND active = true`, resourceID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return ErrResourceNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	conflicts, err := Overlapping(q, resourceID, start, end, exclude)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Resource: name, Conflicts: conflicts}
+	}
+	return nil
+}
+
+// Overlapping returns the active classes and reservations that use a
+// resource at some point between start and end, earliest first
+func Overlapping(q Queryer, resourceID int, start, end time.Time, exclude Exclude) ([]Slot, error) {
+	rows, err := q.Query(`
+		SELECT 'class', id, name, 0, start_time, end_time FROM classes
+		WHERE resource_id = ? AND active = true AND start_time < ? AND end_time > ? AND id != ?
+		UNION ALL
+		SELECT 'reservation', id, COALESCE(NULLIF(note, ''), 'Reservation'), user_id, start_time, end_time
+		FROM resource_reservations
+		WHERE resource_id = ? AND cancelled_at IS NULL AND start_time < ? AND end_time > ? AND id != ?
+		ORDER BY 5, 2`,
+		resourceID, end.UTC(), start.UTC(), exclude.ClassID,
+		resourceID, end.UTC(), start.UTC(), exclude.ReservationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var slots []Slot
+	for rows.Next() {
+		var slot Slot
+		if err := rows.Scan(&slot.Kind, &slot.ID, &slot.Title, &slot.UserID, &slot.StartTime, &slot.EndTime); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	return slots, rows.Err()
+}
@@ -0,0 +1,163 @@
+package resources
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"samskipnad/internal/models"
+)
+
+// Execer runs statements, either directly on the database or inside a
+// caller's transaction
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// RecordInduction inducts a member on the equipment a class trains them
+// on, if any. It is called when the member is checked in to the class, in
+// the check-in's transaction. A member who is already inducted keeps their
+// original induction.
+func RecordInduction(q Execer, classID, userID int, now time.Time) error {
+	_, err := q.Exec(`
+		INSERT OR IGNORE INTO resource_inductions (resource_id, user_id, class_id, completed_at)
+		SELECT induction_resource_id, ?, id, ? FROM classes
+		WHERE id = ? AND induction_resource_id IS NOT NULL`, userID, now.UTC(), classID)
+	if err != nil {
+		return fmt.Errorf("failed to record induction: %w", err)
+	}
+	return nil
+}
+
+// UndoInduction removes an induction recorded when a member was checked in
+// to a class, for when the check-in is undone
+func UndoInduction(q Execer, classID, userID int) error {
+	_, err := q.Exec(`DELETE FROM resource_inductions WHERE class_id = ? AND user_id = ?`, classID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to undo induction: %w", err)
+	}
+	return nil
+}
+
+// HasInduction reports whether a member has been inducted on a resource
+func (s *Service) HasInduction(resourceID, userID int) (bool, error) {
+	return hasInduction(s.db, resourceID, userID)
+}
+
+// Inducted returns the IDs of the resources a member has been inducted on
+func (s *Service) Inducted(userID int) (map[int]bool, error) {
+	rows, err := s.db.Query(`SELECT resource_id FROM resource_inductions WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inducted := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		inducted[id] = true
+	}
+	return inducted, rows.Err()
+}
+
+// Inductions returns the members inducted on a resource, most recent first
+func (s *Service) Inductions(resourceID int) ([]models.ResourceInduction, error) {
+	rows, err := s.db.Query(`
+		SELECT i.id, i.resource_id, i.user_id, i.class_id, i.granted_by, i.completed_at,
+			u.first_name || ' ' || u.last_name
+		FROM resource_inductions i
+		JOIN users u ON u.id = i.user_id
+		WHERE i.resource_id = ?
+		ORDER BY i.completed_at DESC`, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var inductions []models.ResourceInduction
+	for rows.Next() {
+		var i models.ResourceInduction
+		var classID, grantedBy sql.NullInt64
+		err := rows.Scan(&i.ID, &i.ResourceID, &i.UserID, &classID, &grantedBy, &i.CompletedAt, &i.UserName)
+		if err != nil {
+			return nil, err
+		}
+		if classID.Valid {
+			id := int(classID.Int64)
+			i.ClassID = &id
+		}
+		if grantedBy.Valid {
+			id := int(grantedBy.Int64)
+			i.GrantedBy = &id
+		}
+		inductions = append(inductions, i)
+	}
+	return inductions, rows.Err()
+}
+
+// GrantInduction records that an admin has inducted a member on a resource
+// outside an induction class
+func (s *Service) GrantInduction(resourceID, userID, adminID int) error {
+	resource, err := s.GetResource(resourceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT OR IGNORE INTO resource_inductions (resource_id, user_id, granted_by, completed_at)
+		VALUES (?, ?, ?, ?)`, resourceID, userID, adminID, s.now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to grant induction: %w", err)
+	}
+
+	s.publish(EventInductionGranted, resource.TenantID, userID, map[string]interface{}{
+		"resource_id": resourceID,
+		"granted_by":  adminID,
+	})
+	return nil
+}
+
+// RevokeInduction removes a member's induction on a resource. Their
+// existing reservations are kept.
+func (s *Service) RevokeInduction(resourceID, userID int) error {
+	_, err := s.db.Exec(`DELETE FROM resource_inductions WHERE resource_id = ? AND user_id = ?`, resourceID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke induction: %w", err)
+	}
+	return nil
+}
+
+// InductionClasses returns the upcoming classes that induct members on a
+// resource, soonest first
+func (s *Service) InductionClasses(resourceID int) ([]models.Class, error) {
+	rows, err := s.db.Query(`
+		SELECT id, tenant_id, name, start_time, end_time
+		FROM classes
+		WHERE induction_resource_id = ? AND active = true AND start_time > ?
+		ORDER BY start_time`, resourceID, s.now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var classes []models.Class
+	for rows.Next() {
+		var c models.Class
+		if err := rows.Scan(&c.ID, &c.TenantID, &c.Name, &c.StartTime, &c.EndTime); err != nil {
+			return nil, err
+		}
+		classes = append(classes, c)
+	}
+	return classes, rows.Err()
+}
+
+func hasInduction(q Execer, resourceID, userID int) (bool, error) {
+	var inducted bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM resource_inductions WHERE resource_id = ? AND user_id = ?)`,
+		resourceID, userID).Scan(&inducted)
+	return inducted, err
+}
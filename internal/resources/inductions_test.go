@@ -0,0 +1,128 @@
+package resources
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/models"
+)
+
+func (env *testEnv) createMember(t *testing.T, email string) int {
+	result, err := env.db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, tenant_id)
+		VALUES (?, 'x', 'Test', 'Member', 1)`, email)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func (env *testEnv) klippLeft(t *testing.T, cardID int) int {
+	var left int
+	require.NoError(t, env.db.QueryRow(`SELECT klipp_left FROM klippekort WHERE id = ?`, cardID).Scan(&left))
+	return left
+}
+
+func TestInduction(t *testing.T) {
+	env := newTestEnv(t)
+	laser := &models.Resource{TenantID: 1, Name: "Laser cutter", Kind: KindEquipment, Reservable: true,
+		RequiresInduction: true}
+	require.NoError(t, env.service.CreateResource(laser))
+	member := env.createMember(t, "maker@example.com")
+	start := env.now.Add(24 * time.Hour)
+
+	_, err := env.service.Reserve(laser.ID, member, start, start.Add(time.Hour), "")
+	assert.ErrorIs(t, err, ErrInductionRequired)
+
+	result, err := env.db.Exec(`
+		INSERT INTO classes (tenant_id, name, instructor_id, start_time, end_time, max_capacity, price, induction_resource_id)
+		VALUES (1, 'Laser induction', 1, ?, ?, 6, 0, ?)`, env.now.Add(2*time.Hour).UTC(), env.now.Add(3*time.Hour).UTC(), laser.ID)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	classID := int(id)
+
+	classes, err := env.service.InductionClasses(laser.ID)
+	require.NoError(t, err)
+	require.Len(t, classes, 1)
+	assert.Equal(t, "Laser induction", classes[0].Name)
+
+	require.NoError(t, RecordInduction(env.db, classID, member, env.now))
+	require.NoError(t, RecordInduction(env.db, classID, member, env.now.Add(time.Hour)), "a second check-in keeps the induction")
+
+	inducted, err := env.service.HasInduction(laser.ID, member)
+	require.NoError(t, err)
+	assert.True(t, inducted)
+
+	_, err = env.service.Reserve(laser.ID, member, start, start.Add(time.Hour), "")
+	require.NoError(t, err)
+
+	require.NoError(t, UndoInduction(env.db, classID, member))
+	inducted, err = env.service.HasInduction(laser.ID, member)
+	require.NoError(t, err)
+	assert.False(t, inducted)
+
+	t.Run("GrantedByAdmin", func(t *testing.T) {
+		require.NoError(t, env.service.GrantInduction(laser.ID, member, 1))
+
+		inductions, err := env.service.Inductions(laser.ID)
+		require.NoError(t, err)
+		require.Len(t, inductions, 1)
+		assert.Equal(t, "Test Member", inductions[0].UserName)
+		require.NotNil(t, inductions[0].GrantedBy)
+		assert.Nil(t, inductions[0].ClassID)
+
+		require.NoError(t, UndoInduction(env.db, classID, member))
+		inducted, err := env.service.Inducted(member)
+		require.NoError(t, err)
+		assert.True(t, inducted[laser.ID], "undoing a check-in leaves inductions recorded by admins")
+
+		require.NoError(t, env.service.RevokeInduction(laser.ID, member))
+		inducted, err = env.service.Inducted(member)
+		require.NoError(t, err)
+		assert.Empty(t, inducted)
+	})
+}
+
+func TestReserveSlotTerms(t *testing.T) {
+	env := newTestEnv(t)
+	printer := &models.Resource{TenantID: 1, Name: "3D printer", Kind: KindEquipment, Reservable: true,
+		MaxSlotMinutes: 120, CategoryID: "workshops"}
+	require.NoError(t, env.service.CreateResource(printer))
+	member := env.createMember(t, "maker@example.com")
+	start := env.now.Add(24 * time.Hour)
+
+	_, err := env.service.Reserve(printer.ID, member, start, start.Add(150*time.Minute), "")
+	assert.ErrorIs(t, err, ErrSlotTooLong)
+
+	_, err = env.service.Reserve(printer.ID, member, start, start.Add(2*time.Hour), "")
+	assert.ErrorIs(t, err, klippekort.ErrNoKlipp)
+
+	result, err := env.db.Exec(`
+		INSERT INTO klippekort (user_id, tenant_id, category_id, klipp_left, original_klipp)
+		VALUES (?, 1, 'workshops', 2, 2)`, member)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	cardID := int(id)
+
+	reservation, err := env.service.Reserve(printer.ID, member, start, start.Add(2*time.Hour), "")
+	require.NoError(t, err)
+	require.NotNil(t, reservation.KlippekortID)
+	assert.Equal(t, cardID, *reservation.KlippekortID)
+	assert.Equal(t, 1, env.klippLeft(t, cardID))
+
+	require.NoError(t, env.service.CancelReservation(reservation.ID))
+	require.NoError(t, env.service.CancelReservation(reservation.ID))
+	assert.Equal(t, 2, env.klippLeft(t, cardID), "cancelling before the start returns the klipp once")
+
+	reservation, err = env.service.Reserve(printer.ID, member, start, start.Add(time.Hour), "")
+	require.NoError(t, err)
+	env.now = start.Add(30 * time.Minute)
+	require.NoError(t, env.service.CancelReservation(reservation.ID))
+	assert.Equal(t, 1, env.klippLeft(t, cardID), "the klipp is kept once the reservation has started")
+}
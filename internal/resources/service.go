@@ -0,0 +1,393 @@
+package resources
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/models"
+	"samskipnad/internal/services"
+)
+
+// Resource kinds
+const (
+	KindRoom      = "room"
+	KindEquipment = "equipment"
+)
+
+// Event types published by the resources service
+const (
+	EventResourceReserved     = "resource.reserved"
+	EventReservationCancelled = "resource.reservation_cancelled"
+	EventInductionGranted     = "resource.induction_granted"
+)
+
+var (
+	ErrResourceNotFound    = errors.New("resource not found")
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrInvalidResource     = errors.New("a resource needs a name, a kind of room or equipment and a slot length of zero or more")
+	ErrInvalidTime         = errors.New("end time must be after start time")
+	ErrNotReservable       = errors.New("resource cannot be reserved by members")
+	ErrReservationInPast   = errors.New("reservations must start in the future")
+	ErrConflict            = errors.New("resource is already booked")
+	ErrInductionRequired   = errors.New("you need to complete an induction before reserving this equipment")
+	ErrSlotTooLong         = errors.New("reservation is longer than the maximum slot length")
+)
+
+// Service manages rooms and equipment and member reservations of them
+type Service struct {
+	db     *sql.DB
+	events services.EventBusService
+	now    func() time.Time
+}
+
+func NewService(db *sql.DB, events services.EventBusService) *Service {
+	return &Service{
+		db:     db,
+		events: events,
+		now:    time.Now,
+	}
+}
+
+// Resources returns the tenant's active resources ordered by kind and name
+func (s *Service) Resources(tenantID int) ([]models.Resource, error) {
+	rows, err := s.db.Query(`
+		SELECT id, tenant_id, name, kind, COALESCE(description, ''), reservable, requires_induction, max_slot_minutes,
+			COALESCE(category_id, ''), active, created_at, updated_at
+		FROM resources WHERE tenant_id = ? AND active = true
+		ORDER BY kind DESC, name`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var resources []models.Resource
+	for rows.Next() {
+		r, err := scanResource(rows)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, *r)
+	}
+	return resources, rows.Err()
+}
+
+// GetResource returns a resource by ID
+func (s *Service) GetResource(resourceID int) (*models.Resource, error) {
+	r, err := scanResource(s.db.QueryRow(`
+		SELECT id, tenant_id, name, kind, COALESCE(description, ''), reservable, requires_induction, max_slot_minutes,
+			COALESCE(category_id, ''), active, created_at, updated_at
+		FROM resources WHERE id = ?`, resourceID))
+	if err == sql.ErrNoRows {
+		return nil, ErrResourceNotFound
+	}
+	return r, err
+}
+
+// CreateResource adds a room or piece of equipment and sets its ID
+func (s *Service) CreateResource(r *models.Resource) error {
+	if err := validate(r); err != nil {
+		return err
+	}
+
+	now := s.now()
+	result, err := s.db.Exec(`
+		INSERT INTO resources (tenant_id, name, kind, description, reservable, requires_induction, max_slot_minutes,
+			category_id, active, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, true, ?, ?)`,
+		r.TenantID, r.Name, r.Kind, r.Description, r.Reservable, r.RequiresInduction, r.MaxSlotMinutes,
+		nullable(r.CategoryID), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to create resource: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	r.ID = int(id)
+	r.Active = true
+	r.CreatedAt = now
+	r.UpdatedAt = now
+	return nil
+}
+
+// UpdateResource saves changes to a resource's details and the terms
+// members reserve it on
+func (s *Service) UpdateResource(r *models.Resource) error {
+	if err := validate(r); err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE resources SET name = ?, kind = ?, description = ?, reservable = ?, requires_induction = ?,
+			max_slot_minutes = ?, category_id = ?, updated_at = ?
+		WHERE id = ?`, r.Name, r.Kind, r.Description, r.Reservable, r.RequiresInduction, r.MaxSlotMinutes,
+		nullable(r.CategoryID), s.now(), r.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update resource: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrResourceNotFound
+	}
+	return nil
+}
+
+// DeactivateResource retires a resource. Classes and reservations keep
+// referring to it, but nothing new can be scheduled into it.
+func (s *Service) DeactivateResource(resourceID int) error {
+	result, err := s.db.Exec(`UPDATE resources SET active = false, updated_at = ? WHERE id = ?`, s.now(), resourceID)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate resource: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrResourceNotFound
+	}
+	return nil
+}
+
+// Reserve books a reservable resource for a member. The period cannot
+// overlap a class or another reservation of the resource, or be longer
+// than the resource's maximum slot length. Equipment that requires an
+// induction can only be reserved by inducted members, and equipment with a
+// klippekort category costs one klipp per reservation.
+func (s *Service) Reserve(resourceID, userID int, start, end time.Time, note string) (*models.ResourceReservation, error) {
+	if !end.After(start) {
+		return nil, ErrInvalidTime
+	}
+	now := s.now()
+	if !start.After(now) {
+		return nil, ErrReservationInPast
+	}
+
+	resource, err := s.GetResource(resourceID)
+	if err != nil {
+		return nil, err
+	}
+	if !resource.Active {
+		return nil, ErrResourceNotFound
+	}
+	if !resource.Reservable {
+		return nil, ErrNotReservable
+	}
+	if resource.MaxSlotMinutes > 0 && end.Sub(start) > time.Duration(resource.MaxSlotMinutes)*time.Minute {
+		return nil, ErrSlotTooLong
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if resource.RequiresInduction {
+		inducted, err := hasInduction(tx, resourceID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !inducted {
+			return nil, ErrInductionRequired
+		}
+	}
+
+	if err := CheckAvailable(tx, resourceID, start, end, Exclude{}); err != nil {
+		return nil, err
+	}
+
+	var cardID *int
+	if resource.CategoryID != "" {
+		entry := klippekort.Entry{Note: fmt.Sprintf("%s reserved %s", resource.Name, start.Format("Mon Jan 2 15:04"))}
+		id, err := klippekort.Deduct(tx, userID, resource.TenantID, resource.CategoryID, entry, now)
+		if err != nil {
+			return nil, err
+		}
+		cardID = &id
+	}
+
+	note = strings.TrimSpace(note)
+	result, err := tx.Exec(`
+		INSERT INTO resource_reservations (resource_id, user_id, tenant_id, start_time, end_time, note, klippekort_id,
+			created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		resourceID, userID, resource.TenantID, start.UTC(), end.UTC(), note, cardID, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve resource: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	reservation := &models.ResourceReservation{
+		ID:           int(id),
+		ResourceID:   resourceID,
+		UserID:       userID,
+		TenantID:     resource.TenantID,
+		StartTime:    start,
+		EndTime:      end,
+		Note:         note,
+		KlippekortID: cardID,
+		CreatedAt:    now,
+		Resource:     resource,
+	}
+
+	s.publish(EventResourceReserved, resource.TenantID, userID, map[string]interface{}{
+		"reservation_id": reservation.ID,
+		"resource_id":    resourceID,
+	})
+	return reservation, nil
+}
+
+// GetReservation returns a reservation by ID
+func (s *Service) GetReservation(reservationID int) (*models.ResourceReservation, error) {
+	var r models.ResourceReservation
+	var cardID sql.NullInt64
+	var cancelledAt sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT id, resource_id, user_id, tenant_id, start_time, end_time, COALESCE(note, ''), klippekort_id,
+			cancelled_at, created_at
+		FROM resource_reservations WHERE id = ?`, reservationID).Scan(
+		&r.ID, &r.ResourceID, &r.UserID, &r.TenantID, &r.StartTime, &r.EndTime, &r.Note, &cardID, &cancelledAt,
+		&r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrReservationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cardID.Valid {
+		id := int(cardID.Int64)
+		r.KlippekortID = &id
+	}
+	if cancelledAt.Valid {
+		r.CancelledAt = &cancelledAt.Time
+	}
+	return &r, nil
+}
+
+// CancelReservation frees the period a reservation held. A klipp paid for
+// the reservation is returned if it is cancelled before it starts.
+// Cancelling twice is a no-op.
+func (s *Service) CancelReservation(reservationID int) error {
+	reservation, err := s.GetReservation(reservationID)
+	if err != nil {
+		return err
+	}
+	if reservation.CancelledAt != nil {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+	result, err := tx.Exec(`UPDATE resource_reservations SET cancelled_at = ? WHERE id = ? AND cancelled_at IS NULL`,
+		now.UTC(), reservationID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel reservation: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	if reservation.KlippekortID != nil && now.Before(reservation.StartTime) {
+		entry := klippekort.Entry{UserID: reservation.UserID, Note: "Reservation cancelled"}
+		if err := klippekort.Return(tx, *reservation.KlippekortID, entry, now); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.publish(EventReservationCancelled, reservation.TenantID, reservation.UserID, map[string]interface{}{
+		"reservation_id": reservation.ID,
+		"resource_id":    reservation.ResourceID,
+	})
+	return nil
+}
+
+// UpcomingReservations returns a member's reservations that have not ended,
+// soonest first
+func (s *Service) UpcomingReservations(userID int) ([]models.ResourceReservation, error) {
+	rows, err := s.db.Query(`
+		SELECT r.id, r.resource_id, r.user_id, r.tenant_id, r.start_time, r.end_time, COALESCE(r.note, ''), r.created_at,
+			res.name, res.kind
+		FROM resource_reservations r
+		JOIN resources res ON res.id = r.resource_id
+		WHERE r.user_id = ? AND r.cancelled_at IS NULL AND r.end_time > ?
+		ORDER BY r.start_time`, userID, s.now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []models.ResourceReservation
+	for rows.Next() {
+		var r models.ResourceReservation
+		resource := &models.Resource{}
+		err := rows.Scan(&r.ID, &r.ResourceID, &r.UserID, &r.TenantID, &r.StartTime, &r.EndTime, &r.Note, &r.CreatedAt,
+			&resource.Name, &resource.Kind)
+		if err != nil {
+			return nil, err
+		}
+		resource.ID = r.ResourceID
+		r.Resource = resource
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
+
+// Schedule returns the classes and reservations using a resource between
+// from and to, earliest first
+func (s *Service) Schedule(resourceID int, from, to time.Time) ([]Slot, error) {
+	return Overlapping(s.db, resourceID, from, to, Exclude{})
+}
+
+// Helper methods
+
+func validate(r *models.Resource) error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" || (r.Kind != KindRoom && r.Kind != KindEquipment) || r.MaxSlotMinutes < 0 {
+		return ErrInvalidResource
+	}
+	return nil
+}
+
+// nullable stores an empty string as NULL
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanResource(row scanner) (*models.Resource, error) {
+	var r models.Resource
+	err := row.Scan(&r.ID, &r.TenantID, &r.Name, &r.Kind, &r.Description, &r.Reservable, &r.RequiresInduction,
+		&r.MaxSlotMinutes, &r.CategoryID, &r.Active, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// publish dispatches an event from the resources service; see services.Publish
+func (s *Service) publish(eventType string, tenantID, userID int, data map[string]interface{}) {
+	services.Publish(s.events, "resources", eventType, tenantID, userID, data)
+}
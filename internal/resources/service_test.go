@@ -0,0 +1,165 @@
+package resources
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/database"
+	"samskipnad/internal/models"
+	"samskipnad/internal/services"
+)
+
+// setupTestDB creates a migrated in-memory SQLite database for testing
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// recordingBus captures published events
+type recordingBus struct {
+	services.EventBusService
+	events []*services.Event
+}
+
+func (b *recordingBus) Publish(ctx context.Context, event *services.Event) error {
+	b.events = append(b.events, event)
+	return nil
+}
+
+type testEnv struct {
+	db      *sql.DB
+	service *Service
+	events  *recordingBus
+	now     time.Time
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	db := setupTestDB(t)
+	env := &testEnv{
+		db:     db,
+		events: &recordingBus{},
+		now:    time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC),
+	}
+	env.service = NewService(db, env.events)
+	env.service.now = func() time.Time { return env.now }
+	return env
+}
+
+func (env *testEnv) createResource(t *testing.T, name, kind string, reservable bool) int {
+	r := &models.Resource{TenantID: 1, Name: name, Kind: kind, Reservable: reservable}
+	require.NoError(t, env.service.CreateResource(r))
+	return r.ID
+}
+
+func (env *testEnv) createClass(t *testing.T, resourceID int, start time.Time) int {
+	result, err := env.db.Exec(`
+		INSERT INTO classes (tenant_id, name, instructor_id, start_time, end_time, max_capacity, price, resource_id)
+		VALUES (1, 'Open shop', 1, ?, ?, 10, 0, ?)`, start.UTC(), start.Add(2*time.Hour).UTC(), resourceID)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	return int(id)
+}
+
+func TestCreateResource(t *testing.T) {
+	env := newTestEnv(t)
+
+	assert.ErrorIs(t, env.service.CreateResource(&models.Resource{TenantID: 1, Name: " ", Kind: KindRoom}), ErrInvalidResource)
+	assert.ErrorIs(t, env.service.CreateResource(&models.Resource{TenantID: 1, Name: "Lathe", Kind: "tool"}), ErrInvalidResource)
+
+	lathe := env.createResource(t, "Lathe", KindEquipment, true)
+	env.createResource(t, "Workshop", KindRoom, false)
+
+	list, err := env.service.Resources(1)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "Workshop", list[0].Name, "rooms are listed before equipment")
+
+	require.NoError(t, env.service.DeactivateResource(lathe))
+	list, err = env.service.Resources(1)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestReserve(t *testing.T) {
+	env := newTestEnv(t)
+	laser := env.createResource(t, "Laser cutter", KindEquipment, true)
+	room := env.createResource(t, "Classroom", KindRoom, false)
+	start := env.now.Add(24 * time.Hour)
+
+	_, err := env.service.Reserve(laser, 2, start, start, "")
+	assert.ErrorIs(t, err, ErrInvalidTime)
+	_, err = env.service.Reserve(laser, 2, env.now.Add(-time.Hour), env.now, "")
+	assert.ErrorIs(t, err, ErrReservationInPast)
+	_, err = env.service.Reserve(room, 2, start, start.Add(time.Hour), "")
+	assert.ErrorIs(t, err, ErrNotReservable)
+
+	reservation, err := env.service.Reserve(laser, 2, start, start.Add(time.Hour), " Signs ")
+	require.NoError(t, err)
+	assert.Equal(t, "Signs", reservation.Note)
+	require.Len(t, env.events.events, 1)
+	assert.Equal(t, EventResourceReserved, env.events.events[0].Type)
+
+	_, err = env.service.Reserve(laser, 3, start.Add(30*time.Minute), start.Add(90*time.Minute), "")
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.ErrorIs(t, err, ErrConflict)
+	require.Len(t, conflict.Conflicts, 1)
+	assert.Equal(t, SlotReservation, conflict.Conflicts[0].Kind)
+	assert.True(t, start.Equal(conflict.Conflicts[0].StartTime))
+
+	_, err = env.service.Reserve(laser, 3, start.Add(time.Hour), start.Add(2*time.Hour), "")
+	assert.NoError(t, err, "back-to-back reservations do not conflict")
+
+	require.NoError(t, env.service.CancelReservation(reservation.ID))
+	require.NoError(t, env.service.CancelReservation(reservation.ID))
+	_, err = env.service.Reserve(laser, 3, start, start.Add(time.Hour), "")
+	assert.NoError(t, err, "a cancelled reservation frees its period")
+
+	upcoming, err := env.service.UpcomingReservations(3)
+	require.NoError(t, err)
+	require.Len(t, upcoming, 2)
+	assert.True(t, start.Equal(upcoming[0].StartTime))
+	assert.Equal(t, "Laser cutter", upcoming[0].Resource.Name)
+}
+
+func TestCheckAvailable(t *testing.T) {
+	env := newTestEnv(t)
+	workshop := env.createResource(t, "Workshop", KindRoom, true)
+	start := env.now.Add(48 * time.Hour)
+	classID := env.createClass(t, workshop, start)
+
+	_, err := env.service.Reserve(workshop, 2, start.Add(time.Hour), start.Add(3*time.Hour), "")
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	require.Len(t, conflict.Conflicts, 1)
+	assert.Equal(t, SlotClass, conflict.Conflicts[0].Kind)
+	assert.Equal(t, classID, conflict.Conflicts[0].ID)
+	assert.Contains(t, err.Error(), "Workshop is already booked: Open shop")
+
+	err = CheckAvailable(env.db, workshop, start, start.Add(time.Hour), Exclude{ClassID: classID})
+	assert.NoError(t, err, "a class does not conflict with itself")
+
+	_, err = env.service.Reserve(workshop, 2, start.Add(2*time.Hour), start.Add(3*time.Hour), "")
+	require.NoError(t, err)
+
+	slots, err := env.service.Schedule(workshop, start.Add(-time.Hour), start.Add(4*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, slots, 2)
+	assert.Equal(t, SlotClass, slots[0].Kind)
+	assert.Equal(t, SlotReservation, slots[1].Kind)
+
+	require.NoError(t, env.service.DeactivateResource(workshop))
+	err = CheckAvailable(env.db, workshop, start, start.Add(time.Hour), Exclude{})
+	assert.ErrorIs(t, err, ErrResourceNotFound)
+}
@@ -0,0 +1,234 @@
+package scheduling
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequencies supported by the RRULE subset
+const (
+	FreqDaily  = "DAILY"
+	FreqWeekly = "WEEKLY"
+)
+
+var ErrInvalidRule = errors.New("invalid recurrence rule")
+
+// maxOccurrences guards against unbounded expansion of rules without UNTIL or COUNT
+const maxOccurrences = 1000
+
+var weekdayCodes = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// Rule is the subset of an RFC 5545 RRULE that class series support:
+// FREQ=DAILY|WEEKLY with optional INTERVAL, BYDAY, UNTIL and COUNT
+type Rule struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Until    *time.Time
+	Count    int
+}
+
+// ParseRule parses an RRULE value such as "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10".
+// A leading "RRULE:" prefix is accepted.
+func ParseRule(value string) (*Rule, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	if value == "" {
+		return nil, fmt.Errorf("%w: empty rule", ErrInvalidRule)
+	}
+
+	rule := &Rule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed part %q", ErrInvalidRule, part)
+		}
+
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			freq := strings.ToUpper(val)
+			if freq != FreqDaily && freq != FreqWeekly {
+				return nil, fmt.Errorf("%w: unsupported FREQ %s", ErrInvalidRule, val)
+			}
+			rule.Freq = freq
+		case "INTERVAL":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: invalid INTERVAL %s", ErrInvalidRule, val)
+			}
+			rule.Interval = n
+		case "BYDAY":
+			for _, code := range strings.Split(val, ",") {
+				day, ok := weekdayCodes[strings.ToUpper(code)]
+				if !ok {
+					return nil, fmt.Errorf("%w: invalid BYDAY %s", ErrInvalidRule, code)
+				}
+				rule.ByDay = append(rule.ByDay, day)
+			}
+		case "UNTIL":
+			until, err := parseUntil(val)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid UNTIL %s", ErrInvalidRule, val)
+			}
+			rule.Until = &until
+		case "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: invalid COUNT %s", ErrInvalidRule, val)
+			}
+			rule.Count = n
+		case "WKST":
+			if strings.ToUpper(val) != "MO" {
+				return nil, fmt.Errorf("%w: only WKST=MO is supported", ErrInvalidRule)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unsupported part %s", ErrInvalidRule, key)
+		}
+	}
+
+	if rule.Freq == "" {
+		return nil, fmt.Errorf("%w: FREQ is required", ErrInvalidRule)
+	}
+	if rule.Until != nil && rule.Count > 0 {
+		return nil, fmt.Errorf("%w: UNTIL and COUNT are mutually exclusive", ErrInvalidRule)
+	}
+
+	rule.sortDays()
+	return rule, nil
+}
+
+func parseUntil(value string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	// A date-only UNTIL includes the whole day
+	t, err := time.Parse("20060102", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Add(24*time.Hour - time.Second), nil
+}
+
+// String formats the rule back into RRULE syntax
+func (r *Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		codes := make([]string, 0, len(r.ByDay))
+		for _, day := range r.ByDay {
+			codes = append(codes, weekdayCode(day))
+		}
+		parts = append(parts, "BYDAY="+strings.Join(codes, ","))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	if r.Count > 0 {
+		parts = append(parts, fmt.Sprintf("COUNT=%d", r.Count))
+	}
+	return strings.Join(parts, ";")
+}
+
+func weekdayCode(day time.Weekday) string {
+	for code, d := range weekdayCodes {
+		if d == day {
+			return code
+		}
+	}
+	return ""
+}
+
+// sortDays orders BYDAY Monday first so weekly expansion is chronological
+func (r *Rule) sortDays() {
+	sort.Slice(r.ByDay, func(i, j int) bool {
+		return mondayOffset(r.ByDay[i]) < mondayOffset(r.ByDay[j])
+	})
+}
+
+func mondayOffset(day time.Weekday) int {
+	return (int(day) + 6) % 7
+}
+
+// Occurrences expands the rule from dtstart and returns the occurrences that
+// start before end. Wall-clock time is kept in dtstart's location, so a 18:00
+// class stays at 18:00 across DST changes.
+func (r *Rule) Occurrences(dtstart, end time.Time) []time.Time {
+	var occurrences []time.Time
+
+	emit := func(t time.Time) bool {
+		if t.Before(dtstart) {
+			return true
+		}
+		if r.Until != nil && t.After(*r.Until) {
+			return false
+		}
+		if r.Count > 0 && len(occurrences) >= r.Count {
+			return false
+		}
+		if !t.Before(end) || len(occurrences) >= maxOccurrences {
+			return false
+		}
+		occurrences = append(occurrences, t)
+		return true
+	}
+
+	loc := dtstart.Location()
+	hour, min, sec := dtstart.Clock()
+
+	switch r.Freq {
+	case FreqDaily:
+		for i := 0; ; i += r.Interval {
+			d := dtstart.AddDate(0, 0, i)
+			t := time.Date(d.Year(), d.Month(), d.Day(), hour, min, sec, 0, loc)
+			if len(r.ByDay) > 0 && !r.hasDay(t.Weekday()) {
+				if t.After(end) {
+					return occurrences
+				}
+				continue
+			}
+			if !emit(t) {
+				return occurrences
+			}
+		}
+	case FreqWeekly:
+		days := r.ByDay
+		if len(days) == 0 {
+			days = []time.Weekday{dtstart.Weekday()}
+		}
+		weekStart := time.Date(dtstart.Year(), dtstart.Month(), dtstart.Day(), 0, 0, 0, 0, loc).
+			AddDate(0, 0, -mondayOffset(dtstart.Weekday()))
+		for week := 0; ; week += r.Interval {
+			for _, day := range days {
+				d := weekStart.AddDate(0, 0, week*7+mondayOffset(day))
+				t := time.Date(d.Year(), d.Month(), d.Day(), hour, min, sec, 0, loc)
+				if !emit(t) {
+					return occurrences
+				}
+			}
+		}
+	}
+
+	return occurrences
+}
+
+func (r *Rule) hasDay(day time.Weekday) bool {
+	for _, d := range r.ByDay {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
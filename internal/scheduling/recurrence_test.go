@@ -0,0 +1,103 @@
+package scheduling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	t.Run("WeeklyWithDaysAndCount", func(t *testing.T) {
+		rule, err := ParseRule("RRULE:FREQ=WEEKLY;BYDAY=WE,MO;COUNT=6")
+
+		require.NoError(t, err)
+		assert.Equal(t, FreqWeekly, rule.Freq)
+		assert.Equal(t, []time.Weekday{time.Monday, time.Wednesday}, rule.ByDay)
+		assert.Equal(t, 6, rule.Count)
+		assert.Equal(t, "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=6", rule.String())
+	})
+
+	t.Run("DateOnlyUntilIncludesDay", func(t *testing.T) {
+		rule, err := ParseRule("FREQ=WEEKLY;UNTIL=20250131")
+
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2025, 1, 31, 23, 59, 59, 0, time.UTC), *rule.Until)
+	})
+
+	invalid := []string{
+		"",
+		"BYDAY=MO",
+		"FREQ=MONTHLY",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=WEEKLY;INTERVAL=0",
+		"FREQ=WEEKLY;COUNT=3;UNTIL=20250101",
+		"FREQ=WEEKLY;BYMONTH=1",
+	}
+	for _, value := range invalid {
+		t.Run("Invalid/"+value, func(t *testing.T) {
+			_, err := ParseRule(value)
+			assert.ErrorIs(t, err, ErrInvalidRule)
+		})
+	}
+}
+
+func TestRuleOccurrences(t *testing.T) {
+	// Wednesday 2025-01-01 18:00
+	dtstart := time.Date(2025, 1, 1, 18, 0, 0, 0, time.UTC)
+	farFuture := dtstart.AddDate(5, 0, 0)
+
+	t.Run("WeeklyByDayCount", func(t *testing.T) {
+		rule, err := ParseRule("FREQ=WEEKLY;BYDAY=MO,WE;COUNT=4")
+		require.NoError(t, err)
+
+		occurrences := rule.Occurrences(dtstart, farFuture)
+
+		// The Monday before dtstart is not an occurrence
+		assert.Equal(t, []time.Time{
+			time.Date(2025, 1, 1, 18, 0, 0, 0, time.UTC),
+			time.Date(2025, 1, 6, 18, 0, 0, 0, time.UTC),
+			time.Date(2025, 1, 8, 18, 0, 0, 0, time.UTC),
+			time.Date(2025, 1, 13, 18, 0, 0, 0, time.UTC),
+		}, occurrences)
+	})
+
+	t.Run("EveryOtherWeekUntil", func(t *testing.T) {
+		rule, err := ParseRule("FREQ=WEEKLY;INTERVAL=2;UNTIL=20250201")
+		require.NoError(t, err)
+
+		occurrences := rule.Occurrences(dtstart, farFuture)
+
+		assert.Equal(t, []time.Time{
+			time.Date(2025, 1, 1, 18, 0, 0, 0, time.UTC),
+			time.Date(2025, 1, 15, 18, 0, 0, 0, time.UTC),
+			time.Date(2025, 1, 29, 18, 0, 0, 0, time.UTC),
+		}, occurrences)
+	})
+
+	t.Run("OpenEndedStopsAtWindow", func(t *testing.T) {
+		rule, err := ParseRule("FREQ=DAILY")
+		require.NoError(t, err)
+
+		occurrences := rule.Occurrences(dtstart, dtstart.AddDate(0, 0, 3))
+
+		assert.Len(t, occurrences, 3)
+	})
+
+	t.Run("KeepsWallClockAcrossDST", func(t *testing.T) {
+		oslo, err := time.LoadLocation("Europe/Oslo")
+		require.NoError(t, err)
+
+		// Thursday before the 2025-03-30 spring-forward transition
+		start := time.Date(2025, 3, 27, 18, 0, 0, 0, oslo)
+		rule, err := ParseRule("FREQ=WEEKLY;COUNT=2")
+		require.NoError(t, err)
+
+		occurrences := rule.Occurrences(start, start.AddDate(1, 0, 0))
+
+		require.Len(t, occurrences, 2)
+		assert.Equal(t, 18, occurrences[1].Hour())
+		assert.Equal(t, 167*time.Hour, occurrences[1].Sub(occurrences[0]))
+	})
+}
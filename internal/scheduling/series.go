@@ -0,0 +1,556 @@
+package scheduling
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"samskipnad/internal/models"
+	"samskipnad/internal/resources"
+)
+
+// DefaultHorizon is how far ahead series occurrences are materialised as classes
+const DefaultHorizon = 12 * 7 * 24 * time.Hour
+
+// DefaultMaterialiseInterval is how often series are topped up to the horizon
+const DefaultMaterialiseInterval = 24 * time.Hour
+
+var (
+	ErrSeriesNotFound        = errors.New("class series not found")
+	ErrNotSeriesOccurrence   = errors.New("class is not part of a series")
+	ErrOccurrenceHasBookings = errors.New("occurrence has confirmed bookings")
+)
+
+// Service manages recurring class series and their materialised occurrences
+type Service struct {
+	db      *sql.DB
+	horizon time.Duration
+	now     func() time.Time
+}
+
+func NewService(db *sql.DB) *Service {
+	return &Service{
+		db:      db,
+		horizon: DefaultHorizon,
+		now:     time.Now,
+	}
+}
+
+// CreateSeries validates the series' rule, stores it and materialises its
+// occurrences up to the horizon. It fails if an occurrence would overlap
+// another use of the series' resource.
+func (s *Service) CreateSeries(series *models.ClassSeries) error {
+	if _, err := ParseRule(series.RRule); err != nil {
+		return err
+	}
+	if series.DurationMinutes <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if series.Timezone == "" {
+		series.Timezone = series.DTStart.Location().String()
+	}
+	if _, err := time.LoadLocation(series.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %s: %w", series.Timezone, err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.insertSeries(tx, series); err != nil {
+		return fmt.Errorf("failed to create series: %w", err)
+	}
+
+	if _, err := s.materialise(tx, series, s.now().Add(s.horizon), false); err != nil {
+		return fmt.Errorf("failed to materialise series: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// GetSeries returns a series by ID
+func (s *Service) GetSeries(seriesID int) (*models.ClassSeries, error) {
+	return s.getSeries(s.db, seriesID)
+}
+
+// Materialise creates class rows for all occurrences of a series that start
+// before until and have not been materialised yet. Occurrences that would
+// overlap another use of the series' resource are created skipped. It
+// returns the number of classes created.
+func (s *Service) Materialise(seriesID int, until time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	series, err := s.getSeries(tx, seriesID)
+	if err != nil {
+		return 0, err
+	}
+
+	created, err := s.materialise(tx, series, until, true)
+	if err != nil {
+		return 0, err
+	}
+
+	return created, tx.Commit()
+}
+
+// MaterialiseAll tops up every active series to the horizon. It is run
+// periodically by StartMaterialiseJob so that open-ended series keep a
+// rolling window of bookable classes.
+func (s *Service) MaterialiseAll() error {
+	rows, err := s.db.Query(`SELECT id FROM class_series WHERE active = true`)
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	until := s.now().Add(s.horizon)
+	for _, id := range ids {
+		if _, err := s.Materialise(id, until); err != nil {
+			return fmt.Errorf("failed to materialise series %d: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// StartMaterialiseJob tops up every active series to the horizon every
+// interval until the returned stop function is called
+func (s *Service) StartMaterialiseJob(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			if err := s.MaterialiseAll(); err != nil {
+				log.Printf("Failed to materialise class series: %v", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// SkipOccurrence cancels a single occurrence of a series. The class row is
+// kept inactive so the occurrence is not materialised again.
+func (s *Service) SkipOccurrence(classID int) error {
+	seriesID, _, err := s.occurrenceOf(s.db, classID)
+	if err != nil {
+		return err
+	}
+	if seriesID == 0 {
+		return ErrNotSeriesOccurrence
+	}
+
+	var confirmed int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM bookings WHERE class_id = ? AND status = 'confirmed'`, classID).Scan(&confirmed)
+	if err != nil {
+		return err
+	}
+	if confirmed > 0 {
+		return ErrOccurrenceHasBookings
+	}
+
+	_, err = s.db.Exec(`UPDATE classes SET active = false, updated_at = ? WHERE id = ?`, s.now(), classID)
+	return err
+}
+
+// RescheduleOccurrence moves a single occurrence of a series. Its original
+// occurrence start is preserved so the series does not recreate it. The
+// occurrence cannot be moved onto another use of its resource.
+func (s *Service) RescheduleOccurrence(classID int, start, end time.Time) error {
+	if !end.After(start) {
+		return fmt.Errorf("end time must be after start time")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	seriesID, _, err := s.occurrenceOf(tx, classID)
+	if err != nil {
+		return err
+	}
+	if seriesID == 0 {
+		return ErrNotSeriesOccurrence
+	}
+
+	var resourceID sql.NullInt64
+	if err := tx.QueryRow(`SELECT resource_id FROM classes WHERE id = ?`, classID).Scan(&resourceID); err != nil {
+		return err
+	}
+	if resourceID.Valid {
+		err := resources.CheckAvailable(tx, int(resourceID.Int64), start, end, resources.Exclude{ClassID: classID})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE classes SET start_time = ?, end_time = ?, updated_at = ? WHERE id = ?`,
+		start.UTC(), end.UTC(), s.now(), classID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateFollowing applies update to the given occurrence and every later one
+// ("this and following"). The original series is ended before the occurrence
+// and a new series starting at update.DTStart takes over. Existing classes are
+// carried over to the new series where it still has an occurrence on the
+// same day; unmatched classes are removed unless they already have bookings.
+// An empty update.RRule keeps the original rule.
+func (s *Service) UpdateFollowing(classID int, update *models.ClassSeries) (*models.ClassSeries, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seriesID, splitAt, err := s.occurrenceOf(tx, classID)
+	if err != nil {
+		return nil, err
+	}
+	if seriesID == 0 {
+		return nil, ErrNotSeriesOccurrence
+	}
+
+	old, err := s.getSeries(tx, seriesID)
+	if err != nil {
+		return nil, err
+	}
+	oldRule, err := ParseRule(old.RRule)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(old.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	oldStart := old.DTStart.In(loc)
+	splitAt = splitAt.In(loc)
+
+	before := len(oldRule.Occurrences(oldStart, splitAt))
+
+	// Build the rule for the new series
+	var newRule *Rule
+	if update.RRule == "" {
+		copied := *oldRule
+		newRule = &copied
+		if newRule.Count > 0 {
+			newRule.Count -= before
+		}
+	} else {
+		newRule, err = ParseRule(update.RRule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// End the original series just before the split occurrence
+	until := splitAt.Add(-time.Second)
+	oldRule.Until = &until
+	oldRule.Count = 0
+	_, err = tx.Exec(`UPDATE class_series SET rrule = ?, active = ?, updated_at = ? WHERE id = ?`,
+		oldRule.String(), before > 0, s.now(), old.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to end series: %w", err)
+	}
+
+	next := *update
+	next.ID = 0
+	next.TenantID = old.TenantID
+	next.Timezone = old.Timezone
+	next.RRule = newRule.String()
+	next.MaterialisedUntil = nil
+	next.DTStart = update.DTStart.In(loc)
+	if next.DurationMinutes <= 0 {
+		next.DurationMinutes = old.DurationMinutes
+	}
+	if err := s.insertSeries(tx, &next); err != nil {
+		return nil, fmt.Errorf("failed to create series: %w", err)
+	}
+
+	horizon := s.now().Add(s.horizon)
+	if old.MaterialisedUntil != nil && old.MaterialisedUntil.After(horizon) {
+		horizon = *old.MaterialisedUntil
+	}
+
+	byDay := make(map[string]time.Time)
+	for _, occ := range newRule.Occurrences(next.DTStart, horizon) {
+		byDay[occ.Format("2006-01-02")] = occ
+	}
+
+	if err := s.carryOver(tx, old.ID, &next, splitAt, loc, byDay); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.materialise(tx, &next, horizon, false); err != nil {
+		return nil, fmt.Errorf("failed to materialise series: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// carryOver moves the classes of oldSeriesID from splitAt onwards to next.
+// A class cannot be moved onto another use of the new series' resource.
+func (s *Service) carryOver(tx *sql.Tx, oldSeriesID int, next *models.ClassSeries, splitAt time.Time, loc *time.Location, byDay map[string]time.Time) error {
+	rows, err := tx.Query(`
+		SELECT c.id, c.start_time, c.occurrence_start,
+			(SELECT COUNT(*) FROM bookings b WHERE b.class_id = c.id)
+		FROM classes c
+		WHERE c.series_id = ? AND c.occurrence_start >= ?`, oldSeriesID, splitAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	type existing struct {
+		id              int
+		startTime       time.Time
+		occurrenceStart time.Time
+		bookings        int
+	}
+	var classes []existing
+	for rows.Next() {
+		var c existing
+		if err := rows.Scan(&c.id, &c.startTime, &c.occurrenceStart, &c.bookings); err != nil {
+			rows.Close()
+			return err
+		}
+		classes = append(classes, c)
+	}
+	rows.Close()
+
+	duration := time.Duration(next.DurationMinutes) * time.Minute
+	for _, c := range classes {
+		occ, ok := byDay[c.occurrenceStart.In(loc).Format("2006-01-02")]
+		if !ok {
+			if c.bookings > 0 {
+				// Leave booked classes in place as standalone occurrences
+				continue
+			}
+			if _, err := tx.Exec(`DELETE FROM classes WHERE id = ?`, c.id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		start, end := occ, occ.Add(duration)
+		if !c.startTime.Equal(c.occurrenceStart) {
+			// Individually rescheduled occurrences keep their own time
+			start = c.startTime
+			end = c.startTime.Add(duration)
+		}
+
+		if next.ResourceID != nil {
+			err := resources.CheckAvailable(tx, *next.ResourceID, start, end, resources.Exclude{ClassID: c.id})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`
+			UPDATE classes SET series_id = ?, occurrence_start = ?, start_time = ?, end_time = ?,
+				name = ?, description = ?, instructor_id = ?, max_capacity = ?, price = ?,
+				requires_ticket = ?, requires_membership = ?, category_id = ?, resource_id = ?, induction_resource_id = ?,
+				updated_at = ?
+			WHERE id = ?`,
+			next.ID, occ.UTC(), start.UTC(), end.UTC(),
+			next.Name, next.Description, next.InstructorID, next.MaxCapacity, next.Price,
+			next.RequiresTicket, next.RequiresMembership, next.CategoryID, next.ResourceID, next.InductionFor, s.now(),
+			c.id)
+		if err != nil {
+			return fmt.Errorf("failed to update class %d: %w", c.id, err)
+		}
+	}
+
+	return nil
+}
+
+// Helper methods
+
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *Service) insertSeries(q queryer, series *models.ClassSeries) error {
+	now := s.now()
+	result, err := q.Exec(`
+		INSERT INTO class_series (tenant_id, name, description, instructor_id, dtstart, timezone, duration_minutes, rrule,
+			max_capacity, price, requires_ticket, requires_membership, category_id, resource_id, induction_resource_id,
+			active, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, true, ?, ?)`,
+		series.TenantID, series.Name, series.Description, series.InstructorID, series.DTStart.UTC(), series.Timezone,
+		series.DurationMinutes, series.RRule, series.MaxCapacity, series.Price, series.RequiresTicket,
+		series.RequiresMembership, series.CategoryID, series.ResourceID, series.InductionFor, now, now)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	series.ID = int(id)
+	series.Active = true
+	series.CreatedAt = now
+	series.UpdatedAt = now
+	return nil
+}
+
+func (s *Service) getSeries(q queryer, seriesID int) (*models.ClassSeries, error) {
+	var series models.ClassSeries
+	var description sql.NullString
+	var materialisedUntil sql.NullTime
+	var resourceID, inductionFor sql.NullInt64
+	err := q.QueryRow(`
+		SELECT id, tenant_id, name, description, instructor_id, dtstart, timezone, duration_minutes, rrule,
+			max_capacity, price, requires_ticket, requires_membership, COALESCE(category_id, ''), resource_id,
+			induction_resource_id, materialised_until, active, created_at, updated_at
+		FROM class_series WHERE id = ?`, seriesID).Scan(
+		&series.ID, &series.TenantID, &series.Name, &description, &series.InstructorID, &series.DTStart,
+		&series.Timezone, &series.DurationMinutes, &series.RRule, &series.MaxCapacity, &series.Price,
+		&series.RequiresTicket, &series.RequiresMembership, &series.CategoryID, &resourceID, &inductionFor,
+		&materialisedUntil, &series.Active, &series.CreatedAt, &series.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSeriesNotFound
+		}
+		return nil, err
+	}
+
+	series.Description = description.String
+	if resourceID.Valid {
+		id := int(resourceID.Int64)
+		series.ResourceID = &id
+	}
+	if inductionFor.Valid {
+		id := int(inductionFor.Int64)
+		series.InductionFor = &id
+	}
+	if materialisedUntil.Valid {
+		series.MaterialisedUntil = &materialisedUntil.Time
+	}
+	return &series, nil
+}
+
+// occurrenceOf returns the series ID (0 if none) and original occurrence
+// start of a class
+func (s *Service) occurrenceOf(q queryer, classID int) (int, time.Time, error) {
+	var seriesID sql.NullInt64
+	var occurrenceStart sql.NullTime
+	err := q.QueryRow(`SELECT series_id, occurrence_start FROM classes WHERE id = ?`, classID).Scan(&seriesID, &occurrenceStart)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if !seriesID.Valid || !occurrenceStart.Valid {
+		return 0, time.Time{}, nil
+	}
+	return int(seriesID.Int64), occurrenceStart.Time, nil
+}
+
+// materialise creates the series' missing occurrences up to until. An
+// occurrence that would overlap another use of the series' resource fails
+// the whole run, or is created skipped when skipConflicts is set, so that
+// background top-ups do not stall on a single clash.
+func (s *Service) materialise(q queryer, series *models.ClassSeries, until time.Time, skipConflicts bool) (int, error) {
+	rule, err := ParseRule(series.RRule)
+	if err != nil {
+		return 0, err
+	}
+	loc, err := time.LoadLocation(series.Timezone)
+	if err != nil {
+		return 0, err
+	}
+
+	duration := time.Duration(series.DurationMinutes) * time.Minute
+	now := s.now()
+	created := 0
+
+	for _, occ := range rule.Occurrences(series.DTStart.In(loc), until) {
+		if series.MaterialisedUntil != nil && !occ.After(*series.MaterialisedUntil) {
+			continue
+		}
+
+		active := true
+		if series.ResourceID != nil {
+			var exists bool
+			err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM classes WHERE series_id = ? AND occurrence_start = ?)`,
+				series.ID, occ.UTC()).Scan(&exists)
+			if err != nil {
+				return created, err
+			}
+			if exists {
+				continue
+			}
+
+			err = resources.CheckAvailable(q, *series.ResourceID, occ, occ.Add(duration), resources.Exclude{})
+			if errors.Is(err, resources.ErrConflict) && skipConflicts {
+				log.Printf("Skipping occurrence %s of series %d: %v", occ.Format(time.RFC3339), series.ID, err)
+				active = false
+			} else if err != nil {
+				return created, err
+			}
+		}
+
+		result, err := q.Exec(`
+			INSERT OR IGNORE INTO classes (tenant_id, name, description, instructor_id, start_time, end_time,
+				max_capacity, price, requires_ticket, requires_membership, category_id, resource_id,
+				induction_resource_id, series_id, occurrence_start, active, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			series.TenantID, series.Name, series.Description, series.InstructorID, occ.UTC(), occ.Add(duration).UTC(),
+			series.MaxCapacity, series.Price, series.RequiresTicket, series.RequiresMembership, series.CategoryID,
+			series.ResourceID, series.InductionFor, series.ID, occ.UTC(), active, now, now)
+		if err != nil {
+			return created, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			created++
+		}
+	}
+
+	if series.MaterialisedUntil == nil || until.After(*series.MaterialisedUntil) {
+		_, err = q.Exec(`UPDATE class_series SET materialised_until = ?, updated_at = ? WHERE id = ?`, until.UTC(), now, series.ID)
+		if err != nil {
+			return created, err
+		}
+		series.MaterialisedUntil = &until
+	}
+
+	return created, nil
+}
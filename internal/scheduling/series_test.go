@@ -0,0 +1,246 @@
+package scheduling
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/database"
+	"samskipnad/internal/models"
+	"samskipnad/internal/resources"
+)
+
+// setupTestDB creates a migrated in-memory SQLite database for testing
+func setupTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestService(db *sql.DB, now time.Time) *Service {
+	s := NewService(db)
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func seriesClasses(t *testing.T, db *sql.DB, seriesID int) []models.Class {
+	rows, err := db.Query(`
+		SELECT id, name, start_time, end_time, max_capacity, active
+		FROM classes WHERE series_id = ? ORDER BY occurrence_start`, seriesID)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var classes []models.Class
+	for rows.Next() {
+		var c models.Class
+		require.NoError(t, rows.Scan(&c.ID, &c.Name, &c.StartTime, &c.EndTime, &c.MaxCapacity, &c.Active))
+		classes = append(classes, c)
+	}
+	return classes
+}
+
+func TestCreateSeriesMaterialises(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	service := newTestService(db, now)
+
+	series := &models.ClassSeries{
+		TenantID:        1,
+		Name:            "Vinyasa",
+		InstructorID:    1,
+		DTStart:         time.Date(2025, 1, 1, 18, 0, 0, 0, time.UTC),
+		DurationMinutes: 75,
+		RRule:           "FREQ=WEEKLY;BYDAY=WE",
+		MaxCapacity:     15,
+	}
+	require.NoError(t, service.CreateSeries(series))
+
+	classes := seriesClasses(t, db, series.ID)
+	require.Len(t, classes, 12)
+	assert.Equal(t, series.DTStart, classes[0].StartTime.UTC())
+	assert.Equal(t, 75*time.Minute, classes[0].EndTime.Sub(classes[0].StartTime))
+
+	t.Run("MaterialiseIsIdempotent", func(t *testing.T) {
+		created, err := service.Materialise(series.ID, now.Add(DefaultHorizon))
+
+		require.NoError(t, err)
+		assert.Zero(t, created)
+	})
+
+	t.Run("MaterialiseExtendsWindow", func(t *testing.T) {
+		created, err := service.Materialise(series.ID, now.Add(DefaultHorizon+14*24*time.Hour))
+
+		require.NoError(t, err)
+		assert.Equal(t, 2, created)
+	})
+}
+
+func TestMaterialiseJob(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	series := &models.ClassSeries{
+		TenantID:        1,
+		Name:            "Vinyasa",
+		InstructorID:    1,
+		DTStart:         time.Date(2025, 1, 1, 18, 0, 0, 0, time.UTC),
+		DurationMinutes: 75,
+		RRule:           "FREQ=WEEKLY;BYDAY=WE",
+		MaxCapacity:     15,
+	}
+	require.NoError(t, newTestService(db, now).CreateSeries(series))
+	require.Len(t, seriesClasses(t, db, series.ID), 12)
+
+	// Four weeks on, the job keeps twelve weeks of classes bookable
+	stop := newTestService(db, now.AddDate(0, 0, 28)).StartMaterialiseJob(time.Hour)
+	defer stop()
+	require.Eventually(t, func() bool {
+		return len(seriesClasses(t, db, series.ID)) == 16
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSkipAndRescheduleOccurrence(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	service := newTestService(db, now)
+
+	series := &models.ClassSeries{
+		TenantID:        1,
+		Name:            "Yin",
+		InstructorID:    1,
+		DTStart:         time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC),
+		DurationMinutes: 60,
+		RRule:           "FREQ=WEEKLY;COUNT=4",
+	}
+	require.NoError(t, service.CreateSeries(series))
+	classes := seriesClasses(t, db, series.ID)
+	require.Len(t, classes, 4)
+
+	require.NoError(t, service.SkipOccurrence(classes[1].ID))
+
+	newStart := classes[2].StartTime.Add(2 * time.Hour)
+	require.NoError(t, service.RescheduleOccurrence(classes[2].ID, newStart, newStart.Add(time.Hour)))
+
+	// Rematerialising must not resurrect or duplicate exceptions
+	_, err := service.Materialise(series.ID, now.AddDate(1, 0, 0))
+	require.NoError(t, err)
+
+	classes = seriesClasses(t, db, series.ID)
+	require.Len(t, classes, 4)
+	assert.False(t, classes[1].Active)
+	assert.Equal(t, newStart, classes[2].StartTime.UTC())
+
+	t.Run("SkipRefusedWithBookings", func(t *testing.T) {
+		_, err := db.Exec(`INSERT INTO bookings (user_id, class_id, status) VALUES (1, ?, 'confirmed')`, classes[3].ID)
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, service.SkipOccurrence(classes[3].ID), ErrOccurrenceHasBookings)
+	})
+}
+
+func TestUpdateFollowing(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	service := newTestService(db, now)
+
+	series := &models.ClassSeries{
+		TenantID:        1,
+		Name:            "Power",
+		InstructorID:    1,
+		DTStart:         time.Date(2025, 1, 6, 17, 0, 0, 0, time.UTC),
+		DurationMinutes: 60,
+		RRule:           "FREQ=WEEKLY;BYDAY=MO;COUNT=6",
+		MaxCapacity:     10,
+	}
+	require.NoError(t, service.CreateSeries(series))
+	classes := seriesClasses(t, db, series.ID)
+	require.Len(t, classes, 6)
+
+	split := classes[3]
+	next, err := service.UpdateFollowing(split.ID, &models.ClassSeries{
+		Name:            "Power (new time)",
+		InstructorID:    1,
+		DTStart:         split.StartTime.UTC().Add(time.Hour),
+		DurationMinutes: 90,
+		MaxCapacity:     12,
+	})
+	require.NoError(t, err)
+
+	// Earlier occurrences are untouched
+	before := seriesClasses(t, db, series.ID)
+	require.Len(t, before, 3)
+	assert.Equal(t, "Power", before[2].Name)
+
+	old, err := service.GetSeries(series.ID)
+	require.NoError(t, err)
+	assert.Contains(t, old.RRule, "UNTIL=")
+
+	// The remaining COUNT carries over to the new series
+	after := seriesClasses(t, db, next.ID)
+	require.Len(t, after, 3)
+	assert.Equal(t, split.ID, after[0].ID, "existing class rows are reused")
+	assert.Equal(t, "Power (new time)", after[0].Name)
+	assert.Equal(t, 18, after[0].StartTime.UTC().Hour())
+	assert.Equal(t, 90*time.Minute, after[0].EndTime.Sub(after[0].StartTime))
+	assert.Equal(t, 12, after[2].MaxCapacity)
+}
+
+func TestSeriesResourceConflicts(t *testing.T) {
+	db := setupTestDB(t)
+	now := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	service := newTestService(db, now)
+
+	result, err := db.Exec(`INSERT INTO resources (tenant_id, name, kind) VALUES (1, 'Workshop', 'room')`)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	room := int(id)
+
+	bookRoom := func(day time.Time) {
+		_, err := db.Exec(`
+			INSERT INTO classes (tenant_id, name, instructor_id, start_time, end_time, max_capacity, price, resource_id)
+			VALUES (1, 'Open day', 1, ?, ?, 50, 0, ?)`, day.Add(9*time.Hour), day.Add(17*time.Hour), room)
+		require.NoError(t, err)
+	}
+	bookRoom(time.Date(2025, 1, 16, 0, 0, 0, 0, time.UTC))
+
+	series := &models.ClassSeries{
+		TenantID:        1,
+		Name:            "Soldering 101",
+		InstructorID:    1,
+		DTStart:         time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC),
+		DurationMinutes: 120,
+		RRule:           "FREQ=WEEKLY",
+		ResourceID:      &room,
+	}
+	assert.ErrorIs(t, service.CreateSeries(series), resources.ErrConflict)
+
+	series.DTStart = time.Date(2025, 1, 23, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, service.CreateSeries(series))
+	classes := seriesClasses(t, db, series.ID)
+	require.NotEmpty(t, classes)
+
+	clash := time.Date(2025, 1, 16, 12, 0, 0, 0, time.UTC)
+	err = service.RescheduleOccurrence(classes[0].ID, clash, clash.Add(time.Hour))
+	assert.ErrorIs(t, err, resources.ErrConflict)
+
+	t.Run("MaterialiseSkipsConflicts", func(t *testing.T) {
+		last := classes[len(classes)-1].StartTime
+		bookRoom(time.Date(last.Year(), last.Month(), last.Day()+7, 0, 0, 0, 0, time.UTC))
+
+		created, err := service.Materialise(series.ID, last.Add(15*24*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 2, created)
+
+		extended := seriesClasses(t, db, series.ID)
+		require.Len(t, extended, len(classes)+2)
+		assert.False(t, extended[len(classes)].Active, "the clashing occurrence is created skipped")
+		assert.True(t, extended[len(classes)+1].Active)
+	})
+}
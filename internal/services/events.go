@@ -0,0 +1,37 @@
+package services
+
+import (
+	"context"
+	"log"
+)
+
+// Publish dispatches an event from source, such as "booking", on the
+// event bus. Event delivery is best effort: failures are logged and never
+// fail the operation that triggered the event. Nothing is published
+// without an event bus.
+func Publish(events EventBusService, source, eventType string, tenantID, userID int, data map[string]interface{}) {
+	if events == nil {
+		return
+	}
+	err := events.Publish(context.Background(), &Event{
+		Type:     eventType,
+		Source:   source,
+		TenantID: tenantID,
+		UserID:   userID,
+		Data:     data,
+	})
+	if err != nil {
+		log.Printf("Failed to publish %s: %v", eventType, err)
+	}
+}
+
+// Notify sends a user a notification on the event bus, as best effort as
+// Publish
+func Notify(events EventBusService, userID int, notification *Notification) {
+	if events == nil {
+		return
+	}
+	if err := events.SendNotification(context.Background(), userID, notification); err != nil {
+		log.Printf("Failed to notify user %d: %v", userID, err)
+	}
+}
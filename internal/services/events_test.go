@@ -0,0 +1,28 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+
+	"samskipnad/internal/services"
+	"samskipnad/internal/services/mocks"
+)
+
+func TestPublishIsBestEffort(t *testing.T) {
+	events := &mocks.MockEventBusService{}
+	events.On("Publish", mock.Anything, mock.MatchedBy(func(e *services.Event) bool {
+		return e.Type == "class.updated" && e.Source == "booking" && e.TenantID == 1 && e.UserID == 2
+	})).Return(errors.New("bus down"))
+	events.On("SendNotification", mock.Anything, 2, mock.Anything).Return(errors.New("bus down"))
+
+	// Failures are logged, not returned
+	services.Publish(events, "booking", "class.updated", 1, 2, map[string]interface{}{"class_id": 3})
+	services.Notify(events, 2, &services.Notification{Type: "class.updated"})
+	events.AssertExpectations(t)
+
+	// Without an event bus nothing is sent
+	services.Publish(nil, "booking", "class.updated", 1, 2, nil)
+	services.Notify(nil, 2, &services.Notification{})
+}
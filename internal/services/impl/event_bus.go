@@ -0,0 +1,247 @@
+package impl
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"samskipnad/internal/services"
+)
+
+// EventBusServiceImpl provides an in-process implementation of EventBusService.
+// Events are persisted to the events table and dispatched to subscribers in
+// the same process; notifications are stored per user and mirrored to email.
+// Email and SMS delivery are logged until a transport is configured.
+type EventBusServiceImpl struct {
+	db       *sql.DB
+	mu       sync.RWMutex
+	handlers map[string][]services.EventHandler
+}
+
+// NewEventBusService creates a new EventBusService implementation
+func NewEventBusService(db *sql.DB) services.EventBusService {
+	return &EventBusServiceImpl{
+		db:       db,
+		handlers: make(map[string][]services.EventHandler),
+	}
+}
+
+// Publish implements the EventBusService interface. The event is logged and
+// handed to every subscriber of its type; the first handler error is returned
+// after all handlers have run.
+func (e *EventBusServiceImpl) Publish(ctx context.Context, event *services.Event) error {
+	if err := e.LogEvent(ctx, event); err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, handler := range e.handlersFor(event.Type) {
+		if err := handler(ctx, event); err != nil {
+			log.Printf("Event handler for %s failed: %v", event.Type, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// PublishAsync implements the EventBusService interface
+func (e *EventBusServiceImpl) PublishAsync(ctx context.Context, event *services.Event) error {
+	if err := e.LogEvent(ctx, event); err != nil {
+		return err
+	}
+
+	for _, handler := range e.handlersFor(event.Type) {
+		go func(handler services.EventHandler) {
+			if err := handler(context.Background(), event); err != nil {
+				log.Printf("Async event handler for %s failed: %v", event.Type, err)
+			}
+		}(handler)
+	}
+
+	return nil
+}
+
+// Subscribe implements the EventBusService interface
+func (e *EventBusServiceImpl) Subscribe(ctx context.Context, eventType string, handler services.EventHandler) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers[eventType] = append(e.handlers[eventType], handler)
+	return nil
+}
+
+// Unsubscribe implements the EventBusService interface
+func (e *EventBusServiceImpl) Unsubscribe(ctx context.Context, eventType string, handler services.EventHandler) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	target := reflect.ValueOf(handler).Pointer()
+	handlers := e.handlers[eventType]
+	for i, h := range handlers {
+		if reflect.ValueOf(h).Pointer() == target {
+			e.handlers[eventType] = append(handlers[:i], handlers[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("handler not subscribed to %s", eventType)
+}
+
+// SendNotification implements the EventBusService interface
+func (e *EventBusServiceImpl) SendNotification(ctx context.Context, userID int, notification *services.Notification) error {
+	data, err := json.Marshal(notification.Data)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification data: %w", err)
+	}
+
+	_, err = e.db.ExecContext(ctx, `
+		INSERT INTO notifications (user_id, type, title, message, data, priority, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID, notification.Type, notification.Title, notification.Message, string(data), notification.Priority, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to store notification: %w", err)
+	}
+
+	var email string
+	err = e.db.QueryRowContext(ctx, "SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	if err != nil {
+		// The notification is stored; missing contact details are not fatal
+		return nil
+	}
+
+	return e.SendEmail(ctx, email, notification.Title, notification.Message)
+}
+
+// SendEmail implements the EventBusService interface
+func (e *EventBusServiceImpl) SendEmail(ctx context.Context, to, subject, body string) error {
+	// TODO: Deliver through an SMTP or transactional email provider
+	log.Printf("Email to %s: %s", to, subject)
+	return nil
+}
+
+// SendEmailWithAttachments implements the EventBusService interface
+func (e *EventBusServiceImpl) SendEmailWithAttachments(ctx context.Context, to, subject, body string, attachments []services.Attachment) error {
+	// TODO: Deliver through an SMTP or transactional email provider
+	log.Printf("Email to %s: %s (%d attachments)", to, subject, len(attachments))
+	return nil
+}
+
+// SendSMS implements the EventBusService interface
+func (e *EventBusServiceImpl) SendSMS(ctx context.Context, to, message string) error {
+	// TODO: Deliver through an SMS gateway
+	log.Printf("SMS to %s: %s", to, message)
+	return nil
+}
+
+// LogEvent implements the EventBusService interface. Missing IDs and
+// timestamps are filled in on the event.
+func (e *EventBusServiceImpl) LogEvent(ctx context.Context, event *services.Event) error {
+	if event.ID == "" {
+		id, err := newEventID()
+		if err != nil {
+			return err
+		}
+		event.ID = id
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return fmt.Errorf("failed to encode event data: %w", err)
+	}
+
+	_, err = e.db.ExecContext(ctx, `
+		INSERT INTO events (id, type, source, tenant_id, user_id, data, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		event.ID, event.Type, event.Source, event.TenantID, event.UserID, string(data), event.Timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to log event: %w", err)
+	}
+
+	return nil
+}
+
+// GetEventHistory implements the EventBusService interface. Supported
+// filters are "type", "tenant_id", "user_id" and "limit".
+func (e *EventBusServiceImpl) GetEventHistory(ctx context.Context, filters map[string]interface{}) ([]*services.Event, error) {
+	query := "SELECT id, type, source, tenant_id, user_id, data, timestamp FROM events"
+	var conditions []string
+	var args []interface{}
+
+	if v, ok := filters["type"]; ok {
+		conditions = append(conditions, "type = ?")
+		args = append(args, v)
+	}
+	if v, ok := filters["tenant_id"]; ok {
+		conditions = append(conditions, "tenant_id = ?")
+		args = append(args, v)
+	}
+	if v, ok := filters["user_id"]; ok {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, v)
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY timestamp DESC"
+	if v, ok := filters["limit"]; ok {
+		query += " LIMIT ?"
+		args = append(args, v)
+	}
+
+	rows, err := e.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*services.Event
+	for rows.Next() {
+		var event services.Event
+		var source, data sql.NullString
+		var tenantID, userID sql.NullInt64
+		if err := rows.Scan(&event.ID, &event.Type, &source, &tenantID, &userID, &data, &event.Timestamp); err != nil {
+			return nil, err
+		}
+		event.Source = source.String
+		event.TenantID = int(tenantID.Int64)
+		event.UserID = int(userID.Int64)
+		if data.Valid && data.String != "" {
+			if err := json.Unmarshal([]byte(data.String), &event.Data); err != nil {
+				return nil, fmt.Errorf("failed to decode event %s: %w", event.ID, err)
+			}
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+func (e *EventBusServiceImpl) handlersFor(eventType string) []services.EventHandler {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	handlers := make([]services.EventHandler, len(e.handlers[eventType]))
+	copy(handlers, e.handlers[eventType])
+	return handlers
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate event ID: %w", err)
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,84 @@
+package impl_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/database"
+	"samskipnad/internal/services"
+	"samskipnad/internal/services/impl"
+)
+
+// setupMigratedDB creates an in-memory SQLite database with the full schema
+func setupMigratedDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	require.NoError(t, database.Migrate(db))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestEventBusServiceImpl_PublishSubscribe(t *testing.T) {
+	db := setupMigratedDB(t)
+	bus := impl.NewEventBusService(db)
+	ctx := context.Background()
+
+	var received []*services.Event
+	handler := func(ctx context.Context, event *services.Event) error {
+		received = append(received, event)
+		return nil
+	}
+	require.NoError(t, bus.Subscribe(ctx, "booking.cancelled", handler))
+
+	event := &services.Event{
+		Type:     "booking.cancelled",
+		Source:   "test",
+		TenantID: 1,
+		UserID:   1,
+		Data:     map[string]interface{}{"class_id": float64(7)},
+	}
+	require.NoError(t, bus.Publish(ctx, event))
+	require.NoError(t, bus.Publish(ctx, &services.Event{Type: "other", TenantID: 1}))
+
+	require.Len(t, received, 1)
+	assert.NotEmpty(t, event.ID)
+	assert.False(t, event.Timestamp.IsZero())
+
+	t.Run("HistoryIsFiltered", func(t *testing.T) {
+		history, err := bus.GetEventHistory(ctx, map[string]interface{}{"type": "booking.cancelled"})
+
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+		assert.Equal(t, event.ID, history[0].ID)
+		assert.Equal(t, float64(7), history[0].Data["class_id"])
+	})
+
+	t.Run("Unsubscribe", func(t *testing.T) {
+		require.NoError(t, bus.Unsubscribe(ctx, "booking.cancelled", handler))
+		require.NoError(t, bus.Publish(ctx, &services.Event{Type: "booking.cancelled", TenantID: 1}))
+
+		assert.Len(t, received, 1)
+	})
+}
+
+func TestEventBusServiceImpl_SendNotification(t *testing.T) {
+	db := setupMigratedDB(t)
+	bus := impl.NewEventBusService(db)
+	ctx := context.Background()
+
+	err := bus.SendNotification(ctx, 1, &services.Notification{
+		Type:    "booking.waitlist_promoted",
+		Title:   "You're in",
+		Message: "A spot opened up",
+	})
+	require.NoError(t, err)
+
+	var title string
+	require.NoError(t, db.QueryRow("SELECT title FROM notifications WHERE user_id = 1").Scan(&title))
+	assert.Equal(t, "You're in", title)
+}
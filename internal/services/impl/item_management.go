@@ -0,0 +1,315 @@
+package impl
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"samskipnad/internal/booking"
+	"samskipnad/internal/models"
+	"samskipnad/internal/services"
+)
+
+// ItemTypeClass is the item type of classes, currently the only item type
+// backed by storage
+const ItemTypeClass = "class"
+
+var errTagsNotSupported = errors.New("item tags are not supported yet")
+
+// ItemManagementServiceImpl provides a concrete implementation of
+// ItemManagementService over the classes and bookings tables. Booking
+// cancellations go through booking.Service so the community's cancellation
+// policy and waitlist promotion apply.
+type ItemManagementServiceImpl struct {
+	db       *sql.DB
+	bookings *booking.Service
+}
+
+// NewItemManagementService creates a new ItemManagementService implementation
+func NewItemManagementService(db *sql.DB, bookings *booking.Service) services.ItemManagementService {
+	return &ItemManagementServiceImpl{
+		db:       db,
+		bookings: bookings,
+	}
+}
+
+// CreateItem creates an item of the given type. data must be a *models.Class.
+func (s *ItemManagementServiceImpl) CreateItem(ctx context.Context, tenantID int, itemType string, data interface{}) (int, error) {
+	class, err := classItem(itemType, data)
+	if err != nil {
+		return 0, err
+	}
+	class.TenantID = tenantID
+	if err := s.CreateClass(ctx, class); err != nil {
+		return 0, err
+	}
+	return class.ID, nil
+}
+
+// GetItem returns the item with the given ID
+func (s *ItemManagementServiceImpl) GetItem(ctx context.Context, itemID int) (interface{}, error) {
+	return s.GetClass(ctx, itemID)
+}
+
+// UpdateItem updates an item. data must be a *models.Class.
+func (s *ItemManagementServiceImpl) UpdateItem(ctx context.Context, itemID int, data interface{}) error {
+	class, err := classItem(ItemTypeClass, data)
+	if err != nil {
+		return err
+	}
+	return s.UpdateClass(ctx, itemID, class)
+}
+
+// DeleteItem deactivates an item so it no longer appears in listings
+func (s *ItemManagementServiceImpl) DeleteItem(ctx context.Context, itemID int) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE classes SET active = false, updated_at = ? WHERE id = ?`, time.Now(), itemID)
+	if err != nil {
+		return fmt.Errorf("failed to delete item: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return booking.ErrClassNotFound
+	}
+	return nil
+}
+
+// SearchItems returns items matching filters. See ListClasses for the
+// supported filters.
+func (s *ItemManagementServiceImpl) SearchItems(ctx context.Context, tenantID int, itemType string, filters map[string]interface{}) ([]interface{}, error) {
+	if itemType != ItemTypeClass {
+		return nil, fmt.Errorf("unsupported item type: %s", itemType)
+	}
+
+	classes, err := s.ListClasses(ctx, tenantID, filters)
+	if err != nil {
+		return nil, err
+	}
+	return classItems(classes), nil
+}
+
+// ListItems returns a page of items ordered by start time
+func (s *ItemManagementServiceImpl) ListItems(ctx context.Context, tenantID int, itemType string, limit, offset int) ([]interface{}, error) {
+	if itemType != ItemTypeClass {
+		return nil, fmt.Errorf("unsupported item type: %s", itemType)
+	}
+
+	classes, err := s.queryClasses(ctx, `WHERE tenant_id = ? ORDER BY start_time ASC LIMIT ? OFFSET ?`, tenantID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return classItems(classes), nil
+}
+
+// AddTag is not supported yet
+func (s *ItemManagementServiceImpl) AddTag(ctx context.Context, itemID int, tag string) error {
+	return errTagsNotSupported
+}
+
+// RemoveTag is not supported yet
+func (s *ItemManagementServiceImpl) RemoveTag(ctx context.Context, itemID int, tag string) error {
+	return errTagsNotSupported
+}
+
+// GetTags is not supported yet
+func (s *ItemManagementServiceImpl) GetTags(ctx context.Context, itemID int) ([]string, error) {
+	return nil, errTagsNotSupported
+}
+
+// CreateClass creates a class and sets its ID
+func (s *ItemManagementServiceImpl) CreateClass(ctx context.Context, class *models.Class) error {
+	now := time.Now()
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO classes (tenant_id, name, description, instructor_id, start_time, end_time, max_capacity, price,
+			requires_ticket, requires_membership, category_id, active, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, true, ?, ?)`,
+		class.TenantID, class.Name, class.Description, class.InstructorID, class.StartTime.UTC(), class.EndTime.UTC(),
+		class.MaxCapacity, class.Price, class.RequiresTicket, class.RequiresMembership, class.CategoryID, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to create class: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	class.ID = int(id)
+	class.Active = true
+	return nil
+}
+
+// GetClass returns a class by ID
+func (s *ItemManagementServiceImpl) GetClass(ctx context.Context, classID int) (*models.Class, error) {
+	classes, err := s.queryClasses(ctx, `WHERE id = ?`, classID)
+	if err != nil {
+		return nil, err
+	}
+	if len(classes) == 0 {
+		return nil, booking.ErrClassNotFound
+	}
+	return classes[0], nil
+}
+
+// UpdateClass updates the details of a class
+func (s *ItemManagementServiceImpl) UpdateClass(ctx context.Context, classID int, class *models.Class) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE classes SET name = ?, description = ?, instructor_id = ?, start_time = ?, end_time = ?,
+			max_capacity = ?, price = ?, requires_ticket = ?, requires_membership = ?, category_id = ?, updated_at = ?
+		WHERE id = ?`,
+		class.Name, class.Description, class.InstructorID, class.StartTime.UTC(), class.EndTime.UTC(),
+		class.MaxCapacity, class.Price, class.RequiresTicket, class.RequiresMembership, class.CategoryID, time.Now(), classID)
+	if err != nil {
+		return fmt.Errorf("failed to update class: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return booking.ErrClassNotFound
+	}
+	return nil
+}
+
+// ListClasses returns a tenant's classes ordered by start time. Supported
+// filters are "active" (bool), "instructor_id" (int), and "from" and "to"
+// (time.Time) bounding the start time.
+func (s *ItemManagementServiceImpl) ListClasses(ctx context.Context, tenantID int, filters map[string]interface{}) ([]*models.Class, error) {
+	conditions := []string{"tenant_id = ?"}
+	args := []interface{}{tenantID}
+
+	if active, ok := filters["active"].(bool); ok {
+		conditions = append(conditions, "active = ?")
+		args = append(args, active)
+	}
+	if instructorID, ok := filters["instructor_id"].(int); ok {
+		conditions = append(conditions, "instructor_id = ?")
+		args = append(args, instructorID)
+	}
+	if from, ok := filters["from"].(time.Time); ok {
+		conditions = append(conditions, "start_time >= ?")
+		args = append(args, from.UTC())
+	}
+	if to, ok := filters["to"].(time.Time); ok {
+		conditions = append(conditions, "start_time < ?")
+		args = append(args, to.UTC())
+	}
+
+	return s.queryClasses(ctx, "WHERE "+strings.Join(conditions, " AND ")+" ORDER BY start_time ASC", args...)
+}
+
+// CreateBooking books a member onto a class and sets the booking's ID.
+// Bookings with a PaymentID confirm a paid seat; others must be for free
+// classes.
+func (s *ItemManagementServiceImpl) CreateBooking(ctx context.Context, b *models.Booking) error {
+	if b.PaymentID != "" {
+		if err := s.bookings.ConfirmPaid(b.UserID, b.ClassID, b.PaymentID); err != nil {
+			return err
+		}
+		var id int
+		err := s.db.QueryRowContext(ctx, `SELECT id FROM bookings WHERE user_id = ? AND class_id = ?`, b.UserID, b.ClassID).Scan(&id)
+		if err != nil {
+			return err
+		}
+		b.ID = id
+		b.Status = booking.StatusConfirmed
+		return nil
+	}
+
+	booked, err := s.bookings.Book(b.UserID, b.ClassID)
+	if err != nil {
+		return err
+	}
+	*b = *booked
+	return nil
+}
+
+// GetBooking returns a booking by ID
+func (s *ItemManagementServiceImpl) GetBooking(ctx context.Context, bookingID int) (*models.Booking, error) {
+	return s.bookings.GetBooking(bookingID)
+}
+
+// CancelBooking cancels a booking under the community's cancellation policy
+func (s *ItemManagementServiceImpl) CancelBooking(ctx context.Context, bookingID int) error {
+	_, err := s.bookings.Cancel(bookingID)
+	return err
+}
+
+// ListBookings returns all of a member's bookings, newest first
+func (s *ItemManagementServiceImpl) ListBookings(ctx context.Context, userID int) ([]*models.Booking, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id FROM bookings WHERE user_id = ? ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	bookings := make([]*models.Booking, 0, len(ids))
+	for _, id := range ids {
+		b, err := s.bookings.GetBooking(id)
+		if err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, b)
+	}
+	return bookings, nil
+}
+
+// Helper methods
+
+func (s *ItemManagementServiceImpl) queryClasses(ctx context.Context, clause string, args ...interface{}) ([]*models.Class, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, tenant_id, name, COALESCE(description, ''), instructor_id, start_time, end_time,
+			max_capacity, price, requires_ticket, requires_membership, active, COALESCE(category_id, ''), series_id,
+			created_at, updated_at
+		FROM classes `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var classes []*models.Class
+	for rows.Next() {
+		var class models.Class
+		var seriesID sql.NullInt64
+		err := rows.Scan(&class.ID, &class.TenantID, &class.Name, &class.Description, &class.InstructorID,
+			&class.StartTime, &class.EndTime, &class.MaxCapacity, &class.Price, &class.RequiresTicket,
+			&class.RequiresMembership, &class.Active, &class.CategoryID, &seriesID, &class.CreatedAt, &class.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if seriesID.Valid {
+			id := int(seriesID.Int64)
+			class.SeriesID = &id
+		}
+		classes = append(classes, &class)
+	}
+
+	return classes, rows.Err()
+}
+
+func classItem(itemType string, data interface{}) (*models.Class, error) {
+	if itemType != ItemTypeClass {
+		return nil, fmt.Errorf("unsupported item type: %s", itemType)
+	}
+	class, ok := data.(*models.Class)
+	if !ok {
+		return nil, fmt.Errorf("class item data must be *models.Class, got %T", data)
+	}
+	return class, nil
+}
+
+func classItems(classes []*models.Class) []interface{} {
+	items := make([]interface{}, len(classes))
+	for i, class := range classes {
+		items[i] = class
+	}
+	return items
+}
@@ -0,0 +1,77 @@
+package impl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/booking"
+	"samskipnad/internal/models"
+	"samskipnad/internal/services/impl"
+)
+
+func TestItemManagementServiceImpl_Classes(t *testing.T) {
+	t.Setenv("CHECKIN_SECRET", "test secret")
+	db := setupMigratedDB(t)
+	bookingService, err := booking.NewService(db, nil, nil)
+	require.NoError(t, err)
+	svc := impl.NewItemManagementService(db, bookingService)
+	ctx := context.Background()
+
+	start := time.Now().Add(24 * time.Hour).Truncate(time.Second).UTC()
+	class := &models.Class{
+		TenantID:     1,
+		Name:         "Hatha",
+		InstructorID: 1,
+		StartTime:    start,
+		EndTime:      start.Add(time.Hour),
+		MaxCapacity:  1,
+	}
+	require.NoError(t, svc.CreateClass(ctx, class))
+	require.NotZero(t, class.ID)
+
+	got, err := svc.GetClass(ctx, class.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Hatha", got.Name)
+	assert.True(t, got.Active)
+
+	got.Name = "Hatha Flow"
+	require.NoError(t, svc.UpdateClass(ctx, class.ID, got))
+
+	classes, err := svc.ListClasses(ctx, 1, map[string]interface{}{"from": time.Now()})
+	require.NoError(t, err)
+	require.Len(t, classes, 1)
+	assert.Equal(t, "Hatha Flow", classes[0].Name)
+
+	_, err = svc.CreateItem(ctx, 1, "article", &models.Class{})
+	assert.Error(t, err)
+
+	t.Run("Bookings", func(t *testing.T) {
+		b := &models.Booking{UserID: 1, ClassID: class.ID}
+		require.NoError(t, svc.CreateBooking(ctx, b))
+		assert.NotZero(t, b.ID)
+
+		err := svc.CreateBooking(ctx, &models.Booking{UserID: 1, ClassID: class.ID})
+		assert.ErrorIs(t, err, booking.ErrAlreadyBooked)
+
+		bookings, err := svc.ListBookings(ctx, 1)
+		require.NoError(t, err)
+		require.Len(t, bookings, 1)
+		assert.Equal(t, booking.StatusConfirmed, bookings[0].Status)
+	})
+
+	t.Run("CancelAfterStart", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour).UTC()
+		started := &models.Class{TenantID: 1, Name: "Yin", InstructorID: 1, StartTime: past, EndTime: past.Add(time.Hour), MaxCapacity: 5}
+		require.NoError(t, svc.CreateClass(ctx, started))
+
+		b := &models.Booking{UserID: 1, ClassID: started.ID}
+		require.NoError(t, svc.CreateBooking(ctx, b))
+
+		err := svc.CancelBooking(ctx, b.ID)
+		assert.ErrorIs(t, err, booking.ErrCancellationClosed)
+	})
+}
@@ -0,0 +1,138 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"samskipnad/internal/invoices"
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/memberships"
+	"samskipnad/internal/models"
+	"samskipnad/internal/payments"
+	"samskipnad/internal/services"
+)
+
+var errPaymentNotSupported = errors.New("not supported by the payment service yet")
+
+// PaymentServiceImpl provides a concrete implementation of PaymentService
+// over payments.Service, which talks to Stripe, klippekort.Service, which
+// keeps klippekort balances, memberships.Service, which renews membership
+// subscriptions, and invoices.Service, which issues receipts
+type PaymentServiceImpl struct {
+	payments    *payments.Service
+	klippekort  *klippekort.Service
+	memberships *memberships.Service
+	invoices    *invoices.Service
+}
+
+// NewPaymentService creates a new PaymentService implementation
+func NewPaymentService(payments *payments.Service, klippekort *klippekort.Service, memberships *memberships.Service, invoices *invoices.Service) services.PaymentService {
+	return &PaymentServiceImpl{
+		payments:    payments,
+		klippekort:  klippekort,
+		memberships: memberships,
+		invoices:    invoices,
+	}
+}
+
+// ProcessPayment is not supported yet; payments are started through
+// payments.Service payment intents
+func (s *PaymentServiceImpl) ProcessPayment(ctx context.Context, userID, tenantID int, amount int, currency, source string) (*models.Payment, error) {
+	return nil, errPaymentNotSupported
+}
+
+// GetPayment returns a payment by ID
+func (s *PaymentServiceImpl) GetPayment(ctx context.Context, paymentID string) (*models.Payment, error) {
+	return s.payments.GetPayment(paymentID)
+}
+
+// RefundPayment refunds amount (in cents) of a succeeded payment
+func (s *PaymentServiceImpl) RefundPayment(ctx context.Context, paymentID string, amount int) error {
+	return s.payments.RefundPayment(paymentID, amount)
+}
+
+// CreateSubscription starts the payment for the first period of a
+// subscription to the plan of a membership tier, through
+// memberships.Service.CreateSubscription. The membership starts once the
+// member completes the payment.
+func (s *PaymentServiceImpl) CreateSubscription(ctx context.Context, userID, tenantID int, tier, plan string) (*services.Checkout, error) {
+	intent, err := s.memberships.CreateSubscription(userID, tier, plan, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &services.Checkout{
+		PaymentID:    intent.ID,
+		ClientSecret: intent.ClientSecret,
+		RedirectURL:  intent.RedirectURL,
+		Amount:       intent.Amount,
+		Currency:     intent.Currency,
+	}, nil
+}
+
+// CancelSubscription stops a membership subscription, given by its
+// membership ID, from renewing
+func (s *PaymentServiceImpl) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	id, err := strconv.Atoi(subscriptionID)
+	if err != nil {
+		return fmt.Errorf("invalid subscription %q: %w", subscriptionID, memberships.ErrMembershipNotFound)
+	}
+	return s.memberships.Cancel(id)
+}
+
+// GetSubscription returns the member's current membership
+func (s *PaymentServiceImpl) GetSubscription(ctx context.Context, userID, tenantID int) (*models.Membership, error) {
+	return s.memberships.Current(userID)
+}
+
+// PurchaseKlippekort is not supported yet; klippekort are bought through
+// payments.Service payment intents
+func (s *PaymentServiceImpl) PurchaseKlippekort(ctx context.Context, userID, tenantID int, categoryID string, packageIndex int) (*models.Klippekort, error) {
+	return nil, errPaymentNotSupported
+}
+
+// UseKlipp deducts one klipp from the member's oldest non-expired card in
+// the category. It returns klippekort.ErrNoKlipp if none are left. Class
+// bookings paid with klipp go through booking.Service.BookWithKlipp instead,
+// which takes the seat and the klipp together.
+func (s *PaymentServiceImpl) UseKlipp(ctx context.Context, userID, tenantID int, categoryID string) error {
+	_, err := s.klippekort.Use(userID, tenantID, categoryID)
+	return err
+}
+
+// GetKlippekortBalance returns the klipp left on the member's non-expired
+// cards in the category
+func (s *PaymentServiceImpl) GetKlippekortBalance(ctx context.Context, userID, tenantID int, categoryID string) (int, error) {
+	return s.klippekort.Balance(userID, tenantID, categoryID)
+}
+
+// HandleWebhook verifies and processes a webhook from the payment
+// provider. The signature header it came with is carried by ctx; see
+// payments.WithWebhookSignature.
+func (s *PaymentServiceImpl) HandleWebhook(ctx context.Context, provider string, payload []byte) error {
+	return s.payments.HandleWebhook(provider, payload, payments.WebhookSignature(ctx))
+}
+
+// GenerateInvoice returns the receipt for a succeeded payment as a PDF,
+// issuing it if it has not been issued yet
+func (s *PaymentServiceImpl) GenerateInvoice(ctx context.Context, paymentID string) ([]byte, error) {
+	invoice, err := s.invoices.Issue(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	return s.invoices.PDF(invoice), nil
+}
+
+// GetInvoice returns an issued receipt, given by its invoice ID, as a PDF
+func (s *PaymentServiceImpl) GetInvoice(ctx context.Context, invoiceID string) ([]byte, error) {
+	id, err := strconv.Atoi(invoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice %q: %w", invoiceID, invoices.ErrInvoiceNotFound)
+	}
+	invoice, err := s.invoices.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.invoices.PDF(invoice), nil
+}
@@ -0,0 +1,81 @@
+package impl_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"samskipnad/internal/config"
+	"samskipnad/internal/invoices"
+	"samskipnad/internal/klippekort"
+	"samskipnad/internal/memberships"
+	"samskipnad/internal/payments"
+	"samskipnad/internal/services/impl"
+)
+
+func TestPaymentServiceImpl_UseKlipp(t *testing.T) {
+	db := setupMigratedDB(t)
+	paymentService := payments.NewService(db, payments.NewFakeProvider())
+	svc := impl.NewPaymentService(paymentService, klippekort.NewService(db, nil), memberships.NewService(db, nil, paymentService), invoices.NewService(db, nil))
+	ctx := context.Background()
+
+	_, err := db.Exec(`
+		INSERT INTO klippekort (user_id, tenant_id, category_id, klipp_left, original_klipp)
+		VALUES (1, 1, 'yoga', 2, 10)`)
+	require.NoError(t, err)
+
+	require.NoError(t, svc.UseKlipp(ctx, 1, 1, "yoga"))
+
+	balance, err := svc.GetKlippekortBalance(ctx, 1, 1, "yoga")
+	require.NoError(t, err)
+	assert.Equal(t, 1, balance)
+
+	require.NoError(t, svc.UseKlipp(ctx, 1, 1, "yoga"))
+	assert.ErrorIs(t, svc.UseKlipp(ctx, 1, 1, "yoga"), klippekort.ErrNoKlipp)
+}
+
+func TestPaymentServiceImpl_Subscription(t *testing.T) {
+	// Memberships are priced from the community's configuration
+	t.Chdir("../../..")
+	_, err := config.Load("yoga-studio")
+	require.NoError(t, err)
+
+	db := setupMigratedDB(t)
+	provider := payments.NewFakeProvider()
+	provider.AutoPay = true
+	paymentService := payments.NewService(db, provider)
+	membershipService := memberships.NewService(db, nil, paymentService)
+	paymentService.SetMembershipIssuer(membershipService)
+	svc := impl.NewPaymentService(paymentService, klippekort.NewService(db, nil), membershipService, invoices.NewService(db, nil))
+	ctx := context.Background()
+
+	result, err := db.Exec(`
+		INSERT INTO users (email, password_hash, first_name, last_name, phone, tenant_id)
+		VALUES ('kari@example.com', 'x', 'Kari', 'Nordmann', '', 1)`)
+	require.NoError(t, err)
+	id, err := result.LastInsertId()
+	require.NoError(t, err)
+	userID := int(id)
+
+	checkout, err := svc.CreateSubscription(ctx, userID, 1, "", memberships.PlanMonthly)
+	require.NoError(t, err)
+	assert.NotEmpty(t, checkout.PaymentID)
+	assert.NotEmpty(t, checkout.ClientSecret)
+	assert.Positive(t, checkout.Amount)
+
+	_, err = svc.GetSubscription(ctx, userID, 1)
+	assert.ErrorIs(t, err, memberships.ErrMembershipNotFound, "the membership starts once the payment succeeds")
+
+	require.NoError(t, paymentService.ConfirmPayment(checkout.PaymentID))
+	membership, err := svc.GetSubscription(ctx, userID, 1)
+	require.NoError(t, err)
+	assert.True(t, membership.AutoRenew)
+
+	require.NoError(t, svc.CancelSubscription(ctx, strconv.Itoa(membership.ID)))
+	membership, err = svc.GetSubscription(ctx, userID, 1)
+	require.NoError(t, err)
+	assert.False(t, membership.AutoRenew)
+}
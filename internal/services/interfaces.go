@@ -108,7 +108,7 @@ type PaymentService interface {
 	RefundPayment(ctx context.Context, paymentID string, amount int) error
 	
 	// Subscription Management
-	CreateSubscription(ctx context.Context, userID, tenantID int, planID string) (*models.Membership, error)
+	CreateSubscription(ctx context.Context, userID, tenantID int, tier, plan string) (*Checkout, error)
 	CancelSubscription(ctx context.Context, subscriptionID string) error
 	GetSubscription(ctx context.Context, userID, tenantID int) (*models.Membership, error)
 	
@@ -138,6 +138,7 @@ type EventBusService interface {
 	// Notification System
 	SendNotification(ctx context.Context, userID int, notification *Notification) error
 	SendEmail(ctx context.Context, to, subject, body string) error
+	SendEmailWithAttachments(ctx context.Context, to, subject, body string, attachments []Attachment) error
 	SendSMS(ctx context.Context, to, message string) error
 	
 	// Event Logging and Analytics
@@ -158,6 +159,13 @@ type Event struct {
 	Timestamp time.Time              `json:"timestamp"`
 }
 
+// Attachment is a file sent with an email
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"-"`
+}
+
 // EventHandler defines the signature for event handlers
 type EventHandler func(ctx context.Context, event *Event) error
 
@@ -170,6 +178,17 @@ type Notification struct {
 	Priority int                    `json:"priority"`
 }
 
+// Checkout is a payment started for a member to complete, as with the
+// card form for ClientSecret or at the provider's RedirectURL. What it
+// pays for is issued once it succeeds.
+type Checkout struct {
+	PaymentID    string `json:"payment_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	RedirectURL  string `json:"redirect_url,omitempty"`
+	Amount       int    `json:"amount"` // in cents
+	Currency     string `json:"currency"`
+}
+
 // ServiceContainer provides dependency injection for all Core Services
 // This will be used by the Application Logic Layer and Plugin System
 type ServiceContainer struct {
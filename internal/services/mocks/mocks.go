@@ -269,9 +269,9 @@ func (m *MockPaymentService) RefundPayment(ctx context.Context, paymentID string
 	return args.Error(0)
 }
 
-func (m *MockPaymentService) CreateSubscription(ctx context.Context, userID, tenantID int, planID string) (*models.Membership, error) {
-	args := m.Called(ctx, userID, tenantID, planID)
-	return args.Get(0).(*models.Membership), args.Error(1)
+func (m *MockPaymentService) CreateSubscription(ctx context.Context, userID, tenantID int, tier, plan string) (*services.Checkout, error) {
+	args := m.Called(ctx, userID, tenantID, tier, plan)
+	return args.Get(0).(*services.Checkout), args.Error(1)
 }
 
 func (m *MockPaymentService) CancelSubscription(ctx context.Context, subscriptionID string) error {
@@ -349,6 +349,11 @@ func (m *MockEventBusService) SendEmail(ctx context.Context, to, subject, body s
 	return args.Error(0)
 }
 
+func (m *MockEventBusService) SendEmailWithAttachments(ctx context.Context, to, subject, body string, attachments []services.Attachment) error {
+	args := m.Called(ctx, to, subject, body, attachments)
+	return args.Error(0)
+}
+
 func (m *MockEventBusService) SendSMS(ctx context.Context, to, message string) error {
 	args := m.Called(ctx, to, message)
 	return args.Error(0)